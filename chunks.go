@@ -0,0 +1,553 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// Cold points are moved from the metrics table into gorilla encoded chunks,
+// one row per series and chunkWidth aligned time range. Points written within
+// the time range of a chunk are written into it according to their
+// onConflict mode. Other points written into an already compressed range
+// stay in the metrics table until the next compression run merges them into
+// the chunk.
+
+var (
+	chunksTable                     = `simpletsdb_chunks`
+	chunkWidth                      = 2 * time.Hour
+	chunkCompressAfter              = 24 * time.Hour
+	chunkCompressInterval           = time.Hour
+	errChunkWidthNotPositive        = errors.New("chunk width must be positive")
+	errCompressIntervalNotPositive  = errors.New("compress interval must be positive")
+	errCompressionStatsNotSupported = errors.New("compression stats are only supported by the postgres storage engine")
+)
+
+// compressionStatser is implemented by storage engines that compress points
+type compressionStatser interface {
+	CompressionStats() ([]*compressionStats, error)
+}
+
+type seriesPoint struct {
+	seriesID int64
+	pt       *point
+}
+
+func chunksTableMigration(session queryer) ([]string, error) {
+	return []string{
+		fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	series_id bigint NOT NULL,
+	start_time bigint NOT NULL,
+	min_time bigint NOT NULL,
+	max_time bigint NOT NULL,
+	count integer NOT NULL,
+	data bytea NOT NULL,
+	PRIMARY KEY (series_id, start_time)
+)`, chunksTable),
+	}, nil
+}
+
+func chunksMaxTimeIndexMigration(session queryer) ([]string, error) {
+	return []string{
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s_series_id_max_time_idx ON %s(series_id, max_time)`, chunksTable, chunksTable),
+	}, nil
+}
+
+func sortPoints(pts []*point) {
+	sort.SliceStable(pts, func(i, j int) bool {
+		return pts[i].Timestamp < pts[j].Timestamp
+	})
+}
+
+// mergePoints adds the points of added to pts that don't have the timestamp
+// of a point in pts. The result is sorted by timestamp.
+func mergePoints(pts, added []*point) []*point {
+	timestamps := make(map[int64]struct{}, len(pts))
+	for _, pt := range pts {
+		timestamps[pt.Timestamp] = struct{}{}
+	}
+	merged := append([]*point{}, pts...)
+	for _, pt := range added {
+		if _, ok := timestamps[pt.Timestamp]; ok {
+			continue
+		}
+		timestamps[pt.Timestamp] = struct{}{}
+		merged = append(merged, pt)
+	}
+	sortPoints(merged)
+	return merged
+}
+
+// mergeChunkPoints merges the points read from chunks and the metrics table.
+// A chunk point wins over a row with the same series and timestamp since
+// later writes within a chunk's range go into the chunk. A positive n limits
+// the number of points returned.
+func mergeChunkPoints(rows, chunkPoints []*seriesPoint, n int64) []*point {
+	type seriesTimestamp struct {
+		seriesID  int64
+		timestamp int64
+	}
+	compressed := make(map[seriesTimestamp]struct{}, len(chunkPoints))
+	pts := make([]*point, 0, len(rows)+len(chunkPoints))
+	for _, sp := range chunkPoints {
+		compressed[seriesTimestamp{sp.seriesID, sp.pt.Timestamp}] = struct{}{}
+		pts = append(pts, sp.pt)
+	}
+	for _, sp := range rows {
+		if _, ok := compressed[seriesTimestamp{sp.seriesID, sp.pt.Timestamp}]; ok {
+			continue
+		}
+		pts = append(pts, sp.pt)
+	}
+	sortPoints(pts)
+	if n > 0 && int64(len(pts)) > n {
+		pts = pts[:n]
+	}
+	return pts
+}
+
+// groupChunkPoints merges the points read from chunks and the metrics table
+// like mergeChunkPoints but keeps the points of every series apart
+func groupChunkPoints(rows, chunkPoints []*seriesPoint) map[int64][]*point {
+	compressed := map[int64][]*point{}
+	for _, sp := range chunkPoints {
+		compressed[sp.seriesID] = append(compressed[sp.seriesID], sp.pt)
+	}
+	raw := map[int64][]*point{}
+	for _, sp := range rows {
+		raw[sp.seriesID] = append(raw[sp.seriesID], sp.pt)
+	}
+	grouped := make(map[int64][]*point, len(raw))
+	for id, pts := range raw {
+		grouped[id] = mergePoints(compressed[id], pts)
+	}
+	for id, pts := range compressed {
+		if _, ok := grouped[id]; !ok {
+			sortPoints(pts)
+			grouped[id] = pts
+		}
+	}
+	return grouped
+}
+
+func selectChunkPoints(session queryer, seriesIDs []int64, start, end int64) ([]*seriesPoint, error) {
+	query := fmt.Sprintf("SELECT series_id, count, data FROM %s WHERE series_id = ANY($1) AND min_time <= %d AND max_time >= %d", chunksTable, end, start)
+	scanner, err := session.Query(query, pq.Array(seriesIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer scanner.Close()
+	var (
+		seriesID int64
+		count    int
+		data     []byte
+		sps      []*seriesPoint
+	)
+	for scanner.Next() {
+		if err := scanner.Scan(&seriesID, &count, &data); err != nil {
+			return nil, err
+		}
+		pts, err := decodeChunk(data, count)
+		if err != nil {
+			return nil, err
+		}
+		for _, pt := range pts {
+			if pt.Timestamp >= start && pt.Timestamp <= end {
+				sps = append(sps, &seriesPoint{seriesID: seriesID, pt: pt})
+			}
+		}
+	}
+	return sps, scanner.Err()
+}
+
+// selectChunkBoundaryTimestamp returns the first (order ASC) or last (order
+// DESC) compressed timestamp of the series and whether there is one
+func selectChunkBoundaryTimestamp(session queryer, seriesIDs []int64, order string) (int64, bool, error) {
+	aggregate := "min(min_time)"
+	if order == "DESC" {
+		aggregate = "max(max_time)"
+	}
+	var timestamp sql.NullInt64
+	row := session.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE series_id = ANY($1)", aggregate, chunksTable), pq.Array(seriesIDs))
+	if err := row.Scan(&timestamp); err != nil {
+		return 0, false, err
+	}
+	return timestamp.Int64, timestamp.Valid, nil
+}
+
+func upsertChunkTx(tx queryer, seriesID, start int64, pts []*point) error {
+	query := fmt.Sprintf(`
+INSERT INTO %s (series_id,start_time,min_time,max_time,count,data) VALUES ($1,$2,$3,$4,$5,$6)
+ON CONFLICT (series_id,start_time) DO UPDATE SET min_time = EXCLUDED.min_time, max_time = EXCLUDED.max_time, count = EXCLUDED.count, data = EXCLUDED.data`, chunksTable)
+	_, err := tx.Exec(query, seriesID, start, pts[0].Timestamp, pts[len(pts)-1].Timestamp, len(pts), encodeChunk(pts))
+	return err
+}
+
+// mergeChunkPoint writes pt into the sorted points of a chunk according to
+// onConflict. It returns the points and whether pt was inserted or
+// overwrote a point.
+func mergeChunkPoint(pts []*point, pt *point, onConflict string) ([]*point, bool, bool, error) {
+	j := sort.Search(len(pts), func(j int) bool { return pts[j].Timestamp >= pt.Timestamp })
+	if j < len(pts) && pts[j].Timestamp == pt.Timestamp {
+		switch onConflict {
+		case onConflictError:
+			return nil, false, false, errPointExists
+		case onConflictOverwrite:
+			pts[j] = copyPoint(pt)
+		case onConflictSum:
+			pts[j] = sumPoints(pts[j], pt)
+		default:
+			return pts, false, false, nil
+		}
+		return pts, false, true, nil
+	}
+	pts = append(pts, nil)
+	copy(pts[j+1:], pts[j:])
+	pts[j] = copyPoint(pt)
+	return pts, true, false, nil
+}
+
+// writeChunkPoints writes the queries within the time range of a chunk of
+// their series into that chunk according to onConflict, so they aren't
+// shadowed by the chunk's points. It returns the other queries and their
+// series ids, and the number of points inserted and overwritten in chunks.
+// tx must be a transaction since the chunks are locked until it ends.
+func writeChunkPoints(tx queryer, queries []*insertPointQuery, seriesIDs []int64, onConflict string) ([]*insertPointQuery, []int64, int64, int64, error) {
+	if len(queries) == 0 {
+		return queries, seriesIDs, 0, 0, nil
+	}
+	minTimestamp, maxTimestamp := queries[0].Point.Timestamp, queries[0].Point.Timestamp
+	for _, query := range queries {
+		if query.Point.Timestamp < minTimestamp {
+			minTimestamp = query.Point.Timestamp
+		}
+		if query.Point.Timestamp > maxTimestamp {
+			maxTimestamp = query.Point.Timestamp
+		}
+	}
+
+	query := fmt.Sprintf("SELECT series_id, start_time, min_time, max_time, count, data FROM %s WHERE series_id = ANY($1) AND max_time >= $2 AND min_time <= $3 ORDER BY series_id, start_time FOR UPDATE", chunksTable)
+	scanner, err := tx.Query(query, pq.Array(seriesIDs), minTimestamp, maxTimestamp)
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	type chunk struct {
+		start   int64
+		minTime int64
+		maxTime int64
+		pts     []*point
+		dirty   bool
+	}
+	var (
+		chunks   = map[int64][]*chunk{}
+		seriesID int64
+		count    int
+		data     []byte
+	)
+	for scanner.Next() {
+		c := &chunk{}
+		if err := scanner.Scan(&seriesID, &c.start, &c.minTime, &c.maxTime, &count, &data); err != nil {
+			scanner.Close()
+			return nil, nil, 0, 0, err
+		}
+		if c.pts, err = decodeChunk(data, count); err != nil {
+			scanner.Close()
+			return nil, nil, 0, 0, err
+		}
+		chunks[seriesID] = append(chunks[seriesID], c)
+	}
+	scanner.Close()
+	if err := scanner.Err(); err != nil {
+		return nil, nil, 0, 0, err
+	}
+	if len(chunks) == 0 {
+		return queries, seriesIDs, 0, 0, nil
+	}
+
+	var (
+		rest                  = make([]*insertPointQuery, 0, len(queries))
+		restIDs               = make([]int64, 0, len(queries))
+		inserted, overwritten int64
+	)
+	for i, query := range queries {
+		pt := query.Point
+		var c *chunk
+		for _, sc := range chunks[seriesIDs[i]] {
+			if sc.minTime <= pt.Timestamp && pt.Timestamp <= sc.maxTime {
+				c = sc
+				break
+			}
+		}
+		if c == nil {
+			rest = append(rest, query)
+			restIDs = append(restIDs, seriesIDs[i])
+			continue
+		}
+		var added, replaced bool
+		if c.pts, added, replaced, err = mergeChunkPoint(c.pts, pt, onConflict); err != nil {
+			return nil, nil, 0, 0, err
+		}
+		if added {
+			inserted++
+		}
+		if replaced {
+			overwritten++
+		}
+		c.dirty = c.dirty || added || replaced
+	}
+
+	for id, scs := range chunks {
+		for _, c := range scs {
+			if !c.dirty {
+				continue
+			}
+			if err := upsertChunkTx(tx, id, c.start, c.pts); err != nil {
+				return nil, nil, 0, 0, err
+			}
+		}
+	}
+	return rest, restIDs, inserted, overwritten, nil
+}
+
+// deleteChunkPoints removes the points with start <= timestamp <= end from
+// the chunks of the series and returns the number of points removed
+func deleteChunkPoints(session *sql.DB, seriesIDs []int64, start, end int64) (int64, error) {
+	tx, err := session.BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, err
+	}
+	rollback := func(err error) (int64, error) {
+		if err0 := tx.Rollback(); err0 != nil {
+			log.Errorf("deleteChunkPoints rollback error: %s", err0)
+		}
+		return 0, err
+	}
+
+	query := fmt.Sprintf("SELECT series_id, start_time, count, data FROM %s WHERE series_id = ANY($1) AND min_time <= %d AND max_time >= %d FOR UPDATE", chunksTable, end, start)
+	scanner, err := tx.Query(query, pq.Array(seriesIDs))
+	if err != nil {
+		return rollback(err)
+	}
+	type chunk struct {
+		seriesID int64
+		start    int64
+		pts      []*point
+	}
+	var (
+		chunks []*chunk
+		count  int
+		data   []byte
+	)
+	for scanner.Next() {
+		c := &chunk{}
+		if err := scanner.Scan(&c.seriesID, &c.start, &count, &data); err != nil {
+			scanner.Close()
+			return rollback(err)
+		}
+		if c.pts, err = decodeChunk(data, count); err != nil {
+			scanner.Close()
+			return rollback(err)
+		}
+		chunks = append(chunks, c)
+	}
+	scanner.Close()
+	if err := scanner.Err(); err != nil {
+		return rollback(err)
+	}
+
+	var deleted int64
+	for _, c := range chunks {
+		kept := []*point{}
+		for _, pt := range c.pts {
+			if pt.Timestamp < start || pt.Timestamp > end {
+				kept = append(kept, pt)
+			}
+		}
+		deleted += int64(len(c.pts) - len(kept))
+		if len(kept) == 0 {
+			_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE series_id = $1 AND start_time = $2", chunksTable), c.seriesID, c.start)
+		} else {
+			err = upsertChunkTx(tx, c.seriesID, c.start, kept)
+		}
+		if err != nil {
+			return rollback(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// compressSeries moves the points of a series older than cutoff from the
+// metrics table into chunks. The rows are read by deleting them so points
+// inserted concurrently are either compressed or left alone.
+func compressSeries(session *sql.DB, seriesID, cutoff int64) (int, error) {
+	tx, err := session.BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, err
+	}
+	rollback := func(err error) (int, error) {
+		if err0 := tx.Rollback(); err0 != nil {
+			log.Errorf("compressSeries rollback error: %s", err0)
+		}
+		return 0, err
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE series_id = $1 AND timestamp < %d RETURNING timestamp, value", metricsTable, cutoff)
+	scanner, err := tx.Query(query, seriesID)
+	if err != nil {
+		return rollback(err)
+	}
+	var (
+		pts   []*point
+		value sql.NullFloat64
+	)
+	for scanner.Next() {
+		pt := &point{}
+		if err := scanner.Scan(&pt.Timestamp, &value); err != nil {
+			scanner.Close()
+			return rollback(err)
+		}
+		pt.Value, pt.Null = value.Float64, !value.Valid
+		pts = append(pts, pt)
+	}
+	scanner.Close()
+	if err := scanner.Err(); err != nil {
+		return rollback(err)
+	}
+	sortPoints(pts)
+
+	width := chunkWidth.Nanoseconds()
+	for i := 0; i < len(pts); {
+		start := partitionStart(pts[i].Timestamp, width)
+		j := i
+		for j < len(pts) && pts[j].Timestamp < start+width {
+			j++
+		}
+		chunkPts := pts[i:j]
+		i = j
+
+		var (
+			count int
+			data  []byte
+		)
+		row := tx.QueryRow(fmt.Sprintf("SELECT count, data FROM %s WHERE series_id = $1 AND start_time = $2 FOR UPDATE", chunksTable), seriesID, start)
+		switch err := row.Scan(&count, &data); err {
+		case nil:
+			existing, err := decodeChunk(data, count)
+			if err != nil {
+				return rollback(err)
+			}
+			chunkPts = mergePoints(existing, chunkPts)
+		case sql.ErrNoRows:
+		default:
+			return rollback(err)
+		}
+		if err := upsertChunkTx(tx, seriesID, start, chunkPts); err != nil {
+			return rollback(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(pts), nil
+}
+
+// compressColdPoints compresses every point older than chunkCompressAfter
+// whose chunk range has ended
+func compressColdPoints(db *dbConn, now int64) error {
+	cutoff := partitionStart(now-chunkCompressAfter.Nanoseconds(), chunkWidth.Nanoseconds())
+	var seriesIDs []int64
+	err := db.Query(priorityDownsamplers, func(session *sql.DB) error {
+		scanner, err := session.Query(fmt.Sprintf("SELECT DISTINCT series_id FROM %s WHERE timestamp < %d", metricsTable, cutoff))
+		if err != nil {
+			return err
+		}
+		defer scanner.Close()
+		var id int64
+		for scanner.Next() {
+			if err := scanner.Scan(&id); err != nil {
+				return err
+			}
+			seriesIDs = append(seriesIDs, id)
+		}
+		return scanner.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	t0 := time.Now()
+	total := 0
+	for _, id := range seriesIDs {
+		err := db.Query(priorityDownsamplers, func(session *sql.DB) error {
+			n, err := compressSeries(session, id, cutoff)
+			total += n
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if total > 0 {
+		log.Infof("compressed %d points of %d series in %s", total, len(seriesIDs), time.Since(t0))
+	}
+	return nil
+}
+
+func compressChunks(db *dbConn) {
+	for {
+		if err := compressColdPoints(db, time.Now().UnixNano()); err != nil {
+			log.Errorf("compressChunks: %s", err)
+		}
+		time.Sleep(chunkCompressInterval)
+	}
+}
+
+// CompressionStats compares the size of the chunks of every metric with 16
+// bytes per point, the size of an uncompressed timestamp and value
+func (s *pgStorage) CompressionStats() ([]*compressionStats, error) {
+	stats := []*compressionStats{}
+	err := s.db.Query(priorityCRUD, func(session *sql.DB) error {
+		query := fmt.Sprintf(`
+SELECT s.metric, count(*), sum(c.count), sum(octet_length(c.data))
+FROM %s c JOIN %s s ON s.id = c.series_id
+GROUP BY s.metric ORDER BY s.metric`, chunksTable, seriesTable)
+		scanner, err := session.Query(query)
+		if err != nil {
+			return err
+		}
+		defer scanner.Close()
+		for scanner.Next() {
+			st := &compressionStats{}
+			if err := scanner.Scan(&st.Metric, &st.Chunks, &st.Points, &st.CompressedBytes); err != nil {
+				return err
+			}
+			if st.Points > 0 {
+				st.BytesPerPoint = float64(st.CompressedBytes) / float64(st.Points)
+			}
+			if st.CompressedBytes > 0 {
+				st.Ratio = float64(st.Points*16) / float64(st.CompressedBytes)
+			}
+			stats = append(stats, st)
+		}
+		return scanner.Err()
+	})
+	return stats, err
+}
+
+func selectCompressionStats(s Storage) ([]*compressionStats, error) {
+	cs, ok := s.(compressionStatser)
+	if !ok {
+		return nil, errCompressionStatsNotSupported
+	}
+	return cs.CompressionStats()
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeChunkPoints(t *testing.T) {
+	rows := []*seriesPoint{
+		{seriesID: 1, pt: &point{Value: 10, Timestamp: 2}},
+		{seriesID: 2, pt: &point{Value: 20, Timestamp: 2}},
+		{seriesID: 1, pt: &point{Value: 30, Timestamp: 5}},
+	}
+	chunkPoints := []*seriesPoint{
+		{seriesID: 1, pt: &point{Value: 1, Timestamp: 1}},
+		{seriesID: 1, pt: &point{Value: 2, Timestamp: 2}},
+	}
+	// the compressed point of series 1 at 2 wins over its row
+	require.Equal(t, []*point{
+		{Value: 1, Timestamp: 1},
+		{Value: 2, Timestamp: 2},
+		{Value: 20, Timestamp: 2},
+		{Value: 30, Timestamp: 5},
+	}, mergeChunkPoints(rows, chunkPoints, 0))
+	require.Equal(t, 2, len(mergeChunkPoints(rows, chunkPoints, 2)))
+
+	require.Equal(t, []*point{
+		{Value: 1, Timestamp: 1},
+		{Value: 2, Timestamp: 2},
+		{Value: 30, Timestamp: 5},
+	}, mergePoints([]*point{{Value: 1, Timestamp: 1}, {Value: 2, Timestamp: 2}}, []*point{{Value: 30, Timestamp: 5}, {Value: 10, Timestamp: 2}}))
+}
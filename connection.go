@@ -4,6 +4,7 @@ import (
 	"container/heap"
 	"database/sql"
 	"fmt"
+	"strconv"
 	"sync"
 
 	log "github.com/sirupsen/logrus"
@@ -13,72 +14,58 @@ import (
 
 var (
 	metricsTable           = `simpletsdb_metrics`
+	seriesTable            = `simpletsdb_series`
 	downsamplersTable      = `simpletsdb_downsamplers`
 	metaTable              = `simpletsdb_meta`
 	downsamplerWorkerCount = 32
 )
 
-func initDB(pgUser, pgPassword, pgHost string, pgPort int, pgDB, pgSSLMode string, nWorkers int) (*dbConn, chan int, []chan struct{}) {
+// openSession connects to pgDB, creating the database if it doesn't exist.
+func openSession(pgUser, pgPassword, pgHost string, pgPort int, pgDB, pgSSLMode string) (*sql.DB, error) {
 	var passwordString string
 	if pgPassword != "" {
 		passwordString = fmt.Sprintf("password='%s' ", pgPassword)
 	}
 	connStr0 := fmt.Sprintf("user=%s %shost='%s' port=%d sslmode=%s", pgUser, passwordString, pgHost, pgPort, pgSSLMode)
-	var err error
 	session, err := sql.Open("postgres", connStr0)
 	if err != nil {
-		log.Fatalf("initDB: %s", err)
+		return nil, err
 	}
 	if err := session.Ping(); err != nil {
-		log.Fatalf("initDB: %s", err)
+		return nil, err
 	}
 	session.Exec(fmt.Sprintf("create database %s", pgDB))
 	if ok, err := databaseExists(pgDB, session); err != nil {
-		log.Fatalf("initDB: %s", err)
+		return nil, err
 	} else if !ok {
-		log.Fatalf("initDB: could not create database %s", pgDB)
+		return nil, fmt.Errorf("could not create database %s", pgDB)
 	}
 	session.Close()
 
 	connStr := fmt.Sprintf("user=%s %shost='%s' port=%d dbname=%s sslmode=%s", pgUser, passwordString, pgHost, pgPort, pgDB, pgSSLMode)
 	session, err = sql.Open("postgres", connStr)
 	if err != nil {
-		log.Fatalf("initDB: %s", err)
+		return nil, err
 	}
 	if err := session.Ping(); err != nil {
-		log.Fatalf("initDB: %s", err)
+		return nil, err
 	}
+	return session, nil
+}
 
-	session.Exec(fmt.Sprintf(`
-CREATE TABLE %s (
-	metric text,
-	value double precision,
-	timestamp bigint,
-	tags jsonb,
-	UNIQUE(metric, timestamp, tags)
-)
-	`, metricsTable))
-
-	session.Exec(fmt.Sprintf(`
-CREATE TABLE %s (
-  id serial,
-  metric text,
-  out_metric text,
-  run_every bigint,
-  last_downsampled_window bigint,
-	time_update_at bigint NOT NULL,
-	worker_id int,
-  query jsonb
-)
-		`, downsamplersTable))
+func initDB(pgUser, pgPassword, pgHost string, pgPort int, pgDB, pgSSLMode string, nWorkers int) *dbConn {
+	session, err := openSession(pgUser, pgPassword, pgHost, pgPort, pgDB, pgSSLMode)
+	if err != nil {
+		log.Fatalf("initDB: %s", err)
+	}
 
-	session.Exec(fmt.Sprintf(`CREATE INDEX %s_worker_id_idx ON %s(worker_id)`, downsamplersTable, downsamplersTable))
-	session.Exec(fmt.Sprintf(`CREATE INDEX %s_time_update_at_idx ON %s(time_update_at)`, downsamplersTable, downsamplersTable))
+	if err := migrateUp(session); err != nil {
+		log.Fatalf("initDB: migrate: %s", err)
+	}
 
-	session.Exec(fmt.Sprintf(`
-		CREATE TABLE %s (
-			worker_id_count int
-		)`, metaTable))
+	if err := loadPartitions(session); err != nil {
+		log.Fatalf("initDB: %s", err)
+	}
 
 	db := &dbConn{queue: &priorityQueue{}, cond: sync.NewCond(&sync.Mutex{})}
 	heap.Init(db.queue)
@@ -105,6 +92,12 @@ CREATE TABLE %s (
 		log.Fatalf("initDB: could not create %s table", metricsTable)
 	}
 
+	if ok, err := tableExists(db, seriesTable); err != nil {
+		log.Fatalf("initDB: %s", err)
+	} else if !ok {
+		log.Fatalf("initDB: could not create %s table", seriesTable)
+	}
+
 	if ok, err := tableExists(db, downsamplersTable); err != nil {
 		log.Fatal(err)
 	} else if !ok {
@@ -117,24 +110,54 @@ CREATE TABLE %s (
 		log.Fatalf("initDB: could not create %s table", metaTable)
 	}
 
-	downsamplersCount, err := selectDownsamplersCount(db)
-	if err != nil && err.Error() == errStrNoRowsInResultSet {
-		if err0 := insertDownsamplersInitialCount(db); err0 != nil {
-			log.Fatalf("initDB: downsampleCoordinator start: %s", err0)
-		}
-	} else if err != nil {
-		log.Fatalf("initDB: downsampleCoordinator start: %s", err)
+	go managePartitions(db)
+
+	if chunkCompressAfter > 0 {
+		go compressChunks(db)
 	}
 
-	nextDownsamplerID := make(chan int)
-	go downsampleCountCoordinator(db, downsamplersCount, nextDownsamplerID)
+	return db
+}
+
+type pgConfig struct {
+	username     string
+	password     string
+	host         string
+	port         int
+	db           string
+	sslMode      string
+	nConnWorkers int
+}
 
-	cancelDownsampleWait := make([]chan struct{}, downsamplerWorkerCount)
-	for i := 0; i < downsamplerWorkerCount; i++ {
-		i := i
-		cancelDownsampleWait[i] = make(chan struct{}, 100)
-		go handleDownsamplers(db, i, cancelDownsampleWait[i])
+func parsePGConfig(cfg map[string]string) (*pgConfig, error) {
+	for _, key := range []string{"postgres_username", "postgres_ssl_mode", "postgres_host", "postgres_port", "postgres_db", "postgres_n_conn_workers"} {
+		if v, ok := cfg[key]; v == "" || !ok {
+			return nil, fmt.Errorf("%s config is required", key)
+		}
+	}
+	c := &pgConfig{
+		username: cfg["postgres_username"],
+		password: cfg["postgres_password"],
+		host:     cfg["postgres_host"],
+		db:       cfg["postgres_db"],
+		sslMode:  cfg["postgres_ssl_mode"],
+	}
+	var err error
+	if c.port, err = strconv.Atoi(cfg["postgres_port"]); err != nil {
+		return nil, err
 	}
+	if c.nConnWorkers, err = strconv.Atoi(cfg["postgres_n_conn_workers"]); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
 
-	return db, nextDownsamplerID, cancelDownsampleWait
+func newPGStorageFromConfig(cfg map[string]string) (Storage, error) {
+	c, err := parsePGConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	db := initDB(c.username, c.password, c.host, c.port, c.db, c.sslMode, c.nConnWorkers)
+	log.Infof("Connected to database [%s] at %s:%d", c.db, c.host, c.port)
+	return &pgStorage{db: db}, nil
 }
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// Postgres streams insert_points bodies with COPY into a temporary staging
+// table that is merged into the metrics table in the same transaction, so
+// bodies of any size are written all or nothing without being held in
+// memory. Parsing runs at most streamQueueSize points ahead of COPY, and
+// staged points within compressed ranges are merged into their chunks
+// streamChunkBatchSize points at a time.
+
+var (
+	stagingTable              = `simpletsdb_staging_points`
+	stagedChunkTable          = `simpletsdb_staged_chunk_points`
+	stagedChunkCursor         = `simpletsdb_staged_chunk_cursor`
+	streamQueueSize           = 10000
+	streamPartitionsBatchSize = 10000
+	streamChunkBatchSize      = 10000
+)
+
+// pointsStreamer is implemented by storage engines that write the points of
+// an iterator without collecting them first
+type pointsStreamer interface {
+	// StreamPoints writes every point of next or none of them. It returns
+	// the number of points read, inserted and overwritten.
+	StreamPoints(next pointsIterator, onConflict string) (int64, int64, int64, error)
+}
+
+type pointsIteratorResult struct {
+	query *insertPointQuery
+	err   error
+}
+
+// pipePoints runs next in its own goroutine at most size points ahead of the
+// returned iterator. stop must be called once the returned iterator isn't
+// used anymore; it returns once next isn't called anymore.
+func pipePoints(next pointsIterator, size int) (pointsIterator, func()) {
+	results := make(chan *pointsIteratorResult, size)
+	done := make(chan struct{})
+	go func() {
+		defer close(results)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			query, err := next()
+			select {
+			case results <- &pointsIteratorResult{query: query, err: err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	stop := func() {
+		close(done)
+		for range results {
+		}
+	}
+	return func() (*insertPointQuery, error) {
+		result, ok := <-results
+		if !ok {
+			return nil, io.EOF
+		}
+		return result.query, result.err
+	}, stop
+}
+
+// streamPoints validates the points of next while s writes them
+func streamPoints(s pointsStreamer, next pointsIterator, onConflict string) (int64, int64, int64, error) {
+	piped, stop := pipePoints(next, streamQueueSize)
+	defer stop()
+	return s.StreamPoints(func() (*insertPointQuery, error) {
+		query, err := piped()
+		if err == nil {
+			err = validateInsertQueries([]*insertPointQuery{query})
+		}
+		return query, err
+	}, onConflict)
+}
+
+// mergeStagedChunkPoints writes the merged staged points within the time
+// range of a chunk of their series into that chunk, one chunk at a time,
+// and records them in stagedChunkTable so they are left out of the insert
+// into the metrics table. It returns the number of points inserted and
+// overwritten in chunks.
+func mergeStagedChunkPoints(tx queryer, onConflict string) (int64, int64, error) {
+	query := fmt.Sprintf(`CREATE TEMPORARY TABLE %s (series_id bigint NOT NULL, timestamp bigint NOT NULL) ON COMMIT DROP`, stagedChunkTable)
+	if _, err := tx.Exec(query); err != nil {
+		return 0, 0, err
+	}
+	// chunks don't overlap, every staged point joins at most one chunk
+	query = fmt.Sprintf(`DECLARE %s NO SCROLL CURSOR FOR SELECT c.series_id, c.start_time, src.timestamp, src.value FROM (%s) src JOIN %s c ON c.series_id = src.series_id AND c.min_time <= src.timestamp AND c.max_time >= src.timestamp ORDER BY c.series_id, c.start_time`, stagedChunkCursor, stagedPointsQuery(onConflict), chunksTable)
+	if _, err := tx.Exec(query); err != nil {
+		return 0, 0, err
+	}
+
+	type chunk struct {
+		seriesID int64
+		start    int64
+		minTime  int64
+		maxTime  int64
+		pts      []*point
+		found    bool
+		dirty    bool
+	}
+	var (
+		c                     *chunk
+		inserted, overwritten int64
+	)
+	// the chunk is loaded again from the locked row since it may have
+	// changed since the cursor's query started. Points that aren't within
+	// its time range anymore stay in the metrics table.
+	loadChunk := func(seriesID, start int64) (*chunk, error) {
+		loaded := &chunk{seriesID: seriesID, start: start}
+		var (
+			count int
+			data  []byte
+		)
+		row := tx.QueryRow(fmt.Sprintf("SELECT min_time, max_time, count, data FROM %s WHERE series_id = $1 AND start_time = $2 FOR UPDATE", chunksTable), seriesID, start)
+		switch err := row.Scan(&loaded.minTime, &loaded.maxTime, &count, &data); err {
+		case nil:
+		case sql.ErrNoRows:
+			return loaded, nil
+		default:
+			return nil, err
+		}
+		pts, err := decodeChunk(data, count)
+		if err != nil {
+			return nil, err
+		}
+		loaded.pts, loaded.found = pts, true
+		return loaded, nil
+	}
+	writeChunk := func() error {
+		if c == nil || !c.dirty {
+			return nil
+		}
+		return upsertChunkTx(tx, c.seriesID, c.start, c.pts)
+	}
+
+	fetch := fmt.Sprintf("FETCH %d FROM %s", streamChunkBatchSize, stagedChunkCursor)
+	record := fmt.Sprintf("INSERT INTO %s (series_id,timestamp) SELECT * FROM unnest($1::bigint[], $2::bigint[])", stagedChunkTable)
+	batch := make([]*seriesPoint, 0, streamChunkBatchSize)
+	starts := make([]int64, 0, streamChunkBatchSize)
+	for {
+		batch, starts = batch[:0], starts[:0]
+		scanner, err := tx.Query(fetch)
+		if err != nil {
+			return 0, 0, err
+		}
+		var (
+			seriesID, start int64
+			value           sql.NullFloat64
+		)
+		for scanner.Next() {
+			pt := &point{}
+			if err := scanner.Scan(&seriesID, &start, &pt.Timestamp, &value); err != nil {
+				scanner.Close()
+				return 0, 0, err
+			}
+			pt.Value, pt.Null = value.Float64, !value.Valid
+			batch = append(batch, &seriesPoint{seriesID: seriesID, pt: pt})
+			starts = append(starts, start)
+		}
+		scanner.Close()
+		if err := scanner.Err(); err != nil {
+			return 0, 0, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		var seriesIDs, timestamps []int64
+		for i, sp := range batch {
+			if c == nil || c.seriesID != sp.seriesID || c.start != starts[i] {
+				if err := writeChunk(); err != nil {
+					return 0, 0, err
+				}
+				if c, err = loadChunk(sp.seriesID, starts[i]); err != nil {
+					return 0, 0, err
+				}
+			}
+			if !c.found || sp.pt.Timestamp < c.minTime || sp.pt.Timestamp > c.maxTime {
+				continue
+			}
+			var added, replaced bool
+			if c.pts, added, replaced, err = mergeChunkPoint(c.pts, sp.pt, onConflict); err != nil {
+				return 0, 0, err
+			}
+			if added {
+				inserted++
+			}
+			if replaced {
+				overwritten++
+			}
+			c.dirty = c.dirty || added || replaced
+			seriesIDs = append(seriesIDs, sp.seriesID)
+			timestamps = append(timestamps, sp.pt.Timestamp)
+		}
+		if len(seriesIDs) > 0 {
+			if _, err := tx.Exec(record, pq.Array(seriesIDs), pq.Array(timestamps)); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	if err := writeChunk(); err != nil {
+		return 0, 0, err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("CLOSE %s", stagedChunkCursor)); err != nil {
+		return 0, 0, err
+	}
+	return inserted, overwritten, nil
+}
+
+// stagedPointsQuery selects the staged points with their series ids, merging
+// points of the same series and timestamp like mergeDuplicateQueries since
+// an upsert can't update a row twice
+func stagedPointsQuery(onConflict string) string {
+	staged := fmt.Sprintf(`SELECT s.id AS series_id, st.timestamp, st.value, st.seq FROM %s st JOIN %s s ON s.metric = st.metric AND s.tags = st.tags`, stagingTable, seriesTable)
+	switch onConflict {
+	case onConflictError:
+		return fmt.Sprintf(`SELECT series_id, timestamp, value FROM (%s) p`, staged)
+	case onConflictOverwrite:
+		return fmt.Sprintf(`SELECT DISTINCT ON (series_id, timestamp) series_id, timestamp, value FROM (%s) p ORDER BY series_id, timestamp, seq DESC`, staged)
+	case onConflictSum:
+		return fmt.Sprintf(`SELECT series_id, timestamp, sum(value) AS value FROM (%s) p GROUP BY series_id, timestamp`, staged)
+	}
+	return fmt.Sprintf(`SELECT DISTINCT ON (series_id, timestamp) series_id, timestamp, value FROM (%s) p ORDER BY series_id, timestamp, seq`, staged)
+}
+
+func (s *pgStorage) StreamPoints(next pointsIterator, onConflict string) (int64, int64, int64, error) {
+	var read, inserted, overwritten int64
+	err := s.db.Query(priorityCRUD, func(session *sql.DB) error {
+		tx, err := session.BeginTx(context.Background(), nil)
+		if err != nil {
+			return err
+		}
+		rollback := func(err error) error {
+			if err0 := tx.Rollback(); err0 != nil {
+				log.Errorf("StreamPoints rollback error: %s", err0)
+			}
+			return err
+		}
+
+		query := fmt.Sprintf(`CREATE TEMPORARY TABLE %s (seq bigint NOT NULL, metric text NOT NULL, tags jsonb NOT NULL, timestamp bigint NOT NULL, value double precision) ON COMMIT DROP`, stagingTable)
+		if _, err := tx.Exec(query); err != nil {
+			return rollback(err)
+		}
+		stmt, err := tx.Prepare(pq.CopyIn(stagingTable, "seq", "metric", "tags", "timestamp", "value"))
+		if err != nil {
+			return rollback(err)
+		}
+		closeAndRollback := func(err error) error {
+			if err0 := stmt.Close(); err0 != nil {
+				log.Errorf("StreamPoints close error: %s", err0)
+			}
+			return rollback(err)
+		}
+
+		// partitions are created outside of the transaction, a rollback
+		// would otherwise leave the partition cache out of sync
+		timestamps := make([]int64, 0, streamPartitionsBatchSize)
+		for {
+			query, err := next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return closeAndRollback(err)
+			}
+			tagsJSON, err := marshalTags(query.Tags)
+			if err != nil {
+				return closeAndRollback(err)
+			}
+			var value interface{}
+			if !query.Point.Null {
+				value = query.Point.Value
+			}
+			if _, err := stmt.Exec(read, query.Metric, tagsJSON, query.Point.Timestamp, value); err != nil {
+				return closeAndRollback(err)
+			}
+			read++
+			timestamps = append(timestamps, query.Point.Timestamp)
+			if len(timestamps) == streamPartitionsBatchSize {
+				if err := ensurePartitions(session, timestamps); err != nil {
+					return closeAndRollback(err)
+				}
+				timestamps = timestamps[:0]
+			}
+		}
+		if err := ensurePartitions(session, timestamps); err != nil {
+			return closeAndRollback(err)
+		}
+		if _, err := stmt.Exec(); err != nil {
+			return closeAndRollback(err)
+		}
+		if err := stmt.Close(); err != nil {
+			return rollback(err)
+		}
+
+		query = fmt.Sprintf(`INSERT INTO %s (metric,tags) SELECT DISTINCT metric, tags FROM %s ON CONFLICT DO NOTHING`, seriesTable, stagingTable)
+		if _, err := tx.Exec(query); err != nil {
+			return rollback(err)
+		}
+		// staged points within the time range of a chunk are written into
+		// the chunk and left out of the insert below
+		chunkInserted, chunkOverwritten, err := mergeStagedChunkPoints(tx, onConflict)
+		if err != nil {
+			return rollback(err)
+		}
+
+		var distinct int64
+		query = fmt.Sprintf(`
+WITH staged AS (%s), src AS (
+	SELECT staged.* FROM staged WHERE NOT EXISTS (SELECT 1 FROM %s e WHERE e.series_id = staged.series_id AND e.timestamp = staged.timestamp)
+), ins AS (
+	INSERT INTO %s AS t (series_id,timestamp,value) SELECT series_id, timestamp, value FROM src%s RETURNING xmax = 0 AS inserted
+)
+SELECT (SELECT count(*) FROM staged), count(*) FILTER (WHERE inserted), count(*) FILTER (WHERE NOT inserted) FROM ins`, stagedPointsQuery(onConflict), stagedChunkTable, metricsTable, onConflictClause(onConflict))
+		err = tx.QueryRow(query).Scan(&distinct, &inserted, &overwritten)
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pqUniqueViolation {
+			return rollback(errPointExists)
+		}
+		if err != nil {
+			return rollback(err)
+		}
+		inserted += chunkInserted
+		overwritten += chunkOverwritten
+		if onConflict == onConflictOverwrite || onConflict == onConflictSum {
+			overwritten += read - distinct
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return read, 0, 0, err
+	}
+	return read, inserted, overwritten, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipePoints(t *testing.T) {
+	body := `[{"metric":"a","point":{"value":1,"timestamp":1}},{"metric":"b","point":{"value":null,"timestamp":2}}]`
+	next, stop := pipePoints(newPointsIterator("application/json", strings.NewReader(body)), 1)
+	queries, err := readAllPoints(next)
+	stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*insertPointQuery{
+		{Metric: "a", Point: &point{Value: 1, Timestamp: 1}},
+		{Metric: "b", Point: &point{Null: true, Timestamp: 2}},
+	}, queries)
+
+	next, stop = pipePoints(newPointsIterator("application/x.simpletsdb.points", strings.NewReader("a,,1 1\nb 2\na,,3 3\n")), 1)
+	if _, err := next(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := next(); err != errNoMatches {
+		t.Fatalf("expected %s, got %v", errNoMatches, err)
+	}
+	if _, err := next(); err != io.EOF {
+		t.Fatalf("expected EOF after an error, got %v", err)
+	}
+	stop()
+
+	// stopping early ends the pipe before the body is read
+	lines := strings.Repeat("a,,1 1\n", 1000)
+	next, stop = pipePoints(newPointsIterator("application/x.simpletsdb.points", strings.NewReader(lines)), 10)
+	if _, err := next(); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+
+	if _, err := readAllPoints(newPointsIterator("application/json", strings.NewReader(`{"metric":"a"}`))); err != errJSONArrayRequired {
+		t.Fatalf("expected %s, got %v", errJSONArrayRequired, err)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CSV bodies start with a header row. By convention the timestamp column is
+// named timestamp, tag columns are named tag:<key>, and every other column is
+// a value column whose name is the metric. A metric column (with a value
+// column named value) stores a different metric on every row instead. Query
+// parameters override the convention.
+
+var (
+	csvImportMaxErrors          = 10
+	csvTimestampFormats         = []string{"rfc3339", "s", "ms", "ns"}
+	errCSVHeaderRequired        = errors.New("csv header row required")
+	errCSVUnknownColumn         = errors.New("unknown csv column")
+	errCSVValueColumnsRequired  = errors.New("at least one value column is required")
+	errCSVInvalidTimestampFmt   = errors.New("timestampFormat must be rfc3339, s, ms or ns")
+	errCSVInvalidMaxErrors      = errors.New("maxErrors must be a non-negative integer")
+	errCSVMetricColumnAndValues = errors.New("metricColumn requires exactly one value column")
+)
+
+type csvMapping struct {
+	timestamp       int
+	timestampFormat string
+	metric          int // -1 unless metrics are read from a column
+	values          []int
+	valueNames      []string
+	tags            []int
+	tagNames        []string
+}
+
+func csvColumnIndex(header []string, name string) (int, error) {
+	for i, column := range header {
+		if column == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("%s: %s", errCSVUnknownColumn, name)
+}
+
+func splitCSVColumns(s string) []string {
+	columns := []string{}
+	for _, column := range strings.Split(s, ",") {
+		if column = strings.TrimSpace(column); column != "" {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// parseCSVMapping maps the header row to timestamp, metric, value and tag
+// columns using the timestampColumn, timestampFormat, metricColumn,
+// valueColumns and tagColumns parameters
+func parseCSVMapping(header []string, params url.Values) (*csvMapping, error) {
+	m := &csvMapping{metric: -1, timestampFormat: "rfc3339"}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	if f := params.Get("timestampFormat"); f != "" {
+		if !containsString(csvTimestampFormats, f) {
+			return nil, errCSVInvalidTimestampFmt
+		}
+		m.timestampFormat = f
+	}
+	timestampColumn := params.Get("timestampColumn")
+	if timestampColumn == "" {
+		timestampColumn = "timestamp"
+	}
+	var err error
+	if m.timestamp, err = csvColumnIndex(header, timestampColumn); err != nil {
+		return nil, err
+	}
+
+	used := map[int]bool{m.timestamp: true}
+	if metricColumn := params.Get("metricColumn"); metricColumn != "" {
+		if m.metric, err = csvColumnIndex(header, metricColumn); err != nil {
+			return nil, err
+		}
+		used[m.metric] = true
+	}
+
+	if tagColumns, ok := params["tagColumns"]; ok {
+		for _, column := range splitCSVColumns(strings.Join(tagColumns, ",")) {
+			i, err := csvColumnIndex(header, column)
+			if err != nil {
+				return nil, err
+			}
+			m.tags = append(m.tags, i)
+			m.tagNames = append(m.tagNames, column)
+			used[i] = true
+		}
+	} else {
+		for i, column := range header {
+			if strings.HasPrefix(column, "tag:") && !used[i] {
+				m.tags = append(m.tags, i)
+				m.tagNames = append(m.tagNames, strings.TrimPrefix(column, "tag:"))
+				used[i] = true
+			}
+		}
+	}
+	for _, name := range m.tagNames {
+		if !metricAndTagsRe.MatchString(name) {
+			return nil, fmt.Errorf("%s: %s", errUnsupportedTagName, name)
+		}
+	}
+
+	if valueColumns, ok := params["valueColumns"]; ok {
+		for _, column := range splitCSVColumns(strings.Join(valueColumns, ",")) {
+			i, err := csvColumnIndex(header, column)
+			if err != nil {
+				return nil, err
+			}
+			m.values = append(m.values, i)
+			m.valueNames = append(m.valueNames, column)
+		}
+	} else if m.metric >= 0 {
+		i, err := csvColumnIndex(header, "value")
+		if err != nil {
+			return nil, err
+		}
+		m.values = []int{i}
+		m.valueNames = []string{"value"}
+	} else {
+		for i, column := range header {
+			if !used[i] {
+				m.values = append(m.values, i)
+				m.valueNames = append(m.valueNames, column)
+			}
+		}
+	}
+	if len(m.values) == 0 {
+		return nil, errCSVValueColumnsRequired
+	}
+	if m.metric >= 0 && len(m.values) != 1 {
+		return nil, errCSVMetricColumnAndValues
+	}
+	if m.metric < 0 {
+		for _, name := range m.valueNames {
+			if !metricAndTagsRe.MatchString(name) {
+				return nil, fmt.Errorf("%s: %s", errUnsupportedMetricName, name)
+			}
+		}
+	}
+	return m, nil
+}
+
+// parseCSVTimestamp converts a timestamp in the given format to nanoseconds.
+// Epoch seconds and milliseconds may be fractional.
+func parseCSVTimestamp(s, format string) (int64, error) {
+	if format == "rfc3339" {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return 0, err
+		}
+		return t.UnixNano(), nil
+	}
+	scale := map[string]int64{"s": int64(time.Second), "ms": int64(time.Millisecond), "ns": 1}[format]
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ts * scale, nil
+	}
+	if format == "ns" {
+		return 0, fmt.Errorf("invalid timestamp: %s", s)
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid timestamp: %s", s)
+	}
+	return int64(math.Round(f * float64(scale))), nil
+}
+
+// rowToQueries converts a record into one query per non-empty value. A value
+// of null is stored as a null point.
+func (m *csvMapping) rowToQueries(record []string) ([]*insertPointQuery, error) {
+	timestamp, err := parseCSVTimestamp(strings.TrimSpace(record[m.timestamp]), m.timestampFormat)
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	for j, i := range m.tags {
+		if v := strings.TrimSpace(record[i]); v != "" {
+			tags[m.tagNames[j]] = v
+		}
+	}
+	if err := validateTags(tags); err != nil {
+		return nil, err
+	}
+
+	queries := []*insertPointQuery{}
+	for j, i := range m.values {
+		metric := m.valueNames[j]
+		if m.metric >= 0 {
+			metric = strings.TrimSpace(record[m.metric])
+			if !metricAndTagsRe.MatchString(metric) {
+				return nil, fmt.Errorf("%s: %s", errUnsupportedMetricName, metric)
+			}
+		}
+		pt := &point{Timestamp: timestamp}
+		switch v := strings.TrimSpace(record[i]); v {
+		case "":
+			continue
+		case "null":
+			pt.Null = true
+		default:
+			if pt.Value, err = strconv.ParseFloat(v, 64); err != nil {
+				return nil, fmt.Errorf("invalid value in column %s: %s", m.valueNames[j], v)
+			}
+		}
+		queries = append(queries, &insertPointQuery{Metric: metric, Tags: tags, Point: pt})
+	}
+	return queries, nil
+}
+
+// importCSV reads the rows of body and inserts them insertBatchSize points at
+// a time. Invalid rows are counted and skipped, and the first maxErrors of
+// them are reported with the line number they start on, so the header is
+// line 1 and quoted fields may span lines. If a batch fails to insert the summary of the rows
+// inserted so far is returned with the error and the lines of the batch.
+func importCSV(s Storage, body io.Reader, params url.Values) (*csvImportSummary, error) {
+	maxErrors := csvImportMaxErrors
+	if v := params.Get("maxErrors"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, errCSVInvalidMaxErrors
+		}
+		maxErrors = n
+	}
+
+	r := csv.NewReader(body)
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, errCSVHeaderRequired
+	}
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseCSVMapping(header, params)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &csvImportSummary{}
+	reject := func(line int, err error) {
+		summary.Rejected++
+		if len(summary.Errors) < maxErrors {
+			summary.Errors = append(summary.Errors, &csvImportError{Line: line, Error: err.Error()})
+		}
+	}
+	var (
+		queries             = make([]*insertPointQuery, 0, insertBatchSize)
+		rows                int // rows of queries
+		firstLine, lastLine int // lines of the first and last row of queries
+	)
+	flush := func() error {
+		if err := insertPoints(s, queries); err != nil {
+			summary.Failed = &csvImportFailure{FirstLine: firstLine, LastLine: lastLine, Error: err.Error()}
+			return err
+		}
+		summary.Accepted += rows
+		queries, rows = make([]*insertPointQuery, 0, insertBatchSize), 0
+		return nil
+	}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			perr, ok := err.(*csv.ParseError)
+			if !ok {
+				return nil, err
+			}
+			reject(perr.StartLine, err)
+			continue
+		}
+		line, _ := r.FieldPos(0)
+		rowQueries, err := m.rowToQueries(record)
+		if err != nil {
+			reject(line, err)
+			continue
+		}
+		if rows == 0 {
+			firstLine = line
+		}
+		lastLine = line
+		rows++
+		queries = append(queries, rowQueries...)
+		if len(queries) >= insertBatchSize {
+			if err := flush(); err != nil {
+				return summary, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return summary, err
+	}
+	return summary, nil
+}
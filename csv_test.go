@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCSVTimestamp(t *testing.T) {
+	for _, c := range []struct {
+		s, format string
+		expected  int64
+	}{
+		{"2000-01-01T00:00:00Z", "rfc3339", 946684800000000000},
+		{"2000-01-01T00:00:00.5+00:00", "rfc3339", 946684800500000000},
+		{"946684800", "s", 946684800000000000},
+		{"946684800.25", "s", 946684800250000000},
+		{"946684800123", "ms", 946684800123000000},
+		{"946684800000000001", "ns", 946684800000000001},
+	} {
+		ts, err := parseCSVTimestamp(c.s, c.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, c.expected, ts, c.s)
+	}
+	for _, s := range []string{"2000-01-01", "x", "1.5"} {
+		if _, err := parseCSVTimestamp(s, "ns"); err == nil {
+			t.Fatalf("expected error for timestamp %q", s)
+		}
+	}
+}
+
+func TestParseCSVMapping(t *testing.T) {
+	m, err := parseCSVMapping([]string{"timestamp", "tag:host", "cpu", "mem"}, url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, &csvMapping{
+		timestamp:       0,
+		timestampFormat: "rfc3339",
+		metric:          -1,
+		values:          []int{2, 3},
+		valueNames:      []string{"cpu", "mem"},
+		tags:            []int{1},
+		tagNames:        []string{"host"},
+	}, m)
+
+	m, err = parseCSVMapping([]string{"time", "name", "host", "v"}, url.Values{
+		"timestampColumn": {"time"},
+		"timestampFormat": {"s"},
+		"metricColumn":    {"name"},
+		"valueColumns":    {"v"},
+		"tagColumns":      {"host"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, 1, m.metric)
+	require.Equal(t, []int{3}, m.values)
+	require.Equal(t, []string{"host"}, m.tagNames)
+
+	for _, c := range []struct {
+		header []string
+		params url.Values
+	}{
+		{[]string{"time", "cpu"}, url.Values{}},
+		{[]string{"timestamp"}, url.Values{}},
+		{[]string{"timestamp", "cpu"}, url.Values{"timestampFormat": {"us"}}},
+		{[]string{"timestamp", "name", "a", "b"}, url.Values{"metricColumn": {"name"}, "valueColumns": {"a,b"}}},
+		{[]string{"timestamp", "cpu load"}, url.Values{}},
+	} {
+		if _, err := parseCSVMapping(c.header, c.params); err == nil {
+			t.Fatalf("expected error for header %v and params %v", c.header, c.params)
+		}
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	s := newMemStorage()
+	body := `timestamp,tag:host,test_csv_cpu,test_csv_mem
+2000-01-01T00:00:00Z,a,1.5,10
+2000-01-01T00:00:01Z,a,,null
+2000-01-01T00:00:02Z,a,x,1
+yesterday,a,1,1
+2000-01-01T00:00:03Z,a,2
+2000-01-01T00:00:04Z,b,"3
+",30
+2000-01-01T00:00:05Z,a,x,1
+`
+	summary, err := importCSV(s, strings.NewReader(body), url.Values{"maxErrors": {"4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, 3, summary.Accepted)
+	require.Equal(t, 4, summary.Rejected)
+	require.Len(t, summary.Errors, 4)
+	require.Equal(t, 4, summary.Errors[0].Line)
+	require.Equal(t, 5, summary.Errors[1].Line)
+	require.Equal(t, 6, summary.Errors[2].Line)
+	// the quoted value of the row before spans lines 7 and 8
+	require.Equal(t, 9, summary.Errors[3].Line)
+
+	pts, err := queryPoints(s, priorityCRUD, &pointsQuery{Metric: "test_csv_mem", Tags: map[string]string{"host": "a"}, Start: 946684800000000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*point{
+		{Value: 10, Timestamp: 946684800000000000},
+		{Null: true, Timestamp: 946684801000000000},
+	}, pts)
+	pts, err = queryPoints(s, priorityCRUD, &pointsQuery{Metric: "test_csv_cpu", Start: 946684800000000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Len(t, pts, 2)
+
+	if _, err := importCSV(s, strings.NewReader(""), url.Values{}); err != errCSVHeaderRequired {
+		t.Fatalf("expected %s, got %v", errCSVHeaderRequired, err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/julienschmidt/httprouter"
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	maxDecompressedSize               = int64(256 << 20)
+	errDecompressedTooLarge           = errors.New("decompressed body exceeds simpletsdb_max_decompressed_size")
+	errUnsupportedContentEncoding     = errors.New("content-encoding must be gzip, zstd or snappy")
+	errMaxDecompressedSizeNotPositive = errors.New("max decompressed size must be positive")
+)
+
+// limitedBody fails reads once more than maxDecompressedSize bytes are read
+type limitedBody struct {
+	r      io.Reader
+	read   int64
+	close  func() error
+	closed bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.read += int64(n)
+	if b.read > maxDecompressedSize {
+		return 0, errDecompressedTooLarge
+	}
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	return b.close()
+}
+
+// decodeSnappy decodes a snappy block, checking its decoded length first
+func decodeSnappy(compressed []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(compressed)
+	if err != nil {
+		return nil, err
+	}
+	if int64(n) > maxDecompressedSize {
+		return nil, errDecompressedTooLarge
+	}
+	return snappy.Decode(nil, compressed)
+}
+
+// decompressBody returns the body of r decompressed according to its
+// Content-Encoding. snappy bodies are single blocks, as in prometheus remote
+// write.
+func decompressBody(r *http.Request) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return r.Body, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &limitedBody{r: zr, close: func() error {
+			zr.Close()
+			return r.Body.Close()
+		}}, nil
+	case "zstd":
+		zr, err := zstd.NewReader(r.Body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(maxDecompressedSize)))
+		if err != nil {
+			return nil, err
+		}
+		return &limitedBody{r: zr, close: func() error {
+			zr.Close()
+			return r.Body.Close()
+		}}, nil
+	case "snappy":
+		compressed, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		body, err := decodeSnappy(compressed)
+		if err != nil {
+			return nil, err
+		}
+		return &limitedBody{r: bytes.NewReader(body), close: r.Body.Close}, nil
+	}
+	return nil, errUnsupportedContentEncoding
+}
+
+/*
+Decompresses request bodies according to their Content-Encoding.
+Returns 400 on invalid compressed bodies
+Returns 415 on unsupported encodings
+*/
+func withDecompression(fn httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		body, err := decompressBody(r)
+		if err != nil {
+			log.Errorf("withDecompression: %s", err)
+			status := http.StatusBadRequest
+			if err == errUnsupportedContentEncoding {
+				status = http.StatusUnsupportedMediaType
+			}
+			if err0 := writeError(w, status, err.Error()); err0 != nil {
+				log.Errorf("withDecompression: %s", err0)
+			}
+			return
+		}
+		defer body.Close()
+		r.Body = body
+		r.Header.Del("Content-Encoding")
+		fn(w, r, ps)
+	}
+}
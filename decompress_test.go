@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithDecompression(t *testing.T) {
+	body := []byte("test_decompression,id=1,1 946684800000000000\n")
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	if _, err := zw.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstded := enc.EncodeAll(body, nil)
+
+	s := newMemStorage()
+	handler := withDecompression(withStorage(s, insertPointsHandler))
+	insert := func(encoding string, payload []byte) int {
+		req := httptest.NewRequest("POST", "/insert_points", bytes.NewReader(payload))
+		req.Header.Add("Content-Type", "application/x.simpletsdb.points")
+		if encoding != "" {
+			req.Header.Add("Content-Encoding", encoding)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req, nil)
+		return w.Result().StatusCode
+	}
+
+	require.Equal(t, 200, insert("", body))
+	require.Equal(t, 200, insert("gzip", gzipped.Bytes()))
+	require.Equal(t, 200, insert("zstd", zstded))
+	require.Equal(t, 200, insert("snappy", snappy.Encode(nil, body)))
+	require.Equal(t, 400, insert("gzip", body))
+	require.Equal(t, 400, insert("snappy", body))
+	require.Equal(t, 415, insert("br", body))
+
+	defer func(size int64) { maxDecompressedSize = size }(maxDecompressedSize)
+	maxDecompressedSize = 10
+	require.Equal(t, 400, insert("gzip", gzipped.Bytes()))
+	require.Equal(t, 400, insert("zstd", zstded))
+	require.Equal(t, 400, insert("snappy", snappy.Encode(nil, body)))
+
+	pts, err := queryPoints(s, priorityCRUD, &pointsQuery{Metric: "test_decompression", Start: 946684800000000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*point{{Value: 1, Timestamp: 946684800000000000}}, pts)
+}
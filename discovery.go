@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	errKeyRequired = errors.New("key is required")
+)
+
+// discoveryQuery is the parameters of the discovery endpoints. start and end
+// are both 0 unless a time range is set.
+type discoveryQuery struct {
+	metric string
+	key    string
+	filter *tagFilter
+	start  int64
+	end    int64
+}
+
+func parseDiscoveryQuery(params url.Values) (*discoveryQuery, error) {
+	q := &discoveryQuery{
+		metric: params.Get("metric"),
+		key:    params.Get("key"),
+	}
+	if q.metric == "" {
+		return nil, errMetricRequired
+	}
+	if !metricAndTagsRe.MatchString(q.metric) {
+		return nil, errUnsupportedMetricName
+	}
+	var err error
+	if q.filter, err = parseTagFilter(params.Get("filter")); err != nil {
+		return nil, err
+	}
+	start, end := params.Get("start"), params.Get("end")
+	if start == "" && end == "" {
+		return q, nil
+	}
+	q.start, q.end = math.MinInt64, math.MaxInt64
+	if start != "" {
+		if q.start, err = strconv.ParseInt(start, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	if end != "" {
+		if q.end, err = strconv.ParseInt(end, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// listMetrics returns the metrics starting with prefix and matching re if
+// it isn't nil
+func listMetrics(s Storage, prefix string, re *regexp.Regexp) ([]string, error) {
+	metrics, err := s.SelectMetrics()
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, metric := range metrics {
+		if strings.HasPrefix(metric, prefix) && (re == nil || re.MatchString(metric)) {
+			result = append(result, metric)
+		}
+	}
+	return result, nil
+}
+
+// listSeries returns the tags of the series of the query sorted by their
+// JSON encoding
+func listSeries(s Storage, q *discoveryQuery) ([]map[string]string, error) {
+	series, err := s.SelectSeries(q.metric, q.filter, q.start, q.end)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(series))
+	for i, tags := range series {
+		if keys[i], err = marshalTags(tags); err != nil {
+			return nil, err
+		}
+	}
+	sort.Sort(&seriesByKey{keys: keys, series: series})
+	return series, nil
+}
+
+type seriesByKey struct {
+	keys   []string
+	series []map[string]string
+}
+
+func (s *seriesByKey) Len() int           { return len(s.keys) }
+func (s *seriesByKey) Less(i, j int) bool { return s.keys[i] < s.keys[j] }
+func (s *seriesByKey) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.series[i], s.series[j] = s.series[j], s.series[i]
+}
+
+// listTagKeys returns the sorted tag keys of the series of the query
+func listTagKeys(s Storage, q *discoveryQuery) ([]string, error) {
+	series, err := s.SelectSeries(q.metric, q.filter, q.start, q.end)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	result := []string{}
+	for _, tags := range series {
+		for k := range tags {
+			if !seen[k] {
+				seen[k] = true
+				result = append(result, k)
+			}
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// listTagValues returns the sorted values of the tag key of the series of
+// the query
+func listTagValues(s Storage, q *discoveryQuery) ([]string, error) {
+	if q.key == "" {
+		return nil, errKeyRequired
+	}
+	series, err := s.SelectSeries(q.metric, andTagFilters(q.filter, &tagFilter{op: tagFilterExists, key: q.key}), q.start, q.end)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	result := []string{}
+	for _, tags := range series {
+		if v := tags[q.key]; !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
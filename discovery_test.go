@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscoveryHandlers(t *testing.T) {
+	s := newMemStorage()
+	if err := insertPoints(s, []*insertPointQuery{
+		{Metric: "cpu.user", Tags: map[string]string{"host": "web1", "dc": "eu1"}, Point: &point{Value: 1, Timestamp: 946684800000000000}},
+		{Metric: "cpu.user", Tags: map[string]string{"host": "web2", "dc": "us1"}, Point: &point{Value: 1, Timestamp: 946684860000000000}},
+		{Metric: "cpu.user", Tags: map[string]string{"host": "db1", "role": "primary"}, Point: &point{Value: 1, Timestamp: 946684920000000000}},
+		{Metric: "cpu.system", Tags: map[string]string{"host": "web1"}, Point: &point{Value: 1, Timestamp: 946684800000000000}},
+		{Metric: "mem.used", Tags: map[string]string{"host": "web1"}, Point: &point{Value: 1, Timestamp: 946684800000000000}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(handler func(Storage, *httptest.ResponseRecorder, string), url string, result interface{}) int {
+		w := httptest.NewRecorder()
+		handler(s, w, url)
+		if w.Code == 200 {
+			if err := json.NewDecoder(w.Body).Decode(result); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code
+	}
+	metrics := func(s Storage, w *httptest.ResponseRecorder, url string) {
+		metricsHandler(s, w, httptest.NewRequest("GET", url, nil), nil)
+	}
+	tagKeys := func(s Storage, w *httptest.ResponseRecorder, url string) {
+		tagKeysHandler(s, w, httptest.NewRequest("GET", url, nil), nil)
+	}
+	tagValues := func(s Storage, w *httptest.ResponseRecorder, url string) {
+		tagValuesHandler(s, w, httptest.NewRequest("GET", url, nil), nil)
+	}
+	series := func(s Storage, w *httptest.ResponseRecorder, url string) {
+		seriesHandler(s, w, httptest.NewRequest("GET", url, nil), nil)
+	}
+
+	var names []string
+	require.Equal(t, 200, get(metrics, "/metrics", &names))
+	require.Equal(t, []string{"cpu.system", "cpu.user", "mem.used"}, names)
+	require.Equal(t, 200, get(metrics, "/metrics?prefix=cpu.", &names))
+	require.Equal(t, []string{"cpu.system", "cpu.user"}, names)
+	require.Equal(t, 200, get(metrics, "/metrics?regex=user%7Cused", &names))
+	require.Equal(t, []string{"cpu.user", "mem.used"}, names)
+	require.Equal(t, 400, get(metrics, "/metrics?regex=(", &names))
+
+	require.Equal(t, 200, get(tagKeys, "/tag_keys?metric=cpu.user", &names))
+	require.Equal(t, []string{"dc", "host", "role"}, names)
+	require.Equal(t, 200, get(tagKeys, "/tag_keys?metric=cpu.user&filter=dc+exists", &names))
+	require.Equal(t, []string{"dc", "host"}, names)
+	require.Equal(t, 400, get(tagKeys, "/tag_keys", &names))
+
+	require.Equal(t, 200, get(tagValues, "/tag_values?metric=cpu.user&key=host", &names))
+	require.Equal(t, []string{"db1", "web1", "web2"}, names)
+	require.Equal(t, 200, get(tagValues, "/tag_values?metric=cpu.user&key=dc", &names))
+	require.Equal(t, []string{"eu1", "us1"}, names)
+	require.Equal(t, 200, get(tagValues, "/tag_values?metric=cpu.user&key=host&filter=host+%3D~+%27%5Eweb%27&start=946684860000000000", &names))
+	require.Equal(t, []string{"web2"}, names)
+	require.Equal(t, 200, get(tagValues, "/tag_values?metric=cpu.user&key=host&end=946684800000000000", &names))
+	require.Equal(t, []string{"web1"}, names)
+	require.Equal(t, 400, get(tagValues, "/tag_values?metric=cpu.user", &names))
+	require.Equal(t, 400, get(tagValues, "/tag_values?metric=cpu.user&key=host&start=x", &names))
+
+	var tags []map[string]string
+	require.Equal(t, 200, get(series, "/series?metric=cpu.user&filter=host+!%3D+web2", &tags))
+	require.Equal(t, []map[string]string{
+		{"host": "web1", "dc": "eu1"},
+		{"host": "db1", "role": "primary"},
+	}, tags)
+	require.Equal(t, 400, get(series, "/series?metric=cpu.user&filter=host+%3D", &tags))
+
+	// series without points left aren't discovered
+	if err := s.DeletePoints(&deletePointsQuery{Metric: "cpu.user", Tags: map[string]string{"host": "web2"}, Start: 0, End: 946684860000000000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeletePoints(&deletePointsQuery{Metric: "mem.used", Start: 0, End: 946684800000000000}); err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, 200, get(metrics, "/metrics", &names))
+	require.Equal(t, []string{"cpu.system", "cpu.user"}, names)
+	require.Equal(t, 200, get(tagValues, "/tag_values?metric=cpu.user&key=host", &names))
+	require.Equal(t, []string{"db1", "web1"}, names)
+	require.Equal(t, 200, get(tagKeys, "/tag_keys?metric=mem.used", &names))
+	require.Equal(t, []string{}, names)
+}
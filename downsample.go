@@ -1,11 +1,7 @@
 package main
 
 import (
-	"context"
-	"database/sql"
-	"encoding/json"
 	"errors"
-	"fmt"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -16,87 +12,20 @@ var (
 	errLastDownsampledWindowType = errors.New("incorrect type for lastDownsampledWindow")
 )
 
-func downsampleCountCoordinator(db *dbConn, downsamplersCount int, nextDownsamplerID chan int) {
+func downsampleCountCoordinator(downsamplersCount int, nextDownsamplerID chan int) {
 	for {
 		nextDownsamplerID <- downsamplersCount
 		downsamplersCount++
 		if downsamplersCount >= downsamplerWorkerCount {
 			downsamplersCount = 0
 		}
-		/*
-			err := db.Query(priorityDownsamplers+2, func(db *sql.DB) error {
-				query := fmt.Sprintf("UPDATE %s SET worker_id_count = $1", metaTable)
-
-				_, err := db.Exec(query, downsamplersCount)
-				if err != nil {
-					return err
-				}
-				return nil
-			})
-			if err != nil {
-				log.Errorf("downsampleCoordinator: %s", err)
-			}*/
 	}
 }
 
-//select id, out_metric, last_updated, run_every,  (last_updated + run_every)::bigint - (extract(epoch from now())*1000000000)::bigint as time_until_update from simpletsdb_downsamplers;
-
-func handleDownsamplers(db *dbConn, workerID int, cancelDownsampleWait chan struct{}) {
+func handleDownsamplers(s Storage, workerID int, cancelDownsampleWait chan struct{}) {
 	for {
 	start:
-		var (
-			timeUpdateAt int64
-			ds           = &downsampler{}
-		)
-		err := db.Query(priorityDownsamplers, func(db *sql.DB) error {
-			var (
-				queryJSON             string
-				runEvery              int64
-				lastDownsampledWindow interface{}
-			)
-			vals := []interface{}{
-				workerID,
-			}
-			//t0 := time.Now()
-			row := db.QueryRow("SELECT id,metric,out_metric,run_every,last_downsampled_window,query,time_update_at FROM simpletsdb_downsamplers WHERE worker_id = $1 ORDER BY time_update_at ASC LIMIT 1", vals...)
-			//fmt.Println("query took", time.Since(t0))
-			err := row.Scan(
-				&ds.ID,
-				&ds.Metric,
-				&ds.OutMetric,
-				&runEvery,
-				&lastDownsampledWindow,
-				&queryJSON,
-				&timeUpdateAt,
-			)
-			if err != nil {
-				return err
-			}
-			if lastDownsampledWindow != nil {
-				switch v := lastDownsampledWindow.(type) {
-				case int:
-					ds.LastDownsampledWindow = int64(v)
-				case int32:
-					ds.LastDownsampledWindow = int64(v)
-				case int64:
-					ds.LastDownsampledWindow = v
-				default:
-					return errLastDownsampledWindowType
-				}
-			}
-			ds.RunEvery = time.Duration(runEvery).String()
-			ds.RunEveryDur = time.Duration(runEvery)
-
-			ds.Query = &downsampleQuery{}
-			err = json.Unmarshal([]byte(queryJSON), &ds.Query)
-			if err != nil {
-				return err
-			}
-			if err := row.Err(); err != nil {
-				return err
-			}
-			return nil
-		})
+		ds, timeUpdateAt, err := s.NextDownsampler(workerID)
 		if err != nil {
 			if err.Error() == errStrNoRowsInResultSet {
 				<-cancelDownsampleWait
@@ -106,7 +35,6 @@ func handleDownsamplers(db *dbConn, workerID int, cancelDownsampleWait chan stru
 		}
 		timeUntilUpdate := timeUpdateAt - time.Now().UnixNano()
 		if timeUntilUpdate > 0 {
-			//fmt.Println("waiting", time.Duration(timeUntilUpdate).String())
 			select {
 			case <-cancelDownsampleWait:
 				if len(cancelDownsampleWait) > 0 {
@@ -128,25 +56,12 @@ func handleDownsamplers(db *dbConn, workerID int, cancelDownsampleWait chan stru
 			}
 		}
 		t0 := time.Now()
-		err = downsample(db, ds)
+		err = downsample(s, ds)
 		if err != nil {
-			/*log.Errorf("downsample error: %s", err)
-			time.Sleep(30 * time.Second)
-			goto retry
-			*/
 			panic(err)
 		}
 
-		err = db.Query(priorityDownsamplers, func(db *sql.DB) error {
-			query := fmt.Sprintf("UPDATE %s SET time_update_at = $1 WHERE id = $2", downsamplersTable)
-			vals := []interface{}{
-				time.Now().UnixNano() + ds.RunEveryDur.Nanoseconds(),
-				ds.ID,
-			}
-			_, err := db.Exec(query, vals...)
-			return err
-		})
-		if err != nil {
+		if err := s.UpdateDownsamplerTimeUpdateAt(ds.ID, time.Now().UnixNano()+ds.RunEveryDur.Nanoseconds()); err != nil {
 			panic(err)
 		}
 		t1 := time.Since(t0)
@@ -154,104 +69,81 @@ func handleDownsamplers(db *dbConn, workerID int, cancelDownsampleWait chan stru
 	}
 }
 
-func downsample(db *dbConn, ds *downsampler) error {
+func downsample(s Storage, ds *downsampler) error {
 	var (
-		startTime             int64
-		endTime               int64
-		err                   error
-		checkFirstValueUpdate bool
+		startTime int64
+		endTime   int64
 	)
+	filter, err := newQueryTagFilter(ds.Query.Tags, ds.Query.Filter)
+	if err != nil {
+		return err
+	}
 	if ds.LastDownsampledWindow == 0 {
-		startTime, err = selectFirstTimestamp(db, ds.Metric, ds.Query.Tags)
+		startTime, err = s.FirstTimestamp(ds.Metric, filter)
 		if err != nil && err.Error() == errStrNoRowsInResultSet {
 			return nil
 		} else if err != nil {
 			return err
 		}
 
-		endTime, err = selectLastTimestamp(db, ds.Metric, ds.Query.Tags)
+		endTime, err = s.LastTimestamp(ds.Metric, filter)
 		if err != nil && err.Error() == errStrNoRowsInResultSet {
 			return nil
 		} else if err != nil {
 			return err
 		}
 	} else {
-		checkFirstValueUpdate = true
 		startTime = ds.LastDownsampledWindow
-		endTime, err = selectLastTimestamp(db, ds.Metric, ds.Query.Tags)
+		endTime, err = s.LastTimestamp(ds.Metric, filter)
 		if err != nil && err.Error() == errStrNoRowsInResultSet {
 			return nil
 		} else if err != nil {
 			return err
 		}
 	}
-	pts, err := queryPoints(db, priorityDownsamplers, &pointsQuery{
+	query := &pointsQuery{
 		Metric:      ds.Metric,
 		Start:       startTime,
 		End:         endTime,
 		Tags:        ds.Query.Tags,
+		Filter:      ds.Query.Filter,
+		GroupBy:     ds.Query.GroupBy,
 		Window:      ds.Query.Window,
 		Aggregators: ds.Query.Aggregators,
-	})
+	}
+	var series []*seriesPoints
+	if len(ds.Query.GroupBy) > 0 {
+		series, err = queryGroupedPoints(s, priorityDownsamplers, query)
+	} else {
+		var pts []*point
+		pts, err = queryPoints(s, priorityDownsamplers, query)
+		series = []*seriesPoints{{Tags: ds.Query.Tags, Points: pts}}
+	}
 	if err != nil {
 		return err
 	}
 
-	if len(pts) > 0 {
-		err = db.Query(priorityDownsamplers, func(db0 *sql.DB) error {
-			ctx := context.Background()
-			tx, err := db0.BeginTx(ctx, nil)
-
-			defer func() {
-				if err := tx.Commit(); err != nil {
-					log.Errorf("downsample commit error: %s", err)
-				}
-			}()
-
-			if err != nil {
-				return err
-			}
-			if checkFirstValueUpdate && pts[0].Timestamp == ds.LastDownsampledWindow {
-				err := updateFirstPointDownsampleTx(tx, ds.OutMetric, ds.Query.Tags, pts[0])
-				if err != nil {
-					if err0 := tx.Rollback(); err0 != nil {
-						log.Errorf("updateFirstPointDownsampleTx rollback error: %s", err0)
-					}
-					return err
-				}
-				pts = pts[1:]
-			}
-			if len(pts) > 0 {
-				ipts := []*insertPointQuery{}
-				for i := 0; i < len(pts); i++ {
-					pt := pts[i]
-
-					ipts = append(ipts, &insertPointQuery{
-						Metric: ds.OutMetric,
-						Tags:   ds.Query.Tags,
-						Point:  pt,
-					})
-				}
-				if err := insertPointsTx(db, tx, ipts); err != nil {
-					if err0 := tx.Rollback(); err0 != nil {
-						log.Errorf("insertPointsTx rollback error: %s", err0)
-					}
-					return err
-				}
-
-				lastTimestamp := pts[len(pts)-1].Timestamp
-				if err := updateLastDownsampledWindowTx(tx, ds.ID, lastTimestamp); err != nil {
-					if err0 := tx.Rollback(); err0 != nil {
-						log.Errorf("insertPointsTx rollback error: %s", err0)
-					}
-					return err
-				}
-			}
-			return nil
-		})
-
-		return err
+	if _, ok := lastDownsampledWindow(series); ok {
+		return s.CommitDownsample(ds, series)
 	}
 
 	return nil
 }
+
+// lastDownsampledWindow returns the last timestamp of series and false if
+// they have no points
+func lastDownsampledWindow(series []*seriesPoints) (int64, bool) {
+	var (
+		last int64
+		ok   bool
+	)
+	for _, sp := range series {
+		if len(sp.Points) == 0 {
+			continue
+		}
+		if ts := sp.Points[len(sp.Points)-1].Timestamp; !ok || ts > last {
+			last, ok = ts, true
+		}
+	}
+	return last, ok
+}
@@ -3,9 +3,12 @@ module simpletsdb
 go 1.15
 
 require (
+	github.com/golang/snappy v0.0.4
 	github.com/julienschmidt/httprouter v1.3.0
+	github.com/klauspost/compress v1.13.6
 	github.com/lib/pq v1.10.2
 	github.com/sirupsen/logrus v1.8.1
 	github.com/stretchr/testify v1.7.0
+	google.golang.org/protobuf v1.27.1
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
 )
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// Gorilla style chunk encoding as described in "Gorilla: A Fast, Scalable,
+// In-Memory Time Series Database". Timestamps are stored as delta-of-deltas
+// and values as the XOR with the previous value. The delta-of-delta buckets
+// are wider than in the paper since timestamps are in nanoseconds. Every
+// value is preceded by a null bit.
+
+var (
+	errChunkTruncated = errors.New("chunk data is truncated")
+)
+
+type bitWriter struct {
+	buf   []byte
+	nbits uint8 // free bits in the last byte
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.nbits == 0 {
+		w.buf = append(w.buf, 0)
+		w.nbits = 8
+	}
+	w.nbits--
+	if bit {
+		w.buf[len(w.buf)-1] |= 1 << w.nbits
+	}
+}
+
+// writeBits writes the n low bits of v, most significant first
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBit(v>>uint(i)&1 == 1)
+	}
+}
+
+type bitReader struct {
+	buf []byte
+	pos int // in bits
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= len(r.buf)*8 {
+		return false, errChunkTruncated
+	}
+	bit := r.buf[r.pos/8]>>(7-uint(r.pos%8))&1 == 1
+	r.pos++
+	return bit, nil
+}
+
+func (r *bitReader) readBits(n int) (uint64, error) {
+	var v uint64
+	for i := 0; i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v <<= 1
+		if bit {
+			v |= 1
+		}
+	}
+	return v, nil
+}
+
+// delta-of-delta buckets: a prefix of n ones terminated by a zero (except for
+// the last bucket) followed by a signed value of the given width
+var dodBucketBits = []int{0, 16, 32, 48, 64}
+
+func fitsSigned(v int64, n int) bool {
+	if n == 0 {
+		return v == 0
+	}
+	if n >= 64 {
+		return true
+	}
+	return v >= -(1<<uint(n-1)) && v < 1<<uint(n-1)
+}
+
+func signExtend(v uint64, n int) int64 {
+	if n >= 64 {
+		return int64(v)
+	}
+	shift := uint(64 - n)
+	return int64(v<<shift) >> shift
+}
+
+type chunkEncoder struct {
+	w            bitWriter
+	n            int
+	prevTime     int64
+	prevDelta    int64
+	prevBits     uint64
+	prevLeading  int
+	prevTrailing int
+}
+
+func (e *chunkEncoder) writeTimestamp(ts int64) {
+	if e.n == 0 {
+		e.w.writeBits(uint64(ts), 64)
+		e.prevTime = ts
+		return
+	}
+	delta := ts - e.prevTime
+	dod := delta - e.prevDelta
+	for i, n := range dodBucketBits {
+		if !fitsSigned(dod, n) {
+			continue
+		}
+		for j := 0; j < i; j++ {
+			e.w.writeBit(true)
+		}
+		if i < len(dodBucketBits)-1 {
+			e.w.writeBit(false)
+		}
+		e.w.writeBits(uint64(dod), n)
+		break
+	}
+	e.prevTime = ts
+	e.prevDelta = delta
+}
+
+func (e *chunkEncoder) writeValue(pt *point) {
+	e.w.writeBit(pt.Null)
+	if pt.Null {
+		return
+	}
+	v := math.Float64bits(pt.Value)
+	if e.n == 0 {
+		e.w.writeBits(v, 64)
+		e.prevBits = v
+		return
+	}
+	xor := v ^ e.prevBits
+	e.prevBits = v
+	if xor == 0 {
+		e.w.writeBit(false)
+		return
+	}
+	e.w.writeBit(true)
+	leading, trailing := bits.LeadingZeros64(xor), bits.TrailingZeros64(xor)
+	if leading > 31 {
+		leading = 31
+	}
+	if e.prevLeading >= 0 && leading >= e.prevLeading && trailing >= e.prevTrailing {
+		// the meaningful bits fit in the previous window
+		e.w.writeBit(false)
+		e.w.writeBits(xor>>uint(e.prevTrailing), 64-e.prevLeading-e.prevTrailing)
+		return
+	}
+	significant := 64 - leading - trailing
+	e.w.writeBit(true)
+	e.w.writeBits(uint64(leading), 5)
+	// 64 significant bits don't fit in 6 bits and are written as 0
+	e.w.writeBits(uint64(significant&63), 6)
+	e.w.writeBits(xor>>uint(trailing), significant)
+	e.prevLeading, e.prevTrailing = leading, trailing
+}
+
+func (e *chunkEncoder) append(pt *point) {
+	e.writeTimestamp(pt.Timestamp)
+	e.writeValue(pt)
+	e.n++
+}
+
+// encodeChunk encodes points sorted by timestamp
+func encodeChunk(pts []*point) []byte {
+	e := &chunkEncoder{prevLeading: -1}
+	for _, pt := range pts {
+		e.append(pt)
+	}
+	return e.w.buf
+}
+
+// decodeChunk decodes the first count points of a chunk
+func decodeChunk(data []byte, count int) ([]*point, error) {
+	r := &bitReader{buf: data}
+	pts := make([]*point, 0, count)
+	var (
+		prevTime     int64
+		prevDelta    int64
+		prevBits     uint64
+		prevLeading  int
+		prevTrailing int
+	)
+	for i := 0; i < count; i++ {
+		pt := &point{}
+
+		// timestamp
+		if i == 0 {
+			v, err := r.readBits(64)
+			if err != nil {
+				return nil, err
+			}
+			pt.Timestamp = int64(v)
+		} else {
+			bucket := 0
+			for bucket < len(dodBucketBits)-1 {
+				bit, err := r.readBit()
+				if err != nil {
+					return nil, err
+				}
+				if !bit {
+					break
+				}
+				bucket++
+			}
+			n := dodBucketBits[bucket]
+			v, err := r.readBits(n)
+			if err != nil {
+				return nil, err
+			}
+			delta := prevDelta + signExtend(v, n)
+			pt.Timestamp = prevTime + delta
+			prevDelta = delta
+		}
+		prevTime = pt.Timestamp
+
+		// value
+		null, err := r.readBit()
+		if err != nil {
+			return nil, err
+		}
+		if null {
+			pt.Null = true
+			pts = append(pts, pt)
+			continue
+		}
+		if i == 0 {
+			v, err := r.readBits(64)
+			if err != nil {
+				return nil, err
+			}
+			prevBits = v
+		} else {
+			changed, err := r.readBit()
+			if err != nil {
+				return nil, err
+			}
+			if changed {
+				newWindow, err := r.readBit()
+				if err != nil {
+					return nil, err
+				}
+				if newWindow {
+					leading, err := r.readBits(5)
+					if err != nil {
+						return nil, err
+					}
+					significant, err := r.readBits(6)
+					if err != nil {
+						return nil, err
+					}
+					if significant == 0 {
+						significant = 64
+					}
+					prevLeading = int(leading)
+					prevTrailing = 64 - int(leading) - int(significant)
+				}
+				v, err := r.readBits(64 - prevLeading - prevTrailing)
+				if err != nil {
+					return nil, err
+				}
+				prevBits ^= v << uint(prevTrailing)
+			}
+		}
+		pt.Value = math.Float64frombits(prevBits)
+		pts = append(pts, pt)
+	}
+	return pts, nil
+}
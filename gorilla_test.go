@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChunkEncoding(t *testing.T) {
+	baseTime := mustParseTime("2000-01-01T00:00:00Z").UnixNano()
+	rng := rand.New(rand.NewSource(1))
+	pts := []*point{}
+	ts := baseTime
+	value := 100.0
+	for i := 0; i < 1000; i++ {
+		// mostly regular intervals with some jitter and gaps
+		ts += int64(time.Minute)
+		if i%7 == 0 {
+			ts += rng.Int63n(int64(time.Second))
+		}
+		if i%100 == 0 {
+			ts += int64(time.Hour * 24 * 365)
+		}
+		switch {
+		case i%13 == 0:
+			value += rng.Float64()
+		case i%17 == 0:
+			value = -value
+		}
+		pt := &point{Timestamp: ts, Value: value}
+		if i%31 == 0 {
+			pt = &point{Timestamp: ts, Null: true}
+		}
+		pts = append(pts, pt)
+	}
+	pts = append(pts,
+		&point{Timestamp: ts + 1, Value: math.Inf(1)},
+		&point{Timestamp: ts + 2, Value: 0},
+		&point{Timestamp: ts + 3, Value: math.MaxFloat64},
+		&point{Timestamp: ts + 4, Value: math.SmallestNonzeroFloat64},
+	)
+
+	data := encodeChunk(pts)
+	decoded, err := decodeChunk(data, len(pts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, pts, decoded)
+	require.Less(t, len(data), len(pts)*16/2)
+
+	// a leading null and NaN round trip too
+	pts = []*point{{Timestamp: -5, Null: true}, {Timestamp: 10, Value: math.NaN()}, {Timestamp: 11, Value: 1}}
+	decoded, err = decodeChunk(encodeChunk(pts), len(pts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.True(t, decoded[0].Null)
+	require.True(t, math.IsNaN(decoded[1].Value))
+	require.Equal(t, pts[2], decoded[2])
+
+	if _, err := decodeChunk(data[:len(data)/2], 1004); err != errChunkTruncated {
+		t.Fatalf("expected %s, got %v", errChunkTruncated, err)
+	}
+}
+
+func TestChunkEncodingRegularTimestamps(t *testing.T) {
+	baseTime := mustParseTime("2000-01-01T00:00:00Z").UnixNano()
+	e := &chunkEncoder{prevLeading: -1}
+	bitsWritten := func() int {
+		return len(e.w.buf)*8 - int(e.w.nbits)
+	}
+	for i := 0; i < 2; i++ {
+		e.append(&point{Timestamp: baseTime + int64(i)*int64(time.Minute), Null: true})
+	}
+	start := bitsWritten()
+	for i := 2; i < 1000; i++ {
+		e.append(&point{Timestamp: baseTime + int64(i)*int64(time.Minute), Null: true})
+	}
+	// one bit for the zero delta-of-delta and one null bit per point
+	require.Equal(t, 998*2, bitsWritten()-start)
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	graphiteTemplates                   []*graphiteTemplate
+	graphiteFlushInterval               = time.Second
+	graphitePickleMaxLength             = 1 << 20
+	errGraphiteInvalidLine              = errors.New("graphite line must be <path> <value> [timestamp]")
+	errGraphiteInvalidTemplate          = errors.New("invalid graphite template")
+	errGraphiteEmptyMetric              = errors.New("graphite path maps to an empty metric")
+	errGraphitePickleTooLong            = errors.New("graphite pickle payload is too long")
+	errGraphiteInvalidPickleRow         = errors.New("graphite pickle rows must be (path, (timestamp, value))")
+	errGraphiteTimestampRange           = errors.New("graphite timestamp out of range")
+	errGraphiteFlushIntervalNotPositive = errors.New("graphite flush interval must be positive")
+)
+
+// graphiteTemplate maps the dot separated segments of a Graphite path to a
+// metric and tags. Every part of the template names what its segment is:
+// measurement segments are joined with dots into the metric, measurement*
+// takes all remaining segments, empty parts skip their segment and any other
+// part is a tag name. Templates with a filter only apply to paths whose
+// leading segments match it, * matches any segment.
+type graphiteTemplate struct {
+	filter []string
+	parts  []string
+	tags   map[string]string
+}
+
+// parseGraphiteTemplate parses `[filter] template [tag=value,...]`
+func parseGraphiteTemplate(s string) (*graphiteTemplate, error) {
+	fields := strings.Fields(s)
+	t := &graphiteTemplate{tags: map[string]string{}}
+	var template, tags string
+	switch {
+	case len(fields) == 1:
+		template = fields[0]
+	case len(fields) == 2 && strings.Contains(fields[1], "="):
+		template, tags = fields[0], fields[1]
+	case len(fields) == 2:
+		t.filter, template = strings.Split(fields[0], "."), fields[1]
+	case len(fields) == 3:
+		t.filter, template, tags = strings.Split(fields[0], "."), fields[1], fields[2]
+	default:
+		return nil, fmt.Errorf("%s: %q", errGraphiteInvalidTemplate, s)
+	}
+
+	hasMeasurement := false
+	t.parts = strings.Split(template, ".")
+	for _, part := range t.parts {
+		switch {
+		case part == "measurement" || part == "measurement*":
+			hasMeasurement = true
+		case part != "" && !metricAndTagsRe.MatchString(part):
+			return nil, fmt.Errorf("%s: %q", errGraphiteInvalidTemplate, s)
+		}
+	}
+	if !hasMeasurement {
+		return nil, fmt.Errorf("%s: %q has no measurement", errGraphiteInvalidTemplate, s)
+	}
+
+	if tags != "" {
+		for _, kv := range strings.Split(tags, ",") {
+			i := strings.IndexByte(kv, '=')
+			if i < 0 {
+				return nil, fmt.Errorf("%s: %q", errGraphiteInvalidTemplate, s)
+			}
+			t.tags[kv[:i]] = kv[i+1:]
+		}
+		if err := validateTags(t.tags); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// parseGraphiteTemplates parses templates separated by semicolons
+func parseGraphiteTemplates(s string) ([]*graphiteTemplate, error) {
+	templates := []*graphiteTemplate{}
+	for _, ts := range strings.Split(s, ";") {
+		if strings.TrimSpace(ts) == "" {
+			continue
+		}
+		t, err := parseGraphiteTemplate(ts)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+func (t *graphiteTemplate) matches(segments []string) bool {
+	if len(segments) < len(t.filter) {
+		return false
+	}
+	for i, f := range t.filter {
+		if f != "*" && f != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *graphiteTemplate) apply(segments []string) (string, map[string]string) {
+	var measurement []string
+	tags := make(map[string]string, len(t.tags)+len(t.parts))
+	for k, v := range t.tags {
+		tags[k] = v
+	}
+	fromTemplate := map[string]bool{}
+	for i, part := range t.parts {
+		if i >= len(segments) {
+			break
+		}
+		if part == "measurement*" {
+			measurement = append(measurement, segments[i:]...)
+			break
+		}
+		switch part {
+		case "":
+		case "measurement":
+			measurement = append(measurement, segments[i])
+		default:
+			// a tag named by several parts joins their segments
+			if fromTemplate[part] {
+				tags[part] += "." + segments[i]
+			} else {
+				tags[part] = segments[i]
+			}
+			fromTemplate[part] = true
+		}
+	}
+	return strings.Join(measurement, "."), tags
+}
+
+// graphitePathToMetric maps a path with the first template whose filter
+// matches. Paths without a matching template are stored as is.
+func graphitePathToMetric(path string) (string, map[string]string) {
+	segments := strings.Split(path, ".")
+	for _, t := range graphiteTemplates {
+		if t.matches(segments) {
+			return t.apply(segments)
+		}
+	}
+	return path, map[string]string{}
+}
+
+// graphiteQuery builds the insert query of one value. Graphite 1.1 tags
+// (path;tag=value) are added to the template tags. Names are sanitized and
+// empty tag values are dropped.
+func graphiteQuery(path string, value float64, timestamp int64) (*insertPointQuery, error) {
+	pathTags := strings.Split(path, ";")
+	metric, tags := graphitePathToMetric(pathTags[0])
+	for _, kv := range pathTags[1:] {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			tags[kv[:i]] = kv[i+1:]
+		}
+	}
+	metric = sanitizeName(metric)
+	if metric == "" {
+		return nil, fmt.Errorf("%s: %s", errGraphiteEmptyMetric, path)
+	}
+	sanitized := make(map[string]string, len(tags))
+	for k, v := range tags {
+		if k != "" && v != "" {
+			sanitized[sanitizeName(k)] = sanitizeName(v)
+		}
+	}
+	pt := &point{Value: value, Timestamp: timestamp}
+	if math.IsNaN(value) {
+		pt.Value, pt.Null = 0, true
+	}
+	return &insertPointQuery{Metric: metric, Tags: sanitized, Point: pt}, nil
+}
+
+// parseGraphiteTimestamp converts a timestamp in seconds to nanoseconds.
+// Missing timestamps and -1 mean now.
+func parseGraphiteTimestamp(s string, now int64) (int64, error) {
+	if s == "" || s == "-1" {
+		return now, nil
+	}
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return graphiteSecondsToNanos(ts)
+	}
+	ts, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return graphiteFloatSecondsToNanos(ts)
+}
+
+const graphiteMaxSeconds = math.MaxInt64 / int64(time.Second)
+
+// graphiteSecondsToNanos converts a timestamp in seconds to nanoseconds and
+// rejects timestamps that would overflow
+func graphiteSecondsToNanos(seconds int64) (int64, error) {
+	if seconds > graphiteMaxSeconds || seconds < -graphiteMaxSeconds {
+		return 0, fmt.Errorf("%s: %d", errGraphiteTimestampRange, seconds)
+	}
+	return seconds * int64(time.Second), nil
+}
+
+func graphiteFloatSecondsToNanos(seconds float64) (int64, error) {
+	// NaN fails both comparisons
+	if !(seconds <= float64(graphiteMaxSeconds) && seconds >= -float64(graphiteMaxSeconds)) {
+		return 0, fmt.Errorf("%s: %v", errGraphiteTimestampRange, seconds)
+	}
+	return int64(seconds * float64(time.Second)), nil
+}
+
+// parseGraphiteLine parses a plaintext protocol line `path value [timestamp]`
+func parseGraphiteLine(line string, now int64) (*insertPointQuery, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, errGraphiteInvalidLine
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, err
+	}
+	var timestamp int64
+	if len(fields) == 3 {
+		timestamp, err = parseGraphiteTimestamp(fields[2], now)
+	} else {
+		timestamp = now
+	}
+	if err != nil {
+		return nil, err
+	}
+	return graphiteQuery(fields[0], value, timestamp)
+}
+
+func pickleNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// graphitePickleToQueries converts an unpickled list of
+// (path, (timestamp, value)) rows
+func graphitePickleToQueries(v interface{}) ([]*insertPointQuery, error) {
+	list, ok := v.(*pickleList)
+	if !ok {
+		return nil, errGraphiteInvalidPickleRow
+	}
+	queries := []*insertPointQuery{}
+	for _, item := range list.items {
+		row, ok := item.([]interface{})
+		if !ok || len(row) != 2 {
+			return nil, errGraphiteInvalidPickleRow
+		}
+		path, ok := row[0].(string)
+		if !ok {
+			return nil, errGraphiteInvalidPickleRow
+		}
+		datapoint, ok := row[1].([]interface{})
+		if !ok || len(datapoint) != 2 {
+			return nil, errGraphiteInvalidPickleRow
+		}
+		ts, ok := pickleNumber(datapoint[0])
+		if !ok {
+			return nil, errGraphiteInvalidPickleRow
+		}
+		var (
+			timestamp int64
+			err       error
+		)
+		if seconds, ok := datapoint[0].(int64); ok {
+			timestamp, err = graphiteSecondsToNanos(seconds)
+		} else {
+			timestamp, err = graphiteFloatSecondsToNanos(ts)
+		}
+		if err != nil {
+			return nil, err
+		}
+		value, ok := pickleNumber(datapoint[1])
+		if !ok {
+			return nil, errGraphiteInvalidPickleRow
+		}
+		query, err := graphiteQuery(path, value, timestamp)
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, query)
+	}
+	return queries, nil
+}
+
+// pointBatcher collects insert queries from listeners without a request to
+// answer and writes them with insertPoints once insertBatchSize queries are
+// pending or interval passed
+type pointBatcher struct {
+	s        Storage
+	interval time.Duration
+	queries  chan *insertPointQuery
+	done     chan struct{}
+}
+
+func newPointBatcher(s Storage, interval time.Duration) *pointBatcher {
+	b := &pointBatcher{
+		s:        s,
+		interval: interval,
+		queries:  make(chan *insertPointQuery, insertBatchSize),
+		done:     make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *pointBatcher) add(query *insertPointQuery) {
+	b.queries <- query
+}
+
+// close writes the pending queries and stops the batcher
+func (b *pointBatcher) close() {
+	close(b.queries)
+	<-b.done
+}
+
+func (b *pointBatcher) flush(queries []*insertPointQuery) {
+	if len(queries) == 0 {
+		return
+	}
+	if err := insertPoints(b.s, queries); err != nil {
+		log.Errorf("pointBatcher: %s", err)
+	}
+}
+
+func (b *pointBatcher) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	queries := make([]*insertPointQuery, 0, insertBatchSize)
+	for {
+		select {
+		case query, ok := <-b.queries:
+			if !ok {
+				b.flush(queries)
+				return
+			}
+			queries = append(queries, query)
+			if len(queries) >= insertBatchSize {
+				b.flush(queries)
+				queries = make([]*insertPointQuery, 0, insertBatchSize)
+			}
+		case <-ticker.C:
+			b.flush(queries)
+			queries = make([]*insertPointQuery, 0, insertBatchSize)
+		}
+	}
+}
+
+// acceptConns calls handle with every connection of l until l is closed
+func acceptConns(l net.Listener, handle func(conn net.Conn)) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Errorf("acceptConns: %s", err)
+				continue
+			}
+			return
+		}
+		go handle(conn)
+	}
+}
+
+// readGraphiteLines adds the points of every line of r to b. Invalid lines
+// are logged and skipped like carbon does.
+func readGraphiteLines(r io.Reader, b *pointBatcher) error {
+	scanner := bufio.NewScanner(r)
+	buf := make([]byte, readLineProtocolBufferSize)
+	scanner.Buffer(buf, readLineProtocolBufferSize)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		query, err := parseGraphiteLine(line, time.Now().UnixNano())
+		if err != nil {
+			log.Errorf("readGraphiteLines: unable to parse line '%s': %s", line, err)
+			continue
+		}
+		b.add(query)
+	}
+	return scanner.Err()
+}
+
+func serveGraphiteTCP(l net.Listener, b *pointBatcher) {
+	acceptConns(l, func(conn net.Conn) {
+		defer conn.Close()
+		if err := readGraphiteLines(conn, b); err != nil {
+			log.Errorf("serveGraphiteTCP: %s", err)
+		}
+	})
+}
+
+func serveGraphiteUDP(conn net.PacketConn, b *pointBatcher) {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Errorf("serveGraphiteUDP: %s", err)
+				continue
+			}
+			return
+		}
+		if err := readGraphiteLines(bytes.NewReader(buf[:n]), b); err != nil {
+			log.Errorf("serveGraphiteUDP: %s", err)
+		}
+	}
+}
+
+// readGraphitePickle reads length prefixed pickle payloads until r is closed
+func readGraphitePickle(r io.Reader, b *pointBatcher) error {
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		n := binary.BigEndian.Uint32(header[:])
+		if int64(n) > int64(graphitePickleMaxLength) {
+			return errGraphitePickleTooLong
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+		v, err := unpickle(payload)
+		if err != nil {
+			return err
+		}
+		queries, err := graphitePickleToQueries(v)
+		if err != nil {
+			return err
+		}
+		for _, query := range queries {
+			b.add(query)
+		}
+	}
+}
+
+func serveGraphitePickle(l net.Listener, b *pointBatcher) {
+	acceptConns(l, func(conn net.Conn) {
+		defer conn.Close()
+		if err := readGraphitePickle(conn, b); err != nil {
+			log.Errorf("serveGraphitePickle: %s", err)
+		}
+	})
+}
+
+// initGraphite starts the Graphite listeners whose address is set
+func initGraphite(s Storage, tcpAddr, udpAddr, pickleAddr string) error {
+	if tcpAddr == "" && udpAddr == "" && pickleAddr == "" {
+		return nil
+	}
+	b := newPointBatcher(s, graphiteFlushInterval)
+	if tcpAddr != "" {
+		l, err := net.Listen("tcp", tcpAddr)
+		if err != nil {
+			return err
+		}
+		log.Infof("Graphite plaintext listening on tcp %s", l.Addr())
+		go serveGraphiteTCP(l, b)
+	}
+	if udpAddr != "" {
+		conn, err := net.ListenPacket("udp", udpAddr)
+		if err != nil {
+			return err
+		}
+		log.Infof("Graphite plaintext listening on udp %s", conn.LocalAddr())
+		go serveGraphiteUDP(conn, b)
+	}
+	if pickleAddr != "" {
+		l, err := net.Listen("tcp", pickleAddr)
+		if err != nil {
+			return err
+		}
+		log.Infof("Graphite pickle listening on tcp %s", l.Addr())
+		go serveGraphitePickle(l, b)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraphiteTemplates(t *testing.T) {
+	templates, err := parseGraphiteTemplates("servers.* .host.measurement* dc=eu; stats.* ..measurement.measurement.type; host.measurement")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graphiteTemplates = templates
+	defer func() { graphiteTemplates = nil }()
+
+	for path, expected := range map[string]*insertPointQuery{
+		"servers.web01.cpu.load":       {Metric: "cpu.load", Tags: map[string]string{"host": "web01", "dc": "eu"}},
+		"stats.gauges.api.latency.p99": {Metric: "api.latency", Tags: map[string]string{"type": "p99"}},
+		"web01.uptime":                 {Metric: "uptime", Tags: map[string]string{"host": "web01"}},
+		"web01.uptime;dc=us;role=a:b":  {Metric: "uptime", Tags: map[string]string{"host": "web01", "dc": "us", "role": "a_b"}},
+	} {
+		query, err := graphiteQuery(path, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, expected.Metric, query.Metric, path)
+		require.Equal(t, expected.Tags, query.Tags, path)
+	}
+
+	for _, template := range []string{"host.service", "a b c d", "host.measurement dc"} {
+		if _, err := parseGraphiteTemplate(template); err == nil {
+			t.Fatalf("expected error for template %q", template)
+		}
+	}
+}
+
+func TestParseGraphiteLine(t *testing.T) {
+	query, err := parseGraphiteLine("collectd.web01.load 0.5 946684800", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, &insertPointQuery{
+		Metric: "collectd.web01.load",
+		Tags:   map[string]string{},
+		Point:  &point{Value: 0.5, Timestamp: 946684800000000000},
+	}, query)
+
+	query, err = parseGraphiteLine("a.b nan -1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, &point{Null: true, Timestamp: 1}, query.Point)
+
+	for _, line := range []string{"a.b", "a.b x 1", "a.b 1 x", "a.b 1 2 3", "a.b 1 9223372037", "a.b 1 -9223372037", "a.b 1 1e300", "a.b 1 nan"} {
+		if _, err := parseGraphiteLine(line, 1); err == nil {
+			t.Fatalf("expected error for line %q", line)
+		}
+	}
+}
+
+func TestUnpickle(t *testing.T) {
+	// pickle.dumps([('a.b.c',(946684800,1.5)),('x.y',(946684815,2))], protocol=...)
+	for _, data := range []string{
+		"\x80\x02]q\x00(X\x05\x00\x00\x00a.b.cq\x01J\x80Cm8G?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x03\x00\x00\x00x.yq\x04J\x8fCm8K\x02\x86q\x05\x86q\x06e.",
+		"(lp0\n(Va.b.c\np1\n(I946684800\nF1.5\ntp2\ntp3\na(Vx.y\np4\n(I946684815\nI2\ntp5\ntp6\na.",
+	} {
+		v, err := unpickle([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		queries, err := graphitePickleToQueries(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, []*insertPointQuery{
+			{Metric: "a.b.c", Tags: map[string]string{}, Point: &point{Value: 1.5, Timestamp: 946684800000000000}},
+			{Metric: "x.y", Tags: map[string]string{}, Point: &point{Value: 2, Timestamp: 946684815000000000}},
+		}, queries)
+	}
+
+	for _, ts := range []interface{}{int64(math.MaxInt64), -1e300} {
+		rows := &pickleList{items: []interface{}{[]interface{}{"a.b", []interface{}{ts, int64(1)}}}}
+		if _, err := graphitePickleToQueries(rows); err == nil {
+			t.Fatalf("expected error for timestamp %v", ts)
+		}
+	}
+
+	// pickle.dumps(os.system) imports a global
+	if _, err := unpickle([]byte("cposix\nsystem\np0\n.")); err == nil {
+		t.Fatal("expected error for GLOBAL opcode")
+	}
+	if _, err := unpickle([]byte("(lp0\n")); err != errPickleNoStop {
+		t.Fatalf("expected %s, got %v", errPickleNoStop, err)
+	}
+}
+
+func TestUnpickleMalformed(t *testing.T) {
+	// BINUNICODE8 with a length of 1<<63-1
+	if _, err := unpickle([]byte("\x8d\xff\xff\xff\xff\xff\xff\xff\x7f\x00.")); err != errGraphitePickleTooLong {
+		t.Fatalf("expected %s, got %v", errGraphitePickleTooLong, err)
+	}
+	// BINUNICODE8 with a length of 1<<64-1
+	if _, err := unpickle([]byte("\x8d\xff\xff\xff\xff\xff\xff\xff\xff\x00.")); err != errGraphitePickleTooLong {
+		t.Fatalf("expected %s, got %v", errGraphitePickleTooLong, err)
+	}
+	// BINUNICODE with a length past the end of the data
+	if _, err := unpickle([]byte("X\x10\x00\x00\x00ab.")); err != errPickleTruncated {
+		t.Fatalf("expected %s, got %v", errPickleTruncated, err)
+	}
+
+	// truncating or corrupting any byte of a valid payload mustn't panic
+	data := []byte("\x80\x02]q\x00(X\x05\x00\x00\x00a.b.cq\x01J\x80Cm8G?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03\x8a\x01\x02\x8d\x01\x00\x00\x00\x00\x00\x00\x00x\x86q\x04e.")
+	for i := range data {
+		if v, err := unpickle(data[:i]); err == nil {
+			graphitePickleToQueries(v)
+		}
+		for _, c := range []byte{0x00, 0x7f, 0x80, 0xff} {
+			corrupted := append([]byte{}, data...)
+			corrupted[i] = c
+			if v, err := unpickle(corrupted); err == nil {
+				graphitePickleToQueries(v)
+			}
+		}
+	}
+}
+
+func TestGraphiteListeners(t *testing.T) {
+	s := newMemStorage()
+	b := newPointBatcher(s, time.Hour)
+	if err := readGraphiteLines(strings.NewReader("test_graphite.plain 1 946684800\ninvalid\ntest_graphite.plain 2 946684815\n"), b); err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("(lp0\n(Vtest_graphite.pickle\np1\n(I946684800\nF1.5\ntp2\ntp3\na.")
+	frame := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	if err := readGraphitePickle(bytes.NewReader(append(frame, payload...)), b); err != nil {
+		t.Fatal(err)
+	}
+	b.close()
+
+	pts, err := queryPoints(s, priorityCRUD, &pointsQuery{Metric: "test_graphite.plain", Start: 946684800000000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*point{
+		{Value: 1, Timestamp: 946684800000000000},
+		{Value: 2, Timestamp: 946684815000000000},
+	}, pts)
+	pts, err = queryPoints(s, priorityCRUD, &pointsQuery{Metric: "test_graphite.pickle", Start: 946684800000000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*point{{Value: 1.5, Timestamp: 946684800000000000}}, pts)
+}
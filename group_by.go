@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+var (
+	errUnsupportedGroupBy = errors.New(`groupBy must be "*" or an array of tag keys`)
+)
+
+// groupByTags is the tag keys series are grouped by, or ["*"] to keep every
+// series apart. In JSON ["*"] is written as "*".
+type groupByTags []string
+
+func (g *groupByTags) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	var all string
+	if err := json.Unmarshal(b, &all); err == nil {
+		if all != "*" {
+			return errUnsupportedGroupBy
+		}
+		*g = groupByTags{"*"}
+		return nil
+	}
+	var keys []string
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return errUnsupportedGroupBy
+	}
+	*g = keys
+	return nil
+}
+
+func (g groupByTags) MarshalJSON() ([]byte, error) {
+	if g.all() {
+		return json.Marshal("*")
+	}
+	return json.Marshal([]string(g))
+}
+
+func (g groupByTags) all() bool {
+	return len(g) == 1 && g[0] == "*"
+}
+
+func validateGroupBy(g groupByTags) error {
+	if g.all() {
+		return nil
+	}
+	for _, k := range g {
+		if !metricAndTagsRe.MatchString(k) {
+			return errUnsupportedGroupBy
+		}
+	}
+	return nil
+}
+
+// groupSeries groups series by the values of the group by tags. The tags of
+// a group are tags plus the group by tags of its series; series without a
+// group by tag are grouped without it. The points of each group are sorted
+// by timestamp.
+func groupSeries(series []*seriesPoints, tags map[string]string, groupBy groupByTags) []*seriesPoints {
+	var order []string
+	groups := map[string]*seriesPoints{}
+	for _, sp := range series {
+		groupTags := sp.Tags
+		if !groupBy.all() {
+			groupTags = make(map[string]string, len(tags)+len(groupBy))
+			for k, v := range tags {
+				groupTags[k] = v
+			}
+			for _, k := range groupBy {
+				if v, ok := sp.Tags[k]; ok {
+					groupTags[k] = v
+				}
+			}
+		}
+
+		keys := make([]string, 0, len(groupTags))
+		for k := range groupTags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var group strings.Builder
+		for _, k := range keys {
+			group.WriteString(k + "=" + groupTags[k] + ",")
+		}
+		key := group.String()
+
+		if g, ok := groups[key]; ok {
+			g.Points = append(g.Points, sp.Points...)
+			continue
+		}
+		order = append(order, key)
+		groups[key] = &seriesPoints{Tags: groupTags, Points: sp.Points}
+	}
+	sort.Strings(order)
+
+	result := make([]*seriesPoints, 0, len(order))
+	for _, key := range order {
+		g := groups[key]
+		sort.SliceStable(g.Points, func(i, j int) bool {
+			return g.Points[i].Timestamp < g.Points[j].Timestamp
+		})
+		result = append(result, g)
+	}
+	return result
+}
+
+// queryGroupedPoints is queryPoints for queries with groupBy. The window,
+// limit and aggregators apply to each group.
+func queryGroupedPoints(s Storage, priority int, query *pointsQuery) ([]*seriesPoints, error) {
+	filter, err := validatePointsQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateGroupBy(query.GroupBy); err != nil {
+		return nil, err
+	}
+
+	series, err := s.SelectSeriesPoints(priority, query.Metric, filter, query.Start, query.End)
+	if err != nil {
+		return nil, err
+	}
+	groups := groupSeries(series, query.Tags, query.GroupBy)
+	for _, g := range groups {
+		if query.N > 0 && int64(len(g.Points)) > query.N {
+			g.Points = g.Points[:query.N]
+		}
+		if g.Points, err = windowAndAggregate(query.Start, query.End, query.Window, query.Aggregators, g.Points); err != nil {
+			return nil, err
+		}
+	}
+	return groups, nil
+}
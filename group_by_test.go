@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupByTagsJSON(t *testing.T) {
+	for body, expected := range map[string]groupByTags{
+		`{"groupBy":"*"}`:         {"*"},
+		`{"groupBy":["id","dc"]}`: {"id", "dc"},
+		`{"groupBy":null}`:        nil,
+		`{}`:                      nil,
+	} {
+		q := &pointsQuery{}
+		if err := json.Unmarshal([]byte(body), q); err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, expected, q.GroupBy, body)
+	}
+	for _, body := range []string{`{"groupBy":"id"}`, `{"groupBy":1}`, `{"groupBy":[1]}`} {
+		if err := json.Unmarshal([]byte(body), &pointsQuery{}); err == nil {
+			t.Fatalf("expected error for %s", body)
+		}
+	}
+
+	b, err := json.Marshal(&downsampleQuery{GroupBy: groupByTags{"*"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Contains(t, string(b), `"groupBy":"*"`)
+	require.Error(t, validateGroupBy(groupByTags{"id", " x"}))
+}
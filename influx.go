@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	influxFieldMapping            = "metric"
+	influxTagPolicy               = "sanitize"
+	errInfluxMissingFields        = errors.New("missing fields")
+	errInfluxMissingTagValue      = errors.New("missing tag value")
+	errInfluxMissingFieldValue    = errors.New("missing field value")
+	errInfluxMissingMeasurement   = errors.New("missing measurement")
+	errInfluxUnterminatedString   = errors.New("unterminated string field value")
+	errInfluxInvalidFieldValue    = errors.New("invalid field value")
+	errInfluxInvalidPrecision     = errors.New("invalid precision")
+	errInfluxTrailingData         = errors.New("unexpected data after timestamp")
+	errInfluxTimestampOverflow    = errors.New("timestamp out of range")
+	errInfluxInvalidTag           = errors.New("tag is outside of [a-zA-Z0-9\\-._]")
+	errInfluxInvalidName          = errors.New("measurement or field is outside of [a-zA-Z0-9\\-._]")
+	errUnsupportedInfluxTagPolicy = errors.New("influx tag policy must be sanitize or reject")
+	errUnsupportedInfluxFieldMap  = errors.New("influx field mapping must be metric or tag")
+)
+
+// influxPrecisions maps the precision query parameter of the v2 and v1
+// write endpoints to the nanoseconds of one timestamp unit
+var influxPrecisions = map[string]int64{
+	"ns": 1,
+	"n":  1,
+	"us": int64(time.Microsecond),
+	"u":  int64(time.Microsecond),
+	"ms": int64(time.Millisecond),
+	"s":  int64(time.Second),
+	"m":  int64(time.Minute),
+	"h":  int64(time.Hour),
+}
+
+var influxV2Precisions = map[string]bool{"ns": true, "us": true, "ms": true, "s": true}
+
+func parseInfluxPrecision(precision string, v2 bool) (int64, error) {
+	if precision == "" {
+		return 1, nil
+	}
+	if v2 && !influxV2Precisions[precision] {
+		return 0, fmt.Errorf("%s: %s", errInfluxInvalidPrecision, precision)
+	}
+	mult, ok := influxPrecisions[precision]
+	if !ok {
+		return 0, fmt.Errorf("%s: %s", errInfluxInvalidPrecision, precision)
+	}
+	return mult, nil
+}
+
+// scanInfluxToken returns the token of line starting at i up to the first
+// unescaped byte of stops and the index of that byte. Backslashes escaping a
+// byte of escapes are removed, other backslashes are kept like influxdb does.
+func scanInfluxToken(line string, i int, stops, escapes string) (string, int) {
+	b := &strings.Builder{}
+	for ; i < len(line); i++ {
+		c := line[i]
+		if c == '\\' && i+1 < len(line) && strings.IndexByte(escapes, line[i+1]) >= 0 {
+			b.WriteByte(line[i+1])
+			i++
+			continue
+		}
+		if strings.IndexByte(stops, c) >= 0 {
+			break
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), i
+}
+
+// scanInfluxFieldValue returns the raw field value starting at i, keeping the
+// quotes of string values, and the index after it
+func scanInfluxFieldValue(line string, i int) (string, int, error) {
+	if i < len(line) && line[i] == '"' {
+		j := i + 1
+		for ; j < len(line); j++ {
+			if line[j] == '\\' {
+				j++
+				continue
+			}
+			if line[j] == '"' {
+				return line[i : j+1], j + 1, nil
+			}
+		}
+		return "", 0, errInfluxUnterminatedString
+	}
+	j := i
+	for j < len(line) && line[j] != ',' && line[j] != ' ' {
+		j++
+	}
+	return line[i:j], j, nil
+}
+
+// parseInfluxFieldValue converts a field value to a point value. String
+// values can't be stored and return ok false.
+func parseInfluxFieldValue(v string) (float64, bool, error) {
+	if v == "" {
+		return 0, false, errInfluxMissingFieldValue
+	}
+	if v[0] == '"' {
+		return 0, false, nil
+	}
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	switch v[len(v)-1] {
+	case 'i':
+		n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("%s: %s", errInfluxInvalidFieldValue, v)
+		}
+		return float64(n), true, nil
+	case 'u':
+		n, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("%s: %s", errInfluxInvalidFieldValue, v)
+		}
+		return float64(n), true, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("%s: %s", errInfluxInvalidFieldValue, v)
+	}
+	return f, true, nil
+}
+
+// parseInfluxLine parses one line of influx line protocol into a point per
+// numeric or boolean field. Fields become the metric measurement.field, or
+// the tag field=<field> of the metric measurement if influxFieldMapping is
+// tag. Measurements, fields and tags are sanitized or rejected according to
+// influxTagPolicy. Lines
+// without a timestamp are stored at now.
+func parseInfluxLine(line string, precision, now int64) ([]*insertPointQuery, error) {
+	measurement, i := scanInfluxToken(line, 0, ", ", ", ")
+	if measurement == "" {
+		return nil, errInfluxMissingMeasurement
+	}
+	var err error
+	if measurement, err = applyNamePolicy(influxTagPolicy, measurement, errInfluxInvalidName); err != nil {
+		return nil, err
+	}
+
+	tags := map[string]string{}
+	for i < len(line) && line[i] == ',' {
+		var key, value string
+		key, i = scanInfluxToken(line, i+1, "=, ", ",= ")
+		if i >= len(line) || line[i] != '=' {
+			return nil, fmt.Errorf("%s: %s", errInfluxMissingTagValue, key)
+		}
+		value, i = scanInfluxToken(line, i+1, ", ", ",= ")
+		if value == "" {
+			return nil, fmt.Errorf("%s: %s", errInfluxMissingTagValue, key)
+		}
+		if key, err = applyNamePolicy(influxTagPolicy, key, errInfluxInvalidTag); err != nil {
+			return nil, err
+		}
+		if value, err = applyNamePolicy(influxTagPolicy, value, errInfluxInvalidTag); err != nil {
+			return nil, err
+		}
+		tags[key] = value
+	}
+	if i >= len(line) || line[i] != ' ' {
+		return nil, errInfluxMissingFields
+	}
+
+	type field struct {
+		key   string
+		value string
+	}
+	fields := []*field{}
+	i++
+	for i < len(line) && line[i] == ' ' {
+		i++
+	}
+	for {
+		f := &field{}
+		f.key, i = scanInfluxToken(line, i, "=, ", ",= ")
+		if f.key == "" || i >= len(line) || line[i] != '=' {
+			return nil, errInfluxMissingFields
+		}
+		if f.key, err = applyNamePolicy(influxTagPolicy, f.key, errInfluxInvalidName); err != nil {
+			return nil, err
+		}
+		if f.value, i, err = scanInfluxFieldValue(line, i+1); err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+		if i < len(line) && line[i] == ',' {
+			i++
+			continue
+		}
+		break
+	}
+
+	timestamp := now
+	rest := strings.TrimSpace(line[i:])
+	if rest != "" {
+		if strings.ContainsAny(rest, " \t") {
+			return nil, errInfluxTrailingData
+		}
+		ts, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if ts > math.MaxInt64/precision || ts < math.MinInt64/precision {
+			return nil, fmt.Errorf("%s: %s", errInfluxTimestampOverflow, rest)
+		}
+		timestamp = ts * precision
+	}
+
+	queries := []*insertPointQuery{}
+	for _, f := range fields {
+		value, ok, err := parseInfluxFieldValue(f.value)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		query := &insertPointQuery{
+			Metric: measurement + "." + f.key,
+			Tags:   tags,
+			Point:  &point{Value: value, Timestamp: timestamp},
+		}
+		if influxFieldMapping == "tag" {
+			fieldTags := make(map[string]string, len(tags)+1)
+			for k, v := range tags {
+				fieldTags[k] = v
+			}
+			fieldTags["field"] = f.key
+			query.Metric, query.Tags = measurement, fieldTags
+		}
+		queries = append(queries, query)
+	}
+	return queries, nil
+}
+
+// parseInfluxLines parses a body of influx line protocol. Blank lines and
+// comments are skipped. Errors include the line number.
+func parseInfluxLines(body io.Reader, precision int64) ([]*insertPointQuery, error) {
+	scanner := bufio.NewScanner(body)
+	buf := make([]byte, readLineProtocolBufferSize)
+	scanner.Buffer(buf, readLineProtocolBufferSize)
+	now := time.Now().UnixNano()
+	queries := []*insertPointQuery{}
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimLeft(scanner.Text(), " \t")
+		line = strings.TrimRight(line, "\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		lineQueries, err := parseInfluxLine(line, precision, now)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse line %d '%s': %s", lineNumber, line, err)
+		}
+		queries = append(queries, lineQueries...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return queries, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseInfluxLine(t *testing.T) {
+	// escaped measurement, string field with an escaped quote and comma
+	queries, err := parseInfluxLine(`cpu\,load,host=server01,region=us-west usage_idle=90.5,usage_user=3i,up=true,desc="a \"b\", c",free=10u 1465839830`, int64(time.Second), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the string field is skipped
+	require.Equal(t, 4, len(queries))
+	tags := map[string]string{"host": "server01", "region": "us-west"}
+	ts := int64(1465839830) * int64(time.Second)
+	require.Equal(t, &insertPointQuery{Metric: "cpu_load.usage_idle", Tags: tags, Point: &point{Value: 90.5, Timestamp: ts}}, queries[0])
+	require.Equal(t, &insertPointQuery{Metric: "cpu_load.usage_user", Tags: tags, Point: &point{Value: 3, Timestamp: ts}}, queries[1])
+	require.Equal(t, &insertPointQuery{Metric: "cpu_load.up", Tags: tags, Point: &point{Value: 1, Timestamp: ts}}, queries[2])
+	require.Equal(t, &insertPointQuery{Metric: "cpu_load.free", Tags: tags, Point: &point{Value: 10, Timestamp: ts}}, queries[3])
+
+	// no timestamp, no tags
+	queries, err = parseInfluxLine(`mem used=1.5e3`, 1, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*insertPointQuery{{Metric: "mem.used", Tags: map[string]string{}, Point: &point{Value: 1500, Timestamp: 42}}}, queries)
+
+	influxFieldMapping = "tag"
+	queries, err = parseInfluxLine(`mem,host=a used=1 5`, 1, 0)
+	influxFieldMapping = "metric"
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*insertPointQuery{{Metric: "mem", Tags: map[string]string{"host": "a", "field": "used"}, Point: &point{Value: 1, Timestamp: 5}}}, queries)
+
+	// tags outside metricAndTagsRe are sanitized by default
+	queries, err = parseInfluxLine(`disk,path=/,device=/dev/sda1 used=1 5`, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, map[string]string{"path": "_", "device": "_dev_sda1"}, queries[0].Tags)
+	// and so are measurements and fields
+	queries, err = parseInfluxLine(`disk\ io,path=a read/s=1 5`, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, "disk_io.read_s", queries[0].Metric)
+	influxTagPolicy = "reject"
+	_, err = parseInfluxLine(`disk,path=/ used=1 5`, 1, 0)
+	require.Error(t, err)
+	_, err = parseInfluxLine(`disk read/s=1 5`, 1, 0)
+	influxTagPolicy = "sanitize"
+	require.Error(t, err)
+
+	for _, line := range []string{
+		`mem used=1 9223372036854775807`,
+		`mem used=1 -9223372036854775807`,
+	} {
+		if _, err := parseInfluxLine(line, int64(time.Second), 0); err == nil {
+			t.Fatalf("expected overflow error for %s", line)
+		}
+	}
+
+	for _, line := range []string{
+		`mem`,
+		`mem,host used=1`,
+		`mem,host= used=1`,
+		`mem used`,
+		`mem used=`,
+		`mem used=abc`,
+		`mem used="abc`,
+		`mem used=1 1 1`,
+		`mem used=1 abc`,
+	} {
+		if _, err := parseInfluxLine(line, 1, 0); err == nil {
+			t.Fatalf("expected error for %s", line)
+		}
+	}
+}
+
+func TestParseInfluxLines(t *testing.T) {
+	body := strings.NewReader("# comment\n\nmem used=1 5\r\nmem used=2 6\nmem used=\n")
+	_, err := parseInfluxLines(body, int64(time.Millisecond))
+	require.EqualError(t, err, "unable to parse line 5 'mem used=': missing field value")
+
+	queries, err := parseInfluxLines(strings.NewReader("mem used=1 5\nmem used=2 6\n"), int64(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, int64(6*time.Millisecond), queries[1].Point.Timestamp)
+
+	if _, err := parseInfluxPrecision("m", true); err == nil {
+		t.Fatal("expected invalid v2 precision")
+	}
+	p, err := parseInfluxPrecision("m", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, int64(time.Minute), p)
+}
@@ -66,4 +66,19 @@ func TestLineParser(t *testing.T) {
 			Timestamp: 138456387,
 		},
 	}, insert)
+
+	insert, err = parseLineProtocol([]byte(`test0,,null 138456387`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.Equal(t, &insertPointQuery{
+		Metric: "test0",
+		Tags:   map[string]string{},
+		Point: &point{
+			Null:      true,
+			Timestamp: 138456387,
+		},
+	}, insert)
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
 	"strconv"
 	"time"
 
@@ -11,6 +13,10 @@ import (
 func main() {
 	log.SetLevel(log.InfoLevel)
 	configLocation := flag.String("config", "./config/simpletsdb.conf", "path to the configuration file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [migrate status|up|dry-run]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	log.Info("Starting SimpleTSDB")
@@ -19,38 +25,165 @@ func main() {
 	if err := loadConfig(*configLocation, cfg); err != nil {
 		log.Fatalf("main: %s", err)
 	}
-	// parse db variables
-	if v, ok := cfg["postgres_username"]; v == "" || !ok {
-		log.Fatal("postgres_username config is required")
+	// parse storage variables
+	if v, ok := cfg["storage_engine"]; ok && v != "" {
+		storageEngine = v
 	}
-	if v, ok := cfg["postgres_ssl_mode"]; v == "" || !ok {
-		log.Fatal("postgres_ssl_mode config is required")
+
+	var err error
+	if v, ok := cfg["simpletsdb_partition_width"]; ok && v != "" {
+		partitionWidth, err = parseDuration(v)
+		if err != nil {
+			log.Fatalf("main: %s", err)
+		}
+		if partitionWidth <= 0 {
+			log.Fatal(errPartitionWidthNotPositive)
+		}
 	}
-	if v, ok := cfg["postgres_host"]; v == "" || !ok {
-		log.Fatal("postgres_host config is required")
+
+	if v, ok := cfg["simpletsdb_partitions_precreate"]; ok && v != "" {
+		partitionsPrecreate, err = strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("main: %s", err)
+		}
 	}
-	if v, ok := cfg["postgres_port"]; v == "" || !ok {
-		log.Fatal("postgres_port config is required")
+
+	if v, ok := cfg["simpletsdb_chunk_width"]; ok && v != "" {
+		chunkWidth, err = parseDuration(v)
+		if err != nil {
+			log.Fatalf("main: %s", err)
+		}
+		if chunkWidth <= 0 {
+			log.Fatal(errChunkWidthNotPositive)
+		}
 	}
-	if v, ok := cfg["postgres_db"]; v == "" || !ok {
-		log.Fatal("postgres_db config is required")
+
+	if v, ok := cfg["simpletsdb_compress_after"]; ok && v != "" {
+		chunkCompressAfter, err = parseDuration(v)
+		if err != nil {
+			log.Fatalf("main: %s", err)
+		}
 	}
-	if v, ok := cfg["postgres_n_conn_workers"]; v == "" || !ok {
-		log.Fatal("postgres_n_conn_workers config is required")
+
+	if v, ok := cfg["simpletsdb_compress_interval"]; ok && v != "" {
+		chunkCompressInterval, err = parseDuration(v)
+		if err != nil {
+			log.Fatalf("main: %s", err)
+		}
+		if chunkCompressInterval <= 0 {
+			log.Fatal(errCompressIntervalNotPositive)
+		}
 	}
-	var pgPassword string
-	if p, ok := cfg["postgres_password"]; ok {
-		pgPassword = p
+
+	if v, ok := cfg["simpletsdb_influx_field_mapping"]; ok && v != "" {
+		if v != "metric" && v != "tag" {
+			log.Fatal(errUnsupportedInfluxFieldMap)
+		}
+		influxFieldMapping = v
 	}
 
-	dbPort, err := strconv.Atoi(cfg["postgres_port"])
-	if err != nil {
-		log.Fatalf("main: %s", err)
+	if v, ok := cfg["simpletsdb_influx_tag_policy"]; ok && v != "" {
+		if v != "sanitize" && v != "reject" {
+			log.Fatal(errUnsupportedInfluxTagPolicy)
+		}
+		influxTagPolicy = v
 	}
 
-	nConnWorkers, err := strconv.Atoi(cfg["postgres_n_conn_workers"])
-	if err != nil {
-		log.Fatalf("main: %s", err)
+	if v, ok := cfg["simpletsdb_prom_label_policy"]; ok && v != "" {
+		if v != "sanitize" && v != "reject" {
+			log.Fatal(errUnsupportedPromLabelPolicy)
+		}
+		promLabelPolicy = v
+	}
+
+	if v, ok := cfg["simpletsdb_retention_interval"]; ok && v != "" {
+		retentionEnforceInterval, err = parseDuration(v)
+		if err != nil {
+			log.Fatalf("main: %s", err)
+		}
+		if retentionEnforceInterval <= 0 {
+			log.Fatal(errRetentionIntervalNotPositive)
+		}
+	}
+
+	if v, ok := cfg["simpletsdb_graphite_templates"]; ok && v != "" {
+		graphiteTemplates, err = parseGraphiteTemplates(v)
+		if err != nil {
+			log.Fatalf("main: %s", err)
+		}
+	}
+
+	if v, ok := cfg["simpletsdb_graphite_flush_interval"]; ok && v != "" {
+		graphiteFlushInterval, err = parseDuration(v)
+		if err != nil {
+			log.Fatalf("main: %s", err)
+		}
+		if graphiteFlushInterval <= 0 {
+			log.Fatalf("main: %s", errGraphiteFlushIntervalNotPositive)
+		}
+	}
+
+	if v, ok := cfg["simpletsdb_statsd_flush_interval"]; ok && v != "" {
+		statsdFlushInterval, err = parseDuration(v)
+		if err != nil {
+			log.Fatalf("main: %s", err)
+		}
+		if statsdFlushInterval <= 0 {
+			log.Fatalf("main: %s", errStatsdFlushIntervalNotPositive)
+		}
+	}
+
+	if v, ok := cfg["simpletsdb_statsd_percentiles"]; ok && v != "" {
+		statsdPercentiles, err = parseStatsdPercentiles(v)
+		if err != nil {
+			log.Fatalf("main: %s", err)
+		}
+	}
+
+	if v, ok := cfg["simpletsdb_spool_max_size"]; ok && v != "" {
+		spoolMaxSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Fatalf("main: %s", err)
+		}
+		if spoolMaxSize <= 0 {
+			log.Fatalf("main: %s", errSpoolMaxSizeNotPositive)
+		}
+	}
+
+	if v, ok := cfg["simpletsdb_spool_flush_interval"]; ok && v != "" {
+		spoolFlushInterval, err = parseDuration(v)
+		if err != nil {
+			log.Fatalf("main: %s", err)
+		}
+		if spoolFlushInterval <= 0 {
+			log.Fatalf("main: %s", errSpoolFlushIntervalNotPositive)
+		}
+	}
+
+	if v, ok := cfg["simpletsdb_max_decompressed_size"]; ok && v != "" {
+		maxDecompressedSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Fatalf("main: %s", err)
+		}
+		if maxDecompressedSize <= 0 {
+			log.Fatalf("main: %s", errMaxDecompressedSizeNotPositive)
+		}
+	}
+
+	if flag.Arg(0) == "migrate" {
+		c, err := parsePGConfig(cfg)
+		if err != nil {
+			log.Fatalf("main: %s", err)
+		}
+		session, err := openSession(c.username, c.password, c.host, c.port, c.db, c.sslMode)
+		if err != nil {
+			log.Fatalf("main: %s", err)
+		}
+		defer session.Close()
+		if err := runMigrateCommand(session, flag.Arg(1), os.Stdout); err != nil {
+			log.Fatalf("main: migrate: %s", err)
+		}
+		return
 	}
 
 	// parse server variables
@@ -97,11 +230,26 @@ func main() {
 		log.Fatalf("main: %s", err)
 	}
 
-	// init db
-	db, nextDownsamplerID, cancelDownsampleWait := initDB(cfg["postgres_username"], pgPassword, cfg["postgres_host"], dbPort, cfg["postgres_db"], cfg["postgres_ssl_mode"], nConnWorkers)
-	log.Infof("Connected to database [%s] at %s:%d", cfg["postgres_db"], cfg["postgres_host"], dbPort)
+	// init storage
+	storage, err := newStorage(storageEngine, cfg)
+	if err != nil {
+		log.Fatalf("main: %s", err)
+	}
+	log.Infof("Using %s storage engine", storageEngine)
+	nextDownsamplerID, cancelDownsampleWait := initStorage(storage)
+
+	// init listeners
+	if err := initGraphite(storage, cfg["simpletsdb_graphite_tcp_address"], cfg["simpletsdb_graphite_udp_address"], cfg["simpletsdb_graphite_pickle_address"]); err != nil {
+		log.Fatalf("main: %s", err)
+	}
+	if err := initStatsd(storage, cfg["simpletsdb_statsd_address"]); err != nil {
+		log.Fatalf("main: %s", err)
+	}
+	if err := initSpool(storage, cfg["simpletsdb_spool_dir"]); err != nil {
+		log.Fatalf("main: %s", err)
+	}
 
 	// init server
 	log.Infof("Initializing server at %s:%d", cfg["simpletsdb_bind_host"], serverPort)
-	initServer(db, nextDownsamplerID, cancelDownsampleWait, cfg["simpletsdb_bind_host"], serverPort, serverReadTimeout, serverWriteTimeout, readLineProtocolBufferSize)
+	initServer(storage, nextDownsamplerID, cancelDownsampleWait, cfg["simpletsdb_bind_host"], serverPort, serverReadTimeout, serverWriteTimeout, readLineProtocolBufferSize)
 }
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	schemaVersionTable            = `simpletsdb_schema_version`
+	migrationsLockKey       int64 = 0x73747364626d6967 // "stsdbmig"
+	errUnknownMigrateAction       = errors.New("valid migrate actions are status, up and dry-run")
+)
+
+type migration struct {
+	version     int
+	description string
+	// statements returns the SQL for the migration. It may inspect the
+	// current schema through session but must not modify it.
+	statements func(session queryer) ([]string, error)
+}
+
+// migrations must be ordered by version. Released migrations must never be
+// edited, only appended to.
+var migrations = []*migration{
+	{version: 1, description: "create metrics, downsamplers and meta tables", statements: baseTablesMigration},
+	{version: 2, description: "move tags into series catalog", statements: seriesCatalogMigration},
+	{version: 3, description: "partition metrics table by timestamp", statements: partitionedMetricsMigration},
+	{version: 4, description: "create retention policies table", statements: retentionTableMigration},
+	{version: 5, description: "create compressed chunks table", statements: chunksTableMigration},
+	{version: 6, description: "index chunks by series and max time", statements: chunksMaxTimeIndexMigration},
+}
+
+func baseTablesMigration(session queryer) ([]string, error) {
+	return []string{
+		fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	metric text,
+	value double precision,
+	timestamp bigint,
+	tags jsonb,
+	UNIQUE(metric, timestamp, tags)
+)`, metricsTable),
+		fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	id serial,
+	metric text,
+	out_metric text,
+	run_every bigint,
+	last_downsampled_window bigint,
+	time_update_at bigint NOT NULL,
+	worker_id int,
+	query jsonb
+)`, downsamplersTable),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s_worker_id_idx ON %s(worker_id)`, downsamplersTable, downsamplersTable),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s_time_update_at_idx ON %s(time_update_at)`, downsamplersTable, downsamplersTable),
+		fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	worker_id_count int
+)`, metaTable),
+	}, nil
+}
+
+func seriesCatalogMigration(session queryer) ([]string, error) {
+	legacy, err := columnExists(session, metricsTable, "metric")
+	if err != nil {
+		return nil, err
+	}
+	if !legacy {
+		// metrics table was already converted before schema versioning
+		return []string{
+			createSeriesTableQuery(),
+			createSeriesTagsIndexQuery(),
+			createMetricsTableQuery(),
+		}, nil
+	}
+	legacyTable := metricsTable + "_legacy"
+	return []string{
+		fmt.Sprintf(`ALTER TABLE %s RENAME TO %s`, metricsTable, legacyTable),
+		createSeriesTableQuery(),
+		createSeriesTagsIndexQuery(),
+		createMetricsTableQuery(),
+		fmt.Sprintf(`
+INSERT INTO %s (metric,tags)
+SELECT DISTINCT metric, CASE WHEN jsonb_typeof(tags) = 'object' THEN tags ELSE '{}'::jsonb END FROM %s
+ON CONFLICT DO NOTHING`, seriesTable, legacyTable),
+		fmt.Sprintf(`
+INSERT INTO %s (series_id,timestamp,value)
+SELECT s.id, l.timestamp, l.value FROM %s l
+JOIN %s s ON s.metric = l.metric AND s.tags = CASE WHEN jsonb_typeof(l.tags) = 'object' THEN l.tags ELSE '{}'::jsonb END
+ON CONFLICT DO NOTHING`, metricsTable, legacyTable, seriesTable),
+		fmt.Sprintf(`DROP TABLE %s`, legacyTable),
+	}, nil
+}
+
+func createSeriesTableQuery() string {
+	return fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	id bigserial PRIMARY KEY,
+	metric text NOT NULL,
+	tags jsonb NOT NULL,
+	UNIQUE(metric, tags)
+)`, seriesTable)
+}
+
+func createSeriesTagsIndexQuery() string {
+	return fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s_tags_idx ON %s USING gin(tags)`, seriesTable, seriesTable)
+}
+
+func createMetricsTableQuery() string {
+	return fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	series_id bigint NOT NULL,
+	timestamp bigint NOT NULL,
+	value double precision,
+	UNIQUE(series_id, timestamp)
+)`, metricsTable)
+}
+
+func columnExists(session queryer, table, column string) (bool, error) {
+	var n int
+	row := session.QueryRow("SELECT count(*) FROM information_schema.columns WHERE table_schema='public' AND table_name=$1 AND column_name=$2", table, column)
+	if err := row.Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+type appliedMigration struct {
+	version   int
+	appliedAt int64
+}
+
+// selectAppliedMigrations creates the schema version table if needed and
+// returns the migrations recorded in it.
+func selectAppliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]*appliedMigration, error) {
+	query := fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	version int PRIMARY KEY,
+	description text NOT NULL,
+	applied_at bigint NOT NULL
+)`, schemaVersionTable)
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return nil, err
+	}
+
+	scanner, err := conn.QueryContext(ctx, fmt.Sprintf("SELECT version, applied_at FROM %s", schemaVersionTable))
+	if err != nil {
+		return nil, err
+	}
+	defer scanner.Close()
+
+	applied := map[int]*appliedMigration{}
+	for scanner.Next() {
+		m := &appliedMigration{}
+		if err := scanner.Scan(&m.version, &m.appliedAt); err != nil {
+			return nil, err
+		}
+		applied[m.version] = m
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+func applyMigrationTx(tx *sql.Tx, m *migration, out io.Writer) error {
+	stmts, err := m.statements(tx)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range stmts {
+		if out != nil {
+			fmt.Fprintf(out, "%s;\n", stmt)
+		}
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("migration %d: %s", m.version, err)
+		}
+	}
+	query := fmt.Sprintf("INSERT INTO %s (version, description, applied_at) VALUES ($1,$2,$3)", schemaVersionTable)
+	_, err = tx.Exec(query, m.version, m.description, time.Now().UnixNano())
+	return err
+}
+
+// withMigrationsLock runs fn on a dedicated connection holding the migrations
+// advisory lock so concurrently starting instances don't race each other.
+func withMigrationsLock(session *sql.DB, fn func(context.Context, *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := session.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationsLockKey); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationsLockKey); err != nil {
+			log.Errorf("withMigrationsLock: unlock: %s", err)
+		}
+	}()
+
+	return fn(ctx, conn)
+}
+
+// migrateUp applies every pending migration, each in its own transaction.
+func migrateUp(session *sql.DB) error {
+	return withMigrationsLock(session, func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := selectAppliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.version]; ok {
+				continue
+			}
+			t0 := time.Now()
+			tx, err := conn.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			if err := applyMigrationTx(tx, m, nil); err != nil {
+				if err0 := tx.Rollback(); err0 != nil {
+					log.Errorf("migrateUp rollback error: %s", err0)
+				}
+				return err
+			}
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			log.Infof("applied migration %d (%s) in %s", m.version, m.description, time.Since(t0))
+		}
+		return nil
+	})
+}
+
+// migrateDryRun applies every pending migration in a single transaction,
+// writing the executed SQL to out, then rolls it back.
+func migrateDryRun(session *sql.DB, out io.Writer) error {
+	return withMigrationsLock(session, func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := selectAppliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := tx.Rollback(); err != nil {
+				log.Errorf("migrateDryRun rollback error: %s", err)
+			}
+		}()
+		pending := 0
+		for _, m := range migrations {
+			if _, ok := applied[m.version]; ok {
+				continue
+			}
+			pending++
+			fmt.Fprintf(out, "-- migration %d: %s\n", m.version, m.description)
+			if err := applyMigrationTx(tx, m, out); err != nil {
+				return err
+			}
+		}
+		if pending == 0 {
+			fmt.Fprintln(out, "-- no pending migrations")
+		}
+		return nil
+	})
+}
+
+func migrateStatus(session *sql.DB, out io.Writer) error {
+	return withMigrationsLock(session, func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := selectAppliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			status := "pending"
+			if a, ok := applied[m.version]; ok {
+				status = "applied " + time.Unix(0, a.appliedAt).UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(out, "%4d  %-50s  %s\n", m.version, m.description, status)
+		}
+		return nil
+	})
+}
+
+func runMigrateCommand(session *sql.DB, action string, out io.Writer) error {
+	switch action {
+	case "status":
+		return migrateStatus(session, out)
+	case "up":
+		return migrateUp(session)
+	case "dry-run":
+		return migrateDryRun(session, out)
+	}
+	return errUnknownMigrateAction
+}
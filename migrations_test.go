@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrationsOrdered(t *testing.T) {
+	require.NotEmpty(t, migrations)
+	for i, m := range migrations {
+		if i > 0 {
+			require.Greater(t, m.version, migrations[i-1].version, m.description)
+		}
+		require.Positive(t, m.version, m.description)
+		require.NotEmpty(t, m.description, m.version)
+		require.NotNil(t, m.statements, m.version)
+	}
+}
+
+func TestRunMigrateCommandUnknownAction(t *testing.T) {
+	// unknown actions are rejected before connecting
+	for _, action := range []string{"", "down", "UP", "dry_run", "status up"} {
+		out := &bytes.Buffer{}
+		require.Equal(t, errUnknownMigrateAction, runMigrateCommand(nil, action, out), action)
+		require.Empty(t, out.String(), action)
+	}
+}
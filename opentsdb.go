@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	openTSDBDurationRe               = regexp.MustCompile(`^([0-9]+)(ms|s|m|h|d|w|n|y)$`)
+	openTSDBDateLayouts              = []string{"2006/01/02-15:04:05", "2006/01/02-15:04", "2006/01/02"}
+	openTSDBMaxSecondsTimestamp      = int64(9999999999)
+	errOpenTSDBInvalidTime           = errors.New("invalid time")
+	errOpenTSDBTimeOutOfRange        = errors.New("time out of range")
+	errOpenTSDBInvalidDuration       = errors.New("invalid duration")
+	errOpenTSDBInvalidDownsample     = errors.New("downsample must be <interval>-<function>[-<fill policy>]")
+	errOpenTSDBUnsupportedAggregator = errors.New("unsupported aggregator")
+	errOpenTSDBUnsupportedFillPolicy = errors.New("fill policy must be none, nan, null or zero")
+	errOpenTSDBQueriesRequired       = errors.New("at least one sub query is required")
+	errOpenTSDBTimestampRequired     = errors.New("timestamp is required")
+	errOpenTSDBValueRequired         = errors.New("value is required")
+	errOpenTSDBInvalidValue          = errors.New("value must be a number")
+	errOpenTSDBInvalidMetricQuery    = errors.New("m must be <aggregator>:[<downsample>:]<metric>[{<tags>}]")
+	errOpenTSDBDataPointsHadErrors   = errors.New("one or more data points had errors")
+	openTSDBDurationUnits            = map[string]time.Duration{
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+		"d":  24 * time.Hour,
+		"w":  7 * 24 * time.Hour,
+		"n":  30 * 24 * time.Hour,
+		"y":  365 * 24 * time.Hour,
+	}
+)
+
+// openTSDBAggregators maps OpenTSDB aggregators to SimpleTSDB aggregators.
+// none keeps every series apart.
+var openTSDBAggregators = map[string]string{
+	"sum":    "sum",
+	"zimsum": "sum",
+	"min":    "min",
+	"mimmin": "min",
+	"max":    "max",
+	"mimmax": "max",
+	"avg":    "mean",
+	"count":  "count",
+	"dev":    "stddev",
+	"first":  "first",
+	"last":   "last",
+	"p50":    "median",
+	"none":   "",
+}
+
+func parseOpenTSDBDuration(s string) (time.Duration, error) {
+	m := openTSDBDurationRe.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("%s: %s", errOpenTSDBInvalidDuration, s)
+	}
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(n) * openTSDBDurationUnits[m[2]], nil
+}
+
+// openTSDBTimestamp converts a timestamp in seconds, or in milliseconds if
+// it has more than 10 digits, to nanoseconds
+func openTSDBTimestamp(n int64) (int64, error) {
+	mult := int64(time.Second)
+	if n > openTSDBMaxSecondsTimestamp {
+		mult = int64(time.Millisecond)
+	}
+	if n > math.MaxInt64/mult || n < math.MinInt64/mult {
+		return 0, fmt.Errorf("%s: %d", errOpenTSDBTimeOutOfRange, n)
+	}
+	return n * mult, nil
+}
+
+// parseOpenTSDBTime parses an absolute timestamp, a date or a relative time
+// like 1h-ago into nanoseconds. nil returns 0.
+func parseOpenTSDBTime(v interface{}, now int64) (int64, error) {
+	var s string
+	switch v1 := v.(type) {
+	case nil:
+		return 0, nil
+	case json.Number:
+		s = string(v1)
+	case string:
+		s = v1
+	case float64:
+		s = strconv.FormatFloat(v1, 'f', -1, 64)
+	default:
+		return 0, fmt.Errorf("%s: %v", errOpenTSDBInvalidTime, v)
+	}
+
+	if strings.HasSuffix(s, "-ago") {
+		d, err := parseOpenTSDBDuration(strings.TrimSuffix(s, "-ago"))
+		if err != nil {
+			return 0, err
+		}
+		return now - d.Nanoseconds(), nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return openTSDBTimestamp(n)
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		// fractional seconds, NaN fails both comparisons
+		if !(f <= float64(math.MaxInt64/int64(time.Second)) && f >= float64(math.MinInt64/int64(time.Second))) {
+			return 0, fmt.Errorf("%s: %s", errOpenTSDBTimeOutOfRange, s)
+		}
+		return int64(f * float64(time.Second)), nil
+	}
+	for _, layout := range openTSDBDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UnixNano(), nil
+		}
+	}
+	return 0, fmt.Errorf("%s: %s", errOpenTSDBInvalidTime, s)
+}
+
+func openTSDBPointToQuery(p *openTSDBPoint) (*insertPointQuery, error) {
+	if p.Metric == "" {
+		return nil, errMetricRequired
+	}
+	if !metricAndTagsRe.MatchString(p.Metric) {
+		return nil, errUnsupportedMetricName
+	}
+	if err := validateTags(p.Tags); err != nil {
+		return nil, err
+	}
+	if p.Timestamp == nil {
+		return nil, errOpenTSDBTimestampRequired
+	}
+	timestamp, err := parseOpenTSDBTime(p.Timestamp, time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+
+	var value string
+	switch v := p.Value.(type) {
+	case nil:
+		return nil, errOpenTSDBValueRequired
+	case json.Number:
+		value = string(v)
+	case string:
+		value = v
+	default:
+		return nil, errOpenTSDBInvalidValue
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, errOpenTSDBInvalidValue
+	}
+	return &insertPointQuery{
+		Metric: p.Metric,
+		Tags:   p.Tags,
+		Point:  &point{Value: f, Timestamp: timestamp},
+	}, nil
+}
+
+// decodeOpenTSDBPoints decodes a single data point or an array of them
+func decodeOpenTSDBPoints(body io.Reader) ([]*openTSDBPoint, error) {
+	raw, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	raw = bytes.TrimSpace(raw)
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if len(raw) > 0 && raw[0] == '[' {
+		points := []*openTSDBPoint{}
+		if err := dec.Decode(&points); err != nil {
+			return nil, err
+		}
+		return points, nil
+	}
+	p := &openTSDBPoint{}
+	if err := dec.Decode(p); err != nil {
+		return nil, err
+	}
+	return []*openTSDBPoint{p}, nil
+}
+
+// putOpenTSDB inserts the valid data points and reports the invalid ones
+// like OpenTSDB does
+func putOpenTSDB(s Storage, points []*openTSDBPoint) (*openTSDBPutSummary, error) {
+	summary := &openTSDBPutSummary{}
+	queries := []*insertPointQuery{}
+	for _, p := range points {
+		query, err := openTSDBPointToQuery(p)
+		if err != nil {
+			summary.Failed++
+			summary.Errors = append(summary.Errors, &openTSDBPutError{Datapoint: p, Error: err.Error()})
+			continue
+		}
+		queries = append(queries, query)
+	}
+	if err := insertPoints(s, queries); err != nil {
+		return nil, err
+	}
+	summary.Success = len(queries)
+	return summary, nil
+}
+
+// parseOpenTSDBDownsample converts a downsample like 1m-avg or 1m-avg-zero
+// into a window and aggregators
+func parseOpenTSDBDownsample(ds string) (map[string]interface{}, []*aggregatorQuery, error) {
+	parts := strings.Split(ds, "-")
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, nil, fmt.Errorf("%s: %s", errOpenTSDBInvalidDownsample, ds)
+	}
+	every, err := parseOpenTSDBDuration(parts[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if every <= 0 {
+		return nil, nil, fmt.Errorf("%s: %s", errOpenTSDBInvalidDownsample, ds)
+	}
+	name := openTSDBAggregators[parts[1]]
+	if name == "" {
+		return nil, nil, fmt.Errorf("%s: %s", errOpenTSDBUnsupportedAggregator, parts[1])
+	}
+	windowOptions := map[string]interface{}{"every": every.String()}
+	aggregators := []*aggregatorQuery{{Name: name}}
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "none":
+		case "nan", "null":
+			windowOptions["createEmpty"] = true
+		case "zero":
+			windowOptions["createEmpty"] = true
+			aggregators = append(aggregators, &aggregatorQuery{
+				Name:    "fill",
+				Options: map[string]interface{}{"fillValue": float64(0)},
+			})
+		default:
+			return nil, nil, fmt.Errorf("%s: %s", errOpenTSDBUnsupportedFillPolicy, parts[2])
+		}
+	}
+	return windowOptions, aggregators, nil
+}
+
+// parseOpenTSDBMetricQuery parses the m parameter of a GET query, e.g.
+// sum:1m-avg:sys.cpu{host=web01,dc=*}
+func parseOpenTSDBMetricQuery(m string) (*openTSDBSubQuery, error) {
+	sub := &openTSDBSubQuery{Tags: map[string]string{}}
+	if i := strings.IndexByte(m, '{'); i >= 0 {
+		if !strings.HasSuffix(m, "}") {
+			return nil, errOpenTSDBInvalidMetricQuery
+		}
+		for _, kv := range strings.Split(m[i+1:len(m)-1], ",") {
+			if kv == "" {
+				continue
+			}
+			j := strings.IndexByte(kv, '=')
+			if j <= 0 {
+				return nil, errOpenTSDBInvalidMetricQuery
+			}
+			sub.Tags[kv[:j]] = kv[j+1:]
+		}
+		m = m[:i]
+	}
+	parts := strings.Split(m, ":")
+	switch len(parts) {
+	case 2:
+		sub.Aggregator, sub.Metric = parts[0], parts[1]
+	case 3:
+		sub.Aggregator, sub.Downsample, sub.Metric = parts[0], parts[1], parts[2]
+	default:
+		return nil, errOpenTSDBInvalidMetricQuery
+	}
+	return sub, nil
+}
+
+// splitOpenTSDBTags splits query tags into the exact filter and the group by
+// tags. A group by tag is * for any value or values separated by |.
+func splitOpenTSDBTags(tags map[string]string) (map[string]string, map[string][]string) {
+	exact := map[string]string{}
+	groupBy := map[string][]string{}
+	for k, v := range tags {
+		switch {
+		case v == "*":
+			groupBy[k] = nil
+		case strings.Contains(v, "|"):
+			groupBy[k] = strings.Split(v, "|")
+		default:
+			exact[k] = v
+		}
+	}
+	return exact, groupBy
+}
+
+// groupOpenTSDBSeries groups series by the values of the group by tags.
+// Series without a group by tag or with a value that isn't listed are left
+// out.
+func groupOpenTSDBSeries(series []*seriesPoints, groupBy map[string][]string) ([]string, map[string][]*seriesPoints) {
+	keys := make([]string, 0, len(groupBy))
+	for k := range groupBy {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var order []string
+	groups := map[string][]*seriesPoints{}
+outer:
+	for _, sp := range series {
+		var group strings.Builder
+		for _, k := range keys {
+			v, ok := sp.Tags[k]
+			if !ok {
+				continue outer
+			}
+			if values := groupBy[k]; values != nil && !containsString(values, v) {
+				continue outer
+			}
+			group.WriteString(k + "=" + v + ",")
+		}
+		key := group.String()
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], sp)
+	}
+	sort.Strings(order)
+	return order, groups
+}
+
+func containsString(values []string, v string) bool {
+	for _, v0 := range values {
+		if v0 == v {
+			return true
+		}
+	}
+	return false
+}
+
+// aggregateByTimestamp aggregates the points of several series with the same
+// timestamp
+func aggregateByTimestamp(name string, points []*point) ([]*point, error) {
+	sortPoints(points)
+	for _, pt := range points {
+		pt.Window = pt.Timestamp
+	}
+	points, _, err := aggregate(&aggregatorQuery{Name: name}, true, points)
+	if err != nil {
+		return nil, err
+	}
+	for _, pt := range points {
+		pt.Window = 0
+	}
+	return points, nil
+}
+
+func newOpenTSDBQueryResult(metric string, series []*seriesPoints, points []*point, msResolution bool) *openTSDBQueryResult {
+	res := &openTSDBQueryResult{
+		Metric:        metric,
+		Tags:          map[string]string{},
+		AggregateTags: []string{},
+		Dps:           map[string]interface{}{},
+	}
+	aggregateTags := map[string]bool{}
+	for k, v := range series[0].Tags {
+		res.Tags[k] = v
+	}
+	for _, sp := range series[1:] {
+		for k, v := range res.Tags {
+			if v0, ok := sp.Tags[k]; !ok || v0 != v {
+				delete(res.Tags, k)
+				aggregateTags[k] = true
+			}
+		}
+		for k := range sp.Tags {
+			if _, ok := res.Tags[k]; !ok {
+				aggregateTags[k] = true
+			}
+		}
+	}
+	for k := range aggregateTags {
+		res.AggregateTags = append(res.AggregateTags, k)
+	}
+	sort.Strings(res.AggregateTags)
+
+	unit := int64(time.Second)
+	if msResolution {
+		unit = int64(time.Millisecond)
+	}
+	for _, pt := range points {
+		key := strconv.FormatInt(pt.Timestamp/unit, 10)
+		if pt.Null {
+			res.Dps[key] = nil
+		} else {
+			res.Dps[key] = pt.Value
+		}
+	}
+	return res
+}
+
+func runOpenTSDBSubQuery(s Storage, sub *openTSDBSubQuery, start, end int64, msResolution bool) ([]*openTSDBQueryResult, error) {
+	name, ok := openTSDBAggregators[sub.Aggregator]
+	if !ok {
+		return nil, fmt.Errorf("%s: %s", errOpenTSDBUnsupportedAggregator, sub.Aggregator)
+	}
+	if sub.Metric == "" {
+		return nil, errMetricRequired
+	}
+	if !metricAndTagsRe.MatchString(sub.Metric) {
+		return nil, errUnsupportedMetricName
+	}
+	var (
+		windowOptions map[string]interface{}
+		downsamplers  []*aggregatorQuery
+		err           error
+	)
+	if sub.Downsample != "" {
+		if windowOptions, downsamplers, err = parseOpenTSDBDownsample(sub.Downsample); err != nil {
+			return nil, err
+		}
+	}
+	exact, groupBy := splitOpenTSDBTags(sub.Tags)
+	if err := validateTags(exact); err != nil {
+		return nil, err
+	}
+
+	series, err := s.SelectSeriesPoints(priorityCRUD, sub.Metric, newTagsFilter(exact), start, end)
+	if err != nil {
+		return nil, err
+	}
+	order, groups := groupOpenTSDBSeries(series, groupBy)
+	if name == "" {
+		// none doesn't aggregate, every series is its own group
+		order, groups = nil, map[string][]*seriesPoints{}
+		for i, sp := range series {
+			key := strconv.Itoa(i)
+			order = append(order, key)
+			groups[key] = []*seriesPoints{sp}
+		}
+	}
+
+	results := []*openTSDBQueryResult{}
+	for _, key := range order {
+		group := groups[key]
+		points := []*point{}
+		for _, sp := range group {
+			pts := sp.Points
+			if windowOptions != nil {
+				if pts, err = windowAndAggregate(start, end, windowOptions, downsamplers, pts); err != nil {
+					return nil, err
+				}
+			}
+			points = append(points, pts...)
+		}
+		if name != "" {
+			if points, err = aggregateByTimestamp(name, points); err != nil {
+				return nil, err
+			}
+		}
+		results = append(results, newOpenTSDBQueryResult(sub.Metric, group, points, msResolution))
+	}
+	return results, nil
+}
+
+func queryOpenTSDB(s Storage, q *openTSDBQuery) ([]*openTSDBQueryResult, error) {
+	now := time.Now().UnixNano()
+	start, err := parseOpenTSDBTime(q.Start, now)
+	if err != nil {
+		return nil, err
+	}
+	if start == 0 {
+		return nil, errStartRequired
+	}
+	end, err := parseOpenTSDBTime(q.End, now)
+	if err != nil {
+		return nil, err
+	}
+	if end == 0 {
+		end = now
+	}
+	if len(q.Queries) == 0 {
+		return nil, errOpenTSDBQueriesRequired
+	}
+
+	results := []*openTSDBQueryResult{}
+	for _, sub := range q.Queries {
+		subResults, err := runOpenTSDBSubQuery(s, sub, start, end, q.MsResolution)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, subResults...)
+	}
+	return results, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOpenTSDBTime(t *testing.T) {
+	now := int64(946684800000000000)
+	for v, expected := range map[interface{}]int64{
+		json.Number("946684800"):    946684800000000000,
+		json.Number("946684800123"): 946684800123000000,
+		"946684800.5":               946684800500000000,
+		"1h-ago":                    946681200000000000,
+		"2000/01/01-00:00:00":       946684800000000000,
+		"2000/01/01":                946684800000000000,
+		json.Number("999999999"):    999999999000000000,
+		json.Number("10000000000"):  10000000000000000,
+		nil:                         0,
+	} {
+		ts, err := parseOpenTSDBTime(v, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, expected, ts, v)
+	}
+	for _, v := range []interface{}{"1x-ago", "yesterday", true, json.Number("9223372037"), json.Number("-9223372037"), json.Number("9223372036855"), "1e300"} {
+		if _, err := parseOpenTSDBTime(v, now); err == nil {
+			t.Fatalf("expected error for %v", v)
+		}
+	}
+}
+
+func TestParseOpenTSDBDownsample(t *testing.T) {
+	window, aggregators, err := parseOpenTSDBDownsample("1m-avg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, map[string]interface{}{"every": "1m0s"}, window)
+	require.Equal(t, []*aggregatorQuery{{Name: "mean"}}, aggregators)
+
+	window, aggregators, err = parseOpenTSDBDownsample("1h-sum-zero")
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, map[string]interface{}{"every": "1h0m0s", "createEmpty": true}, window)
+	require.Len(t, aggregators, 2)
+
+	for _, ds := range []string{"1m", "1m-none", "1m-avg-x", "x-avg", "0s-avg"} {
+		if _, _, err := parseOpenTSDBDownsample(ds); err == nil {
+			t.Fatalf("expected error for downsample %q", ds)
+		}
+	}
+}
+
+func TestParseOpenTSDBMetricQuery(t *testing.T) {
+	sub, err := parseOpenTSDBMetricQuery("sum:1m-avg:sys.cpu{host=web01,dc=*}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, &openTSDBSubQuery{
+		Aggregator: "sum",
+		Downsample: "1m-avg",
+		Metric:     "sys.cpu",
+		Tags:       map[string]string{"host": "web01", "dc": "*"},
+	}, sub)
+	for _, m := range []string{"sys.cpu", "sum:sys.cpu{host", "a:b:c:d"} {
+		if _, err := parseOpenTSDBMetricQuery(m); err == nil {
+			t.Fatalf("expected error for m %q", m)
+		}
+	}
+}
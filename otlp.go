@@ -0,0 +1,858 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// OTLP metrics are flattened into points: gauges and sums become one point
+// per data point, histograms become Prometheus style _bucket, _sum and _count
+// metrics. Resource and data point attributes become tags, and sums and
+// histograms get a temporality tag of delta or cumulative.
+
+var (
+	otlpTemporalityTag            = "temporality"
+	otlpBucketBoundTag            = "le"
+	errOTLPUnspecifiedTemporality = errors.New("aggregation temporality is unspecified")
+	errOTLPBucketCountMismatch    = errors.New("histogram bucket counts don't match explicit bounds")
+	errOTLPInvalidNumber          = errors.New("invalid number")
+)
+
+// aggregation temporalities
+const (
+	otlpTemporalityUnspecified = iota
+	otlpTemporalityDelta
+	otlpTemporalityCumulative
+)
+
+// otlpFlagNoRecordedValue marks data points without a value
+const otlpFlagNoRecordedValue = 1
+
+var otlpTemporalityNames = map[int64]string{
+	otlpTemporalityDelta:      "delta",
+	otlpTemporalityCumulative: "cumulative",
+}
+
+type otlpNumberPoint struct {
+	attrs     map[string]string
+	timestamp int64
+	value     float64
+	flags     uint64
+}
+
+type otlpHistogramPoint struct {
+	attrs        map[string]string
+	timestamp    int64
+	count        uint64
+	sum          float64
+	hasSum       bool
+	bucketCounts []uint64
+	bounds       []float64
+	flags        uint64
+}
+
+// otlpMetric is a metric of one resource. Sums and histograms are
+// aggregated and have a temporality. Data points of unsupported types are
+// only counted.
+type otlpMetric struct {
+	name        string
+	resource    map[string]string
+	aggregated  bool
+	histogram   bool
+	temporality int64
+	numbers     []*otlpNumberPoint
+	histograms  []*otlpHistogramPoint
+	unsupported int64
+}
+
+// otlpExportResult is the partial success of an export
+type otlpExportResult struct {
+	rejected int64
+	errors   []string
+}
+
+func (res *otlpExportResult) reject(n int64, err string) {
+	if n == 0 {
+		return
+	}
+	res.rejected += n
+	for _, e := range res.errors {
+		if e == err {
+			return
+		}
+	}
+	res.errors = append(res.errors, err)
+}
+
+// protobuf
+
+func decodeOTLPAnyValue(b []byte) (string, error) {
+	var v string
+	err := parseProtoFields(b, func(f *protoField) error {
+		switch f.num {
+		case 1:
+			if err := expectWireType(f, protowire.BytesType); err != nil {
+				return err
+			}
+			v = string(f.bytes)
+		case 2:
+			if err := expectWireType(f, protowire.VarintType); err != nil {
+				return err
+			}
+			v = strconv.FormatBool(f.varint != 0)
+		case 3:
+			if err := expectWireType(f, protowire.VarintType); err != nil {
+				return err
+			}
+			v = strconv.FormatInt(int64(f.varint), 10)
+		case 4:
+			if err := expectWireType(f, protowire.Fixed64Type); err != nil {
+				return err
+			}
+			v = strconv.FormatFloat(math.Float64frombits(f.fixed), 'f', -1, 64)
+		case 7:
+			if err := expectWireType(f, protowire.BytesType); err != nil {
+				return err
+			}
+			v = hex.EncodeToString(f.bytes)
+		}
+		// arrays and key value lists can't be stored as tags
+		return nil
+	})
+	return v, err
+}
+
+func decodeOTLPKeyValue(b []byte, attrs map[string]string) error {
+	var key, value string
+	err := parseProtoFields(b, func(f *protoField) error {
+		if err := expectWireType(f, protowire.BytesType); err != nil {
+			return err
+		}
+		switch f.num {
+		case 1:
+			key = string(f.bytes)
+		case 2:
+			v, err := decodeOTLPAnyValue(f.bytes)
+			if err != nil {
+				return err
+			}
+			value = v
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if value != "" {
+		attrs[key] = value
+	}
+	return nil
+}
+
+func decodeOTLPResource(b []byte) (map[string]string, error) {
+	attrs := map[string]string{}
+	err := parseProtoFields(b, func(f *protoField) error {
+		if f.num != 1 {
+			return nil
+		}
+		if err := expectWireType(f, protowire.BytesType); err != nil {
+			return err
+		}
+		return decodeOTLPKeyValue(f.bytes, attrs)
+	})
+	return attrs, err
+}
+
+func decodeOTLPNumberPoint(b []byte) (*otlpNumberPoint, error) {
+	pt := &otlpNumberPoint{attrs: map[string]string{}}
+	err := parseProtoFields(b, func(f *protoField) error {
+		switch f.num {
+		case 3:
+			if err := expectWireType(f, protowire.Fixed64Type); err != nil {
+				return err
+			}
+			pt.timestamp = int64(f.fixed)
+		case 4:
+			if err := expectWireType(f, protowire.Fixed64Type); err != nil {
+				return err
+			}
+			pt.value = math.Float64frombits(f.fixed)
+		case 6:
+			if err := expectWireType(f, protowire.Fixed64Type); err != nil {
+				return err
+			}
+			pt.value = float64(int64(f.fixed))
+		case 7:
+			if err := expectWireType(f, protowire.BytesType); err != nil {
+				return err
+			}
+			return decodeOTLPKeyValue(f.bytes, pt.attrs)
+		case 8:
+			if err := expectWireType(f, protowire.VarintType); err != nil {
+				return err
+			}
+			pt.flags = f.varint
+		}
+		return nil
+	})
+	return pt, err
+}
+
+// decodeOTLPFixed64s decodes a packed or unpacked repeated fixed64 field
+func decodeOTLPFixed64s(f *protoField) ([]uint64, error) {
+	if f.typ == protowire.Fixed64Type {
+		return []uint64{f.fixed}, nil
+	}
+	if err := expectWireType(f, protowire.BytesType); err != nil {
+		return nil, err
+	}
+	var vals []uint64
+	for b := f.bytes; len(b) > 0; {
+		v, n := protowire.ConsumeFixed64(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		vals = append(vals, v)
+		b = b[n:]
+	}
+	return vals, nil
+}
+
+func decodeOTLPHistogramPoint(b []byte) (*otlpHistogramPoint, error) {
+	pt := &otlpHistogramPoint{attrs: map[string]string{}}
+	err := parseProtoFields(b, func(f *protoField) error {
+		switch f.num {
+		case 3, 4, 5:
+			if err := expectWireType(f, protowire.Fixed64Type); err != nil {
+				return err
+			}
+			switch f.num {
+			case 3:
+				pt.timestamp = int64(f.fixed)
+			case 4:
+				pt.count = f.fixed
+			case 5:
+				pt.sum, pt.hasSum = math.Float64frombits(f.fixed), true
+			}
+		case 6:
+			vals, err := decodeOTLPFixed64s(f)
+			if err != nil {
+				return err
+			}
+			pt.bucketCounts = append(pt.bucketCounts, vals...)
+		case 7:
+			vals, err := decodeOTLPFixed64s(f)
+			if err != nil {
+				return err
+			}
+			for _, v := range vals {
+				pt.bounds = append(pt.bounds, math.Float64frombits(v))
+			}
+		case 9:
+			if err := expectWireType(f, protowire.BytesType); err != nil {
+				return err
+			}
+			return decodeOTLPKeyValue(f.bytes, pt.attrs)
+		case 10:
+			if err := expectWireType(f, protowire.VarintType); err != nil {
+				return err
+			}
+			pt.flags = f.varint
+		}
+		return nil
+	})
+	return pt, err
+}
+
+// decodeOTLPDataPoints decodes a Gauge, Sum or Histogram message into m
+func decodeOTLPDataPoints(b []byte, m *otlpMetric) error {
+	return parseProtoFields(b, func(f *protoField) error {
+		switch f.num {
+		case 1:
+			if err := expectWireType(f, protowire.BytesType); err != nil {
+				return err
+			}
+			if m.histogram {
+				pt, err := decodeOTLPHistogramPoint(f.bytes)
+				if err != nil {
+					return err
+				}
+				m.histograms = append(m.histograms, pt)
+				return nil
+			}
+			pt, err := decodeOTLPNumberPoint(f.bytes)
+			if err != nil {
+				return err
+			}
+			m.numbers = append(m.numbers, pt)
+		case 2:
+			if err := expectWireType(f, protowire.VarintType); err != nil {
+				return err
+			}
+			m.temporality = int64(f.varint)
+		}
+		return nil
+	})
+}
+
+// countOTLPDataPoints counts the data points of an unsupported metric type
+func countOTLPDataPoints(b []byte) (int64, error) {
+	var n int64
+	err := parseProtoFields(b, func(f *protoField) error {
+		if f.num == 1 {
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+func decodeOTLPMetric(b []byte, resource map[string]string) (*otlpMetric, error) {
+	m := &otlpMetric{resource: resource}
+	err := parseProtoFields(b, func(f *protoField) error {
+		switch f.num {
+		case 1:
+			if err := expectWireType(f, protowire.BytesType); err != nil {
+				return err
+			}
+			m.name = string(f.bytes)
+		case 5, 7, 9:
+			if err := expectWireType(f, protowire.BytesType); err != nil {
+				return err
+			}
+			m.aggregated, m.histogram = f.num != 5, f.num == 9
+			return decodeOTLPDataPoints(f.bytes, m)
+		case 10, 11:
+			// exponential histograms and summaries
+			if err := expectWireType(f, protowire.BytesType); err != nil {
+				return err
+			}
+			n, err := countOTLPDataPoints(f.bytes)
+			m.unsupported += n
+			return err
+		}
+		return nil
+	})
+	return m, err
+}
+
+func decodeOTLPScopeMetrics(b []byte, resource map[string]string) ([]*otlpMetric, error) {
+	metrics := []*otlpMetric{}
+	err := parseProtoFields(b, func(f *protoField) error {
+		if f.num != 2 {
+			return nil
+		}
+		if err := expectWireType(f, protowire.BytesType); err != nil {
+			return err
+		}
+		m, err := decodeOTLPMetric(f.bytes, resource)
+		if err != nil {
+			return err
+		}
+		metrics = append(metrics, m)
+		return nil
+	})
+	return metrics, err
+}
+
+func decodeOTLPResourceMetrics(b []byte) ([]*otlpMetric, error) {
+	var (
+		resource = map[string]string{}
+		scopes   [][]byte
+	)
+	// the resource may follow the scope metrics
+	err := parseProtoFields(b, func(f *protoField) error {
+		switch f.num {
+		case 1:
+			if err := expectWireType(f, protowire.BytesType); err != nil {
+				return err
+			}
+			attrs, err := decodeOTLPResource(f.bytes)
+			if err != nil {
+				return err
+			}
+			resource = attrs
+		case 2:
+			if err := expectWireType(f, protowire.BytesType); err != nil {
+				return err
+			}
+			scopes = append(scopes, f.bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	metrics := []*otlpMetric{}
+	for _, scope := range scopes {
+		scopeMetrics, err := decodeOTLPScopeMetrics(scope, resource)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, scopeMetrics...)
+	}
+	return metrics, nil
+}
+
+// decodeOTLPMetricsRequest decodes a protobuf ExportMetricsServiceRequest
+func decodeOTLPMetricsRequest(b []byte) ([]*otlpMetric, error) {
+	metrics := []*otlpMetric{}
+	err := parseProtoFields(b, func(f *protoField) error {
+		if f.num != 1 {
+			return nil
+		}
+		if err := expectWireType(f, protowire.BytesType); err != nil {
+			return err
+		}
+		resourceMetrics, err := decodeOTLPResourceMetrics(f.bytes)
+		if err != nil {
+			return err
+		}
+		metrics = append(metrics, resourceMetrics...)
+		return nil
+	})
+	return metrics, err
+}
+
+// JSON
+
+// otlpJSONNumber is a number of the OTLP JSON encoding. 64 bit integers are
+// encoded as strings and so are the special float values.
+type otlpJSONNumber string
+
+func (n *otlpJSONNumber) UnmarshalJSON(b []byte) error {
+	var s string
+	if len(b) > 0 && b[0] == '"' {
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+	} else {
+		s = string(b)
+	}
+	*n = otlpJSONNumber(s)
+	return nil
+}
+
+func (n otlpJSONNumber) int64() (int64, error) {
+	if n == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseInt(string(n), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", errOTLPInvalidNumber, n)
+	}
+	return v, nil
+}
+
+func (n otlpJSONNumber) uint64() (uint64, error) {
+	if n == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseUint(string(n), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", errOTLPInvalidNumber, n)
+	}
+	return v, nil
+}
+
+func (n otlpJSONNumber) float64() (float64, error) {
+	switch n {
+	case "":
+		return 0, nil
+	case "NaN":
+		return math.NaN(), nil
+	case "Infinity":
+		return math.Inf(1), nil
+	case "-Infinity":
+		return math.Inf(-1), nil
+	}
+	v, err := strconv.ParseFloat(string(n), 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", errOTLPInvalidNumber, n)
+	}
+	return v, nil
+}
+
+// temporality also accepts the enum value names
+func (n otlpJSONNumber) temporality() (int64, error) {
+	switch n {
+	case "AGGREGATION_TEMPORALITY_DELTA":
+		return otlpTemporalityDelta, nil
+	case "AGGREGATION_TEMPORALITY_CUMULATIVE":
+		return otlpTemporalityCumulative, nil
+	case "AGGREGATION_TEMPORALITY_UNSPECIFIED":
+		return otlpTemporalityUnspecified, nil
+	}
+	return n.int64()
+}
+
+type otlpJSONKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue *string         `json:"stringValue"`
+		BoolValue   *bool           `json:"boolValue"`
+		IntValue    *otlpJSONNumber `json:"intValue"`
+		DoubleValue *otlpJSONNumber `json:"doubleValue"`
+		BytesValue  []byte          `json:"bytesValue"`
+	} `json:"value"`
+}
+
+type otlpJSONNumberPoint struct {
+	Attributes   []*otlpJSONKeyValue `json:"attributes"`
+	TimeUnixNano otlpJSONNumber      `json:"timeUnixNano"`
+	AsDouble     *otlpJSONNumber     `json:"asDouble"`
+	AsInt        *otlpJSONNumber     `json:"asInt"`
+	Flags        uint64              `json:"flags"`
+}
+
+type otlpJSONHistogramPoint struct {
+	Attributes     []*otlpJSONKeyValue `json:"attributes"`
+	TimeUnixNano   otlpJSONNumber      `json:"timeUnixNano"`
+	Count          otlpJSONNumber      `json:"count"`
+	Sum            *otlpJSONNumber     `json:"sum"`
+	BucketCounts   []otlpJSONNumber    `json:"bucketCounts"`
+	ExplicitBounds []otlpJSONNumber    `json:"explicitBounds"`
+	Flags          uint64              `json:"flags"`
+}
+
+type otlpJSONDataPoints struct {
+	DataPoints             []json.RawMessage `json:"dataPoints"`
+	AggregationTemporality otlpJSONNumber    `json:"aggregationTemporality"`
+}
+
+type otlpJSONMetric struct {
+	Name                 string              `json:"name"`
+	Gauge                *otlpJSONDataPoints `json:"gauge"`
+	Sum                  *otlpJSONDataPoints `json:"sum"`
+	Histogram            *otlpJSONDataPoints `json:"histogram"`
+	ExponentialHistogram *otlpJSONDataPoints `json:"exponentialHistogram"`
+	Summary              *otlpJSONDataPoints `json:"summary"`
+}
+
+type otlpJSONRequest struct {
+	ResourceMetrics []*struct {
+		Resource struct {
+			Attributes []*otlpJSONKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeMetrics []*struct {
+			Metrics []*otlpJSONMetric `json:"metrics"`
+		} `json:"scopeMetrics"`
+	} `json:"resourceMetrics"`
+}
+
+func otlpJSONAttributes(kvs []*otlpJSONKeyValue) map[string]string {
+	attrs := map[string]string{}
+	for _, kv := range kvs {
+		var v string
+		switch {
+		case kv.Value.StringValue != nil:
+			v = *kv.Value.StringValue
+		case kv.Value.BoolValue != nil:
+			v = strconv.FormatBool(*kv.Value.BoolValue)
+		case kv.Value.IntValue != nil:
+			v = string(*kv.Value.IntValue)
+		case kv.Value.DoubleValue != nil:
+			v = string(*kv.Value.DoubleValue)
+		case kv.Value.BytesValue != nil:
+			v = hex.EncodeToString(kv.Value.BytesValue)
+		}
+		if v != "" {
+			attrs[kv.Key] = v
+		}
+	}
+	return attrs
+}
+
+func otlpJSONNumberPointToPoint(raw json.RawMessage) (*otlpNumberPoint, error) {
+	jpt := &otlpJSONNumberPoint{}
+	if err := json.Unmarshal(raw, jpt); err != nil {
+		return nil, err
+	}
+	pt := &otlpNumberPoint{attrs: otlpJSONAttributes(jpt.Attributes), flags: jpt.Flags}
+	timestamp, err := jpt.TimeUnixNano.uint64()
+	if err != nil {
+		return nil, err
+	}
+	pt.timestamp = int64(timestamp)
+	switch {
+	case jpt.AsDouble != nil:
+		pt.value, err = jpt.AsDouble.float64()
+	case jpt.AsInt != nil:
+		var v int64
+		v, err = jpt.AsInt.int64()
+		pt.value = float64(v)
+	}
+	return pt, err
+}
+
+func otlpJSONHistogramPointToPoint(raw json.RawMessage) (*otlpHistogramPoint, error) {
+	jpt := &otlpJSONHistogramPoint{}
+	if err := json.Unmarshal(raw, jpt); err != nil {
+		return nil, err
+	}
+	pt := &otlpHistogramPoint{attrs: otlpJSONAttributes(jpt.Attributes), flags: jpt.Flags}
+	timestamp, err := jpt.TimeUnixNano.uint64()
+	if err != nil {
+		return nil, err
+	}
+	pt.timestamp = int64(timestamp)
+	if pt.count, err = jpt.Count.uint64(); err != nil {
+		return nil, err
+	}
+	if jpt.Sum != nil {
+		if pt.sum, err = jpt.Sum.float64(); err != nil {
+			return nil, err
+		}
+		pt.hasSum = true
+	}
+	for _, c := range jpt.BucketCounts {
+		v, err := c.uint64()
+		if err != nil {
+			return nil, err
+		}
+		pt.bucketCounts = append(pt.bucketCounts, v)
+	}
+	for _, b := range jpt.ExplicitBounds {
+		v, err := b.float64()
+		if err != nil {
+			return nil, err
+		}
+		pt.bounds = append(pt.bounds, v)
+	}
+	return pt, nil
+}
+
+func otlpJSONMetricToMetric(jm *otlpJSONMetric, resource map[string]string) (*otlpMetric, error) {
+	m := &otlpMetric{name: jm.Name, resource: resource}
+	var dps *otlpJSONDataPoints
+	switch {
+	case jm.Gauge != nil:
+		dps = jm.Gauge
+	case jm.Sum != nil:
+		dps, m.aggregated = jm.Sum, true
+	case jm.Histogram != nil:
+		dps, m.aggregated, m.histogram = jm.Histogram, true, true
+	case jm.ExponentialHistogram != nil:
+		m.unsupported = int64(len(jm.ExponentialHistogram.DataPoints))
+		return m, nil
+	case jm.Summary != nil:
+		m.unsupported = int64(len(jm.Summary.DataPoints))
+		return m, nil
+	default:
+		return m, nil
+	}
+
+	var err error
+	if m.temporality, err = dps.AggregationTemporality.temporality(); err != nil {
+		return nil, err
+	}
+	for _, raw := range dps.DataPoints {
+		if m.histogram {
+			pt, err := otlpJSONHistogramPointToPoint(raw)
+			if err != nil {
+				return nil, err
+			}
+			m.histograms = append(m.histograms, pt)
+			continue
+		}
+		pt, err := otlpJSONNumberPointToPoint(raw)
+		if err != nil {
+			return nil, err
+		}
+		m.numbers = append(m.numbers, pt)
+	}
+	return m, nil
+}
+
+// decodeOTLPMetricsJSONRequest decodes a JSON ExportMetricsServiceRequest
+func decodeOTLPMetricsJSONRequest(b []byte) ([]*otlpMetric, error) {
+	req := &otlpJSONRequest{}
+	if err := json.Unmarshal(b, req); err != nil {
+		return nil, err
+	}
+	metrics := []*otlpMetric{}
+	for _, rm := range req.ResourceMetrics {
+		resource := otlpJSONAttributes(rm.Resource.Attributes)
+		for _, sm := range rm.ScopeMetrics {
+			for _, jm := range sm.Metrics {
+				m, err := otlpJSONMetricToMetric(jm, resource)
+				if err != nil {
+					return nil, err
+				}
+				metrics = append(metrics, m)
+			}
+		}
+	}
+	return metrics, nil
+}
+
+// conversion
+
+// otlpTags merges the resource and data point attributes, data point
+// attributes win. Names and values are sanitized like prometheus labels.
+func otlpTags(resource, attrs map[string]string, temporality string) map[string]string {
+	tags := make(map[string]string, len(resource)+len(attrs)+1)
+	for _, kvs := range []map[string]string{resource, attrs} {
+		for k, v := range kvs {
+			tags[sanitizeName(k)] = sanitizeName(v)
+		}
+	}
+	if temporality != "" {
+		tags[otlpTemporalityTag] = temporality
+	}
+	return tags
+}
+
+func otlpTimestamp(timestamp, now int64) int64 {
+	if timestamp == 0 {
+		return now
+	}
+	return timestamp
+}
+
+func formatOTLPBound(b float64) string {
+	if math.IsInf(b, 1) {
+		return "inf"
+	}
+	return strconv.FormatFloat(b, 'f', -1, 64)
+}
+
+// otlpMetricsToQueries flattens the metrics into insert queries. Data points
+// that can't be stored are rejected and reported in the result.
+func otlpMetricsToQueries(metrics []*otlpMetric) ([]*insertPointQuery, *otlpExportResult) {
+	now := time.Now().UnixNano()
+	res := &otlpExportResult{}
+	queries := []*insertPointQuery{}
+	for _, m := range metrics {
+		res.reject(m.unsupported, "exponential histograms and summaries are not supported")
+		name := sanitizeName(m.name)
+		if name == "" {
+			res.reject(int64(len(m.numbers)+len(m.histograms)), errMetricRequired.Error())
+			continue
+		}
+
+		var temporality string
+		if m.aggregated {
+			temporality = otlpTemporalityNames[m.temporality]
+			if temporality == "" {
+				res.reject(int64(len(m.numbers)+len(m.histograms)), errOTLPUnspecifiedTemporality.Error())
+				continue
+			}
+		}
+
+		for _, pt := range m.numbers {
+			queries = append(queries, &insertPointQuery{
+				Metric: name,
+				Tags:   otlpTags(m.resource, pt.attrs, temporality),
+				Point: &point{
+					Value:     pt.value,
+					Null:      pt.flags&otlpFlagNoRecordedValue != 0,
+					Timestamp: otlpTimestamp(pt.timestamp, now),
+				},
+			})
+		}
+
+		for _, pt := range m.histograms {
+			if len(pt.bucketCounts) > 0 && len(pt.bucketCounts) != len(pt.bounds)+1 {
+				res.reject(1, errOTLPBucketCountMismatch.Error())
+				continue
+			}
+			tags := otlpTags(m.resource, pt.attrs, temporality)
+			timestamp := otlpTimestamp(pt.timestamp, now)
+			null := pt.flags&otlpFlagNoRecordedValue != 0
+			queries = append(queries, &insertPointQuery{
+				Metric: name + "_count",
+				Tags:   tags,
+				Point:  &point{Value: float64(pt.count), Null: null, Timestamp: timestamp},
+			})
+			if pt.hasSum || null {
+				queries = append(queries, &insertPointQuery{
+					Metric: name + "_sum",
+					Tags:   tags,
+					Point:  &point{Value: pt.sum, Null: null, Timestamp: timestamp},
+				})
+			}
+			if null {
+				continue
+			}
+			// buckets are cumulative like prometheus buckets
+			var cumulative uint64
+			for i, c := range pt.bucketCounts {
+				cumulative += c
+				bound := math.Inf(1)
+				if i < len(pt.bounds) {
+					bound = pt.bounds[i]
+				}
+				bucketTags := make(map[string]string, len(tags)+1)
+				for k, v := range tags {
+					bucketTags[k] = v
+				}
+				bucketTags[otlpBucketBoundTag] = formatOTLPBound(bound)
+				queries = append(queries, &insertPointQuery{
+					Metric: name + "_bucket",
+					Tags:   bucketTags,
+					Point:  &point{Value: float64(cumulative), Timestamp: timestamp},
+				})
+			}
+		}
+	}
+	return queries, res
+}
+
+// responses
+
+// encodeOTLPMetricsResponse encodes an ExportMetricsServiceResponse with a
+// partial success if data points were rejected
+func encodeOTLPMetricsResponse(res *otlpExportResult, isJSON bool) ([]byte, error) {
+	message := strings.Join(res.errors, "; ")
+	if isJSON {
+		resp := map[string]interface{}{}
+		if res.rejected > 0 {
+			resp["partialSuccess"] = map[string]string{
+				"rejectedDataPoints": strconv.FormatInt(res.rejected, 10),
+				"errorMessage":       message,
+			}
+		}
+		return json.Marshal(resp)
+	}
+	var b []byte
+	if res.rejected > 0 {
+		var msg []byte
+		msg = protowire.AppendTag(msg, 1, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(res.rejected))
+		msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+		msg = protowire.AppendString(msg, message)
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, msg)
+	}
+	return b, nil
+}
+
+// google.rpc.Code values of OTLP/HTTP error responses
+const (
+	otlpCodeInvalidArgument = 3
+	otlpCodeUnavailable     = 14
+)
+
+// encodeOTLPStatus encodes a google.rpc.Status as OTLP/HTTP error responses
+func encodeOTLPStatus(code int, message string, isJSON bool) ([]byte, error) {
+	if isJSON {
+		return json.Marshal(map[string]interface{}{
+			"code":    code,
+			"message": message,
+		})
+	}
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(code))
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendString(b, message), nil
+}
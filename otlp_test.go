@@ -0,0 +1,163 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func appendProtoMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func appendProtoFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+func appendOTLPStringAttribute(b []byte, num protowire.Number, key, value string) []byte {
+	var kv []byte
+	kv = appendProtoMessage(kv, 1, []byte(key))
+	kv = appendProtoMessage(kv, 2, appendProtoMessage(nil, 1, []byte(value)))
+	return appendProtoMessage(b, num, kv)
+}
+
+// otlpTestRequest is a protobuf ExportMetricsServiceRequest with a gauge, a
+// delta sum, a cumulative histogram and a summary
+func otlpTestRequest() []byte {
+	var gaugePt []byte
+	gaugePt = appendOTLPStringAttribute(gaugePt, 7, "cpu", "0")
+	gaugePt = appendProtoFixed64(gaugePt, 3, 946684800000000000)
+	gaugePt = appendProtoFixed64(gaugePt, 4, math.Float64bits(0.5))
+	var gauge []byte
+	gauge = appendProtoMessage(gauge, 1, []byte("system.cpu.utilization"))
+	gauge = appendProtoMessage(gauge, 5, appendProtoMessage(nil, 1, gaugePt))
+
+	var sumPt []byte
+	sumPt = appendProtoFixed64(sumPt, 3, 946684800000000000)
+	sumPt = appendProtoFixed64(sumPt, 6, 7)
+	var sumMsg []byte
+	sumMsg = appendProtoMessage(sumMsg, 1, sumPt)
+	sumMsg = protowire.AppendTag(sumMsg, 2, protowire.VarintType)
+	sumMsg = protowire.AppendVarint(sumMsg, otlpTemporalityDelta)
+	var sum []byte
+	sum = appendProtoMessage(sum, 1, []byte("http.requests"))
+	sum = appendProtoMessage(sum, 7, sumMsg)
+
+	var histPt []byte
+	histPt = appendProtoFixed64(histPt, 3, 946684800000000000)
+	histPt = appendProtoFixed64(histPt, 4, 6)
+	histPt = appendProtoFixed64(histPt, 5, math.Float64bits(12.5))
+	var counts, bounds []byte
+	for _, c := range []uint64{1, 2, 3} {
+		counts = protowire.AppendFixed64(counts, c)
+	}
+	for _, v := range []float64{0.5, 1000000} {
+		bounds = protowire.AppendFixed64(bounds, math.Float64bits(v))
+	}
+	histPt = appendProtoMessage(histPt, 6, counts)
+	histPt = appendProtoMessage(histPt, 7, bounds)
+	var histMsg []byte
+	histMsg = appendProtoMessage(histMsg, 1, histPt)
+	histMsg = protowire.AppendTag(histMsg, 2, protowire.VarintType)
+	histMsg = protowire.AppendVarint(histMsg, otlpTemporalityCumulative)
+	var hist []byte
+	hist = appendProtoMessage(hist, 1, []byte("http.duration"))
+	hist = appendProtoMessage(hist, 9, histMsg)
+
+	var summary []byte
+	summary = appendProtoMessage(summary, 1, []byte("rpc.duration"))
+	summary = appendProtoMessage(summary, 11, appendProtoMessage(nil, 1, nil))
+
+	var scope []byte
+	for _, m := range [][]byte{gauge, sum, hist, summary} {
+		scope = appendProtoMessage(scope, 2, m)
+	}
+	var rm []byte
+	rm = appendProtoMessage(rm, 2, scope)
+	rm = appendProtoMessage(rm, 1, appendOTLPStringAttribute(nil, 1, "service.name", "api:v1"))
+	return appendProtoMessage(nil, 1, rm)
+}
+
+var otlpTestQueries = []*insertPointQuery{
+	{
+		Metric: "system.cpu.utilization",
+		Tags:   map[string]string{"service.name": "api_v1", "cpu": "0"},
+		Point:  &point{Value: 0.5, Timestamp: 946684800000000000},
+	},
+	{
+		Metric: "http.requests",
+		Tags:   map[string]string{"service.name": "api_v1", "temporality": "delta"},
+		Point:  &point{Value: 7, Timestamp: 946684800000000000},
+	},
+	{
+		Metric: "http.duration_count",
+		Tags:   map[string]string{"service.name": "api_v1", "temporality": "cumulative"},
+		Point:  &point{Value: 6, Timestamp: 946684800000000000},
+	},
+	{
+		Metric: "http.duration_sum",
+		Tags:   map[string]string{"service.name": "api_v1", "temporality": "cumulative"},
+		Point:  &point{Value: 12.5, Timestamp: 946684800000000000},
+	},
+	{
+		Metric: "http.duration_bucket",
+		Tags:   map[string]string{"service.name": "api_v1", "temporality": "cumulative", "le": "0.5"},
+		Point:  &point{Value: 1, Timestamp: 946684800000000000},
+	},
+	{
+		Metric: "http.duration_bucket",
+		Tags:   map[string]string{"service.name": "api_v1", "temporality": "cumulative", "le": "1000000"},
+		Point:  &point{Value: 3, Timestamp: 946684800000000000},
+	},
+	{
+		Metric: "http.duration_bucket",
+		Tags:   map[string]string{"service.name": "api_v1", "temporality": "cumulative", "le": "inf"},
+		Point:  &point{Value: 6, Timestamp: 946684800000000000},
+	},
+}
+
+func TestOTLPMetricsToQueries(t *testing.T) {
+	metrics, err := decodeOTLPMetricsRequest(otlpTestRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries, res := otlpMetricsToQueries(metrics)
+	require.Equal(t, otlpTestQueries, queries)
+	require.Equal(t, &otlpExportResult{
+		rejected: 1,
+		errors:   []string{"exponential histograms and summaries are not supported"},
+	}, res)
+
+	_, res = otlpMetricsToQueries([]*otlpMetric{
+		{name: "a", aggregated: true, numbers: []*otlpNumberPoint{{value: 1}}},
+		{name: "b", aggregated: true, histogram: true, temporality: otlpTemporalityDelta, histograms: []*otlpHistogramPoint{{bucketCounts: []uint64{1}, bounds: []float64{1}}}},
+	})
+	require.Equal(t, int64(2), res.rejected)
+}
+
+func TestDecodeOTLPMetricsJSONRequest(t *testing.T) {
+	body := `{"resourceMetrics":[{
+		"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"api:v1"}}]},
+		"scopeMetrics":[{"metrics":[
+			{"name":"system.cpu.utilization","gauge":{"dataPoints":[{"attributes":[{"key":"cpu","value":{"intValue":"0"}}],"timeUnixNano":"946684800000000000","asDouble":0.5}]}},
+			{"name":"http.requests","sum":{"aggregationTemporality":1,"isMonotonic":true,"dataPoints":[{"timeUnixNano":"946684800000000000","asInt":"7"}]}},
+			{"name":"http.duration","histogram":{"aggregationTemporality":"AGGREGATION_TEMPORALITY_CUMULATIVE","dataPoints":[{"timeUnixNano":"946684800000000000","count":"6","sum":12.5,"bucketCounts":["1","2","3"],"explicitBounds":[0.5,1000000]}]}},
+			{"name":"rpc.duration","summary":{"dataPoints":[{}]}}
+		]}]
+	}]}`
+	metrics, err := decodeOTLPMetricsJSONRequest([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries, res := otlpMetricsToQueries(metrics)
+	require.Equal(t, otlpTestQueries, queries)
+	require.Equal(t, int64(1), res.rejected)
+
+	if _, err := decodeOTLPMetricsJSONRequest([]byte(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"a","gauge":{"dataPoints":[{"asInt":"x"}]}}]}]}]}`)); err == nil {
+		t.Fatal("expected error for invalid number")
+	}
+}
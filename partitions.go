@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	partitionWidth               = 24 * time.Hour
+	partitionsPrecreate          = 3
+	partitionManagerInterval     = time.Minute
+	partitionBoundRe             = regexp.MustCompile(`FROM \('?(-?[0-9]+)'?\) TO \('?(-?[0-9]+)'?\)`)
+	metricsPartitions            = &partitionRanges{}
+	errPartitionWidthNotPositive = errors.New("partition width must be positive")
+)
+
+type partitionRange struct {
+	name  string
+	start int64
+	end   int64
+}
+
+// partitionRanges is the in-process view of the metrics table partitions,
+// sorted by start.
+type partitionRanges struct {
+	mu     sync.Mutex
+	ranges []*partitionRange
+}
+
+func sortPartitionRanges(ranges []*partitionRange) {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+}
+
+func (p *partitionRanges) set(ranges []*partitionRange) {
+	sortPartitionRanges(ranges)
+	p.mu.Lock()
+	p.ranges = ranges
+	p.mu.Unlock()
+}
+
+func (p *partitionRanges) list() []*partitionRange {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*partitionRange{}, p.ranges...)
+}
+
+// find returns the index of the first partition with start > ts and whether
+// the partition before it contains ts. p.mu must be held.
+func (p *partitionRanges) find(ts int64) (int, bool) {
+	i := sort.Search(len(p.ranges), func(i int) bool {
+		return p.ranges[i].start > ts
+	})
+	return i, i > 0 && p.ranges[i-1].end > ts
+}
+
+func partitionStart(ts, width int64) int64 {
+	return ts - ((ts%width)+width)%width
+}
+
+func partitionName(start int64) string {
+	t := time.Unix(0, start).UTC()
+	name := fmt.Sprintf("%s_p%s", metricsTable, t.Format("20060102t150405"))
+	if start%int64(time.Second) != 0 {
+		name += fmt.Sprintf("_%09d", t.Nanosecond())
+	}
+	return name
+}
+
+func createPartitionQuery(name string, start, end int64) string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM (%d) TO (%d)", name, metricsTable, start, end)
+}
+
+func selectPartitions(session queryer) ([]*partitionRange, error) {
+	scanner, err := session.Query(`
+SELECT c.relname, pg_get_expr(c.relpartbound, c.oid)
+FROM pg_inherits i
+JOIN pg_class c ON c.oid = i.inhrelid
+JOIN pg_class p ON p.oid = i.inhparent
+WHERE p.relname = $1`, metricsTable)
+	if err != nil {
+		return nil, err
+	}
+	defer scanner.Close()
+
+	ranges := []*partitionRange{}
+	var (
+		name  string
+		bound string
+	)
+	for scanner.Next() {
+		if err := scanner.Scan(&name, &bound); err != nil {
+			return nil, err
+		}
+		m := partitionBoundRe.FindStringSubmatch(bound)
+		if m == nil {
+			continue
+		}
+		r := &partitionRange{name: name}
+		if r.start, err = strconv.ParseInt(m[1], 10, 64); err != nil {
+			return nil, err
+		}
+		if r.end, err = strconv.ParseInt(m[2], 10, 64); err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ranges, nil
+}
+
+func loadPartitions(session queryer) error {
+	ranges, err := selectPartitions(session)
+	if err != nil {
+		return err
+	}
+	metricsPartitions.set(ranges)
+	return nil
+}
+
+// ensurePartitions creates the partitions needed to store the given
+// timestamps. New partitions are width aligned but clipped so they never
+// overlap existing ones, e.g. after the configured width changed.
+func ensurePartitions(session queryer, timestamps []int64) error {
+	width := partitionWidth.Nanoseconds()
+	p := metricsPartitions
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, ts := range timestamps {
+		i, ok := p.find(ts)
+		if ok {
+			continue
+		}
+		start, end := partitionStart(ts, width), partitionStart(ts, width)+width
+		if i > 0 && p.ranges[i-1].end > start {
+			start = p.ranges[i-1].end
+		}
+		if i < len(p.ranges) && p.ranges[i].start < end {
+			end = p.ranges[i].start
+		}
+		r := &partitionRange{name: partitionName(start), start: start, end: end}
+		if _, err := session.Exec(createPartitionQuery(r.name, r.start, r.end)); err != nil {
+			// another instance may have created an overlapping partition,
+			// reload so the next attempt sees it
+			if ranges, err0 := selectPartitions(session); err0 == nil {
+				sortPartitionRanges(ranges)
+				p.ranges = ranges
+			}
+			return err
+		}
+		log.Infof("created partition %s [%d, %d)", r.name, r.start, r.end)
+		p.ranges = append(p.ranges, nil)
+		copy(p.ranges[i+1:], p.ranges[i:])
+		p.ranges[i] = r
+	}
+	return nil
+}
+
+func insertQueriesTimestamps(queries []*insertPointQuery) []int64 {
+	timestamps := make([]int64, len(queries))
+	for i, query := range queries {
+		timestamps[i] = query.Point.Timestamp
+	}
+	return timestamps
+}
+
+// managePartitions keeps the partition cache in sync with the database and
+// pre-creates the upcoming partitions so inserts of current data never have
+// to wait on DDL.
+func managePartitions(db *dbConn) {
+	for {
+		err := db.Query(priorityCRUD, func(session *sql.DB) error {
+			if err := loadPartitions(session); err != nil {
+				return err
+			}
+			now := time.Now().UnixNano()
+			timestamps := []int64{}
+			for i := 0; i <= partitionsPrecreate; i++ {
+				timestamps = append(timestamps, now+int64(i)*partitionWidth.Nanoseconds())
+			}
+			return ensurePartitions(session, timestamps)
+		})
+		if err != nil {
+			log.Errorf("managePartitions: %s", err)
+		}
+		time.Sleep(partitionManagerInterval)
+	}
+}
+
+func partitionedMetricsMigration(session queryer) ([]string, error) {
+	var relkind string
+	row := session.QueryRow("SELECT relkind FROM pg_class WHERE relname = $1", metricsTable)
+	if err := row.Scan(&relkind); err != nil {
+		return nil, err
+	}
+	if relkind == "p" {
+		return []string{}, nil
+	}
+
+	width := partitionWidth.Nanoseconds()
+	if width <= 0 {
+		return nil, errPartitionWidthNotPositive
+	}
+	unpartitionedTable := metricsTable + "_unpartitioned"
+	stmts := []string{
+		fmt.Sprintf(`ALTER TABLE %s RENAME TO %s`, metricsTable, unpartitionedTable),
+		fmt.Sprintf(`
+CREATE TABLE %s (
+	series_id bigint NOT NULL,
+	timestamp bigint NOT NULL,
+	value double precision,
+	CONSTRAINT %s_series_timestamp_key UNIQUE(series_id, timestamp)
+) PARTITION BY RANGE (timestamp)`, metricsTable, metricsTable),
+	}
+
+	// create a partition for every width aligned range that holds data
+	scanner, err := session.Query(fmt.Sprintf(`SELECT DISTINCT timestamp - ((timestamp %% $1) + $1) %% $1 FROM %s ORDER BY 1`, metricsTable), width)
+	if err != nil {
+		return nil, err
+	}
+	defer scanner.Close()
+	var start int64
+	for scanner.Next() {
+		if err := scanner.Scan(&start); err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, createPartitionQuery(partitionName(start), start, start+width))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return append(stmts,
+		fmt.Sprintf(`INSERT INTO %s (series_id,timestamp,value) SELECT series_id, timestamp, value FROM %s`, metricsTable, unpartitionedTable),
+		fmt.Sprintf(`DROP TABLE %s`, unpartitionedTable),
+	), nil
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"database/sql"
+	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -12,14 +14,21 @@ import (
 )
 
 var (
-	db0                        *dbConn
+	db0                        Storage
 	downsamplersCountTest      chan int
 	downsamplersCancelWaitTest []chan struct{}
 )
 
+// TestMain runs the storage tests against Postgres when a dev config is
+// present and against the in-memory storage otherwise
 func TestMain(t *testing.T) {
 	log.SetLevel(log.FatalLevel)
 	cfg := map[string]string{}
+	if _, err := os.Stat("./config/simpletsdb-dev.conf"); err != nil {
+		db0 = newMemStorage()
+		downsamplersCountTest, downsamplersCancelWaitTest = initStorage(db0)
+		return
+	}
 	if err := loadConfig("./config/simpletsdb-dev.conf", cfg); err != nil {
 		t.Fatal(err)
 	}
@@ -31,9 +40,11 @@ func TestMain(t *testing.T) {
 	if p, ok := cfg["postgres_password"]; ok {
 		pgPassword = p
 	}
-	db0, downsamplersCountTest, downsamplersCancelWaitTest = initDB(cfg["postgres_username"], pgPassword, cfg["postgres_host"], port, cfg["postgres_db"]+"_test", cfg["postgres_ssl_mode"], 1)
+	db := initDB(cfg["postgres_username"], pgPassword, cfg["postgres_host"], port, cfg["postgres_db"]+"_test", cfg["postgres_ssl_mode"], 1)
+	db0 = &pgStorage{db: db}
+	downsamplersCountTest, downsamplersCancelWaitTest = initStorage(db0)
 
-	err = db0.Query(0, func(db *sql.DB) error {
+	err = db.Query(0, func(db *sql.DB) error {
 		_, err = db.Exec("DELETE FROM simpletsdb_metrics WHERE true")
 		return err
 	})
@@ -330,3 +341,436 @@ func TestWindowAggregator(t *testing.T) {
 		{Value: 2, Timestamp: baseTime.Add(time.Minute * 10).UnixNano(), Window: baseAlignedTime + windowDur*2},
 	}, points)
 }
+
+func TestInsertCreatesPartitions(t *testing.T) {
+	if _, ok := db0.(*pgStorage); !ok {
+		t.Skip("partitions are specific to the postgres storage")
+	}
+	baseTime := mustParseTime("1999-06-01T12:00:00Z")
+	if err := insertPoints(db0, []*insertPointQuery{
+		{
+			Metric: "test_partitions",
+			Point: &point{
+				Value:     1,
+				Timestamp: baseTime.UnixNano(),
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	width := partitionWidth.Nanoseconds()
+	found := false
+	for _, r := range metricsPartitions.list() {
+		if r.start <= baseTime.UnixNano() && r.end > baseTime.UnixNano() {
+			found = true
+			require.Equal(t, partitionStart(baseTime.UnixNano(), width), r.start)
+		}
+	}
+	if !found {
+		t.Fatal("expected partition for inserted point")
+	}
+
+	ts, err := db0.FirstTimestamp("test_partitions", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, baseTime.UnixNano(), ts)
+}
+
+func TestInsertOnConflict(t *testing.T) {
+	ts := mustParseTime("2000-01-01T00:00:00Z").UnixNano()
+	query := func(value float64, null bool) []*insertPointQuery {
+		return []*insertPointQuery{{Metric: "test_on_conflict", Point: &point{Value: value, Null: null, Timestamp: ts}}}
+	}
+	for _, c := range []struct {
+		queries     []*insertPointQuery
+		onConflict  string
+		inserted    int64
+		overwritten int64
+		expected    *point
+	}{
+		{query(1, false), onConflictIgnore, 1, 0, &point{Value: 1, Timestamp: ts}},
+		{query(2, false), onConflictIgnore, 0, 0, &point{Value: 1, Timestamp: ts}},
+		{query(3, false), onConflictOverwrite, 0, 1, &point{Value: 3, Timestamp: ts}},
+		{append(query(2, false), query(0, true)...), onConflictSum, 0, 2, &point{Value: 5, Timestamp: ts}},
+	} {
+		inserted, overwritten, err := insertPointsWithMode(db0, c.queries, c.onConflict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, c.inserted, inserted, c.onConflict)
+		require.Equal(t, c.overwritten, overwritten, c.onConflict)
+		pts, err := queryPoints(db0, priorityCRUD, &pointsQuery{Metric: "test_on_conflict", Start: ts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, []*point{c.expected}, pts, c.onConflict)
+	}
+
+	if _, _, err := insertPointsWithMode(db0, query(1, false), onConflictError); err != errPointExists {
+		t.Fatalf("expected %s, got %v", errPointExists, err)
+	}
+}
+
+func TestInsertOnConflictCompressed(t *testing.T) {
+	pg, ok := db0.(*pgStorage)
+	if !ok {
+		t.Skip("chunks are specific to the postgres storage")
+	}
+	ts := mustParseTime("2000-01-01T00:00:00Z").UnixNano()
+	minute := time.Minute.Nanoseconds()
+	query := func(value float64, timestamp int64) []*insertPointQuery {
+		return []*insertPointQuery{{Metric: "test_on_conflict_compressed", Point: &point{Value: value, Timestamp: timestamp}}}
+	}
+	// chunks outlive the metrics table cleanup of TestMain
+	if err := db0.DeletePoints(&deletePointsQuery{Metric: "test_on_conflict_compressed", Start: ts, End: ts + time.Hour.Nanoseconds()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := insertPoints(db0, append(query(1, ts), query(2, ts+2*minute)...)); err != nil {
+		t.Fatal(err)
+	}
+	compress := func() {
+		err := pg.db.Query(priorityCRUD, func(session *sql.DB) error {
+			seriesIDs, err := selectSeriesIDs(session, "test_on_conflict_compressed", nil)
+			if err != nil {
+				return err
+			}
+			_, err = compressSeries(session, seriesIDs[0], ts+time.Hour.Nanoseconds())
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	compress()
+
+	for _, c := range []struct {
+		queries     []*insertPointQuery
+		onConflict  string
+		inserted    int64
+		overwritten int64
+		expected    float64
+	}{
+		{query(5, ts), onConflictIgnore, 0, 0, 1},
+		{query(3, ts), onConflictOverwrite, 0, 1, 3},
+		{query(2, ts), onConflictSum, 0, 1, 5},
+	} {
+		inserted, overwritten, err := insertPointsWithMode(db0, c.queries, c.onConflict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, c.inserted, inserted, c.onConflict)
+		require.Equal(t, c.overwritten, overwritten, c.onConflict)
+		pts, err := queryPoints(db0, priorityCRUD, &pointsQuery{Metric: "test_on_conflict_compressed", Start: ts, End: ts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, []*point{{Value: c.expected, Timestamp: ts}}, pts, c.onConflict)
+	}
+	if _, _, err := insertPointsWithMode(db0, query(1, ts+2*minute), onConflictError); err != errPointExists {
+		t.Fatalf("expected %s, got %v", errPointExists, err)
+	}
+
+	// a new point within the chunk's range and an overwrite through COPY
+	inserted, _, err := insertPointsWithMode(db0, query(7, ts+minute), onConflictError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, int64(1), inserted)
+	body := `[{"metric":"test_on_conflict_compressed","point":{"value":4,"timestamp":` + strconv.FormatInt(ts+2*minute, 10) + `}}]`
+	_, inserted, overwritten, err := streamPoints(pg, newPointsIterator("application/json", strings.NewReader(body)), onConflictOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, int64(0), inserted)
+	require.Equal(t, int64(1), overwritten)
+
+	compress()
+	pts, err := queryPoints(db0, priorityCRUD, &pointsQuery{Metric: "test_on_conflict_compressed", Start: ts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*point{
+		{Value: 5, Timestamp: ts},
+		{Value: 7, Timestamp: ts + minute},
+		{Value: 4, Timestamp: ts + 2*minute},
+	}, pts)
+}
+
+func TestStreamPointsCompressedBatches(t *testing.T) {
+	pg, ok := db0.(*pgStorage)
+	if !ok {
+		t.Skip("chunks are specific to the postgres storage")
+	}
+	ts := mustParseTime("2000-01-01T00:00:00Z").UnixNano()
+	minute := time.Minute.Nanoseconds()
+	metric := "test_stream_compressed_batches"
+	if err := db0.DeletePoints(&deletePointsQuery{Metric: metric, Start: ts, End: ts + time.Hour.Nanoseconds()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := insertPoints(db0, []*insertPointQuery{
+		{Metric: metric, Point: &point{Value: 0, Timestamp: ts}},
+		{Metric: metric, Point: &point{Value: 0, Timestamp: ts + 10*minute}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	err := pg.db.Query(priorityCRUD, func(session *sql.DB) error {
+		seriesIDs, err := selectSeriesIDs(session, metric, nil)
+		if err != nil {
+			return err
+		}
+		_, err = compressSeries(session, seriesIDs[0], ts+time.Hour.Nanoseconds())
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the points within the chunk's range are merged over several fetches
+	defer func(size int) { streamChunkBatchSize = size }(streamChunkBatchSize)
+	streamChunkBatchSize = 2
+	var body strings.Builder
+	expected := []*point{{Value: 0, Timestamp: ts}}
+	for i := int64(1); i <= 5; i++ {
+		body.WriteString(`{"metric":"` + metric + `","point":{"value":` + strconv.FormatInt(i, 10) + `,"timestamp":` + strconv.FormatInt(ts+i*minute, 10) + "}}\n")
+		expected = append(expected, &point{Value: float64(i), Timestamp: ts + i*minute})
+	}
+	expected = append(expected, &point{Value: 10, Timestamp: ts + 10*minute})
+	body.WriteString(`{"metric":"` + metric + `","point":{"value":10,"timestamp":` + strconv.FormatInt(ts+10*minute, 10) + "}}\n")
+	body.WriteString(`{"metric":"` + metric + `","point":{"value":20,"timestamp":` + strconv.FormatInt(ts+20*minute, 10) + "}}\n")
+	expected = append(expected, &point{Value: 20, Timestamp: ts + 20*minute})
+	read, inserted, overwritten, err := streamPoints(pg, newPointsIterator("application/x-ndjson", strings.NewReader(body.String())), onConflictOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, int64(7), read)
+	require.Equal(t, int64(6), inserted)
+	require.Equal(t, int64(1), overwritten)
+	pts, err := queryPoints(db0, priorityCRUD, &pointsQuery{Metric: metric, Start: ts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, expected, pts)
+}
+
+func TestQueryGroupedPoints(t *testing.T) {
+	baseTime := mustParseTime("2000-01-01T00:00:00Z")
+	ipts := []*insertPointQuery{}
+	for i, tags := range []map[string]string{
+		{"id": "1", "type": "high"},
+		{"id": "2", "type": "high"},
+		{"id": "3", "type": "low"},
+	} {
+		for j := 0; j < 4; j++ {
+			ipts = append(ipts, &insertPointQuery{
+				Metric: "test_group_by",
+				Tags:   tags,
+				Point:  &point{Value: float64(i*10 + j), Timestamp: baseTime.Add(time.Duration(j) * time.Minute).UnixNano()},
+			})
+		}
+	}
+	if err := insertPoints(db0, ipts); err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := queryGroupedPoints(db0, priorityCRUD, &pointsQuery{
+		Metric:      "test_group_by",
+		Tags:        map[string]string{"type": "high"},
+		GroupBy:     groupByTags{"id"},
+		Start:       baseTime.UnixNano(),
+		End:         baseTime.Add(time.Hour).UnixNano(),
+		Window:      map[string]interface{}{"every": "2m"},
+		Aggregators: []*aggregatorQuery{{Name: "max"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Len(t, groups, 2)
+	require.Equal(t, map[string]string{"id": "1", "type": "high"}, groups[0].Tags)
+	require.Equal(t, map[string]string{"id": "2", "type": "high"}, groups[1].Tags)
+	require.Equal(t, []*point{
+		{Value: 1, Timestamp: baseTime.UnixNano()},
+		{Value: 3, Timestamp: baseTime.Add(2 * time.Minute).UnixNano()},
+	}, groups[0].Points)
+
+	groups, err = queryGroupedPoints(db0, priorityCRUD, &pointsQuery{
+		Metric:  "test_group_by",
+		GroupBy: groupByTags{"type"},
+		Start:   baseTime.UnixNano(),
+		N:       3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Len(t, groups, 2)
+	require.Equal(t, map[string]string{"type": "high"}, groups[0].Tags)
+	require.Len(t, groups[0].Points, 3)
+	require.Equal(t, groups[0].Points[0].Timestamp, groups[0].Points[1].Timestamp)
+
+	groups, err = queryGroupedPoints(db0, priorityCRUD, &pointsQuery{
+		Metric:  "test_group_by",
+		GroupBy: groupByTags{"*"},
+		Start:   baseTime.UnixNano(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Len(t, groups, 3)
+	require.Equal(t, map[string]string{"id": "3", "type": "low"}, groups[2].Tags)
+}
+
+func TestDownsampleGroupBy(t *testing.T) {
+	baseTime := mustParseTime("2000-01-01T00:00:00Z")
+	ipts := []*insertPointQuery{}
+	for _, id := range []string{"1", "2"} {
+		for i := 0; i < 60; i++ {
+			ipts = append(ipts, &insertPointQuery{
+				Metric: "test_downsample_group_by",
+				Tags:   map[string]string{"id": id},
+				Point:  &point{Value: float64(i), Timestamp: baseTime.Add(time.Duration(i) * time.Minute).UnixNano()},
+			})
+		}
+	}
+	if err := insertPoints(db0, ipts); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := downsample(db0, &downsampler{
+		Metric:      "test_downsample_group_by",
+		OutMetric:   "test_downsample_group_by_15m",
+		RunEvery:    "15m",
+		RunEveryDur: time.Minute * 15,
+		Query: &downsampleQuery{
+			GroupBy:     groupByTags{"id"},
+			Window:      map[string]interface{}{"every": "15m"},
+			Aggregators: []*aggregatorQuery{{Name: "mean"}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"1", "2"} {
+		pts, err := queryPoints(db0, priorityCRUD, &pointsQuery{
+			Metric: "test_downsample_group_by_15m",
+			Tags:   map[string]string{"id": id},
+			Start:  baseTime.UnixNano(),
+			End:    baseTime.Add(time.Hour).UnixNano(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Len(t, pts, 4)
+		require.Equal(t, float64(7), pts[0].Value)
+	}
+}
+
+func TestQueryAndDeletePointsFilter(t *testing.T) {
+	baseTime := mustParseTime("2000-01-01T00:00:00Z")
+	ipts := []*insertPointQuery{}
+	for i, tags := range []map[string]string{
+		{"host": "web1", "dc": "eu1"},
+		{"host": "web2", "dc": "us1"},
+		{"host": "db1"},
+	} {
+		ipts = append(ipts, &insertPointQuery{
+			Metric: "test_filter",
+			Tags:   tags,
+			Point:  &point{Value: float64(i), Timestamp: baseTime.Add(time.Duration(i) * time.Minute).UnixNano()},
+		})
+	}
+	if err := insertPoints(db0, ipts); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(filter string) []float64 {
+		pts, err := queryPoints(db0, priorityCRUD, &pointsQuery{Metric: "test_filter", Filter: filter, Start: baseTime.UnixNano()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := []float64{}
+		for _, pt := range pts {
+			values = append(values, pt.Value)
+		}
+		return values
+	}
+	require.Equal(t, []float64{0, 1}, query(`host =~ '^web'`))
+	require.Equal(t, []float64{1, 2}, query(`dc != eu1`))
+	require.Equal(t, []float64{0, 2}, query(`dc in [eu1] or dc not exists`))
+	require.Equal(t, []float64{1}, query(`host !~ '1$' and dc exists`))
+
+	if _, err := queryPoints(db0, priorityCRUD, &pointsQuery{Metric: "test_filter", Filter: "host =", Start: baseTime.UnixNano()}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if err := deletePoints(db0, &deletePointsQuery{Metric: "test_filter", Filter: `host not in [web1, db1]`, Start: baseTime.UnixNano(), End: baseTime.Add(time.Hour).UnixNano()}); err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []float64{0, 2}, query(""))
+}
+
+func TestSelectSeries(t *testing.T) {
+	if err := insertPoints(db0, []*insertPointQuery{
+		{Metric: "test_select_series", Tags: map[string]string{"host": "a"}, Point: &point{Value: 1, Timestamp: 946684800000000000}},
+		{Metric: "test_select_series", Tags: map[string]string{"host": "b"}, Point: &point{Value: 1, Timestamp: 946684860000000000}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	series, err := listSeries(db0, &discoveryQuery{metric: "test_select_series"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []map[string]string{{"host": "a"}, {"host": "b"}}, series)
+
+	series, err = listSeries(db0, &discoveryQuery{metric: "test_select_series", start: 946684830000000000, end: 946684890000000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []map[string]string{{"host": "b"}}, series)
+}
+
+func TestRetentionTrimsCompressed(t *testing.T) {
+	pg, ok := db0.(*pgStorage)
+	if !ok {
+		t.Skip("chunks are specific to the postgres storage")
+	}
+	ts := mustParseTime("2000-01-01T00:00:00Z").UnixNano()
+	minute := time.Minute.Nanoseconds()
+	if err := db0.DeletePoints(&deletePointsQuery{Metric: "test_retention_compressed", Start: ts, End: ts + time.Hour.Nanoseconds()}); err != nil {
+		t.Fatal(err)
+	}
+	ipts := []*insertPointQuery{}
+	for i := int64(0); i < 4; i++ {
+		ipts = append(ipts, &insertPointQuery{Metric: "test_retention_compressed", Point: &point{Value: float64(i), Timestamp: ts + i*minute}})
+	}
+	if err := insertPoints(db0, ipts); err != nil {
+		t.Fatal(err)
+	}
+	err := pg.db.Query(priorityCRUD, func(session *sql.DB) error {
+		seriesIDs, err := selectSeriesIDs(session, "test_retention_compressed", nil)
+		if err != nil {
+			return err
+		}
+		_, err = compressSeries(session, seriesIDs[0], ts+time.Hour.Nanoseconds())
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the chunk straddles the cutoff
+	policies := []*retentionPolicy{{Metric: "test_retention_compressed", RetentionDur: time.Hour}}
+	n, err := deleteExpiredPoints(pg.db, policies, ts+2*minute+time.Hour.Nanoseconds())
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, int64(2), n)
+	pts, err := queryPoints(db0, priorityCRUD, &pointsQuery{Metric: "test_retention_compressed", Start: ts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*point{
+		{Value: 2, Timestamp: ts + 2*minute},
+		{Value: 3, Timestamp: ts + 3*minute},
+	}, pts)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// A restricted unpickler for the Graphite pickle protocol. Only the opcodes
+// needed for lists and tuples of strings and numbers are supported, opcodes
+// that import or call Python objects are rejected.
+
+var (
+	errPickleTruncated     = errors.New("pickle data is truncated")
+	errPickleStackUnderrun = errors.New("pickle stack underrun")
+	errPickleMarkNotFound  = errors.New("pickle mark not found")
+	errPickleNoStop        = errors.New("pickle data doesn't end with STOP")
+	errPickleNotAppendable = errors.New("pickle append to non list")
+	errPickleBadMemo       = errors.New("pickle memo key not found")
+)
+
+// pickleList is a Python list. Lists are mutated by APPEND after they're
+// memoized, so they're kept by reference.
+type pickleList struct {
+	items []interface{}
+}
+
+type pickleMark struct{}
+
+type unpickler struct {
+	data  []byte
+	pos   int
+	stack []interface{}
+	memo  map[int64]interface{}
+}
+
+func (u *unpickler) read(n int) ([]byte, error) {
+	if n < 0 || n > len(u.data)-u.pos {
+		return nil, errPickleTruncated
+	}
+	b := u.data[u.pos : u.pos+n]
+	u.pos += n
+	return b, nil
+}
+
+func (u *unpickler) readLine() (string, error) {
+	i := bytes.IndexByte(u.data[u.pos:], '\n')
+	if i < 0 {
+		return "", errPickleTruncated
+	}
+	line := string(u.data[u.pos : u.pos+i])
+	u.pos += i + 1
+	return line, nil
+}
+
+func (u *unpickler) push(v interface{}) {
+	u.stack = append(u.stack, v)
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, errPickleStackUnderrun
+	}
+	v := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	return v, nil
+}
+
+func (u *unpickler) top() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, errPickleStackUnderrun
+	}
+	return u.stack[len(u.stack)-1], nil
+}
+
+// popMark pops the items above the topmost mark and the mark
+func (u *unpickler) popMark() ([]interface{}, error) {
+	for i := len(u.stack) - 1; i >= 0; i-- {
+		if _, ok := u.stack[i].(pickleMark); ok {
+			items := append([]interface{}{}, u.stack[i+1:]...)
+			u.stack = u.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, errPickleMarkNotFound
+}
+
+func (u *unpickler) popN(n int) ([]interface{}, error) {
+	if len(u.stack) < n {
+		return nil, errPickleStackUnderrun
+	}
+	items := append([]interface{}{}, u.stack[len(u.stack)-n:]...)
+	u.stack = u.stack[:len(u.stack)-n]
+	return items, nil
+}
+
+func (u *unpickler) appendItems(items []interface{}) error {
+	v, err := u.top()
+	if err != nil {
+		return err
+	}
+	l, ok := v.(*pickleList)
+	if !ok {
+		return errPickleNotAppendable
+	}
+	l.items = append(l.items, items...)
+	return nil
+}
+
+func (u *unpickler) memoize(key int64) error {
+	v, err := u.top()
+	if err != nil {
+		return err
+	}
+	u.memo[key] = v
+	return nil
+}
+
+func (u *unpickler) get(key int64) error {
+	v, ok := u.memo[key]
+	if !ok {
+		return fmt.Errorf("%s: %d", errPickleBadMemo, key)
+	}
+	u.push(v)
+	return nil
+}
+
+func (u *unpickler) readUint(n int) (uint64, error) {
+	b, err := u.read(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for i := n - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, nil
+}
+
+// readPrefixed reads bytes prefixed by their length in size bytes. Lengths
+// are capped by graphitePickleMaxLength before converting them to int.
+func (u *unpickler) readPrefixed(size int) ([]byte, error) {
+	n, err := u.readUint(size)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(graphitePickleMaxLength) {
+		return nil, errGraphitePickleTooLong
+	}
+	return u.read(int(n))
+}
+
+// decodePickleLong decodes a little endian two's complement integer
+func decodePickleLong(b []byte) interface{} {
+	if len(b) == 0 {
+		return int64(0)
+	}
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	n := new(big.Int).SetBytes(be)
+	if b[len(b)-1]&0x80 != 0 {
+		n.Sub(n, new(big.Int).Lsh(big.NewInt(1), uint(len(b)*8)))
+	}
+	if n.IsInt64() {
+		return n.Int64()
+	}
+	f, _ := new(big.Float).SetInt(n).Float64()
+	return f
+}
+
+// unquotePickleString unquotes the Python repr of a protocol 0 string
+func unquotePickleString(s string) string {
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		s = s[1 : len(s)-1]
+	}
+	if unquoted, err := strconv.Unquote(`"` + strings.ReplaceAll(s, `"`, `\"`) + `"`); err == nil {
+		return unquoted
+	}
+	return s
+}
+
+// unpickle decodes pickle data into nil, bool, int64, float64, string,
+// []interface{} for tuples and *pickleList for lists
+func unpickle(data []byte) (interface{}, error) {
+	u := &unpickler{data: data, memo: map[int64]interface{}{}}
+	for u.pos < len(u.data) {
+		op := u.data[u.pos]
+		u.pos++
+		var err error
+		switch op {
+		case 0x80: // PROTO
+			_, err = u.read(1)
+		case 0x95: // FRAME
+			_, err = u.read(8)
+		case '.': // STOP
+			return u.pop()
+		case '(': // MARK
+			u.push(pickleMark{})
+		case '0': // POP
+			_, err = u.pop()
+		case '1': // POP_MARK
+			_, err = u.popMark()
+		case '2': // DUP
+			var v interface{}
+			if v, err = u.top(); err == nil {
+				u.push(v)
+			}
+		case 'N': // NONE
+			u.push(nil)
+		case 0x88: // NEWTRUE
+			u.push(true)
+		case 0x89: // NEWFALSE
+			u.push(false)
+		case 'I': // INT
+			var line string
+			if line, err = u.readLine(); err != nil {
+				break
+			}
+			switch line {
+			case "01":
+				u.push(true)
+			case "00":
+				u.push(false)
+			default:
+				var v int64
+				if v, err = strconv.ParseInt(line, 10, 64); err == nil {
+					u.push(v)
+				}
+			}
+		case 'L': // LONG
+			var line string
+			if line, err = u.readLine(); err != nil {
+				break
+			}
+			var v int64
+			if v, err = strconv.ParseInt(strings.TrimSuffix(line, "L"), 10, 64); err == nil {
+				u.push(v)
+			}
+		case 'J': // BININT
+			var v uint64
+			if v, err = u.readUint(4); err == nil {
+				u.push(int64(int32(uint32(v))))
+			}
+		case 'K': // BININT1
+			var v uint64
+			if v, err = u.readUint(1); err == nil {
+				u.push(int64(v))
+			}
+		case 'M': // BININT2
+			var v uint64
+			if v, err = u.readUint(2); err == nil {
+				u.push(int64(v))
+			}
+		case 0x8a: // LONG1
+			var b []byte
+			if b, err = u.readPrefixed(1); err == nil {
+				u.push(decodePickleLong(b))
+			}
+		case 'F': // FLOAT
+			var line string
+			if line, err = u.readLine(); err != nil {
+				break
+			}
+			var v float64
+			if v, err = strconv.ParseFloat(line, 64); err == nil {
+				u.push(v)
+			}
+		case 'G': // BINFLOAT
+			var b []byte
+			if b, err = u.read(8); err == nil {
+				u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+			}
+		case 'S': // STRING
+			var line string
+			if line, err = u.readLine(); err == nil {
+				u.push(unquotePickleString(line))
+			}
+		case 'V': // UNICODE
+			var line string
+			if line, err = u.readLine(); err == nil {
+				u.push(line)
+			}
+		case 'T', 'X', 'B': // BINSTRING, BINUNICODE, BINBYTES
+			var b []byte
+			if b, err = u.readPrefixed(4); err == nil {
+				u.push(string(b))
+			}
+		case 'U', 0x8c, 'C': // SHORT_BINSTRING, SHORT_BINUNICODE, SHORT_BINBYTES
+			var b []byte
+			if b, err = u.readPrefixed(1); err == nil {
+				u.push(string(b))
+			}
+		case 0x8d: // BINUNICODE8
+			var b []byte
+			if b, err = u.readPrefixed(8); err == nil {
+				u.push(string(b))
+			}
+		case ']': // EMPTY_LIST
+			u.push(&pickleList{})
+		case 'l': // LIST
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				u.push(&pickleList{items: items})
+			}
+		case 'a': // APPEND
+			var v interface{}
+			if v, err = u.pop(); err == nil {
+				err = u.appendItems([]interface{}{v})
+			}
+		case 'e': // APPENDS
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				err = u.appendItems(items)
+			}
+		case ')': // EMPTY_TUPLE
+			u.push([]interface{}{})
+		case 't': // TUPLE
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				u.push(items)
+			}
+		case 0x85, 0x86, 0x87: // TUPLE1, TUPLE2, TUPLE3
+			var items []interface{}
+			if items, err = u.popN(int(op-0x85) + 1); err == nil {
+				u.push(items)
+			}
+		case 'p': // PUT
+			var line string
+			if line, err = u.readLine(); err != nil {
+				break
+			}
+			var key int64
+			if key, err = strconv.ParseInt(line, 10, 64); err == nil {
+				err = u.memoize(key)
+			}
+		case 'q': // BINPUT
+			var key uint64
+			if key, err = u.readUint(1); err == nil {
+				err = u.memoize(int64(key))
+			}
+		case 'r': // LONG_BINPUT
+			var key uint64
+			if key, err = u.readUint(4); err == nil {
+				err = u.memoize(int64(key))
+			}
+		case 0x94: // MEMOIZE
+			err = u.memoize(int64(len(u.memo)))
+		case 'g': // GET
+			var line string
+			if line, err = u.readLine(); err != nil {
+				break
+			}
+			var key int64
+			if key, err = strconv.ParseInt(line, 10, 64); err == nil {
+				err = u.get(key)
+			}
+		case 'h': // BINGET
+			var key uint64
+			if key, err = u.readUint(1); err == nil {
+				err = u.get(int64(key))
+			}
+		case 'j': // LONG_BINGET
+			var key uint64
+			if key, err = u.readUint(4); err == nil {
+				err = u.get(int64(key))
+			}
+		default:
+			return nil, fmt.Errorf("unsupported pickle opcode 0x%02x", op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, errPickleNoStop
+}
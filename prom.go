@@ -0,0 +1,477 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	promLabelPolicy               = "sanitize"
+	promMetricNameLabel           = "__name__"
+	errPromMetricNameRequired     = errors.New("time series without __name__ label")
+	errPromInvalidLabel           = errors.New("label is outside of [a-zA-Z0-9\\-._]")
+	errUnsupportedPromLabelPolicy = errors.New("prometheus label policy must be sanitize or reject")
+	errPromUnexpectedWireType     = errors.New("unexpected protobuf wire type")
+	errUnsupportedPromMatcherType = errors.New("unsupported label matcher type")
+	errPromTimestampOverflow      = errors.New("timestamp out of range")
+)
+
+// label matcher types of the remote read protocol
+const (
+	promMatchEqual = iota
+	promMatchNotEqual
+	promMatchRegexp
+	promMatchNotRegexp
+)
+
+// promStaleNaN is the value prometheus writes to mark a series as stale
+const promStaleNaN uint64 = 0x7ff0000000000002
+
+type promLabel struct {
+	name  string
+	value string
+}
+
+type promSample struct {
+	value     float64
+	timestamp int64 // in milliseconds
+}
+
+type promTimeSeries struct {
+	labels  []*promLabel
+	samples []*promSample
+}
+
+type promMatcher struct {
+	typ   uint64
+	name  string
+	value string
+	re    *regexp.Regexp
+}
+
+type promQuery struct {
+	start    int64 // in milliseconds
+	end      int64 // in milliseconds
+	matchers []*promMatcher
+}
+
+func expectWireType(f *protoField, typ protowire.Type) error {
+	if f.typ != typ {
+		return fmt.Errorf("%s: field %d", errPromUnexpectedWireType, f.num)
+	}
+	return nil
+}
+
+func decodePromLabel(b []byte) (*promLabel, error) {
+	l := &promLabel{}
+	err := parseProtoFields(b, func(f *protoField) error {
+		switch f.num {
+		case 1:
+			if err := expectWireType(f, protowire.BytesType); err != nil {
+				return err
+			}
+			l.name = string(f.bytes)
+		case 2:
+			if err := expectWireType(f, protowire.BytesType); err != nil {
+				return err
+			}
+			l.value = string(f.bytes)
+		}
+		return nil
+	})
+	return l, err
+}
+
+func decodePromSample(b []byte) (*promSample, error) {
+	s := &promSample{}
+	err := parseProtoFields(b, func(f *protoField) error {
+		switch f.num {
+		case 1:
+			if err := expectWireType(f, protowire.Fixed64Type); err != nil {
+				return err
+			}
+			s.value = math.Float64frombits(f.fixed)
+		case 2:
+			if err := expectWireType(f, protowire.VarintType); err != nil {
+				return err
+			}
+			s.timestamp = int64(f.varint)
+		}
+		return nil
+	})
+	return s, err
+}
+
+func decodePromTimeSeries(b []byte) (*promTimeSeries, error) {
+	ts := &promTimeSeries{}
+	err := parseProtoFields(b, func(f *protoField) error {
+		switch f.num {
+		case 1:
+			if err := expectWireType(f, protowire.BytesType); err != nil {
+				return err
+			}
+			l, err := decodePromLabel(f.bytes)
+			if err != nil {
+				return err
+			}
+			ts.labels = append(ts.labels, l)
+		case 2:
+			if err := expectWireType(f, protowire.BytesType); err != nil {
+				return err
+			}
+			s, err := decodePromSample(f.bytes)
+			if err != nil {
+				return err
+			}
+			ts.samples = append(ts.samples, s)
+		}
+		return nil
+	})
+	return ts, err
+}
+
+// decodePromWriteRequest decodes the time series of a remote write
+// WriteRequest. Metadata, exemplars and native histograms are ignored.
+func decodePromWriteRequest(b []byte) ([]*promTimeSeries, error) {
+	series := []*promTimeSeries{}
+	err := parseProtoFields(b, func(f *protoField) error {
+		if f.num != 1 {
+			return nil
+		}
+		if err := expectWireType(f, protowire.BytesType); err != nil {
+			return err
+		}
+		ts, err := decodePromTimeSeries(f.bytes)
+		if err != nil {
+			return err
+		}
+		series = append(series, ts)
+		return nil
+	})
+	return series, err
+}
+
+// sanitizePromName applies promLabelPolicy to a metric name, label name or
+// label value: with sanitize every character outside metricAndTagsRe is
+// replaced by an underscore, with reject an error is returned.
+func sanitizePromName(s string) (string, error) {
+	return applyNamePolicy(promLabelPolicy, s, errPromInvalidLabel)
+}
+
+// promTimeSeriesToQueries maps __name__ to the metric and the other labels to
+// tags. Labels with empty values are dropped since prometheus treats them as
+// unset. Stale markers are skipped.
+func promTimeSeriesToQueries(series []*promTimeSeries) ([]*insertPointQuery, error) {
+	queries := []*insertPointQuery{}
+	for _, ts := range series {
+		var metric string
+		tags := map[string]string{}
+		for _, l := range ts.labels {
+			if l.value == "" {
+				continue
+			}
+			if l.name == promMetricNameLabel {
+				name, err := sanitizePromName(l.value)
+				if err != nil {
+					return nil, err
+				}
+				metric = name
+				continue
+			}
+			name, err := sanitizePromName(l.name)
+			if err != nil {
+				return nil, err
+			}
+			value, err := sanitizePromName(l.value)
+			if err != nil {
+				return nil, err
+			}
+			tags[name] = value
+		}
+		if metric == "" {
+			return nil, errPromMetricNameRequired
+		}
+		for _, s := range ts.samples {
+			if math.Float64bits(s.value) == promStaleNaN {
+				continue
+			}
+			if s.timestamp > math.MaxInt64/int64(1e6) || s.timestamp < math.MinInt64/int64(1e6) {
+				return nil, fmt.Errorf("%s: %d", errPromTimestampOverflow, s.timestamp)
+			}
+			queries = append(queries, &insertPointQuery{
+				Metric: metric,
+				Tags:   tags,
+				Point: &point{
+					Value:     s.value,
+					Timestamp: s.timestamp * 1e6,
+				},
+			})
+		}
+	}
+	return queries, nil
+}
+
+// promMillisToNanos converts a millisecond timestamp to nanoseconds plus
+// offset, clamping to the int64 range instead of overflowing
+func promMillisToNanos(ms, offset int64) int64 {
+	switch {
+	case ms > (math.MaxInt64-offset)/1e6:
+		return math.MaxInt64
+	case ms < math.MinInt64/int64(1e6):
+		return math.MinInt64
+	}
+	return ms*1e6 + offset
+}
+
+func appendPromLabel(b []byte, l *promLabel) []byte {
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, l.name)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendString(b, l.value)
+}
+
+func appendPromSample(b []byte, s *promSample) []byte {
+	b = protowire.AppendTag(b, 1, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(s.value))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(s.timestamp))
+}
+
+// appendPromTimeSeries appends ts as an embedded TimeSeries message with
+// field number num
+func appendPromTimeSeries(b []byte, num protowire.Number, ts *promTimeSeries) []byte {
+	var msg []byte
+	for _, l := range ts.labels {
+		msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, appendPromLabel(nil, l))
+	}
+	for _, s := range ts.samples {
+		msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, appendPromSample(nil, s))
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func decodePromMatcher(b []byte) (*promMatcher, error) {
+	m := &promMatcher{}
+	err := parseProtoFields(b, func(f *protoField) error {
+		switch f.num {
+		case 1:
+			if err := expectWireType(f, protowire.VarintType); err != nil {
+				return err
+			}
+			m.typ = f.varint
+		case 2:
+			if err := expectWireType(f, protowire.BytesType); err != nil {
+				return err
+			}
+			m.name = string(f.bytes)
+		case 3:
+			if err := expectWireType(f, protowire.BytesType); err != nil {
+				return err
+			}
+			m.value = string(f.bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch m.typ {
+	case promMatchEqual, promMatchNotEqual:
+	case promMatchRegexp, promMatchNotRegexp:
+		// prometheus regexps are fully anchored
+		if m.re, err = regexp.Compile("^(?:" + m.value + ")$"); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%s: %d", errUnsupportedPromMatcherType, m.typ)
+	}
+	return m, nil
+}
+
+func decodePromQuery(b []byte) (*promQuery, error) {
+	q := &promQuery{}
+	err := parseProtoFields(b, func(f *protoField) error {
+		switch f.num {
+		case 1, 2:
+			if err := expectWireType(f, protowire.VarintType); err != nil {
+				return err
+			}
+			if f.num == 1 {
+				q.start = int64(f.varint)
+			} else {
+				q.end = int64(f.varint)
+			}
+		case 3:
+			if err := expectWireType(f, protowire.BytesType); err != nil {
+				return err
+			}
+			m, err := decodePromMatcher(f.bytes)
+			if err != nil {
+				return err
+			}
+			q.matchers = append(q.matchers, m)
+		}
+		return nil
+	})
+	return q, err
+}
+
+// decodePromReadRequest decodes the queries of a remote read ReadRequest.
+// Only sampled responses are supported, so accepted_response_types is
+// ignored.
+func decodePromReadRequest(b []byte) ([]*promQuery, error) {
+	queries := []*promQuery{}
+	err := parseProtoFields(b, func(f *protoField) error {
+		if f.num != 1 {
+			return nil
+		}
+		if err := expectWireType(f, protowire.BytesType); err != nil {
+			return err
+		}
+		q, err := decodePromQuery(f.bytes)
+		if err != nil {
+			return err
+		}
+		queries = append(queries, q)
+		return nil
+	})
+	return queries, err
+}
+
+// matches reports whether the label value v matches. Missing labels are
+// matched as empty values like prometheus does.
+func (m *promMatcher) matches(v string) bool {
+	switch m.typ {
+	case promMatchEqual:
+		return v == m.value
+	case promMatchNotEqual:
+		return v != m.value
+	case promMatchRegexp:
+		return m.re.MatchString(v)
+	default:
+		return !m.re.MatchString(v)
+	}
+}
+
+// promSeriesMatches reports whether all matchers match the series
+func promSeriesMatches(matchers []*promMatcher, metric string, tags map[string]string) bool {
+	for _, m := range matchers {
+		v := tags[m.name]
+		if m.name == promMetricNameLabel {
+			v = metric
+		}
+		if !m.matches(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// promMetricMatches reports whether the __name__ matchers match metric
+func promMetricMatches(matchers []*promMatcher, metric string) bool {
+	for _, m := range matchers {
+		if m.name == promMetricNameLabel && !m.matches(metric) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectPromSeries runs a remote read query. An equality matcher on
+// __name__ selects a single metric, otherwise every metric is checked.
+// Equality matchers with non-empty values narrow the series selection, the
+// other matchers are applied to the selected series.
+func selectPromSeries(s Storage, q *promQuery) ([]*promTimeSeries, error) {
+	var metrics []string
+	tags := map[string]string{}
+	for _, m := range q.matchers {
+		if m.typ != promMatchEqual || m.value == "" {
+			continue
+		}
+		if m.name == promMetricNameLabel {
+			metrics = []string{m.value}
+		} else {
+			tags[m.name] = m.value
+		}
+	}
+	result := []*promTimeSeries{}
+	if validateTags(tags) != nil {
+		// nothing stored can match tags that can't be stored
+		return result, nil
+	}
+	if metrics == nil {
+		var err error
+		if metrics, err = s.SelectMetrics(); err != nil {
+			return nil, &storageError{err: err}
+		}
+	}
+
+	start, end := promMillisToNanos(q.start, 0), promMillisToNanos(q.end, 999999)
+	for _, metric := range metrics {
+		if !promMetricMatches(q.matchers, metric) {
+			continue
+		}
+		series, err := s.SelectSeriesPoints(priorityCRUD, metric, newTagsFilter(tags), start, end)
+		if err != nil {
+			return nil, &storageError{err: err}
+		}
+		for _, sp := range series {
+			if !promSeriesMatches(q.matchers, metric, sp.Tags) {
+				continue
+			}
+			if ts := promTimeSeriesFromPoints(metric, sp); len(ts.samples) > 0 {
+				result = append(result, ts)
+			}
+		}
+	}
+	return result, nil
+}
+
+// promTimeSeriesFromPoints converts the points of a series to samples with
+// labels sorted by name. Null points are skipped and only the first point of
+// every millisecond is kept.
+func promTimeSeriesFromPoints(metric string, sp *seriesPoints) *promTimeSeries {
+	ts := &promTimeSeries{
+		labels: []*promLabel{{name: promMetricNameLabel, value: metric}},
+	}
+	for k, v := range sp.Tags {
+		ts.labels = append(ts.labels, &promLabel{name: k, value: v})
+	}
+	sort.Slice(ts.labels, func(i, j int) bool {
+		return ts.labels[i].name < ts.labels[j].name
+	})
+	for _, pt := range sp.Points {
+		if pt.Null {
+			continue
+		}
+		ms := pt.Timestamp / 1e6
+		if n := len(ts.samples); n > 0 && ts.samples[n-1].timestamp == ms {
+			continue
+		}
+		ts.samples = append(ts.samples, &promSample{value: pt.Value, timestamp: ms})
+	}
+	return ts
+}
+
+// encodePromReadResponse encodes a ReadResponse with one QueryResult per
+// query
+func encodePromReadResponse(results [][]*promTimeSeries) []byte {
+	var b []byte
+	for _, series := range results {
+		var msg []byte
+		for _, ts := range series {
+			msg = appendPromTimeSeries(msg, 1, ts)
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, msg)
+	}
+	return b
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestPromTimeSeriesToQueries(t *testing.T) {
+	var b []byte
+	b = appendPromTimeSeries(b, 1, &promTimeSeries{
+		labels: []*promLabel{
+			{name: "__name__", value: "http_requests:rate5m"},
+			{name: "instance", value: "localhost:9090"},
+			{name: "job", value: "prometheus"},
+			{name: "empty", value: ""},
+		},
+		samples: []*promSample{
+			{value: 1.5, timestamp: 946684800000},
+			{value: math.Float64frombits(promStaleNaN), timestamp: 946684815000},
+		},
+	})
+	series, err := decodePromWriteRequest(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries, err := promTimeSeriesToQueries(series)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*insertPointQuery{
+		{
+			Metric: "http_requests_rate5m",
+			Tags:   map[string]string{"instance": "localhost_9090", "job": "prometheus"},
+			Point:  &point{Value: 1.5, Timestamp: 946684800000000000},
+		},
+	}, queries)
+
+	promLabelPolicy = "reject"
+	_, err = promTimeSeriesToQueries(series)
+	promLabelPolicy = "sanitize"
+	require.Error(t, err)
+
+	series[0].samples = []*promSample{{value: 1, timestamp: math.MaxInt64 / 1000}}
+	_, err = promTimeSeriesToQueries(series)
+	require.Error(t, err)
+
+	if _, err := promTimeSeriesToQueries([]*promTimeSeries{{labels: []*promLabel{{name: "job", value: "a"}}}}); err != errPromMetricNameRequired {
+		t.Fatalf("expected %s, got %v", errPromMetricNameRequired, err)
+	}
+	if _, err := decodePromWriteRequest([]byte{0x0a, 0x05, 0x01}); err == nil {
+		t.Fatal("expected error for truncated message")
+	}
+}
+
+func appendPromMatcher(b []byte, typ uint64, name, value string) []byte {
+	var msg []byte
+	msg = protowire.AppendTag(msg, 1, protowire.VarintType)
+	msg = protowire.AppendVarint(msg, typ)
+	msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+	msg = protowire.AppendString(msg, name)
+	msg = protowire.AppendTag(msg, 3, protowire.BytesType)
+	msg = protowire.AppendString(msg, value)
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func appendPromQuery(b []byte, start, end int64, matchers func(b []byte) []byte) []byte {
+	var msg []byte
+	msg = protowire.AppendTag(msg, 1, protowire.VarintType)
+	msg = protowire.AppendVarint(msg, uint64(start))
+	msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+	msg = protowire.AppendVarint(msg, uint64(end))
+	msg = matchers(msg)
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func TestDecodePromReadRequest(t *testing.T) {
+	b := appendPromQuery(nil, 1000, 2000, func(b []byte) []byte {
+		b = appendPromMatcher(b, promMatchEqual, "__name__", "up")
+		return appendPromMatcher(b, promMatchRegexp, "job", "a|b")
+	})
+	queries, err := decodePromReadRequest(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Len(t, queries, 1)
+	require.Equal(t, int64(1000), queries[0].start)
+	require.Equal(t, int64(2000), queries[0].end)
+	require.Len(t, queries[0].matchers, 2)
+
+	// regexps are anchored and missing labels match as empty values
+	require.True(t, promSeriesMatches(queries[0].matchers, "up", map[string]string{"job": "b"}))
+	require.False(t, promSeriesMatches(queries[0].matchers, "up", map[string]string{"job": "ab"}))
+	require.False(t, promSeriesMatches(queries[0].matchers, "up", nil))
+	notRe := []*promMatcher{{typ: promMatchNotRegexp, name: "job", re: regexp.MustCompile("^(?:a)$")}}
+	require.True(t, promSeriesMatches(notRe, "up", nil))
+
+	b = appendPromQuery(nil, 0, 0, func(b []byte) []byte {
+		return appendPromMatcher(b, promMatchRegexp, "job", "(")
+	})
+	if _, err := decodePromReadRequest(b); err == nil {
+		t.Fatal("expected error for invalid regexp")
+	}
+	b = appendPromQuery(nil, 0, 0, func(b []byte) []byte {
+		return appendPromMatcher(b, 7, "job", "a")
+	})
+	if _, err := decodePromReadRequest(b); err == nil {
+		t.Fatal("expected error for unsupported matcher type")
+	}
+}
+
+func TestPromTimeSeriesFromPoints(t *testing.T) {
+	ts := promTimeSeriesFromPoints("up", &seriesPoints{
+		Tags: map[string]string{"job": "a", "instance": "b"},
+		Points: []*point{
+			{Value: 1, Timestamp: 1000000},
+			{Value: 2, Timestamp: 1000001},
+			{Null: true, Timestamp: 2000000},
+			{Value: 3, Timestamp: 3000000},
+		},
+	})
+	require.Equal(t, &promTimeSeries{
+		labels: []*promLabel{
+			{name: "__name__", value: "up"},
+			{name: "instance", value: "b"},
+			{name: "job", value: "a"},
+		},
+		samples: []*promSample{
+			{value: 1, timestamp: 1},
+			{value: 3, timestamp: 3},
+		},
+	}, ts)
+}
+
+func TestPromMillisToNanos(t *testing.T) {
+	require.Equal(t, int64(1000999999), promMillisToNanos(1000, 999999))
+	require.Equal(t, int64(-1000000000), promMillisToNanos(-1000, 0))
+	require.Equal(t, int64(math.MaxInt64), promMillisToNanos(math.MaxInt64, 999999))
+	require.Equal(t, int64(math.MaxInt64), promMillisToNanos(math.MaxInt64/1000000, 999999))
+	require.Equal(t, int64(math.MinInt64), promMillisToNanos(math.MinInt64, 0))
+	require.Equal(t, int64(math.MinInt64), promMillisToNanos(math.MinInt64, 999999))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The protobuf messages of the Prometheus remote APIs are small enough that
+// they're decoded and encoded directly with protowire instead of pulling in
+// their generated code.
+
+// protoField is one field of an encoded message. Only the value matching
+// typ is set: varint for varints, fixed for fixed32 and fixed64, bytes for
+// length delimited fields.
+type protoField struct {
+	num    protowire.Number
+	typ    protowire.Type
+	varint uint64
+	fixed  uint64
+	bytes  []byte
+}
+
+// parseProtoFields calls fn with every field of the encoded message b in
+// order. Groups are skipped.
+func parseProtoFields(b []byte, fn func(f *protoField) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		f := &protoField{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.varint, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.fixed = uint64(v)
+		case protowire.Fixed64Type:
+			f.fixed, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
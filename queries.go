@@ -1,28 +1,26 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"regexp"
-	"sort"
-	"strconv"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
 	priorityCRUD                           = 999
 	priorityDownsamplers                   = 0
-	tagsIndexMap                           = map[string]bool{}
-	createIndexMutex                       = &sync.Mutex{}
 	metricAndTagsRe                        = regexp.MustCompile(`^[a-zA-Z0-9_\-.]+$`)
+	invalidNameCharsRe                     = regexp.MustCompile(`[^a-zA-Z0-9_\-.]`)
 	insertBatchSize                        = 200
+	pqUniqueViolation                      = pq.ErrorCode("23505")
 	errUnsupportedMetricName               = errors.New("valid characters for metrics are [a-zA-Z0-9\\-._]")
 	errUnsupportedOutMetricName            = errors.New("valid characters for out metrics are [a-zA-Z0-9\\-._]")
 	errUnsupportedTagName                  = errors.New("valid characters for tag names are [a-zA-Z0-9\\-._]")
@@ -108,11 +106,17 @@ func tableExists(db *dbConn, name string) (bool, error) {
 	return found, err
 }
 
-func selectDownsamplers(db *dbConn) ([]*downsampler, error) {
+// pgStorage stores points in PostgreSQL. Every statement goes through the
+// prioritized connection workers of db.
+type pgStorage struct {
+	db *dbConn
+}
+
+func (s *pgStorage) SelectDownsamplers() ([]*downsampler, error) {
 	var (
 		downsamplers0 []*downsampler
 	)
-	err := db.Query(priorityCRUD, func(session *sql.DB) error {
+	err := s.db.Query(priorityCRUD, func(session *sql.DB) error {
 		query := fmt.Sprintf("SELECT id,metric,out_metric,run_every,last_downsampled_window,query FROM %s", downsamplersTable)
 		scanner, err := session.Query(query)
 		if err != nil {
@@ -146,7 +150,7 @@ func selectDownsamplers(db *dbConn) ([]*downsampler, error) {
 				case int64:
 					ds.LastDownsampledWindow = v
 				default:
-					return errors.New("incorrect type for lastDownsampledWindow")
+					return errLastDownsampledWindowType
 				}
 			}
 			ds.RunEvery = time.Duration(runEvery).String()
@@ -186,632 +190,706 @@ func insertDownsamplersInitialCount(db *dbConn) error {
 	return err
 }
 
-func generateTagsIndexString(ss []string) string {
-	s := &strings.Builder{}
-	for _, s0 := range ss {
-		s.WriteString(s0)
-		s.WriteString("_")
+func (s *pgStorage) DownsamplersCount() (int, error) {
+	downsamplersCount, err := selectDownsamplersCount(s.db)
+	if err == sql.ErrNoRows {
+		return 0, insertDownsamplersInitialCount(s.db)
 	}
-	return s.String()
+	return downsamplersCount, err
 }
 
-func createIndex(db *dbConn, tags []string) {
-	s := generateTagsIndexString(tags)
-
-	createIndexMutex.Lock()
-	defer createIndexMutex.Unlock()
+// generateInsertStringsAndValues generates an insert of queries that
+// handles conflicting points according to onConflict. The overwrite and sum
+// modes return whether each row was inserted.
+func generateInsertStringsAndValues(queries []*insertPointQuery, seriesIDs []int64, onConflict string) (string, []interface{}) {
+	valuesStrBuilder := &strings.Builder{}
+	values := []interface{}{}
+	var i = 1
+	for z, query := range queries {
+		values = append(values, seriesIDs[z])
+		values = append(values, query.Point.Timestamp)
+		if query.Point.Null {
+			values = append(values, nil)
+		} else {
+			values = append(values, query.Point.Value)
+		}
 
-	if v, ok := tagsIndexMap[s]; ok {
-		if v {
-			return
+		valuesStrBuilder.WriteString(fmt.Sprintf("($%d,$%d,$%d)", i, i+1, i+2))
+		if z+1 < len(queries) {
+			valuesStrBuilder.WriteString(",")
 		}
+		i += 3
 	}
-
-	indexNameStr := &strings.Builder{}
-	indexSchemaStr := &strings.Builder{}
-
-	for _, t := range tags {
-		indexNameStr.WriteString(t)
-		indexNameStr.WriteRune('_')
-		indexSchemaStr.WriteString("(tags->>'")
-		indexSchemaStr.WriteString(t)
-		indexSchemaStr.WriteString("')")
-		indexSchemaStr.WriteRune(',')
+	queryStr := fmt.Sprintf(`INSERT INTO %s AS t (series_id,timestamp,value) VALUES %s%s`, metricsTable, valuesStrBuilder.String(), onConflictClause(onConflict))
+	if onConflict == onConflictOverwrite || onConflict == onConflictSum {
+		queryStr += ` RETURNING xmax = 0`
 	}
-	indexNameStr.WriteString("timestamp")
-	indexSchemaStr.WriteString("timestamp")
+	return queryStr, values
+}
 
-	err := db.Query(priorityCRUD, func(session *sql.DB) error {
-		t0 := time.Now()
-		query := fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_%s ON %s(%s)", metricsTable, indexNameStr.String(), metricsTable, indexSchemaStr.String())
-		_, err := session.Exec(query)
-		if err != nil {
-			return err
-		} else {
-			tagsIndexMap[s] = true
-		}
-		log.Infof("create index if not exists %v took %s", indexNameStr.String(), time.Since(t0))
-		return nil
-	})
+// onConflictClause returns the ON CONFLICT clause of an insert into the
+// metrics table aliased as t
+func onConflictClause(onConflict string) string {
+	switch onConflict {
+	case onConflictError:
+		return ""
+	case onConflictOverwrite:
+		return ` ON CONFLICT (series_id,timestamp) DO UPDATE SET value = EXCLUDED.value`
+	case onConflictSum:
+		return ` ON CONFLICT (series_id,timestamp) DO UPDATE SET value = COALESCE(t.value + EXCLUDED.value, t.value, EXCLUDED.value)`
+	}
+	return ` ON CONFLICT DO NOTHING`
+}
 
-	if err != nil {
-		log.Errorf("createIndex: %s", err)
+// mergeDuplicateQueries merges queries of the same series and timestamp
+// since an upsert can't update a row twice. The last point wins when
+// overwriting, points are added when summing and the first point wins
+// otherwise. It returns how many points were merged.
+func mergeDuplicateQueries(queries []*insertPointQuery, seriesIDs []int64, onConflict string) ([]*insertPointQuery, []int64, int64) {
+	if onConflict == onConflictError {
+		return queries, seriesIDs, 0
 	}
+	type key struct {
+		seriesID  int64
+		timestamp int64
+	}
+	index := map[key]int{}
+	merged := make([]*insertPointQuery, 0, len(queries))
+	mergedIDs := make([]int64, 0, len(queries))
+	for i, query := range queries {
+		k := key{seriesIDs[i], query.Point.Timestamp}
+		j, ok := index[k]
+		if !ok {
+			index[k] = len(merged)
+			merged = append(merged, query)
+			mergedIDs = append(mergedIDs, seriesIDs[i])
+			continue
+		}
+		switch onConflict {
+		case onConflictOverwrite:
+			merged[j] = query
+		case onConflictSum:
+			merged[j] = &insertPointQuery{Metric: query.Metric, Tags: query.Tags, Point: sumPoints(merged[j].Point, query.Point)}
+		}
+	}
+	return merged, mergedIDs, int64(len(queries) - len(merged))
 }
 
-/*func uniqueTags(haystack [][]string, needle []string) bool {
-	m := map[string]struct{}{}
-	for _, s := range haystack {
-		m[generateTagsIndexString(s)] = struct{}{}
+// execInsertPoints inserts queries into their series and returns the number
+// of points inserted and overwritten. Points within the time range of a
+// chunk are written into the chunk, so session must be a transaction.
+func execInsertPoints(session queryer, queries []*insertPointQuery, seriesIDs []int64, onConflict string) (int64, int64, error) {
+	queries, seriesIDs, merged := mergeDuplicateQueries(queries, seriesIDs, onConflict)
+	queries, seriesIDs, chunkInserted, chunkOverwritten, err := writeChunkPoints(session, queries, seriesIDs, onConflict)
+	if err != nil {
+		return 0, 0, err
 	}
-	_, ok := m[generateTagsIndexString(needle)]
-
-	return !ok
-}*/
-
-func containsAll(arr1 []string, arr2 []string) bool {
-	if len(arr1) != len(arr2) {
-		return false
+	inserted, overwritten, err := execInsertRows(session, queries, seriesIDs, onConflict)
+	if err != nil {
+		return 0, 0, err
 	}
-	for i := 0; i < len(arr1); i++ {
-		if arr2[i] != arr1[i] {
-			return false
-		}
+	if onConflict == onConflictOverwrite || onConflict == onConflictSum {
+		overwritten += merged
 	}
-	return true
+	return inserted + chunkInserted, overwritten + chunkOverwritten, nil
 }
 
-func uniqueTags(haystack [][]string, needle []string) bool {
-	unique := true
-finished:
-	for _, ss := range haystack {
-		if containsAll(ss, needle) {
-			unique = false
-			break finished
-		}
+// execInsertRows inserts queries into the metrics table and returns the
+// number of rows inserted and updated
+func execInsertRows(session queryer, queries []*insertPointQuery, seriesIDs []int64, onConflict string) (int64, int64, error) {
+	if len(queries) == 0 {
+		return 0, 0, nil
 	}
-	return unique
-}
-
-func generateInsertStringsAndValues(queries []*insertPointQuery) (string, []interface{}, [][]string, error) {
-	valuesStrBuilder := &strings.Builder{}
-	values := []interface{}{}
-	uniqueTagCombinations := [][]string{}
-	var i = 1
-	for z, query := range queries {
-		if !metricAndTagsRe.MatchString(query.Metric) {
-			return "", nil, nil, errUnsupportedMetricName
-		}
-		if query.Point == nil {
-			return "", nil, nil, errPointRequiredForInsertQuery
-		}
-
-		values = append(values, query.Metric)
-		values = append(values, query.Point.Timestamp)
-		if query.Point.Null {
-			values = append(values, nil)
-		} else {
-			values = append(values, query.Point.Value)
+	queryStr, values := generateInsertStringsAndValues(queries, seriesIDs, onConflict)
+	if onConflict != onConflictOverwrite && onConflict != onConflictSum {
+		res, err := session.Exec(queryStr, values...)
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pqUniqueViolation {
+			return 0, 0, errPointExists
 		}
-
-		bs, err := json.Marshal(query.Tags)
 		if err != nil {
-			return "", nil, nil, err
-		}
-		values = append(values, string(bs))
-
-		valuesStrBuilder.WriteString(fmt.Sprintf("($%d,$%d,$%d,$%d)", i, i+1, i+2, i+3))
-		if z+1 < len(queries) {
-			valuesStrBuilder.WriteString(",")
+			return 0, 0, err
 		}
-		i += 4
-
-		// get unique combinations of tags for indexing
-		tags := make([]string, len(query.Tags))
+		inserted, err := res.RowsAffected()
+		return inserted, 0, err
+	}
 
-		x := 0
-		for k := range query.Tags {
-			tags[x] = k
-			x++
+	scanner, err := session.Query(queryStr, values...)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer scanner.Close()
+	var inserted, overwritten int64
+	for scanner.Next() {
+		var isInsert bool
+		if err := scanner.Scan(&isInsert); err != nil {
+			return 0, 0, err
 		}
-
-		sort.Strings(tags)
-		if uniqueTags(uniqueTagCombinations, tags) {
-			uniqueTagCombinations = append(uniqueTagCombinations, tags)
+		if isInsert {
+			inserted++
+		} else {
+			overwritten++
 		}
 	}
-	return valuesStrBuilder.String(), values, uniqueTagCombinations, nil
+	if err := scanner.Err(); err != nil {
+		return 0, 0, err
+	}
+	return inserted, overwritten, nil
 }
 
-func insertPoints(db *dbConn, queries0 []*insertPointQuery) error {
-	if len(queries0) == 0 {
-		return nil
-	}
+func (s *pgStorage) InsertPoints(queries0 []*insertPointQuery, onConflict string) (int64, int64, error) {
+	var inserted, overwritten int64
 	// batch the queries insertBatchSize at a time to get around
 	// max insert limit of postgres
 	for i := 0; i < len(queries0); i += insertBatchSize {
 		queries := queries0[i:min1(i+insertBatchSize, len(queries0))]
-		valuesStr, values, uniqueTagCombinations, err := generateInsertStringsAndValues(queries)
-		if err != nil {
-			return err
-		}
-		for _, s := range uniqueTagCombinations {
-			if len(s) == 0 {
-				continue
+		err := s.db.Query(priorityCRUD, func(session *sql.DB) error {
+			seriesIDs, err := resolveSeriesIDs(session, queries, true)
+			if err != nil {
+				return err
 			}
-			go createIndex(db, s)
-		}
-		err = db.Query(priorityCRUD, func(session *sql.DB) error {
-			queryStr := fmt.Sprintf(`INSERT INTO %s (metric,timestamp,value,tags) VALUES %s ON CONFLICT DO NOTHING` /* */, metricsTable, valuesStr)
-			if _, err := session.Exec(queryStr, values...); err != nil { //&& err.Error() != fmt.Sprintf(errStringDuplicate, strings.ToLower(firstMetric)) {
+			if err := ensurePartitions(session, insertQueriesTimestamps(queries)); err != nil {
+				return err
+			}
+			tx, err := session.BeginTx(context.Background(), nil)
+			if err != nil {
 				return err
 			}
+			n, m, err := execInsertPoints(tx, queries, seriesIDs, onConflict)
+			if err != nil {
+				if err0 := tx.Rollback(); err0 != nil {
+					log.Errorf("InsertPoints rollback error: %s", err0)
+				}
+				return err
+			}
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			inserted += n
+			overwritten += m
 			return nil
 		})
 		if err != nil {
-			return err
+			return inserted, overwritten, err
 		}
 	}
 
-	return nil
+	return inserted, overwritten, nil
 }
 
-func generateTagsQueryStringAndValues(tags map[string]string, queryVals []interface{}) (string, []interface{}, error) {
-	s := &strings.Builder{}
-	argsCounter := len(queryVals)
-	for k, v := range tags {
-		if !metricAndTagsRe.MatchString(k) {
-			return "", nil, errUnsupportedTagName
-		}
-		if !metricAndTagsRe.MatchString(v) {
-			return "", nil, errUnsupportedTagValue
-		}
-
-		s.WriteString(fmt.Sprintf(" AND tags->>'%s' = $%s", k, strconv.Itoa(argsCounter+1)))
-		argsCounter++
-		queryVals = append(queryVals, v)
-	}
-	return s.String(), queryVals, nil
+// sanitizeName replaces every character of a metric or tag that's outside
+// metricAndTagsRe with an underscore
+func sanitizeName(s string) string {
+	return invalidNameCharsRe.ReplaceAllString(s, "_")
 }
 
-func queryPoints(db *dbConn, priority int, query *pointsQuery) ([]*point, error) {
-	if query.Metric == "" {
-		return nil, errMetricRequired
-	}
-	if !metricAndTagsRe.MatchString(query.Metric) {
-		return nil, errUnsupportedMetricName
+// applyNamePolicy returns s if it matches metricAndTagsRe. Otherwise it's
+// sanitized if policy is sanitize or errInvalid is returned.
+func applyNamePolicy(policy, s string, errInvalid error) (string, error) {
+	if metricAndTagsRe.MatchString(s) {
+		return s, nil
 	}
-	if query.Start == 0 {
-		return nil, errStartRequired
-	}
-	if query.End == 0 {
-		query.End = time.Now().UnixNano()
+	if policy == "reject" {
+		return "", fmt.Errorf("%s: %q", errInvalid, s)
 	}
+	return sanitizeName(s), nil
+}
 
-	var (
-		limitStr string
-		tagStr   string
-		err      error
-	)
-	if query.N > 0 {
-		limitStr = fmt.Sprintf(" LIMIT %d", query.N)
+// generateTagsQueryStringAndValues generates the condition of filter on the
+// series table's tags column. Equality filters become containment filters
+// which are served by its gin index.
+func generateTagsQueryStringAndValues(filter *tagFilter, queryVals []interface{}) (string, []interface{}, error) {
+	if filter == nil {
+		return "", queryVals, nil
 	}
-
-	queryVals := []interface{}{
-		query.Metric, query.Start, query.End,
+	cond, queryVals, err := tagFilterCondition(filter, queryVals)
+	if err != nil {
+		return "", nil, err
 	}
+	return " AND " + cond, queryVals, nil
+}
 
-	if len(query.Tags) > 0 {
-		tagStr, queryVals, err = generateTagsQueryStringAndValues(query.Tags, queryVals)
+func tagFilterCondition(f *tagFilter, queryVals []interface{}) (string, []interface{}, error) {
+	param := func(v interface{}) string {
+		queryVals = append(queryVals, v)
+		return fmt.Sprintf("$%d", len(queryVals))
+	}
+	contains := func(tags map[string]string) (string, error) {
+		tagsJSON, err := marshalTags(tags)
 		if err != nil {
-			return nil, err
-		}
-
-		if len(query.Tags) > 0 {
-			tags := make([]string, len(query.Tags))
-			i := 0
-			for k := range query.Tags {
-				tags[i] = k
-				i++
-			}
-			sort.Strings(tags)
-			go createIndex(db, tags)
+			return "", err
 		}
+		return fmt.Sprintf("tags @> %s::jsonb", param(tagsJSON)), nil
 	}
 
-	var (
-		points []*point
-	)
-
-	err = db.Query(priority, func(session *sql.DB) error {
-		queryStr := fmt.Sprintf(`SELECT timestamp, value FROM %s WHERE metric = $1 AND timestamp >= $2 AND timestamp <= $3%s ORDER BY timestamp ASC%s`, metricsTable, tagStr, limitStr)
-
-		scanner, err := session.Query(queryStr, queryVals...)
-		if err != nil {
-			return err
-		}
+	switch f.op {
+	case tagFilterAnd, tagFilterOr:
 		var (
-			val interface{}
+			conds []string
+			rest  []*tagFilter
+			eq    = map[string]string{}
 		)
-		for scanner.Next() {
-			pt := &point{}
-			if err := scanner.Scan(&pt.Timestamp, &val); err != nil {
-				scanner.Close()
-				return err
-			}
-			if val == nil {
-				pt.Null = true
-			} else {
-				switch v := val.(type) {
-				case int:
-					pt.Value = float64(v)
-				case int32:
-					pt.Value = float64(v)
-				case int64:
-					pt.Value = float64(v)
-				case float32:
-					pt.Value = float64(v)
-				case float64:
-					pt.Value = v
-				default:
-					scanner.Close()
-					return errors.New("incorrect type for lastDownsampledWindow")
+		for _, f0 := range f.filters {
+			// the equality filters of an and are merged into one containment
+			if f.op == tagFilterAnd && f0.op == tagFilterEq {
+				if v, ok := eq[f0.key]; !ok {
+					eq[f0.key] = f0.values[0]
+					continue
+				} else if v == f0.values[0] {
+					continue
 				}
 			}
-			points = append(points, pt)
+			rest = append(rest, f0)
+		}
+		if len(eq) > 0 {
+			cond, err := contains(eq)
+			if err != nil {
+				return "", nil, err
+			}
+			conds = append(conds, cond)
+		}
+		for _, f0 := range rest {
+			cond, vals, err := tagFilterCondition(f0, queryVals)
+			if err != nil {
+				return "", nil, err
+			}
+			queryVals = vals
+			conds = append(conds, cond)
 		}
+		return "(" + strings.Join(conds, " "+strings.ToUpper(f.op)+" ") + ")", queryVals, nil
+	case tagFilterEq, tagFilterNeq:
+		cond, err := contains(map[string]string{f.key: f.values[0]})
+		if err != nil {
+			return "", nil, err
+		}
+		if f.op == tagFilterNeq {
+			cond = "NOT " + cond
+		}
+		return cond, queryVals, nil
+	case tagFilterMatch:
+		return fmt.Sprintf("tags->>%s::text ~ %s::text", param(f.key), param(f.values[0])), queryVals, nil
+	case tagFilterNotMatch:
+		return fmt.Sprintf("NOT COALESCE(tags->>%s::text ~ %s::text, false)", param(f.key), param(f.values[0])), queryVals, nil
+	case tagFilterIn:
+		return fmt.Sprintf("tags->>%s::text = ANY(%s::text[])", param(f.key), param(pq.Array(f.values))), queryVals, nil
+	case tagFilterNotIn:
+		return fmt.Sprintf("NOT COALESCE(tags->>%s::text = ANY(%s::text[]), false)", param(f.key), param(pq.Array(f.values))), queryVals, nil
+	case tagFilterExists:
+		return fmt.Sprintf("tags ? %s::text", param(f.key)), queryVals, nil
+	case tagFilterNotExists:
+		return fmt.Sprintf("NOT tags ? %s::text", param(f.key)), queryVals, nil
+	}
+	return "", nil, errInvalidTagFilter
+}
 
-		scanner.Close()
+// selectRawPoints returns the uncompressed points of the series with
+// start <= timestamp <= end ordered by timestamp. A positive n limits the
+// number of points returned.
+func selectRawPoints(session queryer, seriesIDs []int64, start, end, n int64) ([]*seriesPoint, error) {
+	var limitStr string
+	if n > 0 {
+		limitStr = fmt.Sprintf(" LIMIT %d", n)
+	}
 
-		if err := scanner.Err(); err != nil {
-			return err
-		}
+	// the time bounds are inlined so the planner can prune partitions
+	// instead of leaving it to run time pruning of a generic plan
+	queryStr := fmt.Sprintf(`SELECT series_id, timestamp, value FROM %s WHERE series_id = ANY($1) AND timestamp >= %d AND timestamp <= %d ORDER BY timestamp ASC%s`, metricsTable, start, end, limitStr)
 
-		return nil
-	})
+	scanner, err := session.Query(queryStr, pq.Array(seriesIDs))
 	if err != nil {
 		return nil, err
 	}
-
+	defer scanner.Close()
 	var (
-		windowApplied              bool
-		windowedAggregatorApplied  bool
-		windowedAggregatorApplied0 bool
+		val      interface{}
+		seriesID int64
+		rows     []*seriesPoint
 	)
-
-	if query.Window != nil {
-		points, err = window(query.Start, query.End, query.Window, points)
-		if err != nil {
+	for scanner.Next() {
+		pt := &point{}
+		if err := scanner.Scan(&seriesID, &pt.Timestamp, &val); err != nil {
 			return nil, err
 		}
-		windowApplied = true
+		if val == nil {
+			pt.Null = true
+		} else {
+			switch v := val.(type) {
+			case int:
+				pt.Value = float64(v)
+			case int32:
+				pt.Value = float64(v)
+			case int64:
+				pt.Value = float64(v)
+			case float32:
+				pt.Value = float64(v)
+			case float64:
+				pt.Value = v
+			default:
+				return nil, errors.New("incorrect type for point value")
+			}
+		}
+		rows = append(rows, &seriesPoint{seriesID: seriesID, pt: pt})
 	}
-
-	if len(points) == 0 {
-		return points, nil
+	if err := scanner.Err(); err != nil {
+		return nil, err
 	}
+	return rows, nil
+}
 
-	for _, aggregator := range query.Aggregators {
-		points, windowedAggregatorApplied0, err = aggregate(aggregator, windowApplied, points)
+func (s *pgStorage) SelectPoints(priority int, metric string, filter *tagFilter, start, end, n int64) ([]*point, error) {
+	var points []*point
+	err := s.db.Query(priority, func(session *sql.DB) error {
+		seriesIDs, err := selectSeriesIDs(session, metric, filter)
 		if err != nil {
-			return nil, err
-		}
-		if windowedAggregatorApplied0 {
-			windowedAggregatorApplied = true
+			return err
 		}
-	}
-
-	// Set windows to 0 if the points are window aggregated since all of the
-	// timestamps will be windows anyway
-	if windowedAggregatorApplied {
-		for _, pt := range points {
-			pt.Window = 0
+		if len(seriesIDs) == 0 {
+			return nil
 		}
-	}
-
-	return points, nil
-}
-
-func deletePoints(db *dbConn, query *deletePointsQuery) error {
-	if query.Metric == "" {
-		return errMetricRequired
-	}
-	if !metricAndTagsRe.MatchString(query.Metric) {
-		return errUnsupportedMetricName
-	}
-	if query.Start == 0 {
-		return errStartRequired
-	}
-	if query.End == 0 {
-		return errEndRequired
-	}
-
-	var (
-		tagStr string
-		err    error
-	)
-
-	queryVals := []interface{}{
-		query.Metric, query.Start, query.End,
-	}
 
-	if len(query.Tags) > 0 {
-		tagStr, queryVals, err = generateTagsQueryStringAndValues(query.Tags, queryVals)
+		rows, err := selectRawPoints(session, seriesIDs, start, end, n)
 		if err != nil {
 			return err
 		}
-	}
-	err = db.Query(priorityCRUD, func(session *sql.DB) error {
-		queryStr := fmt.Sprintf(`DELETE FROM %s WHERE metric = $1 AND timestamp >= $2 AND timestamp <= $3%s`, metricsTable, tagStr)
-
-		if _, err := session.Exec(queryStr, queryVals...); err != nil {
+		chunkPoints, err := selectChunkPoints(session, seriesIDs, start, end)
+		if err != nil {
 			return err
 		}
+		points = mergeChunkPoints(rows, chunkPoints, n)
 		return nil
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return points, nil
 }
 
-func addDownsampler(db *dbConn, downsamplersCountChan chan int, cancelDownsampleWait []chan struct{}, ds *downsampler) error {
-	if ds.Metric == "" {
-		return errMetricRequired
-	}
-	if ds.OutMetric == "" {
-		return errOutMetricRequired
-	}
-	if !metricAndTagsRe.MatchString(ds.Metric) {
-		return errUnsupportedMetricName
-	}
-	if !metricAndTagsRe.MatchString(ds.OutMetric) {
-		return errUnsupportedOutMetricName
-	}
-	if ds.Query == nil {
-		return errQueryRequiredForDownsampler
-	}
-	if ds.Query.Window == nil {
-		return errWindowRequiredForDownsampler
-	}
-	if _, ok := ds.Query.Window["every"]; !ok {
-		return errEveryRequired
-	}
-	if ds.RunEvery == "" {
-		return errRunEveryRequiredForDownsampler
-	}
-	if ds.Query.Aggregators == nil {
-		return errAggregatorsRequiredForDownsampler
-	}
-	if len(ds.Query.Aggregators) == 0 {
-		return errOneAggregatorRequiredForDownsampler
-	}
-	query := fmt.Sprintf("INSERT INTO %s (metric,out_metric,time_update_at,run_every,query,worker_id) VALUES ($1,$2,$3,$4,$5,$6) RETURNING id", downsamplersTable)
-	vals := []interface{}{
-		ds.Metric,
-		ds.OutMetric,
-		0,
-	}
-
-	dur, err := time.ParseDuration(ds.RunEvery)
-	if err != nil {
-		return err
-	}
-	vals = append(vals, dur.Nanoseconds())
-	ds.RunEveryDur = dur
-
-	buf := &bytes.Buffer{}
-	if err := json.NewEncoder(buf).Encode(ds.Query); err != nil {
-		return err
-	}
-	t9 := time.Now()
-	workerID := <-downsamplersCountChan
-	fmt.Println("downsample count chan time=", time.Since(t9))
-	vals = append(vals, buf.String())
-	vals = append(vals, workerID)
+func (s *pgStorage) SelectSeriesPoints(priority int, metric string, filter *tagFilter, start, end int64) ([]*seriesPoints, error) {
+	result := []*seriesPoints{}
+	err := s.db.Query(priority, func(session *sql.DB) error {
+		series, err := selectCatalogSeries(session, metric, filter)
+		if err != nil {
+			return err
+		}
+		if len(series) == 0 {
+			return nil
+		}
+		seriesIDs := make([]int64, len(series))
+		for i, cs := range series {
+			seriesIDs[i] = cs.id
+		}
 
-	err = db.Query(priorityDownsamplers, func(session *sql.DB) error {
-		t7 := time.Now()
-		row := session.QueryRow(query, vals...)
-		if err := row.Scan(&ds.ID); err != nil {
+		rows, err := selectRawPoints(session, seriesIDs, start, end, 0)
+		if err != nil {
 			return err
 		}
-		fmt.Println("downsample insert time=", time.Since(t7))
-		if err := row.Err(); err != nil {
+		chunkPoints, err := selectChunkPoints(session, seriesIDs, start, end)
+		if err != nil {
 			return err
 		}
+		grouped := groupChunkPoints(rows, chunkPoints)
+		for _, cs := range series {
+			if pts := grouped[cs.id]; len(pts) > 0 {
+				result = append(result, &seriesPoints{Tags: cs.tags, Points: pts})
+			}
+		}
 		return nil
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	t0 := time.Now()
-	cancelDownsampleWait[workerID] <- struct{}{}
-	fmt.Println("downsample cancel wait time = ", time.Since(t0))
-	return nil
+	return result, nil
 }
 
-func generateDownsamplersQueryAndValues(dss []*downsampler, downsamplerCountChan chan int) (string, []interface{}, []int, error) {
-	str := &strings.Builder{}
-	values := []interface{}{}
-	workerIDs := []int{}
-	i := 1
-	for z, ds := range dss {
-		if ds.Metric == "" {
-			return "", nil, nil, errMetricRequired
-		}
-		if ds.OutMetric == "" {
-			return "", nil, nil, errOutMetricRequired
-		}
-		if !metricAndTagsRe.MatchString(ds.Metric) {
-			return "", nil, nil, errUnsupportedMetricName
-		}
-		if !metricAndTagsRe.MatchString(ds.OutMetric) {
-			return "", nil, nil, errUnsupportedOutMetricName
-		}
-		if ds.Query == nil {
-			return "", nil, nil, errQueryRequiredForDownsampler
-		}
-		if ds.Query.Window == nil {
-			return "", nil, nil, errWindowRequiredForDownsampler
-		}
-		if _, ok := ds.Query.Window["every"]; !ok {
-			return "", nil, nil, errEveryRequired
-		}
-		if ds.RunEvery == "" {
-			return "", nil, nil, errRunEveryRequiredForDownsampler
-		}
-		if ds.Query.Aggregators == nil {
-			return "", nil, nil, errAggregatorsRequiredForDownsampler
+func (s *pgStorage) SelectSeries(metric string, filter *tagFilter, start, end int64) ([]map[string]string, error) {
+	result := []map[string]string{}
+	err := s.db.Query(priorityCRUD, func(session *sql.DB) error {
+		series, err := selectCatalogSeries(session, metric, filter)
+		if err != nil {
+			return err
 		}
-		if len(ds.Query.Aggregators) == 0 {
-			return "", nil, nil, errOneAggregatorRequiredForDownsampler
+		if len(series) == 0 {
+			return nil
 		}
-		//metric,out_metric,time_update_at,run_every,query,worker_id
-		values = append(values, ds.Metric)
-		values = append(values, ds.OutMetric)
-		values = append(values, 0)
-		dur, err := time.ParseDuration(ds.RunEvery)
-		if err != nil {
-			return "", nil, nil, err
+		// series stay in the catalog after their points are deleted
+		seriesIDs := make([]int64, len(series))
+		for i, cs := range series {
+			seriesIDs[i] = cs.id
 		}
-		values = append(values, dur.Nanoseconds())
-		bs, err := json.Marshal(ds.Query)
+		active, err := selectActiveSeriesIDs(session, seriesIDs, start, end)
 		if err != nil {
-			return "", nil, nil, err
+			return err
 		}
-		values = append(values, string(bs))
-		workerID := <-downsamplerCountChan
-		values = append(values, workerID)
-		if len(workerIDs) < downsamplerWorkerCount {
-			workerIDs = append(workerIDs, workerID)
+		for _, cs := range series {
+			if active[cs.id] {
+				result = append(result, cs.tags)
+			}
 		}
-		str.WriteString(fmt.Sprintf("($%d,$%d,$%d,$%d,$%d,$%d)", i, i+1, i+2, i+3, i+4, i+5))
-		if z+1 < len(dss) {
-			str.WriteString(",")
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// selectActiveSeriesIDs returns the series with points with
+// start <= timestamp <= end, or with any point if start and end are both 0.
+// Series with a chunk overlapping the range count as having points in it.
+func selectActiveSeriesIDs(session queryer, seriesIDs []int64, start, end int64) (map[int64]bool, error) {
+	var pointsRange, chunksRange string
+	if start != 0 || end != 0 {
+		pointsRange = fmt.Sprintf(" AND timestamp >= %d AND timestamp <= %d", start, end)
+		chunksRange = fmt.Sprintf(" AND min_time <= %d AND max_time >= %d", end, start)
+	}
+	queryStr := fmt.Sprintf(`SELECT id FROM unnest($1::bigint[]) AS id WHERE
+EXISTS (SELECT 1 FROM %s WHERE series_id = id%s) OR
+EXISTS (SELECT 1 FROM %s WHERE series_id = id%s)`, metricsTable, pointsRange, chunksTable, chunksRange)
+	scanner, err := session.Query(queryStr, pq.Array(seriesIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer scanner.Close()
+	active := map[int64]bool{}
+	var id int64
+	for scanner.Next() {
+		if err := scanner.Scan(&id); err != nil {
+			return nil, err
 		}
-		i += 6
+		active[id] = true
 	}
+	return active, scanner.Err()
+}
 
-	return str.String(), values, workerIDs, nil
+func (s *pgStorage) SelectMetrics() ([]string, error) {
+	metrics := []string{}
+	err := s.db.Query(priorityCRUD, func(session *sql.DB) error {
+		// series stay in the catalog after their points are deleted
+		scanner, err := session.Query(fmt.Sprintf(`SELECT DISTINCT metric FROM %s s WHERE
+EXISTS (SELECT 1 FROM %s WHERE series_id = s.id) OR
+EXISTS (SELECT 1 FROM %s WHERE series_id = s.id) ORDER BY metric`, seriesTable, metricsTable, chunksTable))
+		if err != nil {
+			return err
+		}
+		defer scanner.Close()
+		var metric string
+		for scanner.Next() {
+			if err := scanner.Scan(&metric); err != nil {
+				return err
+			}
+			metrics = append(metrics, metric)
+		}
+		return scanner.Err()
+	})
+	return metrics, err
 }
 
-func addDownsamplers(db *dbConn, downsamplersCountChan chan int, cancelDownsampleWait []chan struct{}, downsamplers []*downsampler) error {
-	insertStr, values, workerIDs, err := generateDownsamplersQueryAndValues(downsamplers, downsamplersCountChan)
+func (s *pgStorage) DeletePoints(query *deletePointsQuery) error {
+	filter, err := newQueryTagFilter(query.Tags, query.Filter)
 	if err != nil {
 		return err
 	}
-	query := fmt.Sprintf("INSERT INTO %s (metric,out_metric,time_update_at,run_every,query,worker_id) VALUES %s", downsamplersTable, insertStr)
+	return s.db.Query(priorityCRUD, func(session *sql.DB) error {
+		seriesIDs, err := selectSeriesIDs(session, query.Metric, filter)
+		if err != nil {
+			return err
+		}
+		if len(seriesIDs) == 0 {
+			return nil
+		}
 
-	err = db.Query(priorityDownsamplers, func(session *sql.DB) error {
+		queryStr := fmt.Sprintf(`DELETE FROM %s WHERE series_id = ANY($1) AND timestamp >= %d AND timestamp <= %d`, metricsTable, query.Start, query.End)
 
-		t7 := time.Now()
-		_, err = session.Exec(query, values...)
-		fmt.Println("downsample insert time=", time.Since(t7))
+		if _, err := session.Exec(queryStr, pq.Array(seriesIDs)); err != nil {
+			return err
+		}
+		_, err = deleteChunkPoints(session, seriesIDs, query.Start, query.End)
 		return err
 	})
-	if err != nil {
-		return err
-	}
-
-	t0 := time.Now()
-	for _, workerID := range workerIDs {
-		cancelDownsampleWait[workerID] <- struct{}{}
-	}
-	fmt.Println("downsamples cancel wait time = ", time.Since(t0))
-	return nil
 }
 
-func deleteDownsampler(db *dbConn, ds *deleteDownsamplerRequest) error {
-	query := fmt.Sprintf("DELETE FROM %s WHERE id = $1", downsamplersTable)
-	vals := []interface{}{
-		ds.ID,
-	}
-	err := db.Query(priorityDownsamplers, func(session *sql.DB) error {
-		_, err := session.Exec(query, vals...)
+// InsertDownsamplers inserts the downsamplers in a single transaction
+func (s *pgStorage) InsertDownsamplers(dss []*downsampler) error {
+	query := fmt.Sprintf("INSERT INTO %s (metric,out_metric,time_update_at,run_every,query,worker_id) VALUES ($1,$2,$3,$4,$5,$6) RETURNING id", downsamplersTable)
+	return s.db.Query(priorityDownsamplers, func(session *sql.DB) error {
+		tx, err := session.Begin()
 		if err != nil {
 			return err
 		}
-		return nil
+		for _, ds := range dss {
+			bs, err := json.Marshal(ds.Query)
+			if err != nil {
+				if err0 := tx.Rollback(); err0 != nil {
+					log.Errorf("InsertDownsamplers rollback error: %s", err0)
+				}
+				return err
+			}
+			row := tx.QueryRow(query, ds.Metric, ds.OutMetric, 0, ds.RunEveryDur.Nanoseconds(), string(bs), ds.WorkerID)
+			if err := row.Scan(&ds.ID); err != nil {
+				if err0 := tx.Rollback(); err0 != nil {
+					log.Errorf("InsertDownsamplers rollback error: %s", err0)
+				}
+				return err
+			}
+		}
+		return tx.Commit()
 	})
-	if err != nil {
-		return err
-	}
+}
 
-	return nil
+func (s *pgStorage) DeleteDownsampler(id int64) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE id = $1", downsamplersTable)
+	return s.db.Query(priorityDownsamplers, func(session *sql.DB) error {
+		_, err := session.Exec(query, id)
+		return err
+	})
 }
 
-func selectLastTimestamp(db *dbConn, metric string, tags map[string]string) (int64, error) {
-	vals := []interface{}{
-		metric,
-	}
-	tagsStr, vals, err := generateTagsQueryStringAndValues(tags, vals)
-	if err != nil {
-		return 0, err
-	}
+func (s *pgStorage) NextDownsampler(workerID int) (*downsampler, int64, error) {
 	var (
-		timestamp int64
+		timeUpdateAt int64
+		ds           = &downsampler{WorkerID: workerID}
 	)
-	err = db.Query(priorityDownsamplers, func(session *sql.DB) error {
-		query := fmt.Sprintf("SELECT timestamp FROM %s WHERE metric = $1%s ORDER BY timestamp DESC LIMIT 1", metricsTable, tagsStr)
-		scanner := session.QueryRow(query, vals...)
-		if err := scanner.Scan(&timestamp); err != nil {
+	err := s.db.Query(priorityDownsamplers, func(db *sql.DB) error {
+		var (
+			queryJSON             string
+			runEvery              int64
+			lastDownsampledWindow interface{}
+		)
+		query := fmt.Sprintf("SELECT id,metric,out_metric,run_every,last_downsampled_window,query,time_update_at FROM %s WHERE worker_id = $1 ORDER BY time_update_at ASC LIMIT 1", downsamplersTable)
+		row := db.QueryRow(query, workerID)
+		err := row.Scan(
+			&ds.ID,
+			&ds.Metric,
+			&ds.OutMetric,
+			&runEvery,
+			&lastDownsampledWindow,
+			&queryJSON,
+			&timeUpdateAt,
+		)
+		if err != nil {
 			return err
 		}
-		if err := scanner.Err(); err != nil {
+		if lastDownsampledWindow != nil {
+			switch v := lastDownsampledWindow.(type) {
+			case int:
+				ds.LastDownsampledWindow = int64(v)
+			case int32:
+				ds.LastDownsampledWindow = int64(v)
+			case int64:
+				ds.LastDownsampledWindow = v
+			default:
+				return errLastDownsampledWindowType
+			}
+		}
+		ds.RunEvery = time.Duration(runEvery).String()
+		ds.RunEveryDur = time.Duration(runEvery)
+
+		ds.Query = &downsampleQuery{}
+		return json.Unmarshal([]byte(queryJSON), &ds.Query)
+	})
+	return ds, timeUpdateAt, err
+}
+
+func (s *pgStorage) UpdateDownsamplerTimeUpdateAt(id int64, timeUpdateAt int64) error {
+	return s.db.Query(priorityDownsamplers, func(db *sql.DB) error {
+		query := fmt.Sprintf("UPDATE %s SET time_update_at = $1 WHERE id = $2", downsamplersTable)
+		_, err := db.Exec(query, timeUpdateAt, id)
+		return err
+	})
+}
+
+func (s *pgStorage) CommitDownsample(ds *downsampler, series []*seriesPoints) error {
+	return s.db.Query(priorityDownsamplers, func(db0 *sql.DB) error {
+		ipts := []*insertPointQuery{}
+		for _, sp := range series {
+			for _, pt := range sp.Points {
+				ipts = append(ipts, &insertPointQuery{
+					Metric: ds.OutMetric,
+					Tags:   sp.Tags,
+					Point:  pt,
+				})
+			}
+		}
+
+		// partitions are created outside of the transaction, a rollback
+		// would otherwise leave the partition cache out of sync
+		timestamps := make([]int64, len(ipts))
+		for i, ipt := range ipts {
+			timestamps[i] = ipt.Point.Timestamp
+		}
+		if err := ensurePartitions(db0, timestamps); err != nil {
 			return err
 		}
-		return nil
+
+		tx, err := db0.BeginTx(context.Background(), nil)
+		if err != nil {
+			return err
+		}
+		rollback := func(err error) error {
+			if err0 := tx.Rollback(); err0 != nil {
+				log.Errorf("CommitDownsample rollback error: %s", err0)
+			}
+			return err
+		}
+
+		if last, ok := lastDownsampledWindow(series); ok {
+			if err := insertPointsTx(tx, ipts, onConflictOverwrite); err != nil {
+				return rollback(err)
+			}
+
+			if err := updateLastDownsampledWindowTx(tx, ds.ID, last); err != nil {
+				return rollback(err)
+			}
+		}
+		return tx.Commit()
 	})
+}
 
-	return timestamp, err
+func (s *pgStorage) LastTimestamp(metric string, filter *tagFilter) (int64, error) {
+	return selectBoundaryTimestamp(s.db, metric, filter, "DESC")
 }
 
-func selectFirstTimestamp(db *dbConn, metric string, tags map[string]string) (int64, error) {
-	vals := []interface{}{
-		metric,
-	}
-	tagsStr, vals, err := generateTagsQueryStringAndValues(tags, vals)
-	if err != nil {
-		return 0, err
-	}
+func (s *pgStorage) FirstTimestamp(metric string, filter *tagFilter) (int64, error) {
+	return selectBoundaryTimestamp(s.db, metric, filter, "ASC")
+}
+
+// selectBoundaryTimestamp returns the first (order ASC) or last (order DESC)
+// timestamp of a metric. A single query over the parent table lets Postgres
+// merge the partitions' index scans in order and stop at the first row. The
+// result is combined with the boundary of the compressed chunks.
+func selectBoundaryTimestamp(db *dbConn, metric string, filter *tagFilter, order string) (int64, error) {
 	var (
 		timestamp int64
 	)
-	err = db.Query(priorityDownsamplers, func(session *sql.DB) error {
-		query := fmt.Sprintf("SELECT timestamp FROM %s WHERE metric = $1%s ORDER BY timestamp ASC LIMIT 1", metricsTable, tagsStr)
-		scanner := session.QueryRow(query, vals...)
-
-		if err := scanner.Scan(&timestamp); err != nil {
+	err := db.Query(priorityDownsamplers, func(session *sql.DB) error {
+		seriesIDs, err := selectSeriesIDs(session, metric, filter)
+		if err != nil {
 			return err
 		}
-		if err := scanner.Err(); err != nil {
+		if len(seriesIDs) == 0 {
+			return sql.ErrNoRows
+		}
+		chunkTimestamp, compressed, err := selectChunkBoundaryTimestamp(session, seriesIDs, order)
+		if err != nil {
 			return err
 		}
+		query := fmt.Sprintf("SELECT timestamp FROM %s WHERE series_id = ANY($1) ORDER BY timestamp %s LIMIT 1", metricsTable, order)
+		err = session.QueryRow(query, pq.Array(seriesIDs)).Scan(&timestamp)
+		switch {
+		case err == sql.ErrNoRows && compressed:
+			timestamp = chunkTimestamp
+			return nil
+		case err != nil:
+			return err
+		}
+		if compressed && ((order == "DESC" && chunkTimestamp > timestamp) || (order == "ASC" && chunkTimestamp < timestamp)) {
+			timestamp = chunkTimestamp
+		}
 		return nil
 	})
 
 	return timestamp, err
 }
 
-func updateFirstPointDownsampleTx(tx *sql.Tx, metric string, tags map[string]string, point *point) error {
-	vals := []interface{}{
-		point.Value,
-		metric,
-		point.Timestamp,
-	}
-	tagsStr, vals, err := generateTagsQueryStringAndValues(tags, vals)
-	if err != nil {
-		return err
-	}
-	query := fmt.Sprintf("UPDATE %s SET value = $1 WHERE metric = $2 AND timestamp = $3%s", metricsTable, tagsStr)
-	if _, err := tx.Exec(query, vals...); err != nil {
-		return err
-	}
-	return nil
-}
-
 func updateLastDownsampledWindowTx(tx *sql.Tx, id int64, lastTimestamp int64) error {
 	vals := []interface{}{
 		lastTimestamp,
@@ -824,7 +902,7 @@ func updateLastDownsampledWindowTx(tx *sql.Tx, id int64, lastTimestamp int64) er
 	return nil
 }
 
-func insertPointsTx(db *dbConn, tx *sql.Tx, queries0 []*insertPointQuery) error {
+func insertPointsTx(tx *sql.Tx, queries0 []*insertPointQuery, onConflict string) error {
 	if len(queries0) == 0 {
 		return nil
 	}
@@ -832,18 +910,13 @@ func insertPointsTx(db *dbConn, tx *sql.Tx, queries0 []*insertPointQuery) error
 	// max insert limit of postgres
 	for i := 0; i < len(queries0); i += insertBatchSize {
 		queries := queries0[i:min1(i+insertBatchSize, len(queries0))]
-		valuesStr, values, uniqueTagCombinations, err := generateInsertStringsAndValues(queries)
+		// series created here only become visible if tx commits so they
+		// aren't cached
+		seriesIDs, err := resolveSeriesIDs(tx, queries, false)
 		if err != nil {
 			return err
 		}
-		for _, s := range uniqueTagCombinations {
-			if len(s) == 0 {
-				continue
-			}
-			go createIndex(db, s)
-		}
-		queryStr := fmt.Sprintf(`INSERT INTO %s (metric,timestamp,value,tags) VALUES %s ON CONFLICT DO NOTHING` /* */, metricsTable, valuesStr)
-		if _, err := tx.Exec(queryStr, values...); err != nil { //&& err.Error() != fmt.Sprintf(errStringDuplicate, strings.ToLower(firstMetric)) {
+		if _, _, err := execInsertPoints(tx, queries, seriesIDs, onConflict); err != nil {
 			return err
 		}
 	}
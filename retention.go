@@ -0,0 +1,264 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	retentionTable                   = `simpletsdb_retention`
+	priorityRetention                = 0
+	retentionEnforceInterval         = time.Hour
+	errRetentionRequired             = errors.New("retention is required")
+	errRetentionNotPositive          = errors.New("retention must be positive")
+	errRetentionIntervalNotPositive  = errors.New("retention interval must be positive")
+	errUnsupportedRetentionPolicyKey = errors.New("retention metric must be a metric name, a metric prefix ending in * or * for the default")
+)
+
+func retentionTableMigration(session queryer) ([]string, error) {
+	return []string{
+		fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	metric text PRIMARY KEY,
+	retention bigint NOT NULL
+)`, retentionTable),
+	}, nil
+}
+
+func validateRetentionPolicyKey(key string) error {
+	if key == "*" {
+		return nil
+	}
+	if !metricAndTagsRe.MatchString(strings.TrimSuffix(key, "*")) {
+		return errUnsupportedRetentionPolicyKey
+	}
+	return nil
+}
+
+// matchRetentionPolicy returns the policy that applies to metric: an exact
+// match wins over the longest matching prefix which wins over the default.
+func matchRetentionPolicy(policies []*retentionPolicy, metric string) *retentionPolicy {
+	var (
+		match     *retentionPolicy
+		matchRank int
+	)
+	for _, p := range policies {
+		rank := 0
+		switch {
+		case p.Metric == metric:
+			rank = len(p.Metric) + 2
+		case p.Metric == "*":
+			rank = 1
+		case strings.HasSuffix(p.Metric, "*") && strings.HasPrefix(metric, strings.TrimSuffix(p.Metric, "*")):
+			rank = len(p.Metric)
+		}
+		if rank > matchRank {
+			match, matchRank = p, rank
+		}
+	}
+	return match
+}
+
+func setRetentionPolicy(s Storage, policy *retentionPolicy) error {
+	if policy.Metric == "" {
+		return errMetricRequired
+	}
+	if err := validateRetentionPolicyKey(policy.Metric); err != nil {
+		return err
+	}
+	if policy.Retention == "" {
+		return errRetentionRequired
+	}
+	dur, err := parseDuration(policy.Retention)
+	if err != nil {
+		return err
+	}
+	if dur <= 0 {
+		return errRetentionNotPositive
+	}
+	policy.RetentionDur = dur
+	return s.SetRetentionPolicy(policy)
+}
+
+func deleteRetentionPolicy(s Storage, req *deleteRetentionPolicyRequest) error {
+	if req.Metric == "" {
+		return errMetricRequired
+	}
+	return s.DeleteRetentionPolicy(req.Metric)
+}
+
+func enforceRetention(s Storage) error {
+	policies, err := s.SelectRetentionPolicies()
+	if err != nil {
+		return err
+	}
+	if len(policies) == 0 {
+		return nil
+	}
+	t0 := time.Now()
+	n, err := s.EnforceRetention(policies, t0.UnixNano())
+	if err != nil {
+		return err
+	}
+	log.Infof("retention: removed %d expired points in %s", n, time.Since(t0))
+	return nil
+}
+
+func handleRetention(s Storage) {
+	for {
+		if err := enforceRetention(s); err != nil {
+			log.Errorf("handleRetention: %s", err)
+		}
+		time.Sleep(retentionEnforceInterval)
+	}
+}
+
+func (s *pgStorage) SetRetentionPolicy(policy *retentionPolicy) error {
+	return s.db.Query(priorityCRUD, func(session *sql.DB) error {
+		query := fmt.Sprintf("INSERT INTO %s (metric,retention) VALUES ($1,$2) ON CONFLICT (metric) DO UPDATE SET retention = EXCLUDED.retention", retentionTable)
+		_, err := session.Exec(query, policy.Metric, policy.RetentionDur.Nanoseconds())
+		return err
+	})
+}
+
+func (s *pgStorage) SelectRetentionPolicies() ([]*retentionPolicy, error) {
+	policies := []*retentionPolicy{}
+	err := s.db.Query(priorityCRUD, func(session *sql.DB) error {
+		scanner, err := session.Query(fmt.Sprintf("SELECT metric, retention FROM %s ORDER BY metric", retentionTable))
+		if err != nil {
+			return err
+		}
+		defer scanner.Close()
+		var retention int64
+		for scanner.Next() {
+			p := &retentionPolicy{}
+			if err := scanner.Scan(&p.Metric, &retention); err != nil {
+				return err
+			}
+			p.RetentionDur = time.Duration(retention)
+			p.Retention = p.RetentionDur.String()
+			policies = append(policies, p)
+		}
+		return scanner.Err()
+	})
+	return policies, err
+}
+
+func (s *pgStorage) DeleteRetentionPolicy(metric string) error {
+	return s.db.Query(priorityCRUD, func(session *sql.DB) error {
+		_, err := session.Exec(fmt.Sprintf("DELETE FROM %s WHERE metric = $1", retentionTable), metric)
+		return err
+	})
+}
+
+// EnforceRetention drops whole partitions where possible before deleting the
+// remaining expired rows
+func (s *pgStorage) EnforceRetention(policies []*retentionPolicy, now int64) (int64, error) {
+	if err := dropExpiredPartitions(s.db, policies, now); err != nil {
+		return 0, err
+	}
+	return deleteExpiredPoints(s.db, policies, now)
+}
+
+// dropExpiredPartitions drops partitions that only hold points older than
+// every retention policy. This is only possible with a default policy since
+// metrics without a policy are kept forever.
+func dropExpiredPartitions(db *dbConn, policies []*retentionPolicy, now int64) error {
+	if matchRetentionPolicy(policies, "") == nil {
+		return nil
+	}
+	var maxRetention time.Duration
+	for _, p := range policies {
+		if p.RetentionDur > maxRetention {
+			maxRetention = p.RetentionDur
+		}
+	}
+	cutoff := now - maxRetention.Nanoseconds()
+
+	return db.Query(priorityRetention, func(session *sql.DB) error {
+		for _, partition := range metricsPartitions.list() {
+			if partition.end > cutoff {
+				break
+			}
+			var estimate float64
+			row := session.QueryRow("SELECT reltuples FROM pg_class WHERE relname = $1", partition.name)
+			if err := row.Scan(&estimate); err != nil {
+				return err
+			}
+			if _, err := session.Exec(fmt.Sprintf("DROP TABLE %s", partition.name)); err != nil {
+				return err
+			}
+			log.Infof("retention: dropped partition %s (~%d points)", partition.name, int64(estimate))
+		}
+		return loadPartitions(session)
+	})
+}
+
+func deleteExpiredPoints(db *dbConn, policies []*retentionPolicy, now int64) (int64, error) {
+	var total int64
+	err := db.Query(priorityRetention, func(session *sql.DB) error {
+		scanner, err := session.Query(fmt.Sprintf("SELECT metric, array_agg(id) FROM %s GROUP BY metric", seriesTable))
+		if err != nil {
+			return err
+		}
+		type metricSeries struct {
+			metric string
+			ids    []int64
+		}
+		metrics := []*metricSeries{}
+		for scanner.Next() {
+			m := &metricSeries{}
+			if err := scanner.Scan(&m.metric, pq.Array(&m.ids)); err != nil {
+				scanner.Close()
+				return err
+			}
+			metrics = append(metrics, m)
+		}
+		scanner.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+
+		for _, m := range metrics {
+			policy := matchRetentionPolicy(policies, m.metric)
+			if policy == nil {
+				continue
+			}
+			cutoff := now - policy.RetentionDur.Nanoseconds()
+			res, err := session.Exec(fmt.Sprintf("DELETE FROM %s WHERE series_id = ANY($1) AND timestamp < %d", metricsTable, cutoff), pq.Array(m.ids))
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			// chunks whose points all expired are dropped without decoding
+			// them, chunks straddling the cutoff are re-encoded without the
+			// expired points
+			var compressed int64
+			row := session.QueryRow(fmt.Sprintf("WITH deleted AS (DELETE FROM %s WHERE series_id = ANY($1) AND max_time < %d RETURNING count) SELECT coalesce(sum(count), 0) FROM deleted", chunksTable, cutoff), pq.Array(m.ids))
+			if err := row.Scan(&compressed); err != nil {
+				return err
+			}
+			trimmed, err := deleteChunkPoints(session, m.ids, math.MinInt64, cutoff-1)
+			if err != nil {
+				return err
+			}
+			n += compressed + trimmed
+			if n > 0 {
+				log.Infof("retention: deleted %d points of %s older than %s (policy %s)", n, m.metric, policy.Retention, policy.Metric)
+			}
+			total += n
+		}
+		return nil
+	})
+	return total, err
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchRetentionPolicy(t *testing.T) {
+	policies := []*retentionPolicy{
+		{Metric: "*", RetentionDur: time.Hour * 24 * 7},
+		{Metric: "price*", RetentionDur: time.Hour * 24 * 30},
+		{Metric: "price_high*", RetentionDur: time.Hour * 24 * 60},
+		{Metric: "price_high_15m", RetentionDur: time.Hour * 24 * 365},
+	}
+
+	require.Equal(t, policies[3], matchRetentionPolicy(policies, "price_high_15m"))
+	require.Equal(t, policies[2], matchRetentionPolicy(policies, "price_high"))
+	require.Equal(t, policies[1], matchRetentionPolicy(policies, "price"))
+	require.Equal(t, policies[0], matchRetentionPolicy(policies, "volume"))
+	require.Nil(t, matchRetentionPolicy(policies[1:], "volume"))
+
+	require.Nil(t, validateRetentionPolicyKey("*"))
+	require.Nil(t, validateRetentionPolicyKey("price_high*"))
+	require.Equal(t, errUnsupportedRetentionPolicyKey, validateRetentionPolicyKey("price high"))
+}
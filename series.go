@@ -0,0 +1,244 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// series catalog cache: (metric, sorted tags) -> series id
+
+type seriesCache struct {
+	mu  sync.RWMutex
+	ids map[string]int64
+}
+
+var seriesIDCache = &seriesCache{ids: map[string]int64{}}
+
+func (c *seriesCache) get(key string) (int64, bool) {
+	c.mu.RLock()
+	id, ok := c.ids[key]
+	c.mu.RUnlock()
+	return id, ok
+}
+
+func (c *seriesCache) set(key string, id int64) {
+	c.mu.Lock()
+	c.ids[key] = id
+	c.mu.Unlock()
+}
+
+// marshalTags returns the canonical jsonb representation of a tag set.
+// encoding/json sorts map keys so equal tag sets produce equal strings.
+func marshalTags(tags map[string]string) (string, error) {
+	if len(tags) == 0 {
+		return "{}", nil
+	}
+	bs, err := json.Marshal(tags)
+	if err != nil {
+		return "", err
+	}
+	return string(bs), nil
+}
+
+func seriesKey(metric, tagsJSON string) string {
+	return metric + " " + tagsJSON
+}
+
+// upsertSeries returns the series ids for the given (metric, tags json) keys,
+// creating series rows that don't exist yet. The rows are written in key
+// order so concurrent upserts lock them in the same order and can't deadlock.
+func upsertSeries(session queryer, keys []string, metrics []string, tagsJSON []string) (map[string]int64, error) {
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return keys[order[i]] < keys[order[j]]
+	})
+	valuesStr := &strings.Builder{}
+	values := []interface{}{}
+	for n, i := range order {
+		valuesStr.WriteString(fmt.Sprintf("($%d,$%d::jsonb)", n*2+1, n*2+2))
+		if n+1 < len(order) {
+			valuesStr.WriteString(",")
+		}
+		values = append(values, metrics[i], tagsJSON[i])
+	}
+	// DO UPDATE instead of DO NOTHING so RETURNING includes existing rows
+	query := fmt.Sprintf(`INSERT INTO %s (metric,tags) VALUES %s ON CONFLICT (metric,tags) DO UPDATE SET metric = EXCLUDED.metric RETURNING id, metric, tags`, seriesTable, valuesStr.String())
+	scanner, err := session.Query(query, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer scanner.Close()
+
+	ids := map[string]int64{}
+	var (
+		id     int64
+		metric string
+		tags   string
+	)
+	for scanner.Next() {
+		if err := scanner.Scan(&id, &metric, &tags); err != nil {
+			return nil, err
+		}
+		m := map[string]string{}
+		if err := json.Unmarshal([]byte(tags), &m); err != nil {
+			return nil, err
+		}
+		tags0, err := marshalTags(m)
+		if err != nil {
+			return nil, err
+		}
+		ids[seriesKey(metric, tags0)] = id
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// resolveSeriesIDs maps every insert query to its series id. Ids are taken from
+// the in-process cache when possible; the rest are upserted with session. When
+// cacheResults is false (e.g. inside a transaction that may roll back) newly
+// resolved ids aren't cached.
+func resolveSeriesIDs(session queryer, queries []*insertPointQuery, cacheResults bool) ([]int64, error) {
+	ids := make([]int64, len(queries))
+	keys := make([]string, len(queries))
+	var (
+		missingKeys    []string
+		missingMetrics []string
+		missingTags    []string
+		seen           = map[string]bool{}
+	)
+	for i, query := range queries {
+		if !metricAndTagsRe.MatchString(query.Metric) {
+			return nil, errUnsupportedMetricName
+		}
+		if query.Point == nil {
+			return nil, errPointRequiredForInsertQuery
+		}
+		tagsJSON, err := marshalTags(query.Tags)
+		if err != nil {
+			return nil, err
+		}
+		key := seriesKey(query.Metric, tagsJSON)
+		keys[i] = key
+		if id, ok := seriesIDCache.get(key); ok {
+			ids[i] = id
+			continue
+		}
+		if !seen[key] {
+			seen[key] = true
+			missingKeys = append(missingKeys, key)
+			missingMetrics = append(missingMetrics, query.Metric)
+			missingTags = append(missingTags, tagsJSON)
+		}
+	}
+
+	if len(missingKeys) == 0 {
+		return ids, nil
+	}
+
+	resolved, err := upsertSeries(session, missingKeys, missingMetrics, missingTags)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		if ids[i] != 0 {
+			continue
+		}
+		id, ok := resolved[key]
+		if !ok {
+			return nil, fmt.Errorf("could not resolve series id for %s", key)
+		}
+		ids[i] = id
+	}
+	if cacheResults {
+		for key, id := range resolved {
+			seriesIDCache.set(key, id)
+		}
+	}
+	return ids, nil
+}
+
+// catalogSeries is a row of the series table
+type catalogSeries struct {
+	id   int64
+	tags map[string]string
+}
+
+// selectCatalogSeries returns the series of metric whose tags match filter
+// ordered by id
+func selectCatalogSeries(session queryer, metric string, filter *tagFilter) ([]*catalogSeries, error) {
+	vals := []interface{}{
+		metric,
+	}
+	tagsStr, vals, err := generateTagsQueryStringAndValues(filter, vals)
+	if err != nil {
+		return nil, err
+	}
+	scanner, err := session.Query(fmt.Sprintf("SELECT id, tags FROM %s WHERE metric = $1%s ORDER BY id", seriesTable, tagsStr), vals...)
+	if err != nil {
+		return nil, err
+	}
+	defer scanner.Close()
+
+	series := []*catalogSeries{}
+	var tagsJSON []byte
+	for scanner.Next() {
+		cs := &catalogSeries{}
+		if err := scanner.Scan(&cs.id, &tagsJSON); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(tagsJSON, &cs.tags); err != nil {
+			return nil, err
+		}
+		series = append(series, cs)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return series, nil
+}
+
+// selectSeriesIDs returns the ids of every series of metric whose tags
+// match filter
+func selectSeriesIDs(session queryer, metric string, filter *tagFilter) ([]int64, error) {
+	vals := []interface{}{
+		metric,
+	}
+	tagsStr, vals, err := generateTagsQueryStringAndValues(filter, vals)
+	if err != nil {
+		return nil, err
+	}
+	scanner, err := session.Query(fmt.Sprintf("SELECT id FROM %s WHERE metric = $1%s", seriesTable, tagsStr), vals...)
+	if err != nil {
+		return nil, err
+	}
+	defer scanner.Close()
+
+	ids := []int64{}
+	var id int64
+	for scanner.Next() {
+		if err := scanner.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
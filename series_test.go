@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var errQueryerUnavailable = errors.New("no database in unit tests")
+
+// recordingQueryer records the queries it gets and fails them
+type recordingQueryer struct {
+	queries []string
+	args    [][]interface{}
+}
+
+func (q *recordingQueryer) record(query string, args []interface{}) {
+	q.queries = append(q.queries, query)
+	q.args = append(q.args, args)
+}
+
+func (q *recordingQueryer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	q.record(query, args)
+	return nil, errQueryerUnavailable
+}
+
+func (q *recordingQueryer) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	q.record(query, args)
+	return nil, errQueryerUnavailable
+}
+
+func (q *recordingQueryer) QueryRow(query string, args ...interface{}) *sql.Row {
+	q.record(query, args)
+	return nil
+}
+
+func TestMarshalTags(t *testing.T) {
+	for _, tags := range []map[string]string{nil, {}} {
+		tagsJSON, err := marshalTags(tags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, "{}", tagsJSON)
+	}
+
+	// equal tag sets give equal keys whatever order they were built in
+	a := map[string]string{}
+	b := map[string]string{}
+	for _, k := range []string{"host", "dc", "role", "az"} {
+		a[k] = k + "1"
+	}
+	for _, k := range []string{"az", "role", "dc", "host"} {
+		b[k] = k + "1"
+	}
+	for i := 0; i < 10; i++ {
+		aJSON, err := marshalTags(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bJSON, err := marshalTags(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		require.Equal(t, `{"az":"az1","dc":"dc1","host":"host1","role":"role1"}`, aJSON)
+		require.Equal(t, seriesKey("cpu", aJSON), seriesKey("cpu", bJSON))
+	}
+	require.NotEqual(t, seriesKey("cpu", "{}"), seriesKey("cpu.user", "{}"))
+}
+
+func TestResolveSeriesIDsCached(t *testing.T) {
+	defer func(cache *seriesCache) { seriesIDCache = cache }(seriesIDCache)
+	seriesIDCache = &seriesCache{ids: map[string]int64{}}
+	seriesIDCache.set(seriesKey("cpu", `{"host":"web1"}`), 1)
+	seriesIDCache.set(seriesKey("cpu", "{}"), 2)
+
+	// cached series are resolved without querying the catalog
+	q := &recordingQueryer{}
+	ids, err := resolveSeriesIDs(q, []*insertPointQuery{
+		{Metric: "cpu", Tags: map[string]string{"host": "web1"}, Point: &point{Timestamp: 1}},
+		{Metric: "cpu", Point: &point{Timestamp: 1}},
+		{Metric: "cpu", Tags: map[string]string{"host": "web1"}, Point: &point{Timestamp: 2}},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []int64{1, 2, 1}, ids)
+	require.Empty(t, q.queries)
+
+	// missing series are upserted once each in key order
+	_, err = resolveSeriesIDs(q, []*insertPointQuery{
+		{Metric: "mem", Tags: map[string]string{"host": "web2"}, Point: &point{Timestamp: 1}},
+		{Metric: "cpu", Tags: map[string]string{"host": "web1"}, Point: &point{Timestamp: 1}},
+		{Metric: "disk", Point: &point{Timestamp: 1}},
+		{Metric: "mem", Tags: map[string]string{"host": "web2"}, Point: &point{Timestamp: 2}},
+		{Metric: "cpu", Tags: map[string]string{"host": "web3"}, Point: &point{Timestamp: 1}},
+	}, true)
+	require.Equal(t, errQueryerUnavailable, err)
+	require.Len(t, q.queries, 1)
+	require.Equal(t, []interface{}{
+		"cpu", `{"host":"web3"}`,
+		"disk", "{}",
+		"mem", `{"host":"web2"}`,
+	}, q.args[0])
+	_, ok := seriesIDCache.get(seriesKey("disk", "{}"))
+	require.False(t, ok)
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"regexp"
+	"strconv"
 	"time"
 
+	"github.com/golang/snappy"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/julienschmidt/httprouter"
@@ -16,17 +20,36 @@ var (
 	readLineProtocolBufferSize = 65536
 )
 
-func initServer(db *dbConn, downsamplersCountChan chan int, cancelDownsampleWait []chan struct{}, tsdbHost string, tsdbPort int, tsdbReadTimeout, tsdbWriteTimeout time.Duration, readLineProtocolBufferSizeP int) {
+func initServer(s Storage, downsamplersCountChan chan int, cancelDownsampleWait []chan struct{}, tsdbHost string, tsdbPort int, tsdbReadTimeout, tsdbWriteTimeout time.Duration, readLineProtocolBufferSizeP int) {
 	router := httprouter.New()
-	router.POST("/insert_points", withDB(db, insertPointsHandler))
-	router.POST("/query_points", withDB(db, queryPointsHandler))
-	router.DELETE("/delete_points", withDB(db, deletePointsHandler))
-	router.POST("/add_downsampler", withDbAndDownsamplerChannels(db, downsamplersCountChan, cancelDownsampleWait, addDownsamplerHandler))
-	router.POST("/add_downsamplers", withDbAndDownsamplerChannels(db, downsamplersCountChan, cancelDownsampleWait, addDownsamplersHandler))
-	router.GET("/list_downsamplers", withDB(db, listDownsamplersHandler))
-	router.DELETE("/delete_downsampler", withDB(db, deleteDownsamplerHandler))
-
-	s := &http.Server{
+	router.POST("/insert_points", withDecompression(withStorage(s, insertPointsHandler)))
+	router.POST("/import_csv", withDecompression(withStorage(s, importCSVHandler)))
+	router.POST("/query_points", withDecompression(withStorage(s, queryPointsHandler)))
+	router.DELETE("/delete_points", withStorage(s, deletePointsHandler))
+	router.POST("/add_downsampler", withStorageAndDownsamplerChannels(s, downsamplersCountChan, cancelDownsampleWait, addDownsamplerHandler))
+	router.POST("/add_downsamplers", withStorageAndDownsamplerChannels(s, downsamplersCountChan, cancelDownsampleWait, addDownsamplersHandler))
+	router.GET("/list_downsamplers", withStorage(s, listDownsamplersHandler))
+	router.DELETE("/delete_downsampler", withStorage(s, deleteDownsamplerHandler))
+	router.POST("/set_retention_policy", withStorage(s, setRetentionPolicyHandler))
+	router.GET("/list_retention_policies", withStorage(s, listRetentionPoliciesHandler))
+	router.DELETE("/delete_retention_policy", withStorage(s, deleteRetentionPolicyHandler))
+	router.GET("/compression_stats", withStorage(s, compressionStatsHandler))
+	router.GET("/spool_stats", spoolStatsHandler)
+	router.GET("/metrics", withStorage(s, metricsHandler))
+	router.GET("/tag_keys", withStorage(s, tagKeysHandler))
+	router.GET("/tag_values", withStorage(s, tagValuesHandler))
+	router.GET("/series", withStorage(s, seriesHandler))
+	router.GET("/stats", withStorage(s, statsHandler))
+	router.POST("/api/v2/write", withDecompression(withStorage(s, influxV2WriteHandler)))
+	router.POST("/write", withDecompression(withStorage(s, influxV1WriteHandler)))
+	router.POST("/api/v1/prom/write", withStorage(s, promWriteHandler))
+	router.POST("/api/v1/prom/read", withStorage(s, promReadHandler))
+	router.POST("/v1/metrics", withDecompression(withStorage(s, otlpMetricsHandler)))
+	router.POST("/api/put", withDecompression(withStorage(s, openTSDBPutHandler)))
+	router.GET("/api/query", withStorage(s, openTSDBQueryHandler))
+	router.POST("/api/query", withDecompression(withStorage(s, openTSDBQueryHandler)))
+
+	server := &http.Server{
 		Addr:           fmt.Sprintf("%s:%d", tsdbHost, tsdbPort),
 		Handler:        router,
 		ReadTimeout:    tsdbReadTimeout,
@@ -36,35 +59,68 @@ func initServer(db *dbConn, downsamplersCountChan chan int, cancelDownsampleWait
 
 	readLineProtocolBufferSize = readLineProtocolBufferSizeP
 
-	log.Fatalf("initServer: %s", s.ListenAndServe())
+	log.Fatalf("initServer: %s", server.ListenAndServe())
 }
 
-func withDbAndDownsamplerChannels(db *dbConn, downsamplersCountChan chan int, cancelDownsampleWait []chan struct{}, fn func(*dbConn, chan int, []chan struct{}, http.ResponseWriter, *http.Request, httprouter.Params)) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+func withStorageAndDownsamplerChannels(s Storage, downsamplersCountChan chan int, cancelDownsampleWait []chan struct{}, fn func(Storage, chan int, []chan struct{}, http.ResponseWriter, *http.Request, httprouter.Params)) func(http.ResponseWriter, *http.Request, httprouter.Params) {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		fn(db, downsamplersCountChan, cancelDownsampleWait, w, r, ps)
+		fn(s, downsamplersCountChan, cancelDownsampleWait, w, r, ps)
 	}
 }
 
-func withDB(db *dbConn, fn func(*dbConn, http.ResponseWriter, *http.Request, httprouter.Params)) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+func withStorage(s Storage, fn func(Storage, http.ResponseWriter, *http.Request, httprouter.Params)) func(http.ResponseWriter, *http.Request, httprouter.Params) {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		fn(db, w, r, ps)
+		fn(s, w, r, ps)
 	}
 }
 
 func write400Error(w http.ResponseWriter, err string) error {
+	return writeError(w, http.StatusBadRequest, err)
+}
+
+func writeError(w http.ResponseWriter, status int, err string) error {
 	w.Header().Add("Content-Type", "application/json")
-	w.WriteHeader(http.StatusBadRequest)
+	w.WriteHeader(status)
 	return json.NewEncoder(w).Encode(&serverError{
 		Error: err,
 	})
 }
 
+func writeOpenTSDBError(w http.ResponseWriter, err string) error {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	return json.NewEncoder(w).Encode(&openTSDBError{
+		Error: &openTSDBErrorDetail{
+			Code:    http.StatusBadRequest,
+			Message: err,
+		},
+	})
+}
+
+func writeInfluxV2Error(w http.ResponseWriter, status int, code, err string) error {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(&influxError{
+		Code:    code,
+		Message: err,
+	})
+}
+
 /*
-Returns 400 on invalid request
+With partial=true valid lines are inserted and the response lists the
+rejected lines. onConflict sets how existing points are handled.
+With async=true points are spooled and inserted in the background.
+Returns 400 on invalid request or on a conflict with onConflict=error
 Returns 200 on successful insertion
+Returns 202 once async points are spooled
+Returns 429 if the spool is full
+Returns 413 if async points can't fit in the spool
+Returns 500 if async points can't be written to the spool
+Returns 200 with inserted, duplicate, overwritten and rejected counts if
+partial or onConflict is set
 Returns 404 if metric doesn't exist
 */
-func insertPointsHandler(db *dbConn, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func insertPointsHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	log.Infof("insert_points request from %s", r.RemoteAddr)
 
 	typeHeader := r.Header.Values("Content-Type")
@@ -77,9 +133,10 @@ func insertPointsHandler(db *dbConn, w http.ResponseWriter, r *http.Request, _ h
 		return
 	}
 
-	if typeHeader[0] != "application/x.simpletsdb.points" {
-		log.Error("insert_points: content-type must be application/x.simpletsdb.points")
-		if err0 := write400Error(w, "content-type must be application/x.simpletsdb.points"); err0 != nil {
+	mediaType, _, err := mime.ParseMediaType(typeHeader[0])
+	if err != nil || (mediaType != "application/x.simpletsdb.points" && mediaType != "application/json" && mediaType != "application/x-ndjson") {
+		log.Error("insert_points: content-type must be application/x.simpletsdb.points, application/json or application/x-ndjson")
+		if err0 := write400Error(w, "content-type must be application/x.simpletsdb.points, application/json or application/x-ndjson"); err0 != nil {
 			log.Errorf("insertPointsHandler: %s", err0)
 		}
 		return
@@ -87,12 +144,47 @@ func insertPointsHandler(db *dbConn, w http.ResponseWriter, r *http.Request, _ h
 
 	defer r.Body.Close()
 
-	scanner := bufio.NewScanner(r.Body)
-	buf := make([]byte, readLineProtocolBufferSize)
-	scanner.Buffer(buf, readLineProtocolBufferSize)
-	queries := []*insertPointQuery{}
-	for scanner.Scan() {
-		query, err := parseLineProtocol(scanner.Bytes())
+	params := r.URL.Query()
+	onConflict := params.Get("onConflict")
+	if onConflict == "" {
+		onConflict = onConflictIgnore
+	}
+	if err := validateOnConflict(onConflict); err != nil {
+		log.Errorf("insertPointsHandler: %s", err)
+		if err0 := write400Error(w, err.Error()); err0 != nil {
+			log.Errorf("insertPointsHandler: %s", err0)
+		}
+		return
+	}
+
+	if params.Get("async") == "true" {
+		if params.Get("partial") == "true" {
+			err = errSpoolPartial
+		} else {
+			_, err = spoolPoints(mediaType, r.Body, onConflict)
+		}
+		if err != nil {
+			log.Errorf("insertPointsHandler: %s", err)
+			status := http.StatusBadRequest
+			switch {
+			case err == errSpoolFull:
+				status = http.StatusTooManyRequests
+			case err == errSpoolBodyTooLarge:
+				status = http.StatusRequestEntityTooLarge
+			case isStorageError(err):
+				status = http.StatusInternalServerError
+			}
+			if err0 := writeError(w, status, err.Error()); err0 != nil {
+				log.Errorf("insertPointsHandler: %s", err0)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if params.Get("partial") == "true" {
+		lines, err := parsePointsLines(mediaType, r.Body)
 		if err != nil {
 			log.Errorf("insertPointsHandler: %s", err)
 			if err0 := write400Error(w, err.Error()); err0 != nil {
@@ -100,10 +192,24 @@ func insertPointsHandler(db *dbConn, w http.ResponseWriter, r *http.Request, _ h
 			}
 			return
 		}
-		queries = append(queries, query)
+		w.Header().Add("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(insertPointsPartial(s, lines, onConflict)); err != nil {
+			log.Errorf("insertPointsHandler: %s", err)
+		}
+		return
 	}
 
-	err := insertPoints(db, queries)
+	var read, inserted, overwritten int64
+	if streamer, ok := s.(pointsStreamer); ok {
+		read, inserted, overwritten, err = streamPoints(streamer, newPointsIterator(mediaType, r.Body), onConflict)
+	} else {
+		var queries []*insertPointQuery
+		queries, err = readAllPoints(newPointsIterator(mediaType, r.Body))
+		if err == nil {
+			read = int64(len(queries))
+			inserted, overwritten, err = insertPointsWithMode(s, queries, onConflict)
+		}
+	}
 	if err != nil {
 		if err == errMetricDoesNotExist {
 			w.WriteHeader(404)
@@ -116,15 +222,28 @@ func insertPointsHandler(db *dbConn, w http.ResponseWriter, r *http.Request, _ h
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	if _, ok := params["onConflict"]; !ok {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&insertPointsSummary{
+		Inserted:    inserted,
+		Duplicates:  read - inserted - overwritten,
+		Overwritten: overwritten,
+		Errors:      []*insertPointsLineError{},
+	}); err != nil {
+		log.Errorf("insertPointsHandler: %s", err)
+	}
 }
 
 /*
+With groupBy the response has the tags and points of every group.
 Returns 400 on invalid request
 Returns 200 on successful query
 Returns 404 if metric doesn't exist
 */
-func queryPointsHandler(db *dbConn, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func queryPointsHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	log.Infof("query_points request from %s", r.RemoteAddr)
 
 	typeHeader := r.Header.Values("Content-Type")
@@ -157,7 +276,17 @@ func queryPointsHandler(db *dbConn, w http.ResponseWriter, r *http.Request, _ ht
 		return
 	}
 
-	pts, err := queryPoints(db, priorityCRUD, req)
+	var (
+		result interface{}
+		err    error
+	)
+	if len(req.GroupBy) > 0 {
+		result, err = queryGroupedPoints(s, priorityCRUD, req)
+	} else {
+		var pts []*point
+		pts, err = queryPoints(s, priorityCRUD, req)
+		result = points(pts)
+	}
 
 	if err != nil {
 		if err.Error() == "metric does not exist" {
@@ -175,7 +304,7 @@ func queryPointsHandler(db *dbConn, w http.ResponseWriter, r *http.Request, _ ht
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
-	if err := json.NewEncoder(w).Encode(points(pts)); err != nil {
+	if err := json.NewEncoder(w).Encode(result); err != nil {
 		log.Errorf("queryPointsHandler: %s", err)
 	}
 }
@@ -185,7 +314,7 @@ Returns 400 on invalid request
 Returns 404 on metrics that don't exist
 Returns 200 on successful deletion
 */
-func deletePointsHandler(db *dbConn, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func deletePointsHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	log.Infof("delete_points request from %s", r.RemoteAddr)
 
 	typeHeader := r.Header.Values("Content-Type")
@@ -217,7 +346,7 @@ func deletePointsHandler(db *dbConn, w http.ResponseWriter, r *http.Request, _ h
 		return
 	}
 
-	if err := deletePoints(db, req); err != nil {
+	if err := deletePoints(s, req); err != nil {
 		log.Errorf("deletePointsHandler: %s", err)
 		if err0 := write400Error(w, err.Error()); err0 != nil {
 			log.Errorf("deletePointsHandler: %s", err0)
@@ -232,7 +361,7 @@ func deletePointsHandler(db *dbConn, w http.ResponseWriter, r *http.Request, _ h
 Returns 400 on invalid request
 Returns 200 on successful request
 */
-func addDownsamplerHandler(db *dbConn, downsamplersCountChan chan int, cancelDownsampleWait []chan struct{}, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func addDownsamplerHandler(s Storage, downsamplersCountChan chan int, cancelDownsampleWait []chan struct{}, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	log.Infof("add_downsampler request from %s", r.RemoteAddr)
 
 	typeHeader := r.Header.Values("Content-Type")
@@ -265,7 +394,7 @@ func addDownsamplerHandler(db *dbConn, downsamplersCountChan chan int, cancelDow
 		return
 	}
 
-	err := addDownsampler(db, downsamplersCountChan, cancelDownsampleWait, req)
+	err := addDownsampler(s, downsamplersCountChan, cancelDownsampleWait, req)
 
 	if err != nil {
 		log.Errorf("addDownsamplerHandler: %s", err)
@@ -282,7 +411,7 @@ func addDownsamplerHandler(db *dbConn, downsamplersCountChan chan int, cancelDow
 Returns 400 on invalid request
 Returns 200 on successful request
 */
-func addDownsamplersHandler(db *dbConn, downsamplersCountChan chan int, cancelDownsampleWait []chan struct{}, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func addDownsamplersHandler(s Storage, downsamplersCountChan chan int, cancelDownsampleWait []chan struct{}, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	log.Infof("add_downsamplers request from %s", r.RemoteAddr)
 
 	typeHeader := r.Header.Values("Content-Type")
@@ -315,7 +444,7 @@ func addDownsamplersHandler(db *dbConn, downsamplersCountChan chan int, cancelDo
 		return
 	}
 
-	err := addDownsamplers(db, downsamplersCountChan, cancelDownsampleWait, req)
+	err := addDownsamplers(s, downsamplersCountChan, cancelDownsampleWait, req)
 
 	if err != nil {
 		log.Errorf("addDownsamplersHandler: %s", err)
@@ -332,10 +461,10 @@ func addDownsamplersHandler(db *dbConn, downsamplersCountChan chan int, cancelDo
 Returns 200 on successful request
 Returns 500 on server failure
 */
-func listDownsamplersHandler(db *dbConn, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func listDownsamplersHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	log.Infof("list_downsampler request from %s", r.RemoteAddr)
 
-	downsamplers, err := selectDownsamplers(db)
+	downsamplers, err := s.SelectDownsamplers()
 	if err != nil {
 		log.Errorf("listDownsamplersHandler: %s", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -355,7 +484,7 @@ func listDownsamplersHandler(db *dbConn, w http.ResponseWriter, r *http.Request,
 Returns 400 on invalid request
 Returns 200 on successful request
 */
-func deleteDownsamplerHandler(db *dbConn, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func deleteDownsamplerHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	log.Infof("delete_downsampler request from %s", r.RemoteAddr)
 
 	typeHeader := r.Header.Values("Content-Type")
@@ -387,7 +516,7 @@ func deleteDownsamplerHandler(db *dbConn, w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	if err := deleteDownsampler(db, del); err != nil {
+	if err := deleteDownsampler(s, del); err != nil {
 		log.Errorf("deleteDownsamplerHandler: %s", err)
 		if err0 := write400Error(w, err.Error()); err0 != nil {
 			log.Errorf("deleteDownsamplerHandler: %s", err0)
@@ -397,3 +526,735 @@ func deleteDownsamplerHandler(db *dbConn, w http.ResponseWriter, r *http.Request
 
 	w.WriteHeader(http.StatusOK)
 }
+
+/*
+Returns 400 on invalid request
+Returns 200 on successful request
+*/
+func setRetentionPolicyHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Infof("set_retention_policy request from %s", r.RemoteAddr)
+
+	typeHeader := r.Header.Values("Content-Type")
+
+	if len(typeHeader) != 1 {
+		log.Error("set_retention_policy: content-type not set")
+		if err0 := write400Error(w, "content-type not set"); err0 != nil {
+			log.Errorf("setRetentionPolicyHandler: %s", err0)
+		}
+		return
+	}
+
+	if typeHeader[0] != "application/json" {
+		log.Error("set_retention_policy: content-type must be application/json")
+		if err0 := write400Error(w, "content-type must be application/json"); err0 != nil {
+			log.Errorf("setRetentionPolicyHandler: %s", err0)
+		}
+		return
+	}
+
+	defer r.Body.Close()
+
+	req := &retentionPolicy{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		log.Errorf("setRetentionPolicyHandler: %s", err)
+		if err0 := write400Error(w, err.Error()); err0 != nil {
+			log.Errorf("setRetentionPolicyHandler: %s", err0)
+		}
+		return
+	}
+
+	if err := setRetentionPolicy(s, req); err != nil {
+		log.Errorf("setRetentionPolicyHandler: %s", err)
+		if err0 := write400Error(w, err.Error()); err0 != nil {
+			log.Errorf("setRetentionPolicyHandler: %s", err0)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+Returns 200 on successful request
+Returns 500 on server failure
+*/
+func listRetentionPoliciesHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Infof("list_retention_policies request from %s", r.RemoteAddr)
+
+	policies, err := s.SelectRetentionPolicies()
+	if err != nil {
+		log.Errorf("listRetentionPoliciesHandler: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(policies); err != nil {
+		log.Errorf("listRetentionPoliciesHandler: %s", err)
+	}
+}
+
+/*
+Returns 400 on invalid request
+Returns 200 on successful request
+*/
+func deleteRetentionPolicyHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Infof("delete_retention_policy request from %s", r.RemoteAddr)
+
+	typeHeader := r.Header.Values("Content-Type")
+
+	if len(typeHeader) != 1 {
+		log.Error("delete_retention_policy: content-type not set")
+		if err0 := write400Error(w, "content-type not set"); err0 != nil {
+			log.Errorf("deleteRetentionPolicyHandler: %s", err0)
+		}
+		return
+	}
+
+	if typeHeader[0] != "application/json" {
+		log.Error("delete_retention_policy: content-type must be application/json")
+		if err0 := write400Error(w, "content-type must be application/json"); err0 != nil {
+			log.Errorf("deleteRetentionPolicyHandler: %s", err0)
+		}
+		return
+	}
+
+	defer r.Body.Close()
+
+	req := &deleteRetentionPolicyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		log.Errorf("deleteRetentionPolicyHandler: %s", err)
+		if err0 := write400Error(w, err.Error()); err0 != nil {
+			log.Errorf("deleteRetentionPolicyHandler: %s", err0)
+		}
+		return
+	}
+
+	if err := deleteRetentionPolicy(s, req); err != nil {
+		log.Errorf("deleteRetentionPolicyHandler: %s", err)
+		if err0 := write400Error(w, err.Error()); err0 != nil {
+			log.Errorf("deleteRetentionPolicyHandler: %s", err0)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+Returns 400 if the storage engine doesn't compress points
+Returns 200 on successful request
+Returns 500 on server failure
+*/
+func compressionStatsHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Infof("compression_stats request from %s", r.RemoteAddr)
+
+	stats, err := selectCompressionStats(s)
+	if err == errCompressionStatsNotSupported {
+		if err0 := write400Error(w, err.Error()); err0 != nil {
+			log.Errorf("compressionStatsHandler: %s", err0)
+		}
+		return
+	} else if err != nil {
+		log.Errorf("compressionStatsHandler: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.Errorf("compressionStatsHandler: %s", err)
+	}
+}
+
+/*
+Returns 200 with the spool depth and flush lag
+*/
+func spoolStatsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Infof("spool_stats request from %s", r.RemoteAddr)
+
+	stats := &spoolStats{}
+	if insertSpool != nil {
+		stats = insertSpool.stats()
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.Errorf("spoolStatsHandler: %s", err)
+	}
+}
+
+/*
+Lists the metrics, optionally only those starting with prefix and matching
+the regex regex.
+Returns 400 on invalid request
+Returns 200 on successful request
+Returns 500 on server failure
+*/
+func metricsHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Infof("metrics request from %s", r.RemoteAddr)
+
+	params := r.URL.Query()
+	var re *regexp.Regexp
+	if pattern := params.Get("regex"); pattern != "" {
+		var err error
+		if re, err = regexp.Compile(pattern); err != nil {
+			writeDiscoveryResult(w, "metricsHandler", nil, err)
+			return
+		}
+	}
+	metrics, err := listMetrics(s, params.Get("prefix"), re)
+	if err != nil {
+		log.Errorf("metricsHandler: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeDiscoveryResult(w, "metricsHandler", metrics, nil)
+}
+
+/*
+Lists the tag keys of the series of metric matching filter, optionally only
+of series with points between start and end.
+Returns 400 on invalid request
+Returns 200 on successful request
+Returns 500 on server failure
+*/
+func tagKeysHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Infof("tag_keys request from %s", r.RemoteAddr)
+
+	q, err := parseDiscoveryQuery(r.URL.Query())
+	if err != nil {
+		writeDiscoveryResult(w, "tagKeysHandler", nil, err)
+		return
+	}
+	keys, err := listTagKeys(s, q)
+	if err != nil {
+		log.Errorf("tagKeysHandler: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeDiscoveryResult(w, "tagKeysHandler", keys, nil)
+}
+
+/*
+Lists the values of the tag key of the series of metric matching filter,
+optionally only of series with points between start and end.
+Returns 400 on invalid request
+Returns 200 on successful request
+Returns 500 on server failure
+*/
+func tagValuesHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Infof("tag_values request from %s", r.RemoteAddr)
+
+	q, err := parseDiscoveryQuery(r.URL.Query())
+	if err == nil && q.key == "" {
+		err = errKeyRequired
+	}
+	if err != nil {
+		writeDiscoveryResult(w, "tagValuesHandler", nil, err)
+		return
+	}
+	values, err := listTagValues(s, q)
+	if err != nil {
+		log.Errorf("tagValuesHandler: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeDiscoveryResult(w, "tagValuesHandler", values, nil)
+}
+
+/*
+Lists the tags of the series of metric matching filter, optionally only of
+series with points between start and end.
+Returns 400 on invalid request
+Returns 200 on successful request
+Returns 500 on server failure
+*/
+func seriesHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Infof("series request from %s", r.RemoteAddr)
+
+	q, err := parseDiscoveryQuery(r.URL.Query())
+	if err != nil {
+		writeDiscoveryResult(w, "seriesHandler", nil, err)
+		return
+	}
+	series, err := listSeries(s, q)
+	if err != nil {
+		log.Errorf("seriesHandler: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeDiscoveryResult(w, "seriesHandler", series, nil)
+}
+
+/*
+Returns the series, points, first and last timestamps, approximate size and
+tag keys with the most values of metric or of every metric. With sample
+below 1 points are counted on that fraction of them, top sets the number of
+tag keys.
+Returns 400 on invalid request
+Returns 404 if metric doesn't exist
+Returns 200 on successful request
+Returns 500 on server failure
+*/
+func statsHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Infof("stats request from %s", r.RemoteAddr)
+
+	params := r.URL.Query()
+	// the storage engine chooses a sample unless one is given
+	var (
+		sample = 0.0
+		top    = statsTopTagKeys
+		err    error
+	)
+	if v := params.Get("sample"); v != "" {
+		sample, err = strconv.ParseFloat(v, 64)
+		if err == nil && sample <= 0 {
+			err = errInvalidStatsSample
+		}
+	}
+	if v := params.Get("top"); v != "" && err == nil {
+		top, err = strconv.Atoi(v)
+	}
+	var stats []*metricStats
+	if err == nil {
+		stats, err = selectStats(s, params.Get("metric"), sample, top)
+	}
+	switch err {
+	case nil:
+	case errMetricDoesNotExist:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case errInvalidStatsSample, errInvalidStatsTop, errUnsupportedMetricName:
+		writeDiscoveryResult(w, "statsHandler", nil, err)
+		return
+	default:
+		if _, ok := err.(*strconv.NumError); ok {
+			writeDiscoveryResult(w, "statsHandler", nil, err)
+			return
+		}
+		log.Errorf("statsHandler: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeDiscoveryResult(w, "statsHandler", stats, nil)
+}
+
+// writeDiscoveryResult writes result or err as a 400
+func writeDiscoveryResult(w http.ResponseWriter, handler string, result interface{}, err error) {
+	if err != nil {
+		log.Errorf("%s: %s", handler, err)
+		if err0 := write400Error(w, err.Error()); err0 != nil {
+			log.Errorf("%s: %s", handler, err0)
+		}
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Errorf("%s: %s", handler, err)
+	}
+}
+
+func writeInflux(s Storage, v2 bool, r *http.Request) error {
+	defer r.Body.Close()
+
+	precision, err := parseInfluxPrecision(r.URL.Query().Get("precision"), v2)
+	if err != nil {
+		return err
+	}
+	queries, err := parseInfluxLines(r.Body, precision)
+	if err != nil {
+		return err
+	}
+	return insertPoints(s, queries)
+}
+
+/*
+Influx v2 write API. The org and bucket parameters are ignored.
+Returns 400 on invalid request
+Returns 500 if the points can't be stored
+Returns 204 on successful insertion
+*/
+func influxV2WriteHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Infof("api/v2/write request from %s", r.RemoteAddr)
+
+	if err := writeInflux(s, true, r); err != nil {
+		log.Errorf("influxV2WriteHandler: %s", err)
+		status, code := http.StatusBadRequest, "invalid"
+		if isStorageError(err) {
+			status, code = http.StatusInternalServerError, "internal error"
+		}
+		if err0 := writeInfluxV2Error(w, status, code, err.Error()); err0 != nil {
+			log.Errorf("influxV2WriteHandler: %s", err0)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+Influx v1 write API. The db and rp parameters are ignored.
+Returns 400 on invalid request
+Returns 500 if the points can't be stored
+Returns 204 on successful insertion
+*/
+func influxV1WriteHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Infof("write request from %s", r.RemoteAddr)
+
+	if err := writeInflux(s, false, r); err != nil {
+		log.Errorf("influxV1WriteHandler: %s", err)
+		status := http.StatusBadRequest
+		if isStorageError(err) {
+			status = http.StatusInternalServerError
+		}
+		if err0 := writeError(w, status, err.Error()); err0 != nil {
+			log.Errorf("influxV1WriteHandler: %s", err0)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writePromRemote(s Storage, r *http.Request) error {
+	defer r.Body.Close()
+
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	body, err := decodeSnappy(compressed)
+	if err != nil {
+		return err
+	}
+	series, err := decodePromWriteRequest(body)
+	if err != nil {
+		return err
+	}
+	queries, err := promTimeSeriesToQueries(series)
+	if err != nil {
+		return err
+	}
+	return insertPoints(s, queries)
+}
+
+/*
+Prometheus remote write receiver. Bodies are snappy compressed WriteRequest
+protobufs.
+Returns 400 on invalid request
+Returns 500 if the samples can't be stored
+Returns 204 on successful insertion
+*/
+func promWriteHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Infof("api/v1/prom/write request from %s", r.RemoteAddr)
+
+	if err := writePromRemote(s, r); err != nil {
+		log.Errorf("promWriteHandler: %s", err)
+		status := http.StatusBadRequest
+		if isStorageError(err) {
+			status = http.StatusInternalServerError
+		}
+		if err0 := writeError(w, status, err.Error()); err0 != nil {
+			log.Errorf("promWriteHandler: %s", err0)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func readPromRemote(s Storage, r *http.Request) ([]byte, error) {
+	defer r.Body.Close()
+
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	body, err := decodeSnappy(compressed)
+	if err != nil {
+		return nil, err
+	}
+	queries, err := decodePromReadRequest(body)
+	if err != nil {
+		return nil, err
+	}
+	results := make([][]*promTimeSeries, len(queries))
+	for i, q := range queries {
+		if results[i], err = selectPromSeries(s, q); err != nil {
+			return nil, err
+		}
+	}
+	return snappy.Encode(nil, encodePromReadResponse(results)), nil
+}
+
+/*
+Prometheus remote read. Bodies are snappy compressed ReadRequest protobufs.
+Returns 400 on invalid request
+Returns 500 if the points can't be read
+Returns 200 with a snappy compressed ReadResponse protobuf
+*/
+func promReadHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Infof("api/v1/prom/read request from %s", r.RemoteAddr)
+
+	resp, err := readPromRemote(s, r)
+	if err != nil {
+		log.Errorf("promReadHandler: %s", err)
+		status := http.StatusBadRequest
+		if isStorageError(err) {
+			status = http.StatusInternalServerError
+		}
+		if err0 := writeError(w, status, err.Error()); err0 != nil {
+			log.Errorf("promReadHandler: %s", err0)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	if _, err := w.Write(resp); err != nil {
+		log.Errorf("promReadHandler: %s", err)
+	}
+}
+
+func writeOTLPMetrics(s Storage, isJSON bool, r *http.Request) (*otlpExportResult, error) {
+	defer r.Body.Close()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	var metrics []*otlpMetric
+	if isJSON {
+		metrics, err = decodeOTLPMetricsJSONRequest(body)
+	} else {
+		metrics, err = decodeOTLPMetricsRequest(body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	queries, res := otlpMetricsToQueries(metrics)
+	if err := insertPoints(s, queries); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+/*
+OTLP/HTTP metrics exporter endpoint. Bodies are protobuf or JSON encoded
+ExportMetricsServiceRequests.
+Returns 415 on unsupported content-type
+Returns 400 with a Status on invalid request
+Returns 503 with a Status if the points can't be stored, which clients retry
+Returns 200 with an ExportMetricsServiceResponse on successful insertion
+*/
+func otlpMetricsHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Infof("v1/metrics request from %s", r.RemoteAddr)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	isJSON := mediaType == "application/json"
+	if !isJSON && mediaType != "application/x-protobuf" {
+		log.Error("v1/metrics: content-type must be application/x-protobuf or application/json")
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	contentType := "application/x-protobuf"
+	if isJSON {
+		contentType = "application/json"
+	}
+
+	status := http.StatusOK
+	res, err := writeOTLPMetrics(s, isJSON, r)
+	var resp []byte
+	if err != nil {
+		log.Errorf("otlpMetricsHandler: %s", err)
+		code := otlpCodeInvalidArgument
+		status = http.StatusBadRequest
+		if isStorageError(err) {
+			status, code = http.StatusServiceUnavailable, otlpCodeUnavailable
+		}
+		resp, err = encodeOTLPStatus(code, err.Error(), isJSON)
+	} else {
+		resp, err = encodeOTLPMetricsResponse(res, isJSON)
+	}
+	if err != nil {
+		log.Errorf("otlpMetricsHandler: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	if _, err := w.Write(resp); err != nil {
+		log.Errorf("otlpMetricsHandler: %s", err)
+	}
+}
+
+/*
+OpenTSDB put API. Bodies are a single data point or an array of data points.
+Valid data points are inserted even if others are invalid.
+Returns 400 on invalid request or if any data point is invalid
+Returns 204 on successful insertion
+Returns 200 with a summary on successful insertion if summary or details is set
+*/
+func openTSDBPutHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Infof("api/put request from %s", r.RemoteAddr)
+
+	defer r.Body.Close()
+
+	points, err := decodeOpenTSDBPoints(r.Body)
+	if err == nil && len(points) == 0 {
+		err = errPointRequiredForInsertQuery
+	}
+	var summary *openTSDBPutSummary
+	if err == nil {
+		summary, err = putOpenTSDB(s, points)
+	}
+	if err != nil {
+		log.Errorf("openTSDBPutHandler: %s", err)
+		if err0 := writeOpenTSDBError(w, err.Error()); err0 != nil {
+			log.Errorf("openTSDBPutHandler: %s", err0)
+		}
+		return
+	}
+
+	params := r.URL.Query()
+	_, details := params["details"]
+	_, withSummary := params["summary"]
+	if !details && !withSummary {
+		if summary.Failed > 0 {
+			if err0 := writeOpenTSDBError(w, errOpenTSDBDataPointsHadErrors.Error()); err0 != nil {
+				log.Errorf("openTSDBPutHandler: %s", err0)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if !details {
+		summary.Errors = nil
+	}
+	w.Header().Add("Content-Type", "application/json")
+	if summary.Failed > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		log.Errorf("openTSDBPutHandler: %s", err)
+	}
+}
+
+// parseOpenTSDBQuery reads a query from the JSON body of a POST or the
+// start, end, m and ms parameters of a GET
+func parseOpenTSDBQuery(r *http.Request) (*openTSDBQuery, error) {
+	q := &openTSDBQuery{}
+	if r.Method == http.MethodPost {
+		dec := json.NewDecoder(r.Body)
+		dec.UseNumber()
+		if err := dec.Decode(q); err != nil {
+			return nil, err
+		}
+		return q, nil
+	}
+
+	params := r.URL.Query()
+	if v := params.Get("start"); v != "" {
+		q.Start = v
+	}
+	if v := params.Get("end"); v != "" {
+		q.End = v
+	}
+	_, q.MsResolution = params["ms"]
+	for _, m := range params["m"] {
+		sub, err := parseOpenTSDBMetricQuery(m)
+		if err != nil {
+			return nil, err
+		}
+		q.Queries = append(q.Queries, sub)
+	}
+	return q, nil
+}
+
+/*
+OpenTSDB query API. Queries are JSON bodies of POST requests or the
+parameters of GET requests.
+Returns 400 on invalid request
+Returns 200 with an array of results
+*/
+func openTSDBQueryHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Infof("api/query request from %s", r.RemoteAddr)
+
+	defer r.Body.Close()
+
+	q, err := parseOpenTSDBQuery(r)
+	var results []*openTSDBQueryResult
+	if err == nil {
+		results, err = queryOpenTSDB(s, q)
+	}
+	if err != nil {
+		log.Errorf("openTSDBQueryHandler: %s", err)
+		if err0 := writeOpenTSDBError(w, err.Error()); err0 != nil {
+			log.Errorf("openTSDBQueryHandler: %s", err0)
+		}
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		log.Errorf("openTSDBQueryHandler: %s", err)
+	}
+}
+
+/*
+Imports a CSV body. See csv.go for the column mapping.
+Returns 400 on invalid request or mapping
+Returns 500 with the rows inserted so far and the lines of the batch that
+failed if a batch can't be stored
+Returns 200 with the number of accepted and rejected rows
+*/
+func importCSVHandler(s Storage, w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	log.Infof("import_csv request from %s", r.RemoteAddr)
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/csv" {
+		log.Error("import_csv: content-type must be text/csv")
+		if err0 := write400Error(w, "content-type must be text/csv"); err0 != nil {
+			log.Errorf("importCSVHandler: %s", err0)
+		}
+		return
+	}
+
+	defer r.Body.Close()
+
+	summary, err := importCSV(s, r.Body, r.URL.Query())
+	if err != nil && summary == nil {
+		log.Errorf("importCSVHandler: %s", err)
+		if err0 := write400Error(w, err.Error()); err0 != nil {
+			log.Errorf("importCSVHandler: %s", err0)
+		}
+		return
+	}
+	status := http.StatusOK
+	if err != nil {
+		log.Errorf("importCSVHandler: %s", err)
+		status = http.StatusBadRequest
+		if isStorageError(err) {
+			status = http.StatusInternalServerError
+		}
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		log.Errorf("importCSVHandler: %s", err)
+	}
+}
@@ -3,15 +3,44 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/golang/snappy"
 	"github.com/stretchr/testify/require"
 )
 
+// failingStorage fails every insert and read like an unavailable database
+type failingStorage struct {
+	Storage
+}
+
+func (failingStorage) InsertPoints(queries []*insertPointQuery, onConflict string) (int64, int64, error) {
+	return 0, 0, errors.New("connection refused")
+}
+
+func (failingStorage) SelectSeriesPoints(priority int, metric string, filter *tagFilter, start, end int64) ([]*seriesPoints, error) {
+	return nil, errors.New("connection refused")
+}
+
+// flakyStorage fails every insert after the first n
+type flakyStorage struct {
+	Storage
+	n int
+}
+
+func (s *flakyStorage) InsertPoints(queries []*insertPointQuery, onConflict string) (int64, int64, error) {
+	if s.n == 0 {
+		return failingStorage{}.InsertPoints(queries, onConflict)
+	}
+	s.n--
+	return s.Storage.InsertPoints(queries, onConflict)
+}
+
 func TestInsertPointsHandler(t *testing.T) {
 	// test invalid query
 	req := httptest.NewRequest("POST", "/insert_points", nil)
@@ -250,7 +279,7 @@ func TestDownsamplerAPI(t *testing.T) {
 		}
 	}
 
-	ds0, err := selectDownsamplers(db0)
+	ds0, err := db0.SelectDownsamplers()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -362,3 +391,493 @@ func TestDownsamplerAPI(t *testing.T) {
 		}
 	}
 }
+
+func TestInfluxWriteHandlers(t *testing.T) {
+	body := bytes.NewBufferString("test_influx,host=a used=1,free=2i 946684800\ntest_influx,host=a used=3 946684860\n")
+	req := httptest.NewRequest("POST", "/api/v2/write?org=o&bucket=b&precision=s", body)
+	w := httptest.NewRecorder()
+	influxV2WriteHandler(db0, w, req, nil)
+	require.Equal(t, 204, w.Result().StatusCode)
+
+	pts, err := queryPoints(db0, priorityCRUD, &pointsQuery{
+		Metric: "test_influx.used",
+		Start:  946684800000000000,
+		Tags:   map[string]string{"host": "a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*point{
+		{Value: 1, Timestamp: 946684800000000000},
+		{Value: 3, Timestamp: 946684860000000000},
+	}, pts)
+
+	req = httptest.NewRequest("POST", "/api/v2/write?precision=h", bytes.NewBufferString("test_influx used=1 1\n"))
+	w = httptest.NewRecorder()
+	influxV2WriteHandler(db0, w, req, nil)
+	resp := w.Result()
+	require.Equal(t, 400, resp.StatusCode)
+	ierr := &influxError{}
+	if err := json.NewDecoder(resp.Body).Decode(ierr); err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, "invalid", ierr.Code)
+
+	// v1 accepts hours
+	req = httptest.NewRequest("POST", "/write?db=d&precision=h", bytes.NewBufferString("test_influx,host=b used=1 262968\n"))
+	w = httptest.NewRecorder()
+	influxV1WriteHandler(db0, w, req, nil)
+	require.Equal(t, 204, w.Result().StatusCode)
+
+	req = httptest.NewRequest("POST", "/write", bytes.NewBufferString("test_influx used\n"))
+	w = httptest.NewRecorder()
+	influxV1WriteHandler(db0, w, req, nil)
+	require.Equal(t, 400, w.Result().StatusCode)
+
+	// storage errors are retried by clients
+	req = httptest.NewRequest("POST", "/api/v2/write", bytes.NewBufferString("test_influx used=1\n"))
+	w = httptest.NewRecorder()
+	influxV2WriteHandler(failingStorage{}, w, req, nil)
+	resp = w.Result()
+	require.Equal(t, 500, resp.StatusCode)
+	if err := json.NewDecoder(resp.Body).Decode(ierr); err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, "internal error", ierr.Code)
+
+	req = httptest.NewRequest("POST", "/write", bytes.NewBufferString("test_influx used=1\n"))
+	w = httptest.NewRecorder()
+	influxV1WriteHandler(failingStorage{}, w, req, nil)
+	require.Equal(t, 500, w.Result().StatusCode)
+}
+
+func TestPromWriteHandler(t *testing.T) {
+	var b []byte
+	b = appendPromTimeSeries(b, 1, &promTimeSeries{
+		labels: []*promLabel{
+			{name: "__name__", value: "test_prom_write"},
+			{name: "job", value: "a"},
+		},
+		samples: []*promSample{
+			{value: 1, timestamp: 946684800000},
+			{value: 2, timestamp: 946684815000},
+		},
+	})
+	req := httptest.NewRequest("POST", "/api/v1/prom/write", bytes.NewReader(snappy.Encode(nil, b)))
+	req.Header.Add("Content-Encoding", "snappy")
+	req.Header.Add("Content-Type", "application/x-protobuf")
+	w := httptest.NewRecorder()
+	promWriteHandler(db0, w, req, nil)
+	require.Equal(t, 204, w.Result().StatusCode)
+
+	pts, err := queryPoints(db0, priorityCRUD, &pointsQuery{
+		Metric: "test_prom_write",
+		Start:  946684800000000000,
+		Tags:   map[string]string{"job": "a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*point{
+		{Value: 1, Timestamp: 946684800000000000},
+		{Value: 2, Timestamp: 946684815000000000},
+	}, pts)
+
+	// not snappy compressed
+	req = httptest.NewRequest("POST", "/api/v1/prom/write", bytes.NewReader(b))
+	w = httptest.NewRecorder()
+	promWriteHandler(db0, w, req, nil)
+	require.Equal(t, 400, w.Result().StatusCode)
+
+	// prometheus only retries 5xx
+	req = httptest.NewRequest("POST", "/api/v1/prom/write", bytes.NewReader(snappy.Encode(nil, b)))
+	w = httptest.NewRecorder()
+	promWriteHandler(failingStorage{}, w, req, nil)
+	require.Equal(t, 500, w.Result().StatusCode)
+}
+
+func TestPromReadHandler(t *testing.T) {
+	if err := insertPoints(db0, []*insertPointQuery{
+		{Metric: "test_prom_read", Tags: map[string]string{"job": "a"}, Point: &point{Value: 1, Timestamp: 946684800000000000}},
+		{Metric: "test_prom_read", Tags: map[string]string{"job": "a"}, Point: &point{Value: 2, Timestamp: 946684815000000000}},
+		{Metric: "test_prom_read", Tags: map[string]string{"job": "b"}, Point: &point{Value: 3, Timestamp: 946684800000000000}},
+		{Metric: "test_prom_read", Tags: map[string]string{"job": "c"}, Point: &point{Value: 4, Timestamp: 946684800000000000}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	b := appendPromQuery(nil, 946684800000, 946684815000, func(b []byte) []byte {
+		b = appendPromMatcher(b, promMatchEqual, "__name__", "test_prom_read")
+		return appendPromMatcher(b, promMatchNotRegexp, "job", "c")
+	})
+	req := httptest.NewRequest("POST", "/api/v1/prom/read", bytes.NewReader(snappy.Encode(nil, b)))
+	w := httptest.NewRecorder()
+	promReadHandler(db0, w, req, nil)
+	require.Equal(t, 200, w.Result().StatusCode)
+	require.Equal(t, "snappy", w.Result().Header.Get("Content-Encoding"))
+
+	body, err := snappy.Decode(nil, w.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var series []*promTimeSeries
+	err = parseProtoFields(body, func(f *protoField) error {
+		return parseProtoFields(f.bytes, func(f *protoField) error {
+			ts, err := decodePromTimeSeries(f.bytes)
+			series = append(series, ts)
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*promTimeSeries{
+		{
+			labels:  []*promLabel{{name: "__name__", value: "test_prom_read"}, {name: "job", value: "a"}},
+			samples: []*promSample{{value: 1, timestamp: 946684800000}, {value: 2, timestamp: 946684815000}},
+		},
+		{
+			labels:  []*promLabel{{name: "__name__", value: "test_prom_read"}, {name: "job", value: "b"}},
+			samples: []*promSample{{value: 3, timestamp: 946684800000}},
+		},
+	}, series)
+
+	// not snappy compressed
+	req = httptest.NewRequest("POST", "/api/v1/prom/read", bytes.NewReader(b))
+	w = httptest.NewRecorder()
+	promReadHandler(db0, w, req, nil)
+	require.Equal(t, 400, w.Result().StatusCode)
+
+	req = httptest.NewRequest("POST", "/api/v1/prom/read", bytes.NewReader(snappy.Encode(nil, b)))
+	w = httptest.NewRecorder()
+	promReadHandler(failingStorage{}, w, req, nil)
+	require.Equal(t, 500, w.Result().StatusCode)
+}
+
+func TestOTLPMetricsHandler(t *testing.T) {
+	req := httptest.NewRequest("POST", "/v1/metrics", bytes.NewReader(otlpTestRequest()))
+	req.Header.Add("Content-Type", "application/x-protobuf")
+	w := httptest.NewRecorder()
+	otlpMetricsHandler(db0, w, req, nil)
+	require.Equal(t, 200, w.Result().StatusCode)
+	require.Equal(t, "application/x-protobuf", w.Result().Header.Get("Content-Type"))
+	require.NotEmpty(t, w.Body.Bytes())
+
+	pts, err := queryPoints(db0, priorityCRUD, &pointsQuery{
+		Metric: "http.duration_bucket",
+		Start:  946684800000000000,
+		Tags:   map[string]string{"le": "inf", "temporality": "cumulative"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*point{{Value: 6, Timestamp: 946684800000000000}}, pts)
+
+	req = httptest.NewRequest("POST", "/v1/metrics", bytes.NewReader([]byte(`{"resourceMetrics":[]}`)))
+	req.Header.Add("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	otlpMetricsHandler(db0, w, req, nil)
+	require.Equal(t, 200, w.Result().StatusCode)
+	require.Equal(t, "{}", w.Body.String())
+
+	req = httptest.NewRequest("POST", "/v1/metrics", bytes.NewReader([]byte(`{`)))
+	req.Header.Add("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	otlpMetricsHandler(db0, w, req, nil)
+	require.Equal(t, 400, w.Result().StatusCode)
+
+	// storage errors are retryable
+	req = httptest.NewRequest("POST", "/v1/metrics", bytes.NewReader([]byte(`{"resourceMetrics":[{"scopeMetrics":[{"metrics":[{"name":"up","gauge":{"dataPoints":[{"asDouble":1,"timeUnixNano":"946684800000000000"}]}}]}]}]}`)))
+	req.Header.Add("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	otlpMetricsHandler(failingStorage{}, w, req, nil)
+	require.Equal(t, 503, w.Result().StatusCode)
+	status := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, float64(otlpCodeUnavailable), status["code"])
+
+	req = httptest.NewRequest("POST", "/v1/metrics", bytes.NewReader(nil))
+	req.Header.Add("Content-Type", "text/plain")
+	w = httptest.NewRecorder()
+	otlpMetricsHandler(db0, w, req, nil)
+	require.Equal(t, 415, w.Result().StatusCode)
+}
+
+func TestOpenTSDBHandlers(t *testing.T) {
+	body := `[
+		{"metric":"test_opentsdb","timestamp":946684800,"value":1,"tags":{"host":"a","dc":"eu"}},
+		{"metric":"test_opentsdb","timestamp":946684830000,"value":"3","tags":{"host":"a","dc":"eu"}},
+		{"metric":"test_opentsdb","timestamp":946684800,"value":10,"tags":{"host":"b","dc":"eu"}},
+		{"metric":"test_opentsdb","timestamp":946684860,"value":20,"tags":{"host":"b","dc":"us"}},
+		{"metric":"test_opentsdb","value":1}
+	]`
+	req := httptest.NewRequest("POST", "/api/put?details", bytes.NewReader([]byte(body)))
+	w := httptest.NewRecorder()
+	openTSDBPutHandler(db0, w, req, nil)
+	require.Equal(t, 400, w.Result().StatusCode)
+	summary := &openTSDBPutSummary{}
+	if err := json.NewDecoder(w.Body).Decode(summary); err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, 4, summary.Success)
+	require.Equal(t, 1, summary.Failed)
+	require.Equal(t, errOpenTSDBTimestampRequired.Error(), summary.Errors[0].Error)
+
+	req = httptest.NewRequest("POST", "/api/put", bytes.NewReader([]byte(`{"metric":"test_opentsdb","timestamp":946684920,"value":5,"tags":{"host":"c","dc":"us"}}`)))
+	w = httptest.NewRecorder()
+	openTSDBPutHandler(db0, w, req, nil)
+	require.Equal(t, 204, w.Result().StatusCode)
+
+	query := `{"start":946684800,"end":946684979,"queries":[{"aggregator":"sum","metric":"test_opentsdb","downsample":"1m-avg","tags":{"dc":"*"}}]}`
+	req = httptest.NewRequest("POST", "/api/query", bytes.NewReader([]byte(query)))
+	w = httptest.NewRecorder()
+	openTSDBQueryHandler(db0, w, req, nil)
+	require.Equal(t, 200, w.Result().StatusCode)
+	results := []*openTSDBQueryResult{}
+	if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*openTSDBQueryResult{
+		{
+			Metric:        "test_opentsdb",
+			Tags:          map[string]string{"dc": "eu"},
+			AggregateTags: []string{"host"},
+			Dps:           map[string]interface{}{"946684800": float64(12)},
+		},
+		{
+			Metric:        "test_opentsdb",
+			Tags:          map[string]string{"dc": "us"},
+			AggregateTags: []string{"host"},
+			Dps:           map[string]interface{}{"946684860": float64(20), "946684920": float64(5)},
+		},
+	}, results)
+
+	req = httptest.NewRequest("GET", "/api/query?start=946684800&end=946684979&m=none:test_opentsdb{host=a|b,dc=eu}", nil)
+	w = httptest.NewRecorder()
+	openTSDBQueryHandler(db0, w, req, nil)
+	require.Equal(t, 200, w.Result().StatusCode)
+	results = []*openTSDBQueryResult{}
+	if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	require.Len(t, results, 2)
+	require.Equal(t, map[string]interface{}{"946684800": float64(1), "946684830": float64(3)}, results[0].Dps)
+
+	req = httptest.NewRequest("GET", "/api/query?start=946684800&m=median:test_opentsdb", nil)
+	w = httptest.NewRecorder()
+	openTSDBQueryHandler(db0, w, req, nil)
+	require.Equal(t, 400, w.Result().StatusCode)
+}
+
+func TestInsertPointsHandlerJSON(t *testing.T) {
+	body := `[
+		{"metric":"test_insert_json","tags":{"id":"1"},"point":{"value":1.5,"timestamp":946684800000000000}},
+		{"metric":"test_insert_json","tags":{"id":"1"},"point":{"value":null,"timestamp":946684801000000000}}
+	]`
+	req := httptest.NewRequest("POST", "/insert_points", bytes.NewReader([]byte(body)))
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	insertPointsHandler(db0, w, req, nil)
+	require.Equal(t, 200, w.Result().StatusCode)
+
+	body = `{"metric":"test_insert_json","tags":{"id":"1"},"point":{"value":3,"timestamp":946684802000000000}}
+
+{"metric":"test_insert_json","tags":{"id":"1"},"point":{"value":null,"timestamp":946684803000000000}}
+`
+	req = httptest.NewRequest("POST", "/insert_points", bytes.NewReader([]byte(body)))
+	req.Header.Add("Content-Type", "application/x-ndjson")
+	w = httptest.NewRecorder()
+	insertPointsHandler(db0, w, req, nil)
+	require.Equal(t, 200, w.Result().StatusCode)
+
+	pts, err := queryPoints(db0, priorityCRUD, &pointsQuery{Metric: "test_insert_json", Tags: map[string]string{"id": "1"}, Start: 946684800000000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*point{
+		{Value: 1.5, Timestamp: 946684800000000000},
+		{Null: true, Timestamp: 946684801000000000},
+		{Value: 3, Timestamp: 946684802000000000},
+		{Null: true, Timestamp: 946684803000000000},
+	}, pts)
+
+	req = httptest.NewRequest("POST", "/insert_points", bytes.NewReader([]byte("{\"metric\":\"test_insert_json\",\"point\":{\"value\":1,\"timestamp\":1}}\n{\"metric\":\"test_insert_json\",\"point\":{\"value\":\"x\"}}\n")))
+	req.Header.Add("Content-Type", "application/x-ndjson")
+	w = httptest.NewRecorder()
+	insertPointsHandler(db0, w, req, nil)
+	require.Equal(t, 400, w.Result().StatusCode)
+	require.Contains(t, w.Body.String(), "line 2")
+
+	req = httptest.NewRequest("POST", "/insert_points", bytes.NewReader([]byte(`[{"metric":"test_insert_json"}]`)))
+	req.Header.Add("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	insertPointsHandler(db0, w, req, nil)
+	require.Equal(t, 400, w.Result().StatusCode)
+
+	// tags outside metricAndTagsRe are rejected like by partial mode
+	for _, body := range []string{
+		`[{"metric":"test_insert_json","tags":{"id":""},"point":{"value":1,"timestamp":1}}]`,
+		`[{"metric":"test_insert_json","tags":{"i d":"1"},"point":{"value":1,"timestamp":1}}]`,
+		`[{"metric":"test_insert_json","tags":{"id":"a/b"},"point":{"value":1,"timestamp":1}}]`,
+	} {
+		for _, contentType := range []string{"application/json", "application/x-ndjson"} {
+			if contentType == "application/x-ndjson" {
+				body = body[1 : len(body)-1]
+			}
+			req = httptest.NewRequest("POST", "/insert_points", bytes.NewReader([]byte(body)))
+			req.Header.Add("Content-Type", contentType)
+			w = httptest.NewRecorder()
+			insertPointsHandler(db0, w, req, nil)
+			require.Equal(t, 400, w.Result().StatusCode, body)
+		}
+	}
+	series, err := db0.SelectSeries("test_insert_json", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []map[string]string{{"id": "1"}}, series)
+}
+
+func TestImportCSVHandler(t *testing.T) {
+	body := "time,metric,value,host\n946684800,test_import_csv,1,a\n946684801,test_import_csv,x,a\n"
+	req := httptest.NewRequest("POST", "/import_csv?timestampColumn=time&timestampFormat=s&metricColumn=metric&tagColumns=host", bytes.NewReader([]byte(body)))
+	req.Header.Add("Content-Type", "text/csv")
+	w := httptest.NewRecorder()
+	importCSVHandler(db0, w, req, nil)
+	require.Equal(t, 200, w.Result().StatusCode)
+	summary := &csvImportSummary{}
+	if err := json.NewDecoder(w.Body).Decode(summary); err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, 1, summary.Accepted)
+	require.Equal(t, 1, summary.Rejected)
+	require.Equal(t, []*csvImportError{{Line: 3, Error: "invalid value in column value: x"}}, summary.Errors)
+
+	pts, err := queryPoints(db0, priorityCRUD, &pointsQuery{Metric: "test_import_csv", Tags: map[string]string{"host": "a"}, Start: 946684800000000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*point{{Value: 1, Timestamp: 946684800000000000}}, pts)
+
+	req = httptest.NewRequest("POST", "/import_csv", bytes.NewReader([]byte(body)))
+	req.Header.Add("Content-Type", "text/csv")
+	w = httptest.NewRecorder()
+	importCSVHandler(db0, w, req, nil)
+	require.Equal(t, 400, w.Result().StatusCode)
+
+	// a batch that fails to insert stops the import with the lines of the batch
+	insertBatchSize = 1
+	req = httptest.NewRequest("POST", "/import_csv?timestampFormat=s", bytes.NewReader([]byte("timestamp,test_import_csv_failed\n1,1\n2,2\n3,3\n")))
+	req.Header.Add("Content-Type", "text/csv")
+	w = httptest.NewRecorder()
+	importCSVHandler(&flakyStorage{Storage: newMemStorage(), n: 1}, w, req, nil)
+	insertBatchSize = 200
+	require.Equal(t, 500, w.Result().StatusCode)
+	summary = &csvImportSummary{}
+	if err := json.NewDecoder(w.Body).Decode(summary); err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, 1, summary.Accepted)
+	require.Equal(t, &csvImportFailure{FirstLine: 3, LastLine: 3, Error: "connection refused"}, summary.Failed)
+}
+
+func TestInsertPointsHandlerPartial(t *testing.T) {
+	body := "test_insert_partial,id=1,1 946684800000000000\n" +
+		"test_insert_partial,id=1,x 946684801000000000\n" +
+		"test_insert_partial,id=1,2 946684800000000000\n" +
+		"test_insert_partial,id=1,null 946684802000000000\n"
+	req := httptest.NewRequest("POST", "/insert_points?partial=true", bytes.NewReader([]byte(body)))
+	req.Header.Add("Content-Type", "application/x.simpletsdb.points")
+	w := httptest.NewRecorder()
+	insertPointsHandler(db0, w, req, nil)
+	require.Equal(t, 200, w.Result().StatusCode)
+	summary := &insertPointsSummary{}
+	if err := json.NewDecoder(w.Body).Decode(summary); err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, &insertPointsSummary{
+		Inserted:   2,
+		Duplicates: 1,
+		Rejected:   1,
+		Errors: []*insertPointsLineError{
+			{Line: 2, Text: "test_insert_partial,id=1,x 946684801000000000", Error: errNoMatches.Error()},
+		},
+	}, summary)
+
+	body = `[{"metric":"test_insert_partial","tags":{"id":"2"},"point":{"value":1,"timestamp":946684800000000000}},{"metric":"test insert"},{"metric":"test_insert_partial","tags":{"id":"a b"},"point":{"value":1,"timestamp":1}}]`
+	req = httptest.NewRequest("POST", "/insert_points?partial=true", bytes.NewReader([]byte(body)))
+	req.Header.Add("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	insertPointsHandler(db0, w, req, nil)
+	require.Equal(t, 200, w.Result().StatusCode)
+	summary = &insertPointsSummary{}
+	if err := json.NewDecoder(w.Body).Decode(summary); err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, int64(1), summary.Inserted)
+	require.Equal(t, int64(2), summary.Rejected)
+	require.Equal(t, 2, summary.Errors[0].Line)
+	require.Equal(t, errUnsupportedTagValue.Error(), summary.Errors[1].Error)
+
+	pts, err := queryPoints(db0, priorityCRUD, &pointsQuery{Metric: "test_insert_partial", Tags: map[string]string{"id": "1"}, Start: 946684800000000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*point{
+		{Value: 1, Timestamp: 946684800000000000},
+		{Null: true, Timestamp: 946684802000000000},
+	}, pts)
+}
+
+func TestInsertPointsHandlerOnConflict(t *testing.T) {
+	insert := func(body, onConflict string) (int, *insertPointsSummary) {
+		req := httptest.NewRequest("POST", "/insert_points?onConflict="+onConflict, bytes.NewReader([]byte(body)))
+		req.Header.Add("Content-Type", "application/x.simpletsdb.points")
+		w := httptest.NewRecorder()
+		insertPointsHandler(db0, w, req, nil)
+		summary := &insertPointsSummary{}
+		if w.Result().StatusCode == 200 {
+			if err := json.NewDecoder(w.Body).Decode(summary); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Result().StatusCode, summary
+	}
+
+	status, summary := insert("test_insert_conflict,,1 946684800000000000\n", "ignore")
+	require.Equal(t, 200, status)
+	require.Equal(t, int64(1), summary.Inserted)
+
+	status, summary = insert("test_insert_conflict,,2 946684800000000000\ntest_insert_conflict,,3 946684801000000000\n", "overwrite")
+	require.Equal(t, 200, status)
+	require.Equal(t, &insertPointsSummary{Inserted: 1, Overwritten: 1, Errors: []*insertPointsLineError{}}, summary)
+
+	status, _ = insert("test_insert_conflict,,4 946684801000000000\n", "error")
+	require.Equal(t, 400, status)
+	status, _ = insert("test_insert_conflict,,4 946684801000000000\n", "replace")
+	require.Equal(t, 400, status)
+
+	// only the conflicting line of the failed batch is rejected
+	status, summary = insert("test_insert_conflict,,5 946684802000000000\ntest_insert_conflict,,4 946684801000000000\ntest_insert_conflict,,6 946684803000000000\n", "error&partial=true")
+	require.Equal(t, 200, status)
+	require.Equal(t, &insertPointsSummary{
+		Inserted: 2,
+		Rejected: 1,
+		Errors: []*insertPointsLineError{
+			{Line: 2, Text: "test_insert_conflict,,4 946684801000000000", Error: errPointExists.Error()},
+		},
+	}, summary)
+
+	pts, err := queryPoints(db0, priorityCRUD, &pointsQuery{Metric: "test_insert_conflict", Start: 946684800000000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*point{
+		{Value: 2, Timestamp: 946684800000000000},
+		{Value: 3, Timestamp: 946684801000000000},
+		{Value: 5, Timestamp: 946684802000000000},
+		{Value: 6, Timestamp: 946684803000000000},
+	}, pts)
+}
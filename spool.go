@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Async inserts are appended to segment files in the spool directory and
+// acknowledged once they are synced. Bodies of more than spoolRecordSize
+// points are written record by record to a staging file of their own, which
+// becomes a segment once the whole body is synced, so they don't have to fit
+// in memory. A flusher writes the spooled points
+// with insertPoints spoolFlushBatchSize points at a time and removes
+// segments once all of their points are written. Segments left at startup
+// are replayed. A segment that was partially written before a crash is
+// written again from its start, which is why async inserts only support the
+// ignore and overwrite modes.
+
+var (
+	spoolMaxSize                     = int64(1 << 30)
+	spoolSegmentSize                 = int64(64 << 20)
+	spoolFlushInterval               = time.Second
+	spoolFlushBatchSize              = 10000
+	spoolRecordSize                  = 1000
+	spoolSegmentExt                  = ".spool"
+	spoolStageExt                    = ".stage"
+	insertSpool                      *spool
+	errSpoolFull                     = errors.New("spool is full, retry later")
+	errSpoolBodyTooLarge             = errors.New("body is larger than the spool")
+	errSpoolDisabled                 = errors.New("async inserts require simpletsdb_spool_dir")
+	errSpoolOnConflict               = errors.New("async inserts support onConflict ignore and overwrite")
+	errSpoolPartial                  = errors.New("async inserts can't be partial")
+	errSpoolMaxSizeNotPositive       = errors.New("spool max size must be positive")
+	errSpoolFlushIntervalNotPositive = errors.New("spool flush interval must be positive")
+)
+
+type spoolRecord struct {
+	ReceivedAt int64
+	OnConflict string
+	Queries    []*insertPointQuery
+}
+
+type spoolSegment struct {
+	path   string
+	seq    int64
+	size   int64
+	offset int64 // bytes already written to storage
+	points int64 // points not yet written to storage
+	// receivedAt is when the oldest point not yet written was received
+	receivedAt int64
+}
+
+type spool struct {
+	mu       sync.Mutex
+	dir      string
+	s        Storage
+	segments []*spoolSegment // oldest first, the last one is appended to
+	active   *os.File
+	size     int64
+	// flushMu serializes flushes
+	flushMu        sync.Mutex
+	lastFlush      int64
+	lastFlushError string
+}
+
+func spoolSegmentPath(dir string, seq int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", seq, spoolSegmentExt))
+}
+
+// openSpool loads the segments of dir, truncating torn records at their
+// ends, and starts a new segment to append to
+func openSpool(dir string, s Storage) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	// bodies that were still being staged were never acknowledged
+	stages, err := filepath.Glob(filepath.Join(dir, "*"+spoolStageExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range stages {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	sp := &spool{dir: dir, s: s}
+	var seq int64
+	for _, path := range paths {
+		seq, err = strconv.ParseInt(strings.TrimSuffix(filepath.Base(path), spoolSegmentExt), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		seg, err := loadSpoolSegment(path, seq)
+		if err != nil {
+			return nil, err
+		}
+		if seg.size == 0 {
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		sp.segments = append(sp.segments, seg)
+		sp.size += seg.size
+	}
+	if err := sp.startSegment(seq + 1); err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+func loadSpoolSegment(path string, seq int64) (*spoolSegment, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	seg := &spoolSegment{path: path, seq: seq}
+	r := bufio.NewReader(f)
+	for {
+		payload, err := readFrame(r)
+		if err == io.EOF {
+			break
+		} else if err == errTornFrame {
+			log.Warnf("spool: truncating torn record of %s at %d", path, seg.size)
+			if err := f.Truncate(seg.size); err != nil {
+				return nil, err
+			}
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		rec := &spoolRecord{}
+		if err := gobDecode(payload, rec); err != nil {
+			return nil, err
+		}
+		if seg.points == 0 {
+			seg.receivedAt = rec.ReceivedAt
+		}
+		seg.points += int64(len(rec.Queries))
+		seg.size += int64(8 + len(payload))
+	}
+	return seg, nil
+}
+
+// startSegment starts the segment seq to append to. sp.mu must be held.
+func (sp *spool) startSegment(seq int64) error {
+	path := spoolSegmentPath(sp.dir, seq)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(sp.dir); err != nil {
+		f.Close()
+		return err
+	}
+	if sp.active != nil {
+		if err := sp.active.Close(); err != nil {
+			log.Errorf("spool: %s", err)
+		}
+	}
+	sp.active = f
+	sp.segments = append(sp.segments, &spoolSegment{path: path, seq: seq})
+	return nil
+}
+
+// append spools queries and returns once they're synced. It returns
+// errSpoolBodyTooLarge if they can't fit in the spool and errSpoolFull if
+// they would grow the spool over spoolMaxSize. I/O errors are returned as a
+// *storageError.
+func (sp *spool) append(onConflict string, queries []*insertPointQuery) error {
+	rec := &spoolRecord{ReceivedAt: time.Now().UnixNano(), OnConflict: onConflict, Queries: queries}
+	payload, err := gobEncode(rec)
+	if err != nil {
+		return &storageError{err: err}
+	}
+	size := int64(8 + len(payload))
+	if size > spoolMaxSize {
+		return errSpoolBodyTooLarge
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.size+size > spoolMaxSize {
+		return errSpoolFull
+	}
+	seg := sp.segments[len(sp.segments)-1]
+	if err := writeFrame(sp.active, payload); err != nil {
+		if err0 := sp.active.Truncate(seg.size); err0 != nil {
+			log.Errorf("spool: %s", err0)
+		}
+		return &storageError{err: err}
+	}
+	if err := sp.active.Sync(); err != nil {
+		return &storageError{err: err}
+	}
+	if seg.points == 0 {
+		seg.receivedAt = rec.ReceivedAt
+	}
+	seg.size += size
+	seg.points += int64(len(queries))
+	sp.size += size
+	if seg.size >= spoolSegmentSize {
+		if err := sp.startSegment(seg.seq + 1); err != nil {
+			return &storageError{err: err}
+		}
+	}
+	return nil
+}
+
+// spoolStage is a body being written to a staging file of its own
+type spoolStage struct {
+	sp         *spool
+	f          *os.File
+	w          *bufio.Writer
+	onConflict string
+	receivedAt int64
+	size       int64
+	points     int64
+}
+
+func (sp *spool) stage(onConflict string) (*spoolStage, error) {
+	f, err := ioutil.TempFile(sp.dir, "*"+spoolStageExt)
+	if err != nil {
+		return nil, &storageError{err: err}
+	}
+	return &spoolStage{
+		sp:         sp,
+		f:          f,
+		w:          bufio.NewWriter(f),
+		onConflict: onConflict,
+		receivedAt: time.Now().UnixNano(),
+	}, nil
+}
+
+// write appends a record of queries. It fails as soon as the body can't fit
+// in the spool.
+func (st *spoolStage) write(queries []*insertPointQuery) error {
+	payload, err := gobEncode(&spoolRecord{ReceivedAt: st.receivedAt, OnConflict: st.onConflict, Queries: queries})
+	if err != nil {
+		return &storageError{err: err}
+	}
+	st.size += int64(8 + len(payload))
+	if st.size > spoolMaxSize {
+		return errSpoolBodyTooLarge
+	}
+	st.sp.mu.Lock()
+	full := st.sp.size+st.size > spoolMaxSize
+	st.sp.mu.Unlock()
+	if full {
+		return errSpoolFull
+	}
+	if err := writeFrame(st.w, payload); err != nil {
+		return &storageError{err: err}
+	}
+	st.points += int64(len(queries))
+	return nil
+}
+
+func (st *spoolStage) abort() {
+	st.f.Close()
+	if err := os.Remove(st.f.Name()); err != nil {
+		log.Errorf("spool: %s", err)
+	}
+}
+
+// commit syncs the staged body and adds it as a segment. A new segment is
+// started to append to first so the body is spooled after the points
+// appended while it was staged.
+func (st *spoolStage) commit() error {
+	if err := st.w.Flush(); err != nil {
+		st.abort()
+		return &storageError{err: err}
+	}
+	if err := st.f.Sync(); err != nil {
+		st.abort()
+		return &storageError{err: err}
+	}
+	if err := st.f.Close(); err != nil {
+		st.abort()
+		return &storageError{err: err}
+	}
+
+	sp := st.sp
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.size+st.size > spoolMaxSize {
+		st.abort()
+		return errSpoolFull
+	}
+	seq := sp.segments[len(sp.segments)-1].seq + 1
+	if err := sp.startSegment(seq + 1); err != nil {
+		st.abort()
+		return &storageError{err: err}
+	}
+	seg := &spoolSegment{path: spoolSegmentPath(sp.dir, seq), seq: seq, size: st.size, points: st.points, receivedAt: st.receivedAt}
+	if err := os.Rename(st.f.Name(), seg.path); err != nil {
+		st.abort()
+		return &storageError{err: err}
+	}
+	active := sp.segments[len(sp.segments)-1]
+	sp.segments = append(sp.segments[:len(sp.segments)-1], seg, active)
+	sp.size += seg.size
+	if err := syncDir(sp.dir); err != nil {
+		return &storageError{err: err}
+	}
+	return nil
+}
+
+// flush writes every spooled point to storage. It stops at the first error,
+// the remaining points are written by the next flush.
+func (sp *spool) flush() error {
+	sp.flushMu.Lock()
+	defer sp.flushMu.Unlock()
+
+	sp.mu.Lock()
+	if sp.segments[len(sp.segments)-1].size > 0 {
+		if err := sp.startSegment(sp.segments[len(sp.segments)-1].seq + 1); err != nil {
+			sp.mu.Unlock()
+			return err
+		}
+	}
+	pending := append([]*spoolSegment{}, sp.segments[:len(sp.segments)-1]...)
+	sp.mu.Unlock()
+
+	var err error
+	for _, seg := range pending {
+		if err = sp.flushSegment(seg); err != nil {
+			break
+		}
+		if err = os.Remove(seg.path); err != nil {
+			break
+		}
+		sp.mu.Lock()
+		sp.segments = sp.segments[1:]
+		sp.size -= seg.size
+		sp.mu.Unlock()
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.lastFlush = time.Now().UnixNano()
+	sp.lastFlushError = ""
+	if err != nil {
+		sp.lastFlushError = err.Error()
+	}
+	return err
+}
+
+// flushSegment writes the points of seg from its offset on. Records with the
+// same onConflict are written together.
+func (sp *spool) flushSegment(seg *spoolSegment) error {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(seg.offset, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+
+	var (
+		batch      []*insertPointQuery
+		onConflict string
+		end        = seg.offset
+	)
+	write := func(next *spoolRecord) error {
+		if len(batch) > 0 {
+			if _, _, err := insertPointsWithMode(sp.s, batch, onConflict); err != nil {
+				return err
+			}
+		}
+		sp.mu.Lock()
+		seg.offset = end
+		seg.points -= int64(len(batch))
+		if next != nil {
+			seg.receivedAt = next.ReceivedAt
+		}
+		sp.mu.Unlock()
+		batch = nil
+		return nil
+	}
+	for {
+		payload, err := readFrame(r)
+		if err == io.EOF || err == errTornFrame {
+			return write(nil)
+		} else if err != nil {
+			return err
+		}
+		rec := &spoolRecord{}
+		if err := gobDecode(payload, rec); err != nil {
+			return err
+		}
+		if len(batch) > 0 && (rec.OnConflict != onConflict || len(batch)+len(rec.Queries) > spoolFlushBatchSize) {
+			if err := write(rec); err != nil {
+				return err
+			}
+		}
+		batch = append(batch, rec.Queries...)
+		onConflict = rec.OnConflict
+		end += int64(8 + len(payload))
+	}
+}
+
+// spoolPoints validates the points of body and spools them for insertion.
+// Bodies of up to spoolRecordSize points are appended as a single record,
+// larger ones are staged.
+func spoolPoints(mediaType string, body io.Reader, onConflict string) (int64, error) {
+	if insertSpool == nil {
+		return 0, errSpoolDisabled
+	}
+	if onConflict != onConflictIgnore && onConflict != onConflictOverwrite {
+		return 0, errSpoolOnConflict
+	}
+	next := newPointsIterator(mediaType, body)
+	var (
+		queries = make([]*insertPointQuery, 0, spoolRecordSize)
+		st      *spoolStage
+		n       int64
+	)
+	fail := func(err error) (int64, error) {
+		if st != nil {
+			st.abort()
+		}
+		return 0, err
+	}
+	for {
+		query, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = validateInsertQueries([]*insertPointQuery{query})
+		}
+		if err != nil {
+			return fail(err)
+		}
+		queries = append(queries, query)
+		n++
+		if len(queries) < spoolRecordSize {
+			continue
+		}
+		if st == nil {
+			if st, err = insertSpool.stage(onConflict); err != nil {
+				return fail(err)
+			}
+		}
+		if err := st.write(queries); err != nil {
+			return fail(err)
+		}
+		queries = queries[:0]
+	}
+	if st == nil {
+		if len(queries) == 0 {
+			return 0, nil
+		}
+		return n, insertSpool.append(onConflict, queries)
+	}
+	if len(queries) > 0 {
+		if err := st.write(queries); err != nil {
+			return fail(err)
+		}
+	}
+	return n, st.commit()
+}
+
+func (sp *spool) stats() *spoolStats {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	stats := &spoolStats{
+		Enabled:        true,
+		Bytes:          sp.size,
+		MaxBytes:       spoolMaxSize,
+		LastFlush:      sp.lastFlush,
+		LastFlushError: sp.lastFlushError,
+	}
+	for _, seg := range sp.segments {
+		if seg.points == 0 {
+			continue
+		}
+		stats.Segments++
+		stats.Points += seg.points
+		if stats.FlushLag == 0 {
+			stats.FlushLag = time.Duration(time.Now().UnixNano() - seg.receivedAt).Seconds()
+		}
+	}
+	return stats
+}
+
+func (sp *spool) flushSpool() {
+	ticker := time.NewTicker(spoolFlushInterval)
+	defer ticker.Stop()
+	for {
+		if err := sp.flush(); err != nil {
+			log.Errorf("flushSpool: %s", err)
+		}
+		<-ticker.C
+	}
+}
+
+// initSpool enables async inserts if the spool directory is set and replays
+// the points spooled before the last shutdown
+func initSpool(s Storage, dir string) error {
+	if dir == "" {
+		return nil
+	}
+	sp, err := openSpool(dir, s)
+	if err != nil {
+		return err
+	}
+	if stats := sp.stats(); stats.Points > 0 {
+		log.Infof("spool: replaying %d points", stats.Points)
+	}
+	insertSpool = sp
+	go sp.flushSpool()
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpool(t *testing.T) {
+	s := newMemStorage()
+	sp, err := openSpool(t.TempDir(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.append(onConflictIgnore, []*insertPointQuery{
+		{Metric: "test_spool", Tags: map[string]string{"id": "1"}, Point: &point{Value: 1, Timestamp: 946684800000000000}},
+		{Metric: "test_spool", Tags: map[string]string{"id": "1"}, Point: &point{Value: 2, Timestamp: 946684801000000000}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.append(onConflictOverwrite, []*insertPointQuery{
+		{Metric: "test_spool", Tags: map[string]string{"id": "1"}, Point: &point{Value: 3, Timestamp: 946684801000000000}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	stats := sp.stats()
+	require.Equal(t, 1, stats.Segments)
+	require.Equal(t, int64(3), stats.Points)
+	require.True(t, stats.FlushLag > 0)
+
+	if err := sp.flush(); err != nil {
+		t.Fatal(err)
+	}
+	stats = sp.stats()
+	require.Equal(t, 0, stats.Segments)
+	require.Equal(t, int64(0), stats.Points)
+	require.Equal(t, int64(0), stats.Bytes)
+	require.Equal(t, float64(0), stats.FlushLag)
+	paths, err := filepath.Glob(filepath.Join(sp.dir, "*"+spoolSegmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Len(t, paths, 1)
+
+	pts, err := queryPoints(s, priorityCRUD, &pointsQuery{Metric: "test_spool", Start: 946684800000000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*point{
+		{Value: 1, Timestamp: 946684800000000000},
+		{Value: 3, Timestamp: 946684801000000000},
+	}, pts)
+}
+
+func TestSpoolReplay(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := openSpool(dir, newMemStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.append(onConflictIgnore, []*insertPointQuery{
+		{Metric: "test_spool_replay", Tags: map[string]string{}, Point: &point{Value: 1, Timestamp: 946684800000000000}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// a torn record is dropped on replay
+	if _, err := sp.active.Write([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	sp.active.Close()
+
+	s := newMemStorage()
+	sp, err = openSpool(dir, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := sp.stats()
+	require.Equal(t, 1, stats.Segments)
+	require.Equal(t, int64(1), stats.Points)
+	if err := sp.flush(); err != nil {
+		t.Fatal(err)
+	}
+	pts, err := queryPoints(s, priorityCRUD, &pointsQuery{Metric: "test_spool_replay", Start: 946684800000000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*point{{Value: 1, Timestamp: 946684800000000000}}, pts)
+}
+
+func TestSpoolFull(t *testing.T) {
+	defer func(size int64) { spoolMaxSize = size }(spoolMaxSize)
+	spoolMaxSize = 1024
+
+	sp, err := openSpool(t.TempDir(), newMemStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := []*insertPointQuery{}
+	for i := int64(0); i < 100; i++ {
+		queries = append(queries, &insertPointQuery{Metric: "test_spool_full", Tags: map[string]string{}, Point: &point{Value: 1, Timestamp: 946684800000000000 + i}})
+	}
+	require.Equal(t, errSpoolBodyTooLarge, sp.append(onConflictIgnore, queries))
+	require.Equal(t, int64(0), sp.stats().Bytes)
+
+	for {
+		err := sp.append(onConflictIgnore, queries[:1])
+		if err == errSpoolFull {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	require.True(t, sp.stats().Bytes <= spoolMaxSize)
+}
+
+func TestSpoolPointsStaged(t *testing.T) {
+	defer func(sp *spool, size int) { insertSpool, spoolRecordSize = sp, size }(insertSpool, spoolRecordSize)
+	spoolRecordSize = 2
+
+	s := newMemStorage()
+	dir := t.TempDir()
+	var err error
+	if insertSpool, err = openSpool(dir, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := insertSpool.append(onConflictIgnore, []*insertPointQuery{
+		{Metric: "test_spool_staged", Tags: map[string]string{}, Point: &point{Value: 1, Timestamp: 946684800000000000}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	body := &bytes.Buffer{}
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(body, "test_spool_staged,,%d %d\n", i+2, 946684800000000000+int64(i))
+	}
+	n, err := spoolPoints("application/x.simpletsdb.points", body, onConflictOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, int64(5), n)
+	stats := insertSpool.stats()
+	require.Equal(t, 2, stats.Segments)
+	require.Equal(t, int64(6), stats.Points)
+
+	// an invalid body leaves nothing behind
+	_, err = spoolPoints("application/x.simpletsdb.points", bytes.NewBufferString("test_spool_staged,,1 1\ntest_spool_staged,,2 2\ntest_spool_staged,,x 3\n"), onConflictIgnore)
+	require.Error(t, err)
+	require.Equal(t, int64(6), insertSpool.stats().Points)
+	stages, err := filepath.Glob(filepath.Join(dir, "*"+spoolStageExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Empty(t, stages)
+
+	// the staged body is written after the point appended before it
+	if err := insertSpool.flush(); err != nil {
+		t.Fatal(err)
+	}
+	pts, err := queryPoints(s, priorityCRUD, &pointsQuery{Metric: "test_spool_staged", Start: 946684800000000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*point{
+		{Value: 2, Timestamp: 946684800000000000},
+		{Value: 3, Timestamp: 946684800000000001},
+		{Value: 4, Timestamp: 946684800000000002},
+		{Value: 5, Timestamp: 946684800000000003},
+		{Value: 6, Timestamp: 946684800000000004},
+	}, pts)
+}
+
+func TestInsertPointsHandlerAsync(t *testing.T) {
+	defer func(sp *spool) { insertSpool = sp }(insertSpool)
+	insert := func(query, body string) int {
+		req := httptest.NewRequest("POST", "/insert_points?"+query, bytes.NewReader([]byte(body)))
+		req.Header.Add("Content-Type", "application/x.simpletsdb.points")
+		w := httptest.NewRecorder()
+		insertPointsHandler(nil, w, req, nil)
+		return w.Result().StatusCode
+	}
+
+	insertSpool = nil
+	require.Equal(t, 400, insert("async=true", "test_insert_async,,1 946684800000000000\n"))
+
+	s := newMemStorage()
+	var err error
+	insertSpool, err = openSpool(t.TempDir(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, 202, insert("async=true", "test_insert_async,,1 946684800000000000\n"))
+	require.Equal(t, 400, insert("async=true&onConflict=sum", "test_insert_async,,1 946684800000000000\n"))
+	require.Equal(t, 400, insert("async=true&partial=true", "test_insert_async,,1 946684800000000000\n"))
+	require.Equal(t, 400, insert("async=true", "test_insert_async,,x 946684800000000000\n"))
+
+	w := httptest.NewRecorder()
+	spoolStatsHandler(w, httptest.NewRequest("GET", "/spool_stats", nil), nil)
+	stats := &spoolStats{}
+	if err := json.NewDecoder(w.Body).Decode(stats); err != nil {
+		t.Fatal(err)
+	}
+	require.True(t, stats.Enabled)
+	require.Equal(t, int64(1), stats.Points)
+
+	if err := insertSpool.flush(); err != nil {
+		t.Fatal(err)
+	}
+	pts, err := queryPoints(s, priorityCRUD, &pointsQuery{Metric: "test_insert_async", Start: 946684800000000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*point{{Value: 1, Timestamp: 946684800000000000}}, pts)
+
+	defer func(size int64) { spoolMaxSize = size }(spoolMaxSize)
+	spoolMaxSize = 1
+	require.Equal(t, 413, insert("async=true", "test_insert_async,,1 946684800000000000\n"))
+	spoolMaxSize = 1 << 20
+	require.Equal(t, 202, insert("async=true", "test_insert_async,,1 946684800000000000\n"))
+	spoolMaxSize = insertSpool.stats().Bytes
+	require.Equal(t, 429, insert("async=true", "test_insert_async,,1 946684800000000000\n"))
+
+	// points that can't be written to the spool are retried by clients
+	spoolMaxSize = 1 << 20
+	insertSpool.active.Close()
+	require.Equal(t, 500, insert("async=true", "test_insert_async,,1 946684800000000000\n"))
+}
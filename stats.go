@@ -0,0 +1,349 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	statsTopTagKeys       = 5
+	statsSampleRows       = int64(1000000)
+	errInvalidStatsSample = errors.New("sample must be greater than 0 and at most 1")
+	errInvalidStatsTop    = errors.New("top must not be negative")
+)
+
+// pointCounter is implemented by storage engines that can count the points
+// of metrics
+type pointCounter interface {
+	// CountPoints returns the number of points and their approximate size in
+	// bytes of metric, or of every metric if it's empty. With a sample below
+	// 1 only that fraction of the uncompressed points is scanned and their
+	// count is estimated from it. A sample of 0 lets the engine choose one.
+	CountPoints(metric string, sample float64) (map[string]*pointCount, error)
+}
+
+type pointCount struct {
+	points  int64
+	bytes   int64
+	sampled bool
+}
+
+// seriesStatser is implemented by storage engines that compute the series
+// stats of every metric at once rather than metric by metric
+type seriesStatser interface {
+	// SeriesStats returns the number of series, the first and last timestamps
+	// and the number of values of every tag key of metric, or of every metric
+	// if it's empty
+	SeriesStats(metric string) (map[string]*metricStats, error)
+}
+
+// topTagKeys returns the top tag keys of series with the most distinct
+// values
+func topTagKeys(series []map[string]string, top int) []*tagKeyStats {
+	values := map[string]map[string]bool{}
+	for _, tags := range series {
+		for k, v := range tags {
+			if values[k] == nil {
+				values[k] = map[string]bool{}
+			}
+			values[k][v] = true
+		}
+	}
+	keys := make([]*tagKeyStats, 0, len(values))
+	for k, vs := range values {
+		keys = append(keys, &tagKeyStats{Key: k, Values: int64(len(vs))})
+	}
+	return sortTopTagKeys(keys, top)
+}
+
+// sortTopTagKeys sorts keys by their number of values and returns the top
+// ones
+func sortTopTagKeys(keys []*tagKeyStats, top int) []*tagKeyStats {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Values != keys[j].Values {
+			return keys[i].Values > keys[j].Values
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	if len(keys) > top {
+		keys = keys[:top]
+	}
+	return keys
+}
+
+// selectStats returns the stats of metric, or of every metric if it's empty,
+// sorted by metric. Points are counted on a sample of them if sample is below
+// 1, or on one chosen by the storage engine if it's 0, and top is the number
+// of tag keys with the most values reported.
+func selectStats(s Storage, metric string, sample float64, top int) ([]*metricStats, error) {
+	if sample < 0 || sample > 1 {
+		return nil, errInvalidStatsSample
+	}
+	if top < 0 {
+		return nil, errInvalidStatsTop
+	}
+	if metric != "" && !metricAndTagsRe.MatchString(metric) {
+		return nil, errUnsupportedMetricName
+	}
+
+	var counts map[string]*pointCount
+	if pc, ok := s.(pointCounter); ok {
+		var err error
+		if counts, err = pc.CountPoints(metric, sample); err != nil {
+			return nil, err
+		}
+	}
+	addCounts := func(st *metricStats) {
+		if c, ok := counts[st.Metric]; ok {
+			st.Points, st.Bytes, st.Sampled = c.points, c.bytes, c.sampled
+		}
+	}
+
+	if ss, ok := s.(seriesStatser); ok {
+		all, err := ss.SeriesStats(metric)
+		if err != nil {
+			return nil, err
+		}
+		if metric != "" && all[metric] == nil {
+			return nil, errMetricDoesNotExist
+		}
+		stats := make([]*metricStats, 0, len(all))
+		for _, st := range all {
+			st.TopTagKeys = sortTopTagKeys(st.TopTagKeys, top)
+			addCounts(st)
+			stats = append(stats, st)
+		}
+		sort.Slice(stats, func(i, j int) bool {
+			return stats[i].Metric < stats[j].Metric
+		})
+		return stats, nil
+	}
+
+	metrics := []string{metric}
+	if metric == "" {
+		var err error
+		if metrics, err = s.SelectMetrics(); err != nil {
+			return nil, err
+		}
+	}
+	stats := []*metricStats{}
+	for _, m := range metrics {
+		series, err := s.SelectSeries(m, nil, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(series) == 0 {
+			if metric != "" {
+				return nil, errMetricDoesNotExist
+			}
+			continue
+		}
+		st := &metricStats{
+			Metric:     m,
+			Series:     int64(len(series)),
+			TopTagKeys: topTagKeys(series, top),
+		}
+		addCounts(st)
+		if st.FirstTimestamp, err = s.FirstTimestamp(m, nil); err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if st.LastTimestamp, err = s.LastTimestamp(m, nil); err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		stats = append(stats, st)
+	}
+	return stats, nil
+}
+
+// SeriesStats reads the series with points and their tag keys from the
+// series catalog and the first and last timestamps of every series from the
+// ends of its index
+func (s *pgStorage) SeriesStats(metric string) (map[string]*metricStats, error) {
+	stats := map[string]*metricStats{}
+	get := func(m string) *metricStats {
+		st, ok := stats[m]
+		if !ok {
+			st = &metricStats{Metric: m, TopTagKeys: []*tagKeyStats{}}
+			stats[m] = st
+		}
+		return st
+	}
+	err := s.db.Query(priorityCRUD, func(session *sql.DB) error {
+		var (
+			where string
+			vals  []interface{}
+		)
+		// series stay in the catalog after their points are deleted
+		live := fmt.Sprintf(" WHERE (EXISTS (SELECT 1 FROM %s WHERE series_id = s.id) OR EXISTS (SELECT 1 FROM %s WHERE series_id = s.id))", metricsTable, chunksTable)
+		if metric != "" {
+			where = " WHERE s.metric = $1"
+			live += " AND s.metric = $1"
+			vals = append(vals, metric)
+		}
+		query := func(query string, scan func(*sql.Rows) error) error {
+			scanner, err := session.Query(query, vals...)
+			if err != nil {
+				return err
+			}
+			defer scanner.Close()
+			for scanner.Next() {
+				if err := scan(scanner); err != nil {
+					return err
+				}
+			}
+			return scanner.Err()
+		}
+		var (
+			m           string
+			n           int64
+			key         string
+			first, last sql.NullInt64
+		)
+
+		err := query(fmt.Sprintf(`SELECT s.metric, count(*) FROM %s s%s GROUP BY s.metric`, seriesTable, live), func(scanner *sql.Rows) error {
+			if err := scanner.Scan(&m, &n); err != nil {
+				return err
+			}
+			get(m).Series = n
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		err = query(fmt.Sprintf(`SELECT s.metric, t.key, count(DISTINCT t.value) FROM %s s CROSS JOIN LATERAL jsonb_each_text(s.tags) t%s GROUP BY s.metric, t.key`, seriesTable, live), func(scanner *sql.Rows) error {
+			if err := scanner.Scan(&m, &key, &n); err != nil {
+				return err
+			}
+			st := get(m)
+			st.TopTagKeys = append(st.TopTagKeys, &tagKeyStats{Key: key, Values: n})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// metrics whose timestamps were read
+		ranged := map[string]bool{}
+		setRange := func(scanner *sql.Rows) error {
+			if err := scanner.Scan(&m, &first, &last); err != nil {
+				return err
+			}
+			if !first.Valid {
+				return nil
+			}
+			st := get(m)
+			if !ranged[m] || first.Int64 < st.FirstTimestamp {
+				st.FirstTimestamp = first.Int64
+			}
+			if !ranged[m] || last.Int64 > st.LastTimestamp {
+				st.LastTimestamp = last.Int64
+			}
+			ranged[m] = true
+			return nil
+		}
+		err = query(fmt.Sprintf(`
+SELECT s.metric, min(f.timestamp), max(l.timestamp) FROM %s s
+LEFT JOIN LATERAL (SELECT timestamp FROM %s WHERE series_id = s.id ORDER BY timestamp LIMIT 1) f ON true
+LEFT JOIN LATERAL (SELECT timestamp FROM %s WHERE series_id = s.id ORDER BY timestamp DESC LIMIT 1) l ON true%s
+GROUP BY s.metric`, seriesTable, metricsTable, metricsTable, where), setRange)
+		if err != nil {
+			return err
+		}
+		return query(fmt.Sprintf(`SELECT s.metric, min(c.min_time), max(c.max_time) FROM %s c JOIN %s s ON s.id = c.series_id%s GROUP BY s.metric`, chunksTable, seriesTable, where), setRange)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// CountPoints counts the rows of the metrics partitions, or a sample of them,
+// and the points of the chunks. Rows are given their share of the size of the
+// partitions and their indexes according to the planner's row estimates. A
+// sample of 0 scans about statsSampleRows rows according to the estimates.
+func (s *pgStorage) CountPoints(metric string, sample float64) (map[string]*pointCount, error) {
+	counts := map[string]*pointCount{}
+	err := s.db.Query(priorityCRUD, func(session *sql.DB) error {
+		var (
+			where string
+			vals  []interface{}
+		)
+		if metric != "" {
+			where = " WHERE s.metric = $1"
+			vals = append(vals, metric)
+		}
+		var (
+			m     string
+			n     int64
+			rows  int64
+			bytes int64
+		)
+		row := session.QueryRow(`SELECT coalesce(sum(greatest(c.reltuples, 0)), 0)::bigint, coalesce(sum(pg_total_relation_size(c.oid)), 0)::bigint FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid WHERE i.inhparent = $1::regclass`, metricsTable)
+		if err := row.Scan(&rows, &bytes); err != nil {
+			return err
+		}
+		if sample == 0 {
+			sample = 1
+			if rows > statsSampleRows {
+				sample = float64(statsSampleRows) / float64(rows)
+			}
+		}
+		var tableSample string
+		if sample < 1 {
+			tableSample = fmt.Sprintf(" TABLESAMPLE SYSTEM (%g)", sample*100)
+		}
+
+		scanner, err := session.Query(fmt.Sprintf(`SELECT s.metric, count(*) FROM %s m%s JOIN %s s ON s.id = m.series_id%s GROUP BY s.metric`, metricsTable, tableSample, seriesTable, where), vals...)
+		if err != nil {
+			return err
+		}
+		for scanner.Next() {
+			if err := scanner.Scan(&m, &n); err != nil {
+				scanner.Close()
+				return err
+			}
+			counts[m] = &pointCount{points: int64(float64(n) / sample), sampled: sample < 1}
+		}
+		scanner.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+
+		if rows == 0 && metric == "" {
+			for _, c := range counts {
+				rows += c.points
+			}
+		}
+		if rows > 0 {
+			for _, c := range counts {
+				c.bytes = int64(float64(c.points) / float64(rows) * float64(bytes))
+			}
+		}
+
+		scanner, err = session.Query(fmt.Sprintf(`SELECT s.metric, sum(c.count), sum(octet_length(c.data)) FROM %s c JOIN %s s ON s.id = c.series_id%s GROUP BY s.metric`, chunksTable, seriesTable, where), vals...)
+		if err != nil {
+			return err
+		}
+		defer scanner.Close()
+		for scanner.Next() {
+			if err := scanner.Scan(&m, &n, &bytes); err != nil {
+				return err
+			}
+			c, ok := counts[m]
+			if !ok {
+				c = &pointCount{}
+				counts[m] = c
+			}
+			c.points += n
+			c.bytes += bytes
+		}
+		return scanner.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsHandler(t *testing.T) {
+	s := newMemStorage()
+	if err := insertPoints(s, []*insertPointQuery{
+		{Metric: "cpu.user", Tags: map[string]string{"host": "web1", "dc": "eu1"}, Point: &point{Value: 1, Timestamp: 946684800000000000}},
+		{Metric: "cpu.user", Tags: map[string]string{"host": "web1", "dc": "eu1"}, Point: &point{Value: 2, Timestamp: 946684860000000000}},
+		{Metric: "cpu.user", Tags: map[string]string{"host": "web2", "dc": "eu1"}, Point: &point{Value: 1, Timestamp: 946684920000000000}},
+		{Metric: "cpu.user", Tags: map[string]string{"host": "db1", "role": "primary"}, Point: &point{Value: 1, Timestamp: 946684740000000000}},
+		{Metric: "mem.used", Tags: map[string]string{"host": "web1"}, Point: &point{Value: 1, Timestamp: 946684800000000000}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(url string, result interface{}) int {
+		w := httptest.NewRecorder()
+		statsHandler(s, w, httptest.NewRequest("GET", url, nil), nil)
+		if w.Code == 200 {
+			if err := json.NewDecoder(w.Body).Decode(result); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code
+	}
+
+	var stats []*metricStats
+	require.Equal(t, 200, get("/stats", &stats))
+	require.Equal(t, []*metricStats{
+		{
+			Metric:         "cpu.user",
+			Series:         3,
+			Points:         4,
+			FirstTimestamp: 946684740000000000,
+			LastTimestamp:  946684920000000000,
+			Bytes:          64,
+			TopTagKeys: []*tagKeyStats{
+				{Key: "host", Values: 3},
+				{Key: "dc", Values: 1},
+				{Key: "role", Values: 1},
+			},
+		},
+		{
+			Metric:         "mem.used",
+			Series:         1,
+			Points:         1,
+			FirstTimestamp: 946684800000000000,
+			LastTimestamp:  946684800000000000,
+			Bytes:          16,
+			TopTagKeys:     []*tagKeyStats{{Key: "host", Values: 1}},
+		},
+	}, stats)
+
+	// the in-memory engine always counts every point
+	require.Equal(t, 200, get("/stats?metric=cpu.user&top=1&sample=0.5", &stats))
+	require.Len(t, stats, 1)
+	require.False(t, stats[0].Sampled)
+	require.Equal(t, int64(4), stats[0].Points)
+	require.Equal(t, []*tagKeyStats{{Key: "host", Values: 3}}, stats[0].TopTagKeys)
+
+	require.Equal(t, 404, get("/stats?metric=disk.used", &stats))
+
+	// series without points left aren't counted
+	if err := s.DeletePoints(&deletePointsQuery{Metric: "cpu.user", Tags: map[string]string{"host": "db1"}, Start: 0, End: 946684740000000000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeletePoints(&deletePointsQuery{Metric: "mem.used", Start: 0, End: 946684800000000000}); err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, 200, get("/stats?metric=cpu.user", &stats))
+	require.Len(t, stats, 1)
+	require.Equal(t, int64(2), stats[0].Series)
+	require.Equal(t, []*tagKeyStats{{Key: "host", Values: 2}, {Key: "dc", Values: 1}}, stats[0].TopTagKeys)
+	require.Equal(t, 404, get("/stats?metric=mem.used", &stats))
+	require.Equal(t, 200, get("/stats", &stats))
+	require.Len(t, stats, 1)
+	require.Equal(t, 400, get("/stats?sample=0", &stats))
+	require.Equal(t, 400, get("/stats?sample=x", &stats))
+	require.Equal(t, 400, get("/stats?top=-1", &stats))
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StatsD metrics are aggregated in memory and written every
+// statsdFlushInterval: counters as <name>.count and <name>.rate per second,
+// gauges as <name> with their last value, timers as <name>.count, .mean,
+// .lower, .upper and .p<percentile>, and sets as <name>.count of their unique
+// values.
+
+var (
+	statsdFlushInterval               = 10 * time.Second
+	statsdPercentiles                 = []float64{90}
+	errStatsdInvalidLine              = errors.New("statsd line must be <name>:<value>|<type>[|@<rate>][|#<tags>]")
+	errStatsdUnsupportedType          = errors.New("unsupported statsd metric type")
+	errStatsdInvalidRate              = errors.New("statsd sample rate must be in (0, 1]")
+	errStatsdInvalidPercent           = errors.New("statsd percentiles must be in (0, 100]")
+	errStatsdFlushIntervalNotPositive = errors.New("statsd flush interval must be positive")
+)
+
+type statsdMetric struct {
+	name  string
+	tags  map[string]string
+	typ   string
+	value float64
+	raw   string // the value of sets
+	delta bool   // relative gauge update
+	rate  float64
+}
+
+// parseStatsdLine parses one StatsD line with optional DogStatsD tags. Tags
+// without a value are stored with the value true.
+func parseStatsdLine(line string) (*statsdMetric, error) {
+	sections := strings.Split(line, "|")
+	i := strings.LastIndexByte(sections[0], ':')
+	if i <= 0 || len(sections) < 2 {
+		return nil, errStatsdInvalidLine
+	}
+	m := &statsdMetric{
+		name: sanitizeName(sections[0][:i]),
+		tags: map[string]string{},
+		typ:  sections[1],
+		raw:  sections[0][i+1:],
+		rate: 1,
+	}
+	for _, section := range sections[2:] {
+		switch {
+		case strings.HasPrefix(section, "@"):
+			rate, err := strconv.ParseFloat(section[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, errStatsdInvalidRate
+			}
+			m.rate = rate
+		case strings.HasPrefix(section, "#"):
+			for _, tag := range strings.Split(section[1:], ",") {
+				if tag == "" {
+					continue
+				}
+				k, v := tag, "true"
+				if j := strings.IndexByte(tag, ':'); j >= 0 {
+					k, v = tag[:j], tag[j+1:]
+				}
+				if k != "" && v != "" {
+					m.tags[sanitizeName(k)] = sanitizeName(v)
+				}
+			}
+		}
+	}
+
+	switch m.typ {
+	case "s":
+		return m, nil
+	case "c", "g", "ms", "h", "d":
+	default:
+		return nil, fmt.Errorf("%s: %s", errStatsdUnsupportedType, m.typ)
+	}
+	m.delta = m.typ == "g" && (strings.HasPrefix(m.raw, "+") || strings.HasPrefix(m.raw, "-"))
+	value, err := strconv.ParseFloat(m.raw, 64)
+	if err != nil {
+		return nil, err
+	}
+	m.value = value
+	return m, nil
+}
+
+type statsdAggregate struct {
+	name         string
+	tags         map[string]string
+	counter      float64
+	gauge        float64
+	gaugeUpdated bool
+	timings      []float64
+	timingCount  float64
+	set          map[string]struct{}
+}
+
+type statsdAggregator struct {
+	mu       sync.Mutex
+	counters map[string]*statsdAggregate
+	gauges   map[string]*statsdAggregate
+	timers   map[string]*statsdAggregate
+	sets     map[string]*statsdAggregate
+}
+
+func newStatsdAggregator() *statsdAggregator {
+	return &statsdAggregator{
+		counters: map[string]*statsdAggregate{},
+		gauges:   map[string]*statsdAggregate{},
+		timers:   map[string]*statsdAggregate{},
+		sets:     map[string]*statsdAggregate{},
+	}
+}
+
+func getOrCreateAggregate(aggregates map[string]*statsdAggregate, m *statsdMetric) *statsdAggregate {
+	tagsJSON, _ := marshalTags(m.tags)
+	key := seriesKey(m.name, tagsJSON)
+	agg, ok := aggregates[key]
+	if !ok {
+		agg = &statsdAggregate{name: m.name, tags: m.tags}
+		aggregates[key] = agg
+	}
+	return agg
+}
+
+func (a *statsdAggregator) add(m *statsdMetric) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch m.typ {
+	case "c":
+		agg := getOrCreateAggregate(a.counters, m)
+		agg.counter += m.value / m.rate
+	case "g":
+		agg := getOrCreateAggregate(a.gauges, m)
+		if m.delta {
+			agg.gauge += m.value
+		} else {
+			agg.gauge = m.value
+		}
+		agg.gaugeUpdated = true
+	case "s":
+		agg := getOrCreateAggregate(a.sets, m)
+		if agg.set == nil {
+			agg.set = map[string]struct{}{}
+		}
+		agg.set[m.raw] = struct{}{}
+	default:
+		agg := getOrCreateAggregate(a.timers, m)
+		agg.timings = append(agg.timings, m.value)
+		agg.timingCount += 1 / m.rate
+	}
+}
+
+// percentile returns the nearest rank percentile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func formatStatsdPercentile(p float64) string {
+	return "p" + strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", 1)
+}
+
+// flush returns the points aggregated since the last flush and resets
+// everything but the gauge values, which relative updates apply to
+func (a *statsdAggregator) flush(now int64, interval time.Duration) []*insertPointQuery {
+	a.mu.Lock()
+	counters, timers, sets := a.counters, a.timers, a.sets
+	a.counters, a.timers, a.sets = map[string]*statsdAggregate{}, map[string]*statsdAggregate{}, map[string]*statsdAggregate{}
+	var gauges []*statsdAggregate
+	for _, agg := range a.gauges {
+		if agg.gaugeUpdated {
+			gauges = append(gauges, &statsdAggregate{name: agg.name, tags: agg.tags, gauge: agg.gauge})
+			agg.gaugeUpdated = false
+		}
+	}
+	a.mu.Unlock()
+
+	queries := []*insertPointQuery{}
+	write := func(agg *statsdAggregate, suffix string, value float64) {
+		queries = append(queries, &insertPointQuery{
+			Metric: agg.name + suffix,
+			Tags:   agg.tags,
+			Point:  &point{Value: value, Timestamp: now},
+		})
+	}
+	for _, agg := range counters {
+		write(agg, ".count", agg.counter)
+		write(agg, ".rate", agg.counter/interval.Seconds())
+	}
+	for _, agg := range gauges {
+		write(agg, "", agg.gauge)
+	}
+	for _, agg := range timers {
+		sort.Float64s(agg.timings)
+		var sum float64
+		for _, v := range agg.timings {
+			sum += v
+		}
+		write(agg, ".timer.count", agg.timingCount)
+		write(agg, ".mean", sum/float64(len(agg.timings)))
+		write(agg, ".lower", agg.timings[0])
+		write(agg, ".upper", agg.timings[len(agg.timings)-1])
+		for _, p := range statsdPercentiles {
+			write(agg, "."+formatStatsdPercentile(p), percentile(agg.timings, p))
+		}
+	}
+	for _, agg := range sets {
+		write(agg, ".set.count", float64(len(agg.set)))
+	}
+	return queries
+}
+
+// parseStatsdPercentiles parses a comma separated list of percentiles
+func parseStatsdPercentiles(s string) ([]float64, error) {
+	percentiles := []float64{}
+	for _, ps := range strings.Split(s, ",") {
+		ps = strings.TrimSpace(ps)
+		if ps == "" {
+			continue
+		}
+		p, err := strconv.ParseFloat(ps, 64)
+		if err != nil {
+			return nil, err
+		}
+		if p <= 0 || p > 100 {
+			return nil, fmt.Errorf("%s: %s", errStatsdInvalidPercent, ps)
+		}
+		percentiles = append(percentiles, p)
+	}
+	return percentiles, nil
+}
+
+// readStatsdPacket adds the metrics of every line of a packet to a. Invalid
+// lines are logged and skipped.
+func readStatsdPacket(packet string, a *statsdAggregator) {
+	for _, line := range strings.Split(packet, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		m, err := parseStatsdLine(line)
+		if err != nil {
+			log.Errorf("readStatsdPacket: unable to parse line '%s': %s", line, err)
+			continue
+		}
+		if m.name == "" {
+			log.Errorf("readStatsdPacket: unable to parse line '%s': %s", line, errMetricRequired)
+			continue
+		}
+		a.add(m)
+	}
+}
+
+func serveStatsd(conn net.PacketConn, a *statsdAggregator) {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Errorf("serveStatsd: %s", err)
+				continue
+			}
+			return
+		}
+		readStatsdPacket(string(buf[:n]), a)
+	}
+}
+
+func flushStatsd(s Storage, a *statsdAggregator) {
+	ticker := time.NewTicker(statsdFlushInterval)
+	defer ticker.Stop()
+	for t := range ticker.C {
+		if err := insertPoints(s, a.flush(t.UnixNano(), statsdFlushInterval)); err != nil {
+			log.Errorf("flushStatsd: %s", err)
+		}
+	}
+}
+
+// initStatsd starts the StatsD listener if its address is set
+func initStatsd(s Storage, addr string) error {
+	if addr == "" {
+		return nil
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	log.Infof("StatsD listening on udp %s", conn.LocalAddr())
+	a := newStatsdAggregator()
+	go serveStatsd(conn, a)
+	go flushStatsd(s, a)
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStatsdLine(t *testing.T) {
+	m, err := parseStatsdLine("api.requests:2|c|@0.5|#env:prod,canary,host:a:b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, &statsdMetric{
+		name:  "api.requests",
+		tags:  map[string]string{"env": "prod", "canary": "true", "host": "a_b"},
+		typ:   "c",
+		value: 2,
+		raw:   "2",
+		rate:  0.5,
+	}, m)
+
+	m, err = parseStatsdLine("queue.size:-3|g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.True(t, m.delta)
+
+	for _, line := range []string{"a", "a:1", ":1|c", "a:x|c", "a:1|x", "a:1|c|@2"} {
+		if _, err := parseStatsdLine(line); err == nil {
+			t.Fatalf("expected error for line %q", line)
+		}
+	}
+}
+
+func TestStatsdAggregator(t *testing.T) {
+	a := newStatsdAggregator()
+	readStatsdPacket("hits:1|c\nhits:2|c|@0.5\ninvalid\nload:5|g\nload:+2|g\nusers:a|s\nusers:b|s\nusers:a|s", a)
+	for i := 1; i <= 10; i++ {
+		m, err := parseStatsdLine("latency:" + strconv.Itoa(i) + "|ms")
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.add(m)
+	}
+
+	tags := map[string]string{}
+	require.ElementsMatch(t, []*insertPointQuery{
+		{Metric: "hits.count", Tags: tags, Point: &point{Value: 5, Timestamp: 1}},
+		{Metric: "hits.rate", Tags: tags, Point: &point{Value: 0.5, Timestamp: 1}},
+		{Metric: "load", Tags: tags, Point: &point{Value: 7, Timestamp: 1}},
+		{Metric: "latency.timer.count", Tags: tags, Point: &point{Value: 10, Timestamp: 1}},
+		{Metric: "latency.mean", Tags: tags, Point: &point{Value: 5.5, Timestamp: 1}},
+		{Metric: "latency.lower", Tags: tags, Point: &point{Value: 1, Timestamp: 1}},
+		{Metric: "latency.upper", Tags: tags, Point: &point{Value: 10, Timestamp: 1}},
+		{Metric: "latency.p90", Tags: tags, Point: &point{Value: 9, Timestamp: 1}},
+		{Metric: "users.set.count", Tags: tags, Point: &point{Value: 2, Timestamp: 1}},
+	}, a.flush(1, 10*time.Second))
+
+	// only updated gauges are written, relative updates apply to the last value
+	require.Empty(t, a.flush(2, 10*time.Second))
+	readStatsdPacket("load:-1|g", a)
+	require.Equal(t, []*insertPointQuery{
+		{Metric: "load", Tags: tags, Point: &point{Value: 6, Timestamp: 3}},
+	}, a.flush(3, 10*time.Second))
+
+	// a counter, timer and set of the same name write different counts
+	readStatsdPacket("req:1|c\nreq:1|ms\nreq:a|s", a)
+	counts := map[string]bool{}
+	for _, q := range a.flush(4, 10*time.Second) {
+		require.False(t, counts[q.Metric], q.Metric)
+		counts[q.Metric] = true
+	}
+	require.True(t, counts["req.count"] && counts["req.timer.count"] && counts["req.set.count"])
+
+	if _, err := parseStatsdPercentiles("50,101"); err == nil {
+		t.Fatal("expected error for percentile above 100")
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// onConflict modes of inserts for points whose series already has a point at
+// the same timestamp
+const (
+	onConflictIgnore    = "ignore"
+	onConflictOverwrite = "overwrite"
+	onConflictError     = "error"
+	onConflictSum       = "sum"
+)
+
+var (
+	storageEngine               = "postgres"
+	errUnsupportedStorageEngine = errors.New("valid storage engines are postgres, embedded and memory")
+	errUnsupportedOnConflict    = errors.New("onConflict must be ignore, overwrite, error or sum")
+	errPointExists              = errors.New("point already exists")
+)
+
+// Storage is implemented by every storage engine. Validation, windowing and
+// aggregation are done by the callers so engines only store and scan points.
+type Storage interface {
+	// InsertPoints stores points. Points whose series already has a point at
+	// the same timestamp are handled according to onConflict. It returns the
+	// number of points inserted and overwritten.
+	InsertPoints(queries []*insertPointQuery, onConflict string) (int64, int64, error)
+	// SelectPoints returns the points of every series of metric whose tags
+	// match filter with start <= timestamp <= end ordered by timestamp. A
+	// positive n limits the number of points returned.
+	SelectPoints(priority int, metric string, filter *tagFilter, start, end, n int64) ([]*point, error)
+	// SelectSeriesPoints is SelectPoints without a limit that keeps the
+	// points of every series apart. Series without points are left out.
+	SelectSeriesPoints(priority int, metric string, filter *tagFilter, start, end int64) ([]*seriesPoints, error)
+	// SelectMetrics returns the names of all metrics with points sorted
+	SelectMetrics() ([]string, error)
+	// SelectSeries returns the tags of the series of metric with points
+	// whose tags match filter. Unless start and end are 0 only series with
+	// points with start <= timestamp <= end are returned.
+	SelectSeries(metric string, filter *tagFilter, start, end int64) ([]map[string]string, error)
+	DeletePoints(query *deletePointsQuery) error
+	// FirstTimestamp and LastTimestamp return sql.ErrNoRows if there are no
+	// points
+	FirstTimestamp(metric string, filter *tagFilter) (int64, error)
+	LastTimestamp(metric string, filter *tagFilter) (int64, error)
+
+	// InsertDownsamplers stores downsamplers and sets their IDs
+	InsertDownsamplers(dss []*downsampler) error
+	SelectDownsamplers() ([]*downsampler, error)
+	DeleteDownsampler(id int64) error
+	// DownsamplersCount is the worker ID the downsample coordinator
+	// starts from
+	DownsamplersCount() (int, error)
+	// NextDownsampler returns the downsampler of workerID that is due first
+	// and the time it is due at or sql.ErrNoRows if the worker has none
+	NextDownsampler(workerID int) (*downsampler, int64, error)
+	UpdateDownsamplerTimeUpdateAt(id int64, timeUpdateAt int64) error
+	// CommitDownsample atomically writes downsampled series to ds.OutMetric
+	// with their tags, overwriting existing points such as the ones of the
+	// last downsampled window, and records the last downsampled window.
+	CommitDownsample(ds *downsampler, series []*seriesPoints) error
+
+	SetRetentionPolicy(policy *retentionPolicy) error
+	SelectRetentionPolicies() ([]*retentionPolicy, error)
+	DeleteRetentionPolicy(metric string) error
+	// EnforceRetention removes points older than the retention policy of
+	// their metric and returns how many were removed
+	EnforceRetention(policies []*retentionPolicy, now int64) (int64, error)
+}
+
+// initStorage starts the downsampler workers and the retention enforcer
+func initStorage(s Storage) (chan int, []chan struct{}) {
+	downsamplersCount, err := s.DownsamplersCount()
+	if err != nil {
+		log.Fatalf("initStorage: downsampleCoordinator start: %s", err)
+	}
+
+	nextDownsamplerID := make(chan int)
+	go downsampleCountCoordinator(downsamplersCount, nextDownsamplerID)
+
+	cancelDownsampleWait := make([]chan struct{}, downsamplerWorkerCount)
+	for i := 0; i < downsamplerWorkerCount; i++ {
+		i := i
+		cancelDownsampleWait[i] = make(chan struct{}, 100)
+		go handleDownsamplers(s, i, cancelDownsampleWait[i])
+	}
+
+	go handleRetention(s)
+
+	return nextDownsamplerID, cancelDownsampleWait
+}
+
+func validateInsertQueries(queries []*insertPointQuery) error {
+	for _, query := range queries {
+		if !metricAndTagsRe.MatchString(query.Metric) {
+			return errUnsupportedMetricName
+		}
+		if err := validateTags(query.Tags); err != nil {
+			return err
+		}
+		if query.Point == nil {
+			return errPointRequiredForInsertQuery
+		}
+	}
+	return nil
+}
+
+// storageError is an error of the storage engine as opposed to an invalid
+// request. Ingestion endpoints answer it with a status clients retry.
+type storageError struct {
+	err error
+}
+
+func (e *storageError) Error() string {
+	return e.err.Error()
+}
+
+func isStorageError(err error) bool {
+	_, ok := err.(*storageError)
+	return ok
+}
+
+// insertPoints validates and inserts points, ignoring duplicates. Errors of
+// the storage engine are returned as a *storageError.
+func insertPoints(s Storage, queries []*insertPointQuery) error {
+	if len(queries) == 0 {
+		return nil
+	}
+	if err := validateInsertQueries(queries); err != nil {
+		return err
+	}
+	if _, _, err := s.InsertPoints(queries, onConflictIgnore); err != nil {
+		return &storageError{err: err}
+	}
+	return nil
+}
+
+// insertPointsWithMode is insertPoints with an onConflict mode that returns
+// the number of points inserted and overwritten. The others were duplicates.
+func insertPointsWithMode(s Storage, queries []*insertPointQuery, onConflict string) (int64, int64, error) {
+	if len(queries) == 0 {
+		return 0, 0, nil
+	}
+	if err := validateInsertQueries(queries); err != nil {
+		return 0, 0, err
+	}
+	return s.InsertPoints(queries, onConflict)
+}
+
+func validateOnConflict(onConflict string) error {
+	switch onConflict {
+	case onConflictIgnore, onConflictOverwrite, onConflictError, onConflictSum:
+		return nil
+	}
+	return errUnsupportedOnConflict
+}
+
+// sumPoints adds the value of pt to existing. Null values count as missing.
+func sumPoints(existing, pt *point) *point {
+	sum := copyPoint(pt)
+	switch {
+	case existing.Null:
+	case pt.Null:
+		sum.Value, sum.Null = existing.Value, false
+	default:
+		sum.Value += existing.Value
+	}
+	return sum
+}
+
+// insertPointsPartial inserts the valid lines insertBatchSize at a time and
+// reports the others. A batch that fails to insert is retried one line at a
+// time so only the lines that fail on their own are reported.
+func insertPointsPartial(s Storage, lines []*insertPointsLine, onConflict string) *insertPointsSummary {
+	summary := &insertPointsSummary{Errors: []*insertPointsLineError{}}
+	reject := func(l *insertPointsLine, err error) {
+		summary.Rejected++
+		summary.Errors = append(summary.Errors, &insertPointsLineError{Line: l.line, Text: l.text, Error: err.Error()})
+	}
+	batch := make([]*insertPointsLine, 0, insertBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		queries := make([]*insertPointQuery, len(batch))
+		for i, l := range batch {
+			queries[i] = l.query
+		}
+		inserted, overwritten, err := insertPointsWithMode(s, queries, onConflict)
+		if err == nil {
+			summary.Inserted += inserted
+			summary.Overwritten += overwritten
+			summary.Duplicates += int64(len(queries)) - inserted - overwritten
+			batch = batch[:0]
+			return
+		}
+		for _, l := range batch {
+			inserted, overwritten, err := insertPointsWithMode(s, []*insertPointQuery{l.query}, onConflict)
+			summary.Inserted += inserted
+			summary.Overwritten += overwritten
+			if err != nil {
+				reject(l, err)
+				continue
+			}
+			summary.Duplicates += 1 - inserted - overwritten
+		}
+		batch = batch[:0]
+	}
+	for _, l := range lines {
+		err := l.err
+		if err == nil {
+			err = validateInsertQueries([]*insertPointQuery{l.query})
+		}
+		if err != nil {
+			reject(l, err)
+			continue
+		}
+		batch = append(batch, l)
+		if len(batch) >= insertBatchSize {
+			flush()
+		}
+	}
+	flush()
+	return summary
+}
+
+func validateTags(tags map[string]string) error {
+	for k, v := range tags {
+		if !metricAndTagsRe.MatchString(k) {
+			return errUnsupportedTagName
+		}
+		if !metricAndTagsRe.MatchString(v) {
+			return errUnsupportedTagValue
+		}
+	}
+	return nil
+}
+
+// validatePointsQuery validates query and returns its tag filter
+func validatePointsQuery(query *pointsQuery) (*tagFilter, error) {
+	if query.Metric == "" {
+		return nil, errMetricRequired
+	}
+	if !metricAndTagsRe.MatchString(query.Metric) {
+		return nil, errUnsupportedMetricName
+	}
+	if query.Start == 0 {
+		return nil, errStartRequired
+	}
+	if query.End == 0 {
+		query.End = time.Now().UnixNano()
+	}
+	if err := validateTags(query.Tags); err != nil {
+		return nil, err
+	}
+	return newQueryTagFilter(query.Tags, query.Filter)
+}
+
+func queryPoints(s Storage, priority int, query *pointsQuery) ([]*point, error) {
+	filter, err := validatePointsQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	points, err := s.SelectPoints(priority, query.Metric, filter, query.Start, query.End, query.N)
+	if err != nil {
+		return nil, err
+	}
+	return windowAndAggregate(query.Start, query.End, query.Window, query.Aggregators, points)
+}
+
+// windowAndAggregate applies the window and aggregators of a query to points
+// sorted by timestamp
+func windowAndAggregate(start, end int64, windowOptions map[string]interface{}, aggregators []*aggregatorQuery, points []*point) ([]*point, error) {
+	var (
+		windowApplied              bool
+		windowedAggregatorApplied  bool
+		windowedAggregatorApplied0 bool
+		err                        error
+	)
+
+	if windowOptions != nil {
+		points, err = window(start, end, windowOptions, points)
+		if err != nil {
+			return nil, err
+		}
+		windowApplied = true
+	}
+
+	if len(points) == 0 {
+		return points, nil
+	}
+
+	for _, aggregator := range aggregators {
+		points, windowedAggregatorApplied0, err = aggregate(aggregator, windowApplied, points)
+		if err != nil {
+			return nil, err
+		}
+		if windowedAggregatorApplied0 {
+			windowedAggregatorApplied = true
+		}
+	}
+
+	// Set windows to 0 if the points are window aggregated since all of the
+	// timestamps will be windows anyway
+	if windowedAggregatorApplied {
+		for _, pt := range points {
+			pt.Window = 0
+		}
+	}
+
+	return points, nil
+}
+
+func deletePoints(s Storage, query *deletePointsQuery) error {
+	if query.Metric == "" {
+		return errMetricRequired
+	}
+	if !metricAndTagsRe.MatchString(query.Metric) {
+		return errUnsupportedMetricName
+	}
+	if query.Start == 0 {
+		return errStartRequired
+	}
+	if query.End == 0 {
+		return errEndRequired
+	}
+	if err := validateTags(query.Tags); err != nil {
+		return err
+	}
+	if _, err := parseTagFilter(query.Filter); err != nil {
+		return err
+	}
+	return s.DeletePoints(query)
+}
+
+func validateDownsampler(ds *downsampler) error {
+	if ds.Metric == "" {
+		return errMetricRequired
+	}
+	if ds.OutMetric == "" {
+		return errOutMetricRequired
+	}
+	if !metricAndTagsRe.MatchString(ds.Metric) {
+		return errUnsupportedMetricName
+	}
+	if !metricAndTagsRe.MatchString(ds.OutMetric) {
+		return errUnsupportedOutMetricName
+	}
+	if ds.Query == nil {
+		return errQueryRequiredForDownsampler
+	}
+	if ds.Query.Window == nil {
+		return errWindowRequiredForDownsampler
+	}
+	if _, ok := ds.Query.Window["every"]; !ok {
+		return errEveryRequired
+	}
+	if ds.RunEvery == "" {
+		return errRunEveryRequiredForDownsampler
+	}
+	if ds.Query.Aggregators == nil {
+		return errAggregatorsRequiredForDownsampler
+	}
+	if len(ds.Query.Aggregators) == 0 {
+		return errOneAggregatorRequiredForDownsampler
+	}
+	if err := validateTags(ds.Query.Tags); err != nil {
+		return err
+	}
+	if err := validateGroupBy(ds.Query.GroupBy); err != nil {
+		return err
+	}
+	if _, err := parseTagFilter(ds.Query.Filter); err != nil {
+		return err
+	}
+	dur, err := time.ParseDuration(ds.RunEvery)
+	if err != nil {
+		return err
+	}
+	ds.RunEveryDur = dur
+	return nil
+}
+
+func addDownsampler(s Storage, downsamplersCountChan chan int, cancelDownsampleWait []chan struct{}, ds *downsampler) error {
+	return addDownsamplers(s, downsamplersCountChan, cancelDownsampleWait, []*downsampler{ds})
+}
+
+func addDownsamplers(s Storage, downsamplersCountChan chan int, cancelDownsampleWait []chan struct{}, dss []*downsampler) error {
+	for _, ds := range dss {
+		if err := validateDownsampler(ds); err != nil {
+			return err
+		}
+	}
+
+	workerIDs := []int{}
+	for _, ds := range dss {
+		ds.WorkerID = <-downsamplersCountChan
+		if len(workerIDs) < downsamplerWorkerCount {
+			workerIDs = append(workerIDs, ds.WorkerID)
+		}
+	}
+
+	t7 := time.Now()
+	if err := s.InsertDownsamplers(dss); err != nil {
+		return err
+	}
+	log.Debugf("downsample insert time=%s", time.Since(t7))
+
+	for _, workerID := range workerIDs {
+		cancelDownsampleWait[workerID] <- struct{}{}
+	}
+	return nil
+}
+
+func deleteDownsampler(s Storage, ds *deleteDownsamplerRequest) error {
+	return s.DeleteDownsampler(ds.ID)
+}
+
+func newStorage(engine string, cfg map[string]string) (Storage, error) {
+	switch engine {
+	case "postgres":
+		return newPGStorageFromConfig(cfg)
+	case "embedded":
+		return newEmbeddedStorageFromConfig(cfg)
+	case "memory":
+		return newMemStorage(), nil
+	}
+	return nil, fmt.Errorf("%s: %s", errUnsupportedStorageEngine, engine)
+}
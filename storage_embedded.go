@@ -0,0 +1,789 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	embeddedDataDir            = "./data"
+	embeddedCompactionInterval = 5 * time.Minute
+	embeddedChunkSize          = 1024
+	embeddedMaxFrameSize       = 1 << 28
+	embeddedWALFile            = "wal"
+	embeddedMetaFile           = "meta"
+	embeddedSeriesDir          = "series"
+	embeddedSeriesFileExt      = ".chunks"
+	errTornFrame               = errors.New("torn or corrupt frame")
+	errUnknownWALRecord        = errors.New("unknown wal record")
+	errCompactionNotPositive   = errors.New("embedded compaction interval must be positive")
+)
+
+// wal record operations
+const (
+	walInsertPoints = iota + 1
+	walDeletePoints
+	walInsertDownsamplers
+	walDeleteDownsampler
+	walUpdateDownsamplerTimeUpdateAt
+	walCommitDownsample
+	walSetRetentionPolicy
+	walDeleteRetentionPolicy
+	walEnforceRetention
+)
+
+// walRecord is one logged write. Only the fields of its Op are set.
+type walRecord struct {
+	Op            int
+	Queries       []*insertPointQuery
+	Delete        *deletePointsQuery
+	Downsamplers  []*storedDownsampler
+	DownsamplerID int64
+	TimeUpdateAt  int64
+	Metric        string
+	Tags          map[string]string
+	Points        []*point
+	Series        []*seriesPoints
+	OnConflict    string
+	Policy        *retentionPolicy
+	Policies      []*retentionPolicy
+	Now           int64
+}
+
+// storedDownsampler is the on-disk form of a downsampler. The query is kept as
+// json like the postgres downsamplers table does since its options hold
+// arbitrary values.
+type storedDownsampler struct {
+	ID                    int64
+	Metric                string
+	OutMetric             string
+	RunEvery              int64
+	LastDownsampledWindow int64
+	WorkerID              int
+	TimeUpdateAt          int64
+	Query                 []byte
+}
+
+type embeddedMeta struct {
+	NextDownsamplerID int64
+	Downsamplers      []*storedDownsampler
+	Retention         []*retentionPolicy
+}
+
+type embeddedSeriesHeader struct {
+	Metric string
+	Tags   map[string]string
+}
+
+// embeddedSeriesChanges are the changes to a series since the last
+// compaction. New points are appended to the series file as a chunk unless
+// points were replaced or removed, then the file is rewritten.
+type embeddedSeriesChanges struct {
+	points  []*point
+	rewrite bool
+}
+
+// embeddedStorage serves reads from memory and persists every write to a
+// write-ahead log before applying it. Compaction moves the logged changes
+// into one append-only chunk file per series and truncates the log. On
+// startup the chunk files are loaded and the log is replayed on top of them.
+type embeddedStorage struct {
+	*memStorage
+	// mu serializes writes and compaction
+	mu    sync.Mutex
+	dir   string
+	wal   *os.File
+	dirty map[*memSeries]*embeddedSeriesChanges
+}
+
+func newStoredDownsampler(ds *downsampler, timeUpdateAt int64) (*storedDownsampler, error) {
+	bs, err := json.Marshal(ds.Query)
+	if err != nil {
+		return nil, err
+	}
+	return &storedDownsampler{
+		ID:                    ds.ID,
+		Metric:                ds.Metric,
+		OutMetric:             ds.OutMetric,
+		RunEvery:              ds.RunEveryDur.Nanoseconds(),
+		LastDownsampledWindow: ds.LastDownsampledWindow,
+		WorkerID:              ds.WorkerID,
+		TimeUpdateAt:          timeUpdateAt,
+		Query:                 bs,
+	}, nil
+}
+
+func (sd *storedDownsampler) downsampler() (*downsampler, error) {
+	ds := &downsampler{
+		ID:                    sd.ID,
+		Metric:                sd.Metric,
+		OutMetric:             sd.OutMetric,
+		RunEvery:              time.Duration(sd.RunEvery).String(),
+		RunEveryDur:           time.Duration(sd.RunEvery),
+		LastDownsampledWindow: sd.LastDownsampledWindow,
+		WorkerID:              sd.WorkerID,
+		Query:                 &downsampleQuery{},
+	}
+	if err := json.Unmarshal(sd.Query, ds.Query); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// frames are a little endian uint32 payload length and crc32 followed by the
+// payload
+
+func writeFrame(w io.Writer, payload []byte) error {
+	buf := make([]byte, 8+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[8:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readFrame returns io.EOF at the end of r and errTornFrame if the frame was
+// only partially written or doesn't match its checksum
+func readFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err == io.EOF {
+		return nil, io.EOF
+	} else if err == io.ErrUnexpectedEOF {
+		return nil, errTornFrame
+	} else if err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(header[0:4])
+	if size > uint32(embeddedMaxFrameSize) {
+		return nil, errTornFrame
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, errTornFrame
+	} else if err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, errTornFrame
+	}
+	return payload, nil
+}
+
+func gobEncode(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gobDecode(bs []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(bs)).Decode(v)
+}
+
+// points are encoded as the timestamp, the value's bits and a null flag
+const encodedPointSize = 17
+
+func encodePoints(pts []*point) []byte {
+	buf := make([]byte, len(pts)*encodedPointSize)
+	for i, pt := range pts {
+		b := buf[i*encodedPointSize:]
+		binary.LittleEndian.PutUint64(b[0:8], uint64(pt.Timestamp))
+		binary.LittleEndian.PutUint64(b[8:16], math.Float64bits(pt.Value))
+		if pt.Null {
+			b[16] = 1
+		}
+	}
+	return buf
+}
+
+func decodePoints(bs []byte) ([]*point, error) {
+	if len(bs)%encodedPointSize != 0 {
+		return nil, errTornFrame
+	}
+	pts := make([]*point, len(bs)/encodedPointSize)
+	for i := range pts {
+		b := bs[i*encodedPointSize:]
+		pts[i] = &point{
+			Timestamp: int64(binary.LittleEndian.Uint64(b[0:8])),
+			Value:     math.Float64frombits(binary.LittleEndian.Uint64(b[8:16])),
+			Null:      b[16] == 1,
+		}
+	}
+	return pts, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// writeFileAtomic replaces path with the frames of payloads
+func writeFileAtomic(path string, payloads ...[]byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, payload := range payloads {
+		if err := writeFrame(w, payload); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func newEmbeddedStorage(dir string) (*embeddedStorage, error) {
+	e := &embeddedStorage{
+		memStorage: newMemStorage(),
+		dir:        dir,
+		dirty:      map[*memSeries]*embeddedSeriesChanges{},
+	}
+	if err := os.MkdirAll(filepath.Join(dir, embeddedSeriesDir), 0755); err != nil {
+		return nil, err
+	}
+	if err := e.loadMeta(); err != nil {
+		return nil, err
+	}
+	if err := e.loadSeries(); err != nil {
+		return nil, err
+	}
+	e.memStorage.changed = e.markDirty
+	if err := e.replayWAL(); err != nil {
+		return nil, err
+	}
+	if len(e.dirty) > 0 {
+		if err := e.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func newEmbeddedStorageFromConfig(cfg map[string]string) (Storage, error) {
+	if v, ok := cfg["embedded_data_dir"]; ok && v != "" {
+		embeddedDataDir = v
+	}
+	if v, ok := cfg["embedded_compaction_interval"]; ok && v != "" {
+		dur, err := parseDuration(v)
+		if err != nil {
+			return nil, err
+		}
+		if dur <= 0 {
+			return nil, errCompactionNotPositive
+		}
+		embeddedCompactionInterval = dur
+	}
+	e, err := newEmbeddedStorage(embeddedDataDir)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Opened embedded storage at %s", embeddedDataDir)
+	go e.manageCompaction()
+	return e, nil
+}
+
+func (e *embeddedStorage) seriesPath(series *memSeries) string {
+	return filepath.Join(e.dir, embeddedSeriesDir, fmt.Sprintf("%x%s", sha1.Sum([]byte(series.key)), embeddedSeriesFileExt))
+}
+
+func (e *embeddedStorage) loadMeta() error {
+	f, err := os.Open(filepath.Join(e.dir, embeddedMetaFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	payload, err := readFrame(f)
+	if err != nil {
+		return fmt.Errorf("%s: %s", embeddedMetaFile, err)
+	}
+	meta := &embeddedMeta{}
+	if err := gobDecode(payload, meta); err != nil {
+		return err
+	}
+	for _, sd := range meta.Downsamplers {
+		ds, err := sd.downsampler()
+		if err != nil {
+			return err
+		}
+		e.memStorage.putDownsampler(ds, sd.TimeUpdateAt)
+	}
+	if meta.NextDownsamplerID > e.memStorage.nextDownsamplerID {
+		e.memStorage.nextDownsamplerID = meta.NextDownsamplerID
+	}
+	for _, p := range meta.Retention {
+		e.memStorage.retention[p.Metric] = p
+	}
+	return nil
+}
+
+func (e *embeddedStorage) loadSeries() error {
+	dir := filepath.Join(e.dir, embeddedSeriesDir)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		path := filepath.Join(dir, fi.Name())
+		if strings.HasSuffix(fi.Name(), ".tmp") {
+			// left over from an interrupted rewrite
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			continue
+		}
+		if !strings.HasSuffix(fi.Name(), embeddedSeriesFileExt) {
+			continue
+		}
+		if err := e.loadSeriesFile(path); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	return nil
+}
+
+// loadSeriesFile reads the header and chunks of a series file. A torn last
+// chunk is cut off, its points are still in the wal.
+func (e *embeddedStorage) loadSeriesFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	payload, err := readFrame(r)
+	if err == io.EOF || err == errTornFrame {
+		log.Warnf("embedded: removing series file %s without header", path)
+		return os.Remove(path)
+	} else if err != nil {
+		return err
+	}
+	header := &embeddedSeriesHeader{}
+	if err := gobDecode(payload, header); err != nil {
+		return err
+	}
+	offset := int64(8 + len(payload))
+	series, err := e.memStorage.getOrCreateSeries(header.Metric, header.Tags)
+	if err != nil {
+		return err
+	}
+
+	for {
+		payload, err := readFrame(r)
+		if err == io.EOF {
+			return nil
+		} else if err == errTornFrame {
+			log.Warnf("embedded: truncating torn chunk of %s at %d", path, offset)
+			return f.Truncate(offset)
+		} else if err != nil {
+			return err
+		}
+		pts, err := decodePoints(payload)
+		if err != nil {
+			return err
+		}
+		for _, pt := range pts {
+			series.insert(pt, false)
+		}
+		offset += int64(8 + len(payload))
+	}
+}
+
+// replayWAL applies the logged writes that weren't compacted yet and
+// truncates a torn last record
+func (e *embeddedStorage) replayWAL() error {
+	f, err := os.OpenFile(filepath.Join(e.dir, embeddedWALFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	var (
+		offset  int64
+		records int
+	)
+	for {
+		payload, err := readFrame(r)
+		if err == io.EOF {
+			break
+		} else if err == errTornFrame {
+			log.Warnf("embedded: truncating torn wal record at %d", offset)
+			if err := f.Truncate(offset); err != nil {
+				f.Close()
+				return err
+			}
+			break
+		} else if err != nil {
+			f.Close()
+			return err
+		}
+		rec := &walRecord{}
+		if err := gobDecode(payload, rec); err != nil {
+			f.Close()
+			return err
+		}
+		if _, err := e.apply(rec); err != nil {
+			f.Close()
+			return err
+		}
+		offset += int64(8 + len(payload))
+		records++
+	}
+	if records > 0 {
+		log.Infof("embedded: replayed %d wal records", records)
+	}
+	e.wal = f
+	return nil
+}
+
+// markDirty is the changed callback of the memory storage
+func (e *embeddedStorage) markDirty(series *memSeries, pt *point) {
+	changes, ok := e.dirty[series]
+	if !ok {
+		changes = &embeddedSeriesChanges{}
+		e.dirty[series] = changes
+	}
+	if pt == nil {
+		changes.rewrite = true
+		changes.points = nil
+	} else if !changes.rewrite {
+		changes.points = append(changes.points, copyPoint(pt))
+	}
+}
+
+// apply applies rec to memory. It returns the number of inserted points of
+// walInsertPoints records and of removed points of walEnforceRetention
+// records.
+func (e *embeddedStorage) apply(rec *walRecord) (int64, error) {
+	m := e.memStorage
+	switch rec.Op {
+	case walInsertPoints:
+		inserted, _, err := m.InsertPoints(rec.Queries, rec.OnConflict)
+		return inserted, err
+	case walDeletePoints:
+		return 0, m.DeletePoints(rec.Delete)
+	case walInsertDownsamplers:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		for _, sd := range rec.Downsamplers {
+			ds, err := sd.downsampler()
+			if err != nil {
+				return 0, err
+			}
+			m.putDownsampler(ds, sd.TimeUpdateAt)
+		}
+		return 0, nil
+	case walDeleteDownsampler:
+		return 0, m.DeleteDownsampler(rec.DownsamplerID)
+	case walUpdateDownsamplerTimeUpdateAt:
+		return 0, m.UpdateDownsamplerTimeUpdateAt(rec.DownsamplerID, rec.TimeUpdateAt)
+	case walCommitDownsample:
+		ds := &downsampler{
+			ID:        rec.DownsamplerID,
+			OutMetric: rec.Metric,
+			Query:     &downsampleQuery{Tags: rec.Tags},
+		}
+		series := rec.Series
+		if series == nil {
+			// logged before downsamplers could group by tags
+			series = []*seriesPoints{{Tags: rec.Tags, Points: rec.Points}}
+		}
+		return 0, m.CommitDownsample(ds, series)
+	case walSetRetentionPolicy:
+		return 0, m.SetRetentionPolicy(rec.Policy)
+	case walDeleteRetentionPolicy:
+		return 0, m.DeleteRetentionPolicy(rec.Metric)
+	case walEnforceRetention:
+		return m.EnforceRetention(rec.Policies, rec.Now)
+	}
+	return 0, fmt.Errorf("%s: %d", errUnknownWALRecord, rec.Op)
+}
+
+// appendWAL logs rec and syncs the log. e.mu must be held.
+func (e *embeddedStorage) appendWAL(rec *walRecord) error {
+	payload, err := gobEncode(rec)
+	if err != nil {
+		return err
+	}
+	if err := writeFrame(e.wal, payload); err != nil {
+		return err
+	}
+	return e.wal.Sync()
+}
+
+func (e *embeddedStorage) write(rec *walRecord) (int64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.appendWAL(rec); err != nil {
+		return 0, err
+	}
+	return e.apply(rec)
+}
+
+// InsertPoints checks for conflicts before logging in onConflictError mode
+// so the log only holds records that replay. Sums are logged as overwrites
+// of the summed values so replaying them twice doesn't add them twice.
+func (e *embeddedStorage) InsertPoints(queries []*insertPointQuery, onConflict string) (int64, int64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var err error
+	switch onConflict {
+	case onConflictError:
+		e.memStorage.mu.RLock()
+		err = e.memStorage.checkConflicts(queries)
+		e.memStorage.mu.RUnlock()
+	case onConflictSum:
+		e.memStorage.mu.RLock()
+		queries, err = e.memStorage.resolveSums(queries)
+		e.memStorage.mu.RUnlock()
+		onConflict = onConflictOverwrite
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := e.appendWAL(&walRecord{Op: walInsertPoints, Queries: queries, OnConflict: onConflict}); err != nil {
+		return 0, 0, err
+	}
+	return e.memStorage.InsertPoints(queries, onConflict)
+}
+
+func (e *embeddedStorage) DeletePoints(query *deletePointsQuery) error {
+	_, err := e.write(&walRecord{Op: walDeletePoints, Delete: query})
+	return err
+}
+
+// InsertDownsamplers assigns the IDs before logging so replaying the log
+// restores the same IDs
+func (e *embeddedStorage) InsertDownsamplers(dss []*downsampler) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.memStorage.mu.RLock()
+	id := e.memStorage.nextDownsamplerID
+	e.memStorage.mu.RUnlock()
+
+	rec := &walRecord{Op: walInsertDownsamplers}
+	for i, ds := range dss {
+		ds.ID = id + int64(i) + 1
+		sd, err := newStoredDownsampler(ds, 0)
+		if err != nil {
+			return err
+		}
+		rec.Downsamplers = append(rec.Downsamplers, sd)
+	}
+	if err := e.appendWAL(rec); err != nil {
+		return err
+	}
+	_, err := e.apply(rec)
+	return err
+}
+
+func (e *embeddedStorage) DeleteDownsampler(id int64) error {
+	_, err := e.write(&walRecord{Op: walDeleteDownsampler, DownsamplerID: id})
+	return err
+}
+
+func (e *embeddedStorage) UpdateDownsamplerTimeUpdateAt(id int64, timeUpdateAt int64) error {
+	_, err := e.write(&walRecord{Op: walUpdateDownsamplerTimeUpdateAt, DownsamplerID: id, TimeUpdateAt: timeUpdateAt})
+	return err
+}
+
+func (e *embeddedStorage) CommitDownsample(ds *downsampler, series []*seriesPoints) error {
+	_, err := e.write(&walRecord{
+		Op:            walCommitDownsample,
+		DownsamplerID: ds.ID,
+		Metric:        ds.OutMetric,
+		Tags:          ds.Query.Tags,
+		Series:        series,
+	})
+	return err
+}
+
+func (e *embeddedStorage) SetRetentionPolicy(policy *retentionPolicy) error {
+	_, err := e.write(&walRecord{Op: walSetRetentionPolicy, Policy: policy})
+	return err
+}
+
+func (e *embeddedStorage) DeleteRetentionPolicy(metric string) error {
+	_, err := e.write(&walRecord{Op: walDeleteRetentionPolicy, Metric: metric})
+	return err
+}
+
+func (e *embeddedStorage) EnforceRetention(policies []*retentionPolicy, now int64) (int64, error) {
+	return e.write(&walRecord{Op: walEnforceRetention, Policies: policies, Now: now})
+}
+
+func (e *embeddedStorage) appendSeriesChunk(series *memSeries, pts []*point) error {
+	sort.Slice(pts, func(i, j int) bool {
+		return pts[i].Timestamp < pts[j].Timestamp
+	})
+	path := e.seriesPath(series)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if fi.Size() == 0 {
+		header, err := gobEncode(&embeddedSeriesHeader{Metric: series.metric, Tags: series.tags})
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if err := writeFrame(w, header); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	for i := 0; i < len(pts); i += embeddedChunkSize {
+		if err := writeFrame(w, encodePoints(pts[i:min1(i+embeddedChunkSize, len(pts))])); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (e *embeddedStorage) rewriteSeriesFile(series *memSeries) error {
+	path := e.seriesPath(series)
+	if len(series.points) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	header, err := gobEncode(&embeddedSeriesHeader{Metric: series.metric, Tags: series.tags})
+	if err != nil {
+		return err
+	}
+	payloads := [][]byte{header}
+	for i := 0; i < len(series.points); i += embeddedChunkSize {
+		payloads = append(payloads, encodePoints(series.points[i:min1(i+embeddedChunkSize, len(series.points))]))
+	}
+	return writeFileAtomic(path, payloads...)
+}
+
+// writeMeta persists the downsamplers and retention policies. e.memStorage.mu
+// must be held.
+func (e *embeddedStorage) writeMeta() error {
+	m := e.memStorage
+	meta := &embeddedMeta{NextDownsamplerID: m.nextDownsamplerID}
+	for _, mds := range m.downsamplers {
+		sd, err := newStoredDownsampler(mds.ds, mds.timeUpdateAt)
+		if err != nil {
+			return err
+		}
+		meta.Downsamplers = append(meta.Downsamplers, sd)
+	}
+	for _, p := range m.retention {
+		meta.Retention = append(meta.Retention, p)
+	}
+	payload, err := gobEncode(meta)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(e.dir, embeddedMetaFile), payload)
+}
+
+// compact writes the changes since the last compaction to the series files
+// and the metadata file, then truncates the wal. If it fails part way the
+// wal is kept and replaying it over the partially written files gives the
+// same result since every record is idempotent: sums are logged as
+// overwrites of the summed values.
+func (e *embeddedStorage) compact() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.memStorage.mu.RLock()
+	defer e.memStorage.mu.RUnlock()
+
+	t0 := time.Now()
+	for series, changes := range e.dirty {
+		var err error
+		if changes.rewrite {
+			err = e.rewriteSeriesFile(series)
+		} else {
+			err = e.appendSeriesChunk(series, changes.points)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := e.writeMeta(); err != nil {
+		return err
+	}
+	if err := e.wal.Truncate(0); err != nil {
+		return err
+	}
+	if err := e.wal.Sync(); err != nil {
+		return err
+	}
+	log.Debugf("embedded: compacted %d series in %s", len(e.dirty), time.Since(t0))
+	e.dirty = map[*memSeries]*embeddedSeriesChanges{}
+	return nil
+}
+
+func (e *embeddedStorage) manageCompaction() {
+	for {
+		time.Sleep(embeddedCompactionInterval)
+		if err := e.compact(); err != nil {
+			log.Errorf("manageCompaction: %s", err)
+		}
+	}
+}
+
+func (e *embeddedStorage) close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.wal.Close()
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func embeddedTestPoints(t *testing.T, e Storage) []*point {
+	pts, err := e.SelectPoints(priorityCRUD, "test_embedded", newTagsFilter(map[string]string{"id": "1"}), 0, 1<<62, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pts
+}
+
+func TestEmbeddedStorageRecovery(t *testing.T) {
+	dir := t.TempDir()
+	e, err := newEmbeddedStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	baseTime := mustParseTime("2000-01-01T00:00:00Z")
+	ipts := []*insertPointQuery{}
+	for i := 0; i < 10; i++ {
+		ipts = append(ipts, &insertPointQuery{
+			Metric: "test_embedded",
+			Tags:   map[string]string{"id": "1"},
+			Point: &point{
+				Value:     float64(i),
+				Timestamp: baseTime.Add(time.Duration(i) * time.Minute).UnixNano(),
+				Null:      i == 3,
+			},
+		})
+	}
+	if err := insertPoints(e, ipts); err != nil {
+		t.Fatal(err)
+	}
+	if err := deletePoints(e, &deletePointsQuery{
+		Metric: "test_embedded",
+		Start:  baseTime.Add(time.Minute * 8).UnixNano(),
+		End:    baseTime.Add(time.Minute * 9).UnixNano(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ds := &downsampler{
+		Metric:      "test_embedded",
+		OutMetric:   "test_embedded_5m",
+		RunEvery:    "5m",
+		RunEveryDur: time.Minute * 5,
+		Query: &downsampleQuery{
+			Window:      map[string]interface{}{"every": "5m"},
+			Aggregators: []*aggregatorQuery{{Name: "mean"}},
+		},
+	}
+	if err := e.InsertDownsamplers([]*downsampler{ds}); err != nil {
+		t.Fatal(err)
+	}
+	expected := embeddedTestPoints(t, e)
+	require.Equal(t, 8, len(expected))
+
+	// reopening without compaction replays the wal
+	e1, err := newEmbeddedStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, expected, embeddedTestPoints(t, e1))
+	dss, err := e1.SelectDownsamplers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, 1, len(dss))
+	require.Equal(t, ds.ID, dss[0].ID)
+	require.Equal(t, "5m", dss[0].Query.Window["every"])
+
+	// after compaction everything is loaded from the series files
+	if err := insertPoints(e1, ipts[8:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := e1.compact(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, embeddedWALFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, int64(0), fi.Size())
+
+	e2, err := newEmbeddedStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pts := embeddedTestPoints(t, e2)
+	require.Equal(t, 10, len(pts))
+	require.True(t, pts[3].Null)
+	dss, err = e2.SelectDownsamplers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, 1, len(dss))
+}
+
+func TestEmbeddedStorageTornWAL(t *testing.T) {
+	dir := t.TempDir()
+	e, err := newEmbeddedStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := insertPoints(e, []*insertPointQuery{
+		{Metric: "test_embedded", Tags: map[string]string{"id": "1"}, Point: &point{Value: 1, Timestamp: 1}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash in the middle of appending a record
+	walPath := filepath.Join(dir, embeddedWALFile)
+	fi, err := os.Stat(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(walPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{100, 0, 0, 0, 1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	e1, err := newEmbeddedStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*point{{Value: 1, Timestamp: 1}}, embeddedTestPoints(t, e1))
+
+	// the replayed record was compacted and the torn tail cut off
+	fi1, err := os.Stat(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, int64(0), fi1.Size())
+	require.NotEqual(t, int64(0), fi.Size())
+}
+
+func TestEmbeddedStorageOnConflict(t *testing.T) {
+	dir := t.TempDir()
+	e, err := newEmbeddedStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, onConflict := range []string{onConflictIgnore, onConflictSum, onConflictOverwrite, onConflictError} {
+		if _, _, err := insertPointsWithMode(e, []*insertPointQuery{
+			{Metric: "test_embedded", Tags: map[string]string{"id": "1"}, Point: &point{Value: 2, Timestamp: 1}},
+		}, onConflict); err != nil && onConflict != onConflictError {
+			t.Fatal(err)
+		}
+	}
+	require.Equal(t, []*point{{Value: 2, Timestamp: 1}}, embeddedTestPoints(t, e))
+
+	// the rejected insert isn't logged and the modes replay
+	e1, err := newEmbeddedStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*point{{Value: 2, Timestamp: 1}}, embeddedTestPoints(t, e1))
+}
+
+func TestEmbeddedStorageSumReplay(t *testing.T) {
+	dir := t.TempDir()
+	e, err := newEmbeddedStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []float64{2, 3} {
+		if _, _, err := insertPointsWithMode(e, []*insertPointQuery{
+			{Metric: "test_embedded", Tags: map[string]string{"id": "1"}, Point: &point{Value: value, Timestamp: 1}},
+		}, onConflictSum); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// simulate a crash after the series files were written but before the
+	// wal was truncated
+	walPath := filepath.Join(dir, embeddedWALFile)
+	wal, err := ioutil.ReadFile(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(walPath, wal, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	e1, err := newEmbeddedStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, []*point{{Value: 5, Timestamp: 1}}, embeddedTestPoints(t, e1))
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// memSeries holds the points of one series sorted by timestamp
+type memSeries struct {
+	key    string
+	metric string
+	tags   map[string]string
+	points []*point
+}
+
+type memDownsampler struct {
+	ds           *downsampler
+	timeUpdateAt int64
+}
+
+// memStorage keeps everything in process memory. Nothing survives a restart
+// so it's meant for tests and throwaway instances.
+type memStorage struct {
+	mu                sync.RWMutex
+	series            map[string]*memSeries
+	downsamplers      map[int64]*memDownsampler
+	nextDownsamplerID int64
+	retention         map[string]*retentionPolicy
+	// changed is called with every point added to a series and with a nil
+	// point when points of a series were replaced or removed. s.mu is held.
+	changed func(series *memSeries, pt *point)
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		series:       map[string]*memSeries{},
+		downsamplers: map[int64]*memDownsampler{},
+		retention:    map[string]*retentionPolicy{},
+	}
+}
+
+func copyPoint(pt *point) *point {
+	pt0 := *pt
+	return &pt0
+}
+
+// search returns the index of the first point with timestamp >= ts
+func (s *memSeries) search(ts int64) int {
+	return sort.Search(len(s.points), func(i int) bool {
+		return s.points[i].Timestamp >= ts
+	})
+}
+
+// insert adds pt unless a point with the same timestamp exists. If overwrite
+// is set the existing point is replaced instead. It returns whether a point
+// was added and whether one was replaced.
+func (s *memSeries) insert(pt *point, overwrite bool) (bool, bool) {
+	i := s.search(pt.Timestamp)
+	if i < len(s.points) && s.points[i].Timestamp == pt.Timestamp {
+		if overwrite {
+			s.points[i] = copyPoint(pt)
+			return false, true
+		}
+		return false, false
+	}
+	s.points = append(s.points, nil)
+	copy(s.points[i+1:], s.points[i:])
+	s.points[i] = copyPoint(pt)
+	return true, false
+}
+
+// deleteRange removes the points with start <= timestamp <= end and returns
+// how many were removed
+func (s *memSeries) deleteRange(start, end int64) int64 {
+	i, j := s.search(start), s.search(end)
+	for j < len(s.points) && s.points[j].Timestamp == end {
+		j++
+	}
+	if i >= j {
+		return 0
+	}
+	s.points = append(s.points[:i], s.points[j:]...)
+	return int64(j - i)
+}
+
+// getOrCreateSeries returns the series of metric and tags. s.mu must be held
+// for writing.
+func (s *memStorage) getOrCreateSeries(metric string, tags map[string]string) (*memSeries, error) {
+	tagsJSON, err := marshalTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	key := seriesKey(metric, tagsJSON)
+	series, ok := s.series[key]
+	if !ok {
+		tags0 := make(map[string]string, len(tags))
+		for k, v := range tags {
+			tags0[k] = v
+		}
+		series = &memSeries{key: key, metric: metric, tags: tags0}
+		s.series[key] = series
+	}
+	return series, nil
+}
+
+// insert adds pt to series and reports the change. s.mu must be held for
+// writing.
+func (s *memStorage) insert(series *memSeries, pt *point, overwrite bool) (bool, bool) {
+	added, replaced := series.insert(pt, overwrite)
+	if s.changed == nil {
+		return added, replaced
+	}
+	if added {
+		s.changed(series, pt)
+	} else if replaced {
+		s.changed(series, nil)
+	}
+	return added, replaced
+}
+
+// checkConflicts returns errPointExists if a query has the timestamp of an
+// existing point or of an earlier query of the same series. s.mu must be
+// held.
+func (s *memStorage) checkConflicts(queries []*insertPointQuery) error {
+	seen := map[string]bool{}
+	for _, query := range queries {
+		tagsJSON, err := marshalTags(query.Tags)
+		if err != nil {
+			return err
+		}
+		key := seriesKey(query.Metric, tagsJSON)
+		ts := query.Point.Timestamp
+		tsKey := key + "@" + strconv.FormatInt(ts, 10)
+		if seen[tsKey] {
+			return errPointExists
+		}
+		seen[tsKey] = true
+		if series, ok := s.series[key]; ok {
+			if i := series.search(ts); i < len(series.points) && series.points[i].Timestamp == ts {
+				return errPointExists
+			}
+		}
+	}
+	return nil
+}
+
+// matchSeries returns every series of metric whose tags contain tags. s.mu
+// must be held.
+func (s *memStorage) matchSeries(metric string, filter *tagFilter) []*memSeries {
+	matches := []*memSeries{}
+	for _, series := range s.series {
+		if series.metric == metric && filter.match(series.tags) {
+			matches = append(matches, series)
+		}
+	}
+	return matches
+}
+
+// resolveSums returns queries with the values they sum to in onConflictSum
+// mode, so inserting them in onConflictOverwrite mode gives the same result.
+// s.mu must be held.
+func (s *memStorage) resolveSums(queries []*insertPointQuery) ([]*insertPointQuery, error) {
+	sums := map[string]*point{}
+	resolved := make([]*insertPointQuery, len(queries))
+	for i, query := range queries {
+		tagsJSON, err := marshalTags(query.Tags)
+		if err != nil {
+			return nil, err
+		}
+		key := seriesKey(query.Metric, tagsJSON)
+		ts := query.Point.Timestamp
+		tsKey := key + "@" + strconv.FormatInt(ts, 10)
+		pt := query.Point
+		if sum, ok := sums[tsKey]; ok {
+			pt = sumPoints(sum, pt)
+		} else if series, ok := s.series[key]; ok {
+			if j := series.search(ts); j < len(series.points) && series.points[j].Timestamp == ts {
+				pt = sumPoints(series.points[j], pt)
+			}
+		}
+		sums[tsKey] = pt
+		resolved[i] = &insertPointQuery{Metric: query.Metric, Tags: query.Tags, Point: pt}
+	}
+	return resolved, nil
+}
+
+func (s *memStorage) InsertPoints(queries []*insertPointQuery, onConflict string) (int64, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if onConflict == onConflictError {
+		if err := s.checkConflicts(queries); err != nil {
+			return 0, 0, err
+		}
+	}
+	var inserted, overwritten int64
+	for _, query := range queries {
+		series, err := s.getOrCreateSeries(query.Metric, query.Tags)
+		if err != nil {
+			return inserted, overwritten, err
+		}
+		pt := query.Point
+		if onConflict == onConflictSum {
+			if i := series.search(pt.Timestamp); i < len(series.points) && series.points[i].Timestamp == pt.Timestamp {
+				pt = sumPoints(series.points[i], pt)
+			}
+		}
+		added, replaced := s.insert(series, pt, onConflict == onConflictOverwrite || onConflict == onConflictSum)
+		if added {
+			inserted++
+		} else if replaced {
+			overwritten++
+		}
+	}
+	return inserted, overwritten, nil
+}
+
+func (s *memStorage) SelectPoints(priority int, metric string, filter *tagFilter, start, end, n int64) ([]*point, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pts := []*point{}
+	for _, series := range s.matchSeries(metric, filter) {
+		for i := series.search(start); i < len(series.points) && series.points[i].Timestamp <= end; i++ {
+			pts = append(pts, copyPoint(series.points[i]))
+		}
+	}
+	sort.SliceStable(pts, func(i, j int) bool {
+		return pts[i].Timestamp < pts[j].Timestamp
+	})
+	if n > 0 && int64(len(pts)) > n {
+		pts = pts[:n]
+	}
+	return pts, nil
+}
+
+func (s *memStorage) SelectSeriesPoints(priority int, metric string, filter *tagFilter, start, end int64) ([]*seriesPoints, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	matches := s.matchSeries(metric, filter)
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].key < matches[j].key
+	})
+	result := []*seriesPoints{}
+	for _, series := range matches {
+		pts := []*point{}
+		for i := series.search(start); i < len(series.points) && series.points[i].Timestamp <= end; i++ {
+			pts = append(pts, copyPoint(series.points[i]))
+		}
+		if len(pts) == 0 {
+			continue
+		}
+		tags0 := make(map[string]string, len(series.tags))
+		for k, v := range series.tags {
+			tags0[k] = v
+		}
+		result = append(result, &seriesPoints{Tags: tags0, Points: pts})
+	}
+	return result, nil
+}
+
+func (s *memStorage) SelectSeries(metric string, filter *tagFilter, start, end int64) ([]map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := []map[string]string{}
+	for _, series := range s.matchSeries(metric, filter) {
+		if len(series.points) == 0 {
+			continue
+		}
+		if start != 0 || end != 0 {
+			if i := series.search(start); i >= len(series.points) || series.points[i].Timestamp > end {
+				continue
+			}
+		}
+		tags := make(map[string]string, len(series.tags))
+		for k, v := range series.tags {
+			tags[k] = v
+		}
+		result = append(result, tags)
+	}
+	return result, nil
+}
+
+// CountPoints counts every point, sample is ignored. Points count as 16
+// bytes, the size of a timestamp and value.
+func (s *memStorage) CountPoints(metric string, sample float64) (map[string]*pointCount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	counts := map[string]*pointCount{}
+	for _, series := range s.series {
+		if metric != "" && series.metric != metric {
+			continue
+		}
+		c, ok := counts[series.metric]
+		if !ok {
+			c = &pointCount{}
+			counts[series.metric] = c
+		}
+		c.points += int64(len(series.points))
+		c.bytes += int64(16 * len(series.points))
+	}
+	return counts, nil
+}
+
+func (s *memStorage) SelectMetrics() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	seen := map[string]struct{}{}
+	metrics := []string{}
+	for _, series := range s.series {
+		if _, ok := seen[series.metric]; ok || len(series.points) == 0 {
+			continue
+		}
+		seen[series.metric] = struct{}{}
+		metrics = append(metrics, series.metric)
+	}
+	sort.Strings(metrics)
+	return metrics, nil
+}
+
+func (s *memStorage) DeletePoints(query *deletePointsQuery) error {
+	filter, err := newQueryTagFilter(query.Tags, query.Filter)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, series := range s.matchSeries(query.Metric, filter) {
+		if series.deleteRange(query.Start, query.End) > 0 && s.changed != nil {
+			s.changed(series, nil)
+		}
+	}
+	return nil
+}
+
+func (s *memStorage) boundaryTimestamp(metric string, filter *tagFilter, last bool) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var (
+		timestamp int64
+		found     bool
+	)
+	for _, series := range s.matchSeries(metric, filter) {
+		if len(series.points) == 0 {
+			continue
+		}
+		ts := series.points[0].Timestamp
+		if last {
+			ts = series.points[len(series.points)-1].Timestamp
+		}
+		if !found || (last && ts > timestamp) || (!last && ts < timestamp) {
+			timestamp, found = ts, true
+		}
+	}
+	if !found {
+		return 0, sql.ErrNoRows
+	}
+	return timestamp, nil
+}
+
+func (s *memStorage) FirstTimestamp(metric string, filter *tagFilter) (int64, error) {
+	return s.boundaryTimestamp(metric, filter, false)
+}
+
+func (s *memStorage) LastTimestamp(metric string, filter *tagFilter) (int64, error) {
+	return s.boundaryTimestamp(metric, filter, true)
+}
+
+func copyDownsampler(ds *downsampler) *downsampler {
+	ds0 := *ds
+	return &ds0
+}
+
+func (s *memStorage) InsertDownsamplers(dss []*downsampler) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ds := range dss {
+		ds.ID = s.nextDownsamplerID + 1
+		s.putDownsampler(ds, 0)
+	}
+	return nil
+}
+
+// putDownsampler stores ds under its ID. s.mu must be held for writing.
+func (s *memStorage) putDownsampler(ds *downsampler, timeUpdateAt int64) {
+	s.downsamplers[ds.ID] = &memDownsampler{ds: copyDownsampler(ds), timeUpdateAt: timeUpdateAt}
+	if ds.ID > s.nextDownsamplerID {
+		s.nextDownsamplerID = ds.ID
+	}
+}
+
+func (s *memStorage) SelectDownsamplers() ([]*downsampler, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	dss := []*downsampler{}
+	for _, mds := range s.downsamplers {
+		dss = append(dss, copyDownsampler(mds.ds))
+	}
+	sort.Slice(dss, func(i, j int) bool {
+		return dss[i].ID < dss[j].ID
+	})
+	return dss, nil
+}
+
+func (s *memStorage) DeleteDownsampler(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.downsamplers, id)
+	return nil
+}
+
+func (s *memStorage) DownsamplersCount() (int, error) {
+	return 0, nil
+}
+
+func (s *memStorage) NextDownsampler(workerID int) (*downsampler, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var next *memDownsampler
+	for _, mds := range s.downsamplers {
+		if mds.ds.WorkerID != workerID {
+			continue
+		}
+		if next == nil || mds.timeUpdateAt < next.timeUpdateAt || (mds.timeUpdateAt == next.timeUpdateAt && mds.ds.ID < next.ds.ID) {
+			next = mds
+		}
+	}
+	if next == nil {
+		return nil, 0, sql.ErrNoRows
+	}
+	return copyDownsampler(next.ds), next.timeUpdateAt, nil
+}
+
+func (s *memStorage) UpdateDownsamplerTimeUpdateAt(id int64, timeUpdateAt int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if mds, ok := s.downsamplers[id]; ok {
+		mds.timeUpdateAt = timeUpdateAt
+	}
+	return nil
+}
+
+func (s *memStorage) CommitDownsample(ds *downsampler, series []*seriesPoints) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sp := range series {
+		out, err := s.getOrCreateSeries(ds.OutMetric, sp.Tags)
+		if err != nil {
+			return err
+		}
+		for _, pt := range sp.Points {
+			s.insert(out, pt, true)
+		}
+	}
+	last, ok := lastDownsampledWindow(series)
+	if !ok {
+		return nil
+	}
+	if mds, ok := s.downsamplers[ds.ID]; ok {
+		mds.ds.LastDownsampledWindow = last
+	}
+	return nil
+}
+
+func (s *memStorage) SetRetentionPolicy(policy *retentionPolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retention[policy.Metric] = &retentionPolicy{
+		Metric:       policy.Metric,
+		Retention:    policy.RetentionDur.String(),
+		RetentionDur: policy.RetentionDur,
+	}
+	return nil
+}
+
+func (s *memStorage) SelectRetentionPolicies() ([]*retentionPolicy, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	policies := []*retentionPolicy{}
+	for _, p := range s.retention {
+		p0 := *p
+		policies = append(policies, &p0)
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Metric < policies[j].Metric
+	})
+	return policies, nil
+}
+
+func (s *memStorage) DeleteRetentionPolicy(metric string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.retention, metric)
+	return nil
+}
+
+func (s *memStorage) EnforceRetention(policies []*retentionPolicy, now int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var total int64
+	for _, series := range s.series {
+		policy := matchRetentionPolicy(policies, series.metric)
+		if policy == nil || len(series.points) == 0 {
+			continue
+		}
+		cutoff := now - policy.RetentionDur.Nanoseconds()
+		i := series.search(cutoff)
+		if i == 0 {
+			continue
+		}
+		series.points = series.points[i:]
+		total += int64(i)
+		if s.changed != nil {
+			s.changed(series, nil)
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Tag filters select series by their tags, e.g.
+//
+//	host =~ '^web' and (dc in [eu1, eu2] or dc not exists)
+//
+// Keys and values are bare words of [a-zA-Z0-9_-.], double quoted strings
+// with Go escapes or single quoted raw strings. Every key and value ends up
+// in a query parameter, never in the SQL itself.
+
+const (
+	tagFilterAnd       = "and"
+	tagFilterOr        = "or"
+	tagFilterEq        = "="
+	tagFilterNeq       = "!="
+	tagFilterMatch     = "=~"
+	tagFilterNotMatch  = "!~"
+	tagFilterIn        = "in"
+	tagFilterNotIn     = "not in"
+	tagFilterExists    = "exists"
+	tagFilterNotExists = "not exists"
+)
+
+var (
+	tagFilterMaxLength  = 64 << 10
+	tagFilterMaxDepth   = 64
+	errInvalidTagFilter = errors.New("invalid tag filter")
+	tagFilterWordRe     = regexp.MustCompile(`^[a-zA-Z0-9_\-.]+`)
+)
+
+// tagFilter is a node of a parsed tag filter. and and or nodes have filters,
+// the others a key and, except for exists, values. A nil *tagFilter matches
+// every series.
+type tagFilter struct {
+	op      string
+	key     string
+	values  []string
+	re      *regexp.Regexp
+	filters []*tagFilter
+}
+
+func (f *tagFilter) match(tags map[string]string) bool {
+	if f == nil {
+		return true
+	}
+	v, ok := tags[f.key]
+	switch f.op {
+	case tagFilterAnd:
+		for _, f0 := range f.filters {
+			if !f0.match(tags) {
+				return false
+			}
+		}
+		return true
+	case tagFilterOr:
+		for _, f0 := range f.filters {
+			if f0.match(tags) {
+				return true
+			}
+		}
+		return false
+	case tagFilterEq:
+		return ok && v == f.values[0]
+	case tagFilterNeq:
+		return !ok || v != f.values[0]
+	case tagFilterMatch:
+		return ok && f.re.MatchString(v)
+	case tagFilterNotMatch:
+		return !ok || !f.re.MatchString(v)
+	case tagFilterIn:
+		return ok && containsString(f.values, v)
+	case tagFilterNotIn:
+		return !ok || !containsString(f.values, v)
+	case tagFilterExists:
+		return ok
+	case tagFilterNotExists:
+		return !ok
+	}
+	return false
+}
+
+// newTagsFilter returns a filter matching series whose tags contain tags
+func newTagsFilter(tags map[string]string) *tagFilter {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	filters := make([]*tagFilter, len(keys))
+	for i, k := range keys {
+		filters[i] = &tagFilter{op: tagFilterEq, key: k, values: []string{tags[k]}}
+	}
+	return andTagFilters(filters...)
+}
+
+// andTagFilters returns a filter matching series matched by every filter.
+// nil filters are skipped.
+func andTagFilters(filters ...*tagFilter) *tagFilter {
+	var and []*tagFilter
+	for _, f := range filters {
+		if f != nil {
+			and = append(and, f)
+		}
+	}
+	switch len(and) {
+	case 0:
+		return nil
+	case 1:
+		return and[0]
+	}
+	return &tagFilter{op: tagFilterAnd, filters: and}
+}
+
+// newQueryTagFilter returns the filter of a query's tags and filter
+func newQueryTagFilter(tags map[string]string, filter string) (*tagFilter, error) {
+	f, err := parseTagFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	return andTagFilters(newTagsFilter(tags), f), nil
+}
+
+type tagFilterToken struct {
+	text   string
+	quoted bool
+	pos    int
+}
+
+func tokenizeTagFilter(filter string) ([]*tagFilterToken, error) {
+	tokens := []*tagFilterToken{}
+	for i := 0; i < len(filter); {
+		switch c := filter[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']' || c == ',':
+			tokens = append(tokens, &tagFilterToken{text: filter[i : i+1], pos: i})
+			i++
+		case c == '=' || c == '!':
+			op := filter[i : i+1]
+			if i+1 < len(filter) && (filter[i+1] == '=' || filter[i+1] == '~') {
+				op = filter[i : i+2]
+			}
+			if op == "!" || op == "==" {
+				return nil, fmt.Errorf("%s: unexpected %q at %d", errInvalidTagFilter, op, i)
+			}
+			tokens = append(tokens, &tagFilterToken{text: op, pos: i})
+			i += len(op)
+		case c == '\'':
+			end := strings.IndexByte(filter[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("%s: unterminated string at %d", errInvalidTagFilter, i)
+			}
+			tokens = append(tokens, &tagFilterToken{text: filter[i+1 : i+1+end], quoted: true, pos: i})
+			i += end + 2
+		case c == '"':
+			end := i + 1
+			for end < len(filter) && filter[end] != '"' {
+				if filter[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(filter) {
+				return nil, fmt.Errorf("%s: unterminated string at %d", errInvalidTagFilter, i)
+			}
+			s, err := strconv.Unquote(filter[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s at %d", errInvalidTagFilter, err, i)
+			}
+			tokens = append(tokens, &tagFilterToken{text: s, quoted: true, pos: i})
+			i = end + 1
+		default:
+			word := tagFilterWordRe.FindString(filter[i:])
+			if word == "" {
+				return nil, fmt.Errorf("%s: unexpected %q at %d", errInvalidTagFilter, c, i)
+			}
+			tokens = append(tokens, &tagFilterToken{text: word, pos: i})
+			i += len(word)
+		}
+	}
+	return tokens, nil
+}
+
+type tagFilterParser struct {
+	tokens []*tagFilterToken
+	i      int
+	end    int
+	depth  int
+}
+
+func (p *tagFilterParser) peek() *tagFilterToken {
+	if p.i < len(p.tokens) {
+		return p.tokens[p.i]
+	}
+	return nil
+}
+
+// keyword returns whether the next token is the unquoted keyword kw and
+// consumes it if it is
+func (p *tagFilterParser) keyword(kw string) bool {
+	t := p.peek()
+	if t == nil || t.quoted || !strings.EqualFold(t.text, kw) {
+		return false
+	}
+	p.i++
+	return true
+}
+
+func (p *tagFilterParser) errorf(format string, args ...interface{}) error {
+	pos := p.end
+	if t := p.peek(); t != nil {
+		pos = t.pos
+	}
+	return fmt.Errorf("%s: %s at %d", errInvalidTagFilter, fmt.Sprintf(format, args...), pos)
+}
+
+func (p *tagFilterParser) parseOr() (*tagFilter, error) {
+	return p.parseList(tagFilterOr, p.parseAnd)
+}
+
+func (p *tagFilterParser) parseAnd() (*tagFilter, error) {
+	return p.parseList(tagFilterAnd, p.parseFactor)
+}
+
+func (p *tagFilterParser) parseList(op string, parse func() (*tagFilter, error)) (*tagFilter, error) {
+	f, err := parse()
+	if err != nil {
+		return nil, err
+	}
+	filters := []*tagFilter{f}
+	for p.keyword(op) {
+		if f, err = parse(); err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return &tagFilter{op: op, filters: filters}, nil
+}
+
+func (p *tagFilterParser) parseFactor() (*tagFilter, error) {
+	if t := p.peek(); t != nil && !t.quoted && t.text == "(" {
+		// the parser recurses once per parenthesis
+		if p.depth >= tagFilterMaxDepth {
+			return nil, p.errorf("parentheses nested deeper than %d", tagFilterMaxDepth)
+		}
+		p.i++
+		p.depth++
+		f, err := p.parseOr()
+		p.depth--
+		if err != nil {
+			return nil, err
+		}
+		if t := p.peek(); t == nil || t.quoted || t.text != ")" {
+			return nil, p.errorf("expected )")
+		}
+		p.i++
+		return f, nil
+	}
+
+	key, err := p.parseValue("tag key")
+	if err != nil {
+		return nil, err
+	}
+	f := &tagFilter{key: key}
+	switch {
+	case p.keyword("exists"):
+		f.op = tagFilterExists
+		return f, nil
+	case p.keyword("in"):
+		f.op = tagFilterIn
+		f.values, err = p.parseValues()
+		return f, err
+	case p.keyword("not"):
+		if p.keyword("exists") {
+			f.op = tagFilterNotExists
+			return f, nil
+		}
+		if !p.keyword("in") {
+			return nil, p.errorf("expected in or exists")
+		}
+		f.op = tagFilterNotIn
+		f.values, err = p.parseValues()
+		return f, err
+	}
+
+	t := p.peek()
+	if t == nil || t.quoted {
+		return nil, p.errorf("expected operator")
+	}
+	switch t.text {
+	case tagFilterEq, tagFilterNeq, tagFilterMatch, tagFilterNotMatch:
+		f.op = t.text
+	default:
+		return nil, p.errorf("expected operator")
+	}
+	p.i++
+	value, err := p.parseValue("value")
+	if err != nil {
+		return nil, err
+	}
+	f.values = []string{value}
+	if f.op == tagFilterMatch || f.op == tagFilterNotMatch {
+		if f.re, err = regexp.Compile(value); err != nil {
+			return nil, fmt.Errorf("%s: %s", errInvalidTagFilter, err)
+		}
+	}
+	return f, nil
+}
+
+// parseValue parses a quoted string or a word that isn't a keyword
+func (p *tagFilterParser) parseValue(what string) (string, error) {
+	t := p.peek()
+	if t == nil || (!t.quoted && !tagFilterWordRe.MatchString(t.text)) {
+		return "", p.errorf("expected %s", what)
+	}
+	if !t.quoted {
+		switch strings.ToLower(t.text) {
+		case "and", "or", "not", "in", "exists":
+			return "", p.errorf("expected %s", what)
+		}
+	}
+	p.i++
+	return t.text, nil
+}
+
+func (p *tagFilterParser) parseValues() ([]string, error) {
+	if t := p.peek(); t == nil || t.quoted || t.text != "[" {
+		return nil, p.errorf("expected [")
+	}
+	p.i++
+	values := []string{}
+	for {
+		v, err := p.parseValue("value")
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		t := p.peek()
+		if t == nil || t.quoted || (t.text != "," && t.text != "]") {
+			return nil, p.errorf("expected , or ]")
+		}
+		p.i++
+		if t.text == "]" {
+			return values, nil
+		}
+	}
+}
+
+// parseTagFilter parses a tag filter. An empty filter is nil.
+func parseTagFilter(filter string) (*tagFilter, error) {
+	if strings.TrimSpace(filter) == "" {
+		return nil, nil
+	}
+	if len(filter) > tagFilterMaxLength {
+		return nil, fmt.Errorf("%s: longer than %d bytes", errInvalidTagFilter, tagFilterMaxLength)
+	}
+	tokens, err := tokenizeTagFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	p := &tagFilterParser{tokens: tokens, end: len(filter)}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != nil {
+		return nil, p.errorf("unexpected %q", p.peek().text)
+	}
+	return f, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTagFilterMatch(t *testing.T) {
+	web1 := map[string]string{"host": "web1", "dc": "eu1"}
+	web2 := map[string]string{"host": "web2", "dc": "us1"}
+	db1 := map[string]string{"host": "db1"}
+	for filter, expected := range map[string][]bool{
+		``:                                       {true, true, true},
+		`host = web1`:                            {true, false, false},
+		`host != web1`:                           {false, true, true},
+		`dc != eu1`:                              {false, true, true},
+		`host =~ '^web'`:                         {true, true, false},
+		`host !~ "^web\\d"`:                      {false, false, true},
+		`dc in [eu1, "us1"]`:                     {true, true, false},
+		`dc not in [eu1]`:                        {false, true, true},
+		`dc exists`:                              {true, true, false},
+		`dc not exists`:                          {false, false, true},
+		`host =~ web and dc = us1 or host = db1`: {false, true, true},
+		`host =~ web and (dc = us1 or dc = eu1)`: {true, true, false},
+		`HOST = web1 OR host = web2`:             {false, true, false},
+		`'host' = "web1" AND NOT_A_KEY not exists`: {true, false, false},
+	} {
+		f, err := parseTagFilter(filter)
+		if err != nil {
+			t.Fatalf("%s: %s", filter, err)
+		}
+		require.Equal(t, expected, []bool{f.match(web1), f.match(web2), f.match(db1)}, filter)
+	}
+}
+
+func TestParseTagFilterErrors(t *testing.T) {
+	for _, filter := range []string{
+		`host`,
+		`host = `,
+		`host == web1`,
+		`host ! web1`,
+		`= web1`,
+		`host = web1 and`,
+		`(host = web1`,
+		`host = web1)`,
+		`host in web1`,
+		`host in [web1`,
+		`host in []`,
+		`host not web1`,
+		`host = 'web1`,
+		`host = "web1`,
+		`host =~ '('`,
+		`and = web1`,
+		`host = web1 dc = eu1`,
+		`host = web*`,
+	} {
+		if _, err := parseTagFilter(filter); err == nil {
+			t.Fatalf("expected error for %q", filter)
+		}
+	}
+}
+
+func TestParseTagFilterLimits(t *testing.T) {
+	nested := func(depth int) string {
+		return strings.Repeat("(", depth) + "host = web1" + strings.Repeat(")", depth)
+	}
+	if _, err := parseTagFilter(nested(tagFilterMaxDepth)); err != nil {
+		t.Fatal(err)
+	}
+	for _, filter := range []string{
+		nested(tagFilterMaxDepth + 1),
+		strings.Repeat("(", 6<<20),
+		"host = " + strings.Repeat("a", tagFilterMaxLength),
+	} {
+		_, err := parseTagFilter(filter)
+		if err == nil || !strings.HasPrefix(err.Error(), errInvalidTagFilter.Error()) {
+			t.Fatalf("expected %s, got %v", errInvalidTagFilter, err)
+		}
+	}
+}
+
+func TestGenerateTagsQueryStringAndValues(t *testing.T) {
+	f, err := newQueryTagFilter(map[string]string{"dc": "eu1"}, `host = web1 and (host =~ '^web' or host not in [a, b] or role not exists)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	str, vals, err := generateTagsQueryStringAndValues(f, []interface{}{"metric"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, ` AND (tags @> $2::jsonb AND (tags @> $3::jsonb AND (tags->>$4::text ~ $5::text OR NOT COALESCE(tags->>$6::text = ANY($7::text[]), false) OR NOT tags ? $8::text)))`, str)
+	require.Equal(t, []interface{}{"metric", `{"dc":"eu1"}`, `{"host":"web1"}`, "host", "^web", "host", pq.Array([]string{"a", "b"}), "role"}, vals)
+
+	str, vals, err = generateTagsQueryStringAndValues(newTagsFilter(map[string]string{"a": "1", "b": "2"}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, ` AND (tags @> $1::jsonb)`, str)
+	require.Equal(t, []interface{}{`{"a":"1","b":"2"}`}, vals)
+
+	str, vals, err = generateTagsQueryStringAndValues(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, "", str)
+	require.Nil(t, vals)
+}
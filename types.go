@@ -20,6 +20,7 @@ type deletePointsQuery struct {
 	Start  int64             `json:"start"`
 	End    int64             `json:"end"`
 	Tags   map[string]string `json:"tags"`
+	Filter string            `json:"filter,omitempty"`
 }
 
 type aggregatorQuery struct {
@@ -33,18 +34,80 @@ type pointsQuery struct {
 	End         int64                  `json:"end"`
 	N           int64                  `json:"n"`
 	Tags        map[string]string      `json:"tags"`
+	Filter      string                 `json:"filter,omitempty"`
+	GroupBy     groupByTags            `json:"groupBy,omitempty"`
 	Window      map[string]interface{} `json:"window"`
 	Aggregators []*aggregatorQuery     `json:"aggregators"`
 }
 
+type seriesPoints struct {
+	Tags   map[string]string `json:"tags"`
+	Points []*point          `json:"points"`
+}
+
 type serverError struct {
 	Error string `json:"error"`
 }
 
+type influxError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type openTSDBError struct {
+	Error *openTSDBErrorDetail `json:"error"`
+}
+
+type openTSDBErrorDetail struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type openTSDBPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp interface{}       `json:"timestamp"`
+	Value     interface{}       `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+type openTSDBPutError struct {
+	Datapoint *openTSDBPoint `json:"datapoint"`
+	Error     string         `json:"error"`
+}
+
+type openTSDBPutSummary struct {
+	Failed  int                 `json:"failed"`
+	Success int                 `json:"success"`
+	Errors  []*openTSDBPutError `json:"errors,omitempty"`
+}
+
+type openTSDBQuery struct {
+	Start        interface{}         `json:"start"`
+	End          interface{}         `json:"end"`
+	Queries      []*openTSDBSubQuery `json:"queries"`
+	MsResolution bool                `json:"msResolution"`
+}
+
+type openTSDBSubQuery struct {
+	Aggregator string            `json:"aggregator"`
+	Metric     string            `json:"metric"`
+	Downsample string            `json:"downsample"`
+	Tags       map[string]string `json:"tags"`
+}
+
+type openTSDBQueryResult struct {
+	Metric        string                 `json:"metric"`
+	Tags          map[string]string      `json:"tags"`
+	AggregateTags []string               `json:"aggregateTags"`
+	Dps           map[string]interface{} `json:"dps"`
+}
+
 type downsampleQuery struct {
 	Aggregators []*aggregatorQuery     `json:"aggregators"`
 	Window      map[string]interface{} `json:"window"`
 	Tags        map[string]string      `json:"tags"`
+	Filter      string                 `json:"filter,omitempty"`
+	GroupBy     groupByTags            `json:"groupBy,omitempty"`
 }
 
 type downsampler struct {
@@ -55,8 +118,89 @@ type downsampler struct {
 	RunEveryDur           time.Duration    `json:"-"`
 	Query                 *downsampleQuery `json:"query"`
 	LastDownsampledWindow int64            `json:"-"`
+	WorkerID              int              `json:"-"`
 }
 
 type deleteDownsamplerRequest struct {
 	ID int64 `json:"id"`
 }
+
+type retentionPolicy struct {
+	Metric       string        `json:"metric"`
+	Retention    string        `json:"retention"`
+	RetentionDur time.Duration `json:"-"`
+}
+
+type compressionStats struct {
+	Metric          string  `json:"metric"`
+	Chunks          int64   `json:"chunks"`
+	Points          int64   `json:"points"`
+	CompressedBytes int64   `json:"compressedBytes"`
+	BytesPerPoint   float64 `json:"bytesPerPoint"`
+	Ratio           float64 `json:"ratio"`
+}
+
+type deleteRetentionPolicyRequest struct {
+	Metric string `json:"metric"`
+}
+
+type csvImportError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// csvImportFailure is the range of lines of the batch that failed to insert.
+// The rows before it were inserted, the rows from it on weren't.
+type csvImportFailure struct {
+	FirstLine int    `json:"firstLine"`
+	LastLine  int    `json:"lastLine"`
+	Error     string `json:"error"`
+}
+
+type csvImportSummary struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Errors   []*csvImportError `json:"errors,omitempty"`
+	Failed   *csvImportFailure `json:"failed,omitempty"`
+}
+
+type insertPointsLineError struct {
+	Line  int    `json:"line"`
+	Text  string `json:"text"`
+	Error string `json:"error"`
+}
+
+type insertPointsSummary struct {
+	Inserted    int64                    `json:"inserted"`
+	Duplicates  int64                    `json:"duplicates"`
+	Overwritten int64                    `json:"overwritten"`
+	Rejected    int64                    `json:"rejected"`
+	Errors      []*insertPointsLineError `json:"errors"`
+}
+
+type spoolStats struct {
+	Enabled        bool    `json:"enabled"`
+	Segments       int     `json:"segments"`
+	Points         int64   `json:"points"`
+	Bytes          int64   `json:"bytes"`
+	MaxBytes       int64   `json:"maxBytes"`
+	FlushLag       float64 `json:"flushLagSeconds"`
+	LastFlush      int64   `json:"lastFlush"`
+	LastFlushError string  `json:"lastFlushError,omitempty"`
+}
+
+type tagKeyStats struct {
+	Key    string `json:"key"`
+	Values int64  `json:"values"`
+}
+
+type metricStats struct {
+	Metric         string         `json:"metric"`
+	Series         int64          `json:"series"`
+	Points         int64          `json:"points"`
+	FirstTimestamp int64          `json:"firstTimestamp"`
+	LastTimestamp  int64          `json:"lastTimestamp"`
+	Bytes          int64          `json:"bytes"`
+	Sampled        bool           `json:"sampled,omitempty"`
+	TopTagKeys     []*tagKeyStats `json:"topTagKeys"`
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"container/heap"
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"regexp"
 	"strconv"
@@ -15,10 +18,12 @@ import (
 )
 
 var (
-	configMatchRe     = regexp.MustCompile("[#].*\\n|\\s+\\n|\\S+[=]|.*\n")
-	lineMatchRe       = regexp.MustCompile(`^\s*([a-zA-Z0-9\-_.]+)\s*,\s*((?:[a-zA-Z0-9\-_.]+\s*=\s*[a-zA-Z0-9\-_.]+\s*)*)\s*,\s*([+-]?([0-9]+([.][0-9]*)?|[.][0-9]+))\s+([0-9]+)\s*$`)
-	errPointValueType = errors.New("point value must be null or number")
-	errNoMatches      = errors.New("parse line: invalid line protocol syntax - no matches")
+	configMatchRe        = regexp.MustCompile("[#].*\\n|\\s+\\n|\\S+[=]|.*\n")
+	lineMatchRe          = regexp.MustCompile(`^\s*([a-zA-Z0-9\-_.]+)\s*,\s*((?:[a-zA-Z0-9\-_.]+\s*=\s*[a-zA-Z0-9\-_.]+\s*)*)\s*,\s*(null|[+-]?([0-9]+([.][0-9]*)?|[.][0-9]+))\s+([0-9]+)\s*$`)
+	durationDaysRe       = regexp.MustCompile(`^([0-9]+)d(.*)$`)
+	errPointValueType    = errors.New("point value must be null or number")
+	errNoMatches         = errors.New("parse line: invalid line protocol syntax - no matches")
+	errJSONArrayRequired = errors.New("body must be a json array")
 )
 
 // time utils
@@ -31,6 +36,28 @@ func mustParseTime(t string) time.Time {
 	return t0
 }
 
+// parseDuration is time.ParseDuration with additional support for a `d`
+// (24h) unit, e.g. `1d` or `1d12h`
+func parseDuration(s string) (time.Duration, error) {
+	m := durationDaysRe.FindStringSubmatch(s)
+	if m == nil {
+		return time.ParseDuration(s)
+	}
+	days, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	dur := time.Duration(days) * 24 * time.Hour
+	if m[2] != "" {
+		rest, err := time.ParseDuration(m[2])
+		if err != nil {
+			return 0, err
+		}
+		dur += rest
+	}
+	return dur, nil
+}
+
 // min/max utils
 
 func min1(a, b int) int {
@@ -245,6 +272,132 @@ func parseLineProtocol(line []byte) (*insertPointQuery, error) {
 	}, nil
 }
 
+// pointsIterator returns the next point of a body or io.EOF after the last
+type pointsIterator func() (*insertPointQuery, error)
+
+// newPointsIterator parses the points of an insert_points body in the given
+// format one at a time so bodies don't have to fit in memory
+func newPointsIterator(mediaType string, body io.Reader) pointsIterator {
+	if mediaType == "application/json" {
+		dec := json.NewDecoder(body)
+		started := false
+		return func() (*insertPointQuery, error) {
+			if !started {
+				started = true
+				tok, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+					return nil, errJSONArrayRequired
+				}
+			}
+			if !dec.More() {
+				if _, err := dec.Token(); err != nil {
+					return nil, err
+				}
+				return nil, io.EOF
+			}
+			query := &insertPointQuery{}
+			if err := dec.Decode(query); err != nil {
+				return nil, err
+			}
+			return query, nil
+		}
+	}
+
+	scanner := bufio.NewScanner(body)
+	buf := make([]byte, readLineProtocolBufferSize)
+	scanner.Buffer(buf, readLineProtocolBufferSize)
+	lineNumber := 0
+	return func() (*insertPointQuery, error) {
+		for scanner.Scan() {
+			lineNumber++
+			if mediaType != "application/x-ndjson" {
+				return parseLineProtocol(scanner.Bytes())
+			}
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			query := &insertPointQuery{}
+			if err := json.Unmarshal(line, query); err != nil {
+				return nil, fmt.Errorf("unable to parse line %d: %s", lineNumber, err)
+			}
+			return query, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+}
+
+// readAllPoints collects the points of next
+func readAllPoints(next pointsIterator) ([]*insertPointQuery, error) {
+	queries := []*insertPointQuery{}
+	for {
+		query, err := next()
+		if err == io.EOF {
+			return queries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, query)
+	}
+}
+
+// insertPointsLine is a line of an insert_points body parsed on its own.
+// Elements of JSON arrays count as lines.
+type insertPointsLine struct {
+	line  int
+	text  string
+	query *insertPointQuery
+	err   error
+}
+
+// parsePointsLines parses every line of body in the given format without
+// stopping at invalid lines
+func parsePointsLines(mediaType string, body io.Reader) ([]*insertPointsLine, error) {
+	lines := []*insertPointsLine{}
+	if mediaType == "application/json" {
+		elems := []json.RawMessage{}
+		if err := json.NewDecoder(body).Decode(&elems); err != nil {
+			return nil, err
+		}
+		for i, elem := range elems {
+			query := &insertPointQuery{}
+			err := json.Unmarshal(elem, query)
+			lines = append(lines, &insertPointsLine{line: i + 1, text: string(elem), query: query, err: err})
+		}
+		return lines, nil
+	}
+
+	scanner := bufio.NewScanner(body)
+	buf := make([]byte, readLineProtocolBufferSize)
+	scanner.Buffer(buf, readLineProtocolBufferSize)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		l := &insertPointsLine{line: lineNumber, text: scanner.Text()}
+		if mediaType == "application/x-ndjson" {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			l.query = &insertPointQuery{}
+			l.err = json.Unmarshal(scanner.Bytes(), l.query)
+		} else {
+			l.query, l.err = parseLineProtocol(scanner.Bytes())
+		}
+		lines = append(lines, l)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
 // config utils
 
 /*